@@ -0,0 +1,264 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"watermark-generator/audit"
+	"watermark-generator/auth"
+	"watermark-generator/mail"
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MigrateEmailVerification marks accounts created before email
+// verification existed as verified, so they can still sign in.
+func (h *AuthHandler) MigrateEmailVerification(ctx context.Context) error {
+	result, err := h.DB.Collection("users").UpdateMany(ctx,
+		bson.M{"emailVerified": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"emailVerified": true}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to migrate email verification: %v", err)
+	}
+	if result.ModifiedCount > 0 {
+		log.Printf("MigrateEmailVerification: Marked %d existing users as verified", result.ModifiedCount)
+	}
+	return nil
+}
+
+// appLink returns a link to a frontend page carrying token.
+func appLink(path, token string) string {
+	return os.Getenv("VITE_API_URL") + path + "?token=" + url.QueryEscape(token)
+}
+
+// sendTokenEmail issues a one-time token for the user and emails a link to
+// the frontend page at path using the named template.
+func (h *AuthHandler) sendTokenEmail(ctx context.Context, user *models.User, purpose string, ttl time.Duration, template, path string) error {
+	token, err := h.OneTime.Issue(ctx, user.ID, purpose, ttl)
+	if err != nil {
+		return err
+	}
+	msg, err := mail.Render(template, user.Email, map[string]string{
+		"Link":    appLink(path, token),
+		"Expires": formatTTL(ttl),
+	})
+	if err != nil {
+		return err
+	}
+	return h.Mail.Send(ctx, msg)
+}
+
+func (h *AuthHandler) sendVerification(ctx context.Context, user *models.User) error {
+	return h.sendTokenEmail(ctx, user, auth.PurposeVerifyEmail, auth.VerifyEmailTTL, "verify.txt", "/verify-email")
+}
+
+func formatTTL(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		return plural(int(d/(24*time.Hour)), "day")
+	}
+	if d%time.Hour == 0 {
+		return plural(int(d/time.Hour), "hour")
+	}
+	return plural(int(d/time.Minute), "minute")
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+func writeMessage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+// findByEmail returns the user with email, or nil when there is none.
+func (h *AuthHandler) findByEmail(ctx context.Context, email string) (*models.User, error) {
+	user, err := h.Accounts.UserByEmail(ctx, email)
+	if err == auth.ErrUserNotFound {
+		return nil, nil
+	}
+	return user, err
+}
+
+// VerifyEmailHandler confirms the address of the account the token from
+// the verification email was issued to.
+func (h *AuthHandler) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" {
+		writeMessage(w, http.StatusBadRequest, "token is required")
+		return
+	}
+
+	userID, err := h.OneTime.Redeem(r.Context(), body.Token, auth.PurposeVerifyEmail)
+	if err == auth.ErrInvalidToken {
+		writeMessage(w, http.StatusBadRequest, "This link is invalid or has expired")
+		return
+	}
+	if err != nil {
+		log.Printf("VerifyEmailHandler: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to verify email")
+		return
+	}
+	if err := h.Accounts.MarkEmailVerified(r.Context(), userID); err != nil {
+		log.Printf("VerifyEmailHandler: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to verify email")
+		return
+	}
+	writeMessage(w, http.StatusOK, "Email verified")
+}
+
+// ResendVerificationHandler sends a new verification email. It answers the
+// same whether or not the address has an account.
+func (h *AuthHandler) ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	h.emailRequest(w, r, "If the address has an unverified account, a new link is on its way", func(user *models.User) error {
+		if user.EmailVerified {
+			return nil
+		}
+		return h.sendVerification(r.Context(), user)
+	})
+}
+
+// ForgotPasswordHandler emails a password reset link. It answers the same
+// whether or not the address has an account.
+func (h *AuthHandler) ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	h.emailRequest(w, r, "If the address has an account, a reset link is on its way", func(user *models.User) error {
+		if user.Disabled {
+			return nil
+		}
+		return h.sendTokenEmail(r.Context(), user, auth.PurposeResetPassword, auth.ResetPasswordTTL, "reset.txt", "/reset-password")
+	})
+}
+
+// emailRequest reads {"email"} and calls send for the matching user. The
+// response is the same for unknown addresses so it cannot be used to find
+// out who has an account.
+func (h *AuthHandler) emailRequest(w http.ResponseWriter, r *http.Request, message string, send func(*models.User) error) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Email == "" {
+		writeMessage(w, http.StatusBadRequest, "Email cannot be empty")
+		return
+	}
+
+	user, err := h.findByEmail(r.Context(), body.Email)
+	if err != nil {
+		log.Printf("emailRequest: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if user != nil {
+		if err := send(user); err != nil {
+			log.Printf("emailRequest: Failed to send email to user %s: %v", user.ID.Hex(), err)
+		}
+	}
+	writeMessage(w, http.StatusAccepted, message)
+}
+
+// ResetPasswordHandler sets a new password using the token from the reset
+// email, signs the user out everywhere and revokes their API keys.
+func (h *AuthHandler) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" {
+		writeMessage(w, http.StatusBadRequest, "token is required")
+		return
+	}
+	if body.Password == "" {
+		writeMessage(w, http.StatusBadRequest, "Password cannot be empty")
+		return
+	}
+	// The token is only looked up here and used up once the password is
+	// accepted, so a rejected password can be retried with the same link
+	userID, err := h.OneTime.Lookup(r.Context(), body.Token, auth.PurposeResetPassword)
+	if err == auth.ErrInvalidToken {
+		writeMessage(w, http.StatusBadRequest, "This link is invalid or has expired")
+		return
+	}
+	if err != nil {
+		log.Printf("ResetPasswordHandler: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+	user, err := h.Accounts.UserByID(r.Context(), userID)
+	if err == auth.ErrUserNotFound {
+		writeMessage(w, http.StatusBadRequest, "This link is invalid or has expired")
+		return
+	}
+	if err != nil {
+		log.Printf("ResetPasswordHandler: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+	if err := h.Policy.Check(body.Password, user.Email); err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Redeeming again makes sure two requests with the same link cannot
+	// both set a password
+	if _, err := h.OneTime.Redeem(r.Context(), body.Token, auth.PurposeResetPassword); err == auth.ErrInvalidToken {
+		writeMessage(w, http.StatusBadRequest, "This link is invalid or has expired")
+		return
+	} else if err != nil {
+		log.Printf("ResetPasswordHandler: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("ResetPasswordHandler: Failed to hash password: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+	// Following the emailed link also proves control of the address
+	if err := h.Accounts.ResetPassword(r.Context(), userID, string(hashedPassword), time.Now()); err != nil {
+		log.Printf("ResetPasswordHandler: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+	if err := h.Sessions.RevokeAll(r.Context(), userID); err != nil {
+		log.Printf("ResetPasswordHandler: Failed to revoke sessions: %v", err)
+	}
+	// Whoever knew the old password may have created keys with it
+	revokedKeys, err := h.APIKeys.RevokeAll(r.Context(), userID)
+	if err != nil {
+		log.Printf("ResetPasswordHandler: Failed to revoke API keys: %v", err)
+	}
+	recordEvent(h.Audit, r, "ResetPasswordHandler", audit.Entry{
+		Action:   "auth.password.reset",
+		ActorID:  userID,
+		TargetID: userID,
+		Details:  map[string]interface{}{"revokedAPIKeys": revokedKeys},
+	})
+	writeMessage(w, http.StatusOK, "Password updated, please sign in")
+}
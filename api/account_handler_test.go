@@ -0,0 +1,298 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"watermark-generator/audit"
+	"watermark-generator/auth"
+	"watermark-generator/mail"
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testOneTimeStore is an auth.OneTimeStore for tests.
+type testOneTimeStore struct {
+	mu     sync.Mutex
+	tokens []*auth.OneTimeToken
+}
+
+func (s *testOneTimeStore) CreateOneTimeToken(_ context.Context, t *auth.OneTimeToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = append(s.tokens, t)
+	return nil
+}
+
+func (s *testOneTimeStore) find(hash, purpose string, now time.Time) int {
+	for i, t := range s.tokens {
+		if t.TokenHash == hash && t.Purpose == purpose && t.ExpiresAt.After(now) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *testOneTimeStore) TakeOneTimeToken(_ context.Context, hash, purpose string, now time.Time) (*auth.OneTimeToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.find(hash, purpose, now)
+	if i < 0 {
+		return nil, auth.ErrInvalidToken
+	}
+	t := s.tokens[i]
+	s.tokens = append(s.tokens[:i], s.tokens[i+1:]...)
+	return t, nil
+}
+
+func (s *testOneTimeStore) FindOneTimeToken(_ context.Context, hash, purpose string, now time.Time) (*auth.OneTimeToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.find(hash, purpose, now)
+	if i < 0 {
+		return nil, auth.ErrInvalidToken
+	}
+	return s.tokens[i], nil
+}
+
+func (s *testOneTimeStore) DeleteOneTimeTokens(_ context.Context, userID primitive.ObjectID, purpose string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.tokens[:0]
+	for _, t := range s.tokens {
+		if t.UserID != userID || t.Purpose != purpose {
+			kept = append(kept, t)
+		}
+	}
+	s.tokens = kept
+	return nil
+}
+
+// expireAll moves every stored token past its expiry.
+func (s *testOneTimeStore) expireAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		t.ExpiresAt = time.Now().Add(-time.Minute)
+	}
+}
+
+// testAccounts is an auth.AccountStore for tests.
+type testAccounts struct {
+	testUsers
+}
+
+func (a testAccounts) UserByEmail(_ context.Context, email string) (*models.User, error) {
+	for _, user := range a.testUsers {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return nil, auth.ErrUserNotFound
+}
+
+func (a testAccounts) MarkEmailVerified(_ context.Context, id primitive.ObjectID) error {
+	if user, ok := a.testUsers[id]; ok {
+		user.EmailVerified = true
+	}
+	return nil
+}
+
+func (a testAccounts) ResetPassword(_ context.Context, id primitive.ObjectID, hash string, at time.Time) error {
+	if user, ok := a.testUsers[id]; ok {
+		user.Password = hash
+		user.EmailVerified = true
+		user.TokensRevokedAt = at
+	}
+	return nil
+}
+
+// testSessionStore records which users were signed out everywhere.
+type testSessionStore struct {
+	auth.SessionStore
+	revoked []primitive.ObjectID
+}
+
+func (s *testSessionStore) DeleteUserSessions(_ context.Context, userID primitive.ObjectID) error {
+	s.revoked = append(s.revoked, userID)
+	return nil
+}
+
+// testAccountHandler returns an AuthHandler for the email link flows with
+// one unverified user.
+func testAccountHandler(t *testing.T) (*AuthHandler, *models.User, *testOneTimeStore, *mail.MemorySender) {
+	t.Helper()
+	t.Setenv("VITE_API_URL", "https://app.example.com")
+	user := &models.User{ID: primitive.NewObjectID(), Email: "reset.user@example.com", Password: "old"}
+	store := &testOneTimeStore{}
+	sender := &mail.MemorySender{}
+	h := &AuthHandler{
+		Sessions: auth.NewSessions(auth.NewTokenIssuer([]byte("test-secret"), time.Hour), &testSessionStore{}),
+		Accounts: testAccounts{testUsers{user.ID: user}},
+		OneTime:  auth.NewOneTimeTokens(store),
+		APIKeys:  auth.NewAPIKeys(testAPIKeys{}),
+		Mail:     sender,
+		Policy:   auth.DefaultPasswordPolicy(),
+		Audit:    audit.NewLog(&testAuditStore{}),
+	}
+	return h, user, store, sender
+}
+
+var linkToken = regexp.MustCompile(`\?token=(\S+)`)
+
+// emailedToken returns the token from the link in the last message sent.
+func emailedToken(t *testing.T, sender *mail.MemorySender) string {
+	t.Helper()
+	messages := sender.Messages()
+	if len(messages) == 0 {
+		t.Fatal("no email sent")
+	}
+	m := linkToken.FindStringSubmatch(messages[len(messages)-1].Body)
+	if m == nil {
+		t.Fatalf("no link in %q", messages[len(messages)-1].Body)
+	}
+	token, err := url.QueryUnescape(m[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func postJSON(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	return w
+}
+
+func TestVerifyEmailHandler(t *testing.T) {
+	h, user, store, sender := testAccountHandler(t)
+	if err := h.sendVerification(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	token := emailedToken(t, sender)
+
+	if w := postJSON(h.VerifyEmailHandler, `{"token":"`+token+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if !user.EmailVerified {
+		t.Error("email not marked verified")
+	}
+	if w := postJSON(h.VerifyEmailHandler, `{"token":"`+token+`"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("second use: status %d, want 400", w.Code)
+	}
+
+	// An expired link is refused
+	user.EmailVerified = false
+	if err := h.sendVerification(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	store.expireAll()
+	if w := postJSON(h.VerifyEmailHandler, `{"token":"`+emailedToken(t, sender)+`"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expired: status %d, want 400", w.Code)
+	}
+	if user.EmailVerified {
+		t.Error("expired link verified the email")
+	}
+}
+
+func TestForgotPasswordHandler(t *testing.T) {
+	h, user, _, sender := testAccountHandler(t)
+	if w := postJSON(h.ForgotPasswordHandler, `{"email":"nobody@example.com"}`); w.Code != http.StatusAccepted {
+		t.Errorf("unknown address: status %d, want 202", w.Code)
+	}
+	if n := len(sender.Messages()); n != 0 {
+		t.Errorf("%d emails sent to an unknown address", n)
+	}
+
+	if w := postJSON(h.ForgotPasswordHandler, `{"email":"`+user.Email+`"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	messages := sender.Messages()
+	if len(messages) != 1 || messages[0].To != user.Email {
+		t.Fatalf("messages = %+v, want one reset email to %s", messages, user.Email)
+	}
+	if !strings.Contains(messages[0].Body, "https://app.example.com/reset-password?token=") {
+		t.Errorf("no reset link in %q", messages[0].Body)
+	}
+}
+
+func TestResetPasswordHandler(t *testing.T) {
+	h, user, store, sender := testAccountHandler(t)
+	ctx := context.Background()
+	if _, _, err := h.APIKeys.Create(ctx, user.ID, "ci", []string{auth.ScopeWatermarkWrite}); err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, _ := h.APIKeys.Create(ctx, primitive.NewObjectID(), "ci", []string{auth.ScopeWatermarkWrite})
+	if w := postJSON(h.ForgotPasswordHandler, `{"email":"`+user.Email+`"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	token := emailedToken(t, sender)
+
+	// The account's own address is refused and the link still works after
+	w := postJSON(h.ResetPasswordHandler, `{"token":"`+token+`","password":"`+user.Email+`"}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "email address") {
+		t.Errorf("email as password: status %d: %s", w.Code, w.Body)
+	}
+	if w := postJSON(h.ResetPasswordHandler, `{"token":"`+token+`","password":"a new passphrase"}`); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("a new passphrase")) != nil {
+		t.Error("password not changed")
+	}
+	if !user.EmailVerified || user.TokensRevokedAt.IsZero() {
+		t.Errorf("verified %v, tokens revoked at %v", user.EmailVerified, user.TokensRevokedAt)
+	}
+	if revoked := h.Sessions.Store.(*testSessionStore).revoked; len(revoked) != 1 || revoked[0] != user.ID {
+		t.Errorf("revoked sessions of %v, want the user's", revoked)
+	}
+	if n, _ := h.APIKeys.Store.CountAPIKeys(ctx, user.ID); n != 0 {
+		t.Errorf("%d API keys left after the reset", n)
+	}
+	if _, err := h.APIKeys.Authenticate(ctx, otherKey); err != nil {
+		t.Errorf("another user's key revoked: %v", err)
+	}
+	if w := postJSON(h.ResetPasswordHandler, `{"token":"`+token+`","password":"another passphrase"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("second use: status %d, want 400", w.Code)
+	}
+
+	// An expired link is refused
+	if w := postJSON(h.ForgotPasswordHandler, `{"email":"`+user.Email+`"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	store.expireAll()
+	if w := postJSON(h.ResetPasswordHandler, `{"token":"`+emailedToken(t, sender)+`","password":"another passphrase"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expired: status %d, want 400", w.Code)
+	}
+}
+
+func TestFormatTTL(t *testing.T) {
+	tests := map[time.Duration]string{
+		time.Hour:        "1 hour",
+		48 * time.Hour:   "2 days",
+		90 * time.Minute: "90 minutes",
+		24 * time.Hour:   "1 day",
+		3 * time.Hour:    "3 hours",
+		1 * time.Minute:  "1 minute",
+	}
+	for d, want := range tests {
+		if got := formatTTL(d); got != want {
+			t.Errorf("formatTTL(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestAppLinkEscapesToken(t *testing.T) {
+	t.Setenv("VITE_API_URL", "https://example.com")
+	if got, want := appLink("/reset-password", "a+b/c"), "https://example.com/reset-password?token=a%2Bb%2Fc"; got != want {
+		t.Errorf("appLink = %q, want %q", got, want)
+	}
+}
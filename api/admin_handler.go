@@ -0,0 +1,298 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"watermark-generator/audit"
+	"watermark-generator/auth"
+	"watermark-generator/db"
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// AdminHandler serves the staff endpoints under /api/admin. Routes decide
+// which roles may call each handler; the handlers record every change in
+// the audit log.
+type AdminHandler struct {
+	DB       *mongo.Database
+	Sessions *auth.Sessions
+	Audit    *audit.Log
+}
+
+func NewAdminHandler(sessions *auth.Sessions, auditLog *audit.Log) *AdminHandler {
+	return &AdminHandler{DB: db.GetDatabase(), Sessions: sessions, Audit: auditLog}
+}
+
+// userQuery is a parsed user search.
+type userQuery struct {
+	Filter bson.M
+	Page   int
+	Limit  int
+}
+
+// parseUserQuery reads the q (email substring), role, disabled, page and
+// limit parameters of a user listing.
+func parseUserQuery(values url.Values) (userQuery, error) {
+	q := userQuery{Filter: bson.M{}, Page: 1, Limit: defaultPageSize}
+	if search := values.Get("q"); search != "" {
+		q.Filter["email"] = primitive.Regex{Pattern: regexp.QuoteMeta(search), Options: "i"}
+	}
+	if role := values.Get("role"); role != "" {
+		if !contains(models.Roles, role) {
+			return q, fmt.Errorf("role must be one of %v", models.Roles)
+		}
+		if role == models.RoleUser {
+			// Accounts created before roles existed have none stored
+			q.Filter["role"] = bson.M{"$in": bson.A{models.RoleUser, nil}}
+		} else {
+			q.Filter["role"] = role
+		}
+	}
+	if disabled := values.Get("disabled"); disabled != "" {
+		d, err := strconv.ParseBool(disabled)
+		if err != nil {
+			return q, fmt.Errorf("disabled must be true or false")
+		}
+		if d {
+			q.Filter["disabled"] = true
+		} else {
+			q.Filter["disabled"] = bson.M{"$ne": true}
+		}
+	}
+	if page := values.Get("page"); page != "" {
+		p, err := strconv.Atoi(page)
+		if err != nil || p < 1 {
+			return q, fmt.Errorf("page must be a positive number")
+		}
+		q.Page = p
+	}
+	if limit := values.Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 || l > maxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		q.Limit = l
+	}
+	return q, nil
+}
+
+// UsersHandler lists users matching the query parameters of
+// parseUserQuery, newest first.
+func (h *AdminHandler) UsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseUserQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	collection := h.DB.Collection("users")
+	total, err := collection.CountDocuments(r.Context(), q.Filter)
+	if err != nil {
+		log.Printf("UsersHandler: Failed to count users: %v", err)
+		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+		return
+	}
+	cursor, err := collection.Find(r.Context(), q.Filter, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: -1}}).
+		SetSkip(int64((q.Page-1)*q.Limit)).
+		SetLimit(int64(q.Limit)))
+	if err != nil {
+		log.Printf("UsersHandler: Failed to fetch users: %v", err)
+		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+		return
+	}
+	users := []models.User{}
+	if err := cursor.All(r.Context(), &users); err != nil {
+		log.Printf("UsersHandler: Failed to decode users: %v", err)
+		http.Error(w, "Failed to decode users", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users": users,
+		"total": total,
+		"page":  q.Page,
+		"limit": q.Limit,
+	})
+}
+
+// adminRequest is the body of the user management endpoints.
+type adminRequest struct {
+	UserID   string `json:"userId"`
+	Disabled bool   `json:"disabled"`
+	Role     string `json:"role"`
+	Reason   string `json:"reason"`
+}
+
+// target decodes the request body and loads the user it names.
+func (h *AdminHandler) target(w http.ResponseWriter, r *http.Request) (*adminRequest, *models.User, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, nil, false
+	}
+	var req adminRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	id, err := primitive.ObjectIDFromHex(req.UserID)
+	if err != nil {
+		http.Error(w, "Invalid userId", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	user, err := auth.MongoUsers{DB: h.DB}.UserByID(r.Context(), id)
+	if err == auth.ErrUserNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	if err != nil {
+		log.Printf("AdminHandler: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	return &req, user, true
+}
+
+// DisableHandler disables or re-enables an account. Disabling signs the
+// user out everywhere.
+func (h *AdminHandler) DisableHandler(w http.ResponseWriter, r *http.Request) {
+	req, user, ok := h.target(w, r)
+	if !ok {
+		return
+	}
+	if user.ID == auth.UserFrom(r.Context()).ID {
+		http.Error(w, "You cannot disable your own account", http.StatusBadRequest)
+		return
+	}
+
+	set := bson.M{"disabled": req.Disabled}
+	if req.Disabled {
+		set["tokensRevokedAt"] = time.Now()
+	}
+	if _, err := h.DB.Collection("users").UpdateOne(r.Context(), bson.M{"_id": user.ID}, bson.M{"$set": set}); err != nil {
+		log.Printf("DisableHandler: Failed to update user: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if req.Disabled {
+		if err := h.Sessions.RevokeAll(r.Context(), user.ID); err != nil {
+			log.Printf("DisableHandler: Failed to revoke sessions: %v", err)
+		}
+	}
+	action := "user.enable"
+	if req.Disabled {
+		action = "user.disable"
+	}
+	recordEvent(h.Audit, r, "DisableHandler", audit.Entry{
+		Action:   action,
+		TargetID: user.ID,
+		Changes:  audit.Diff(map[string]interface{}{"disabled": user.Disabled}, map[string]interface{}{"disabled": req.Disabled}),
+		Details:  map[string]interface{}{"reason": req.Reason},
+	})
+
+	user.Disabled = req.Disabled
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// RoleHandler changes a user's role.
+func (h *AdminHandler) RoleHandler(w http.ResponseWriter, r *http.Request) {
+	req, user, ok := h.target(w, r)
+	if !ok {
+		return
+	}
+	if !contains(models.Roles, req.Role) {
+		http.Error(w, fmt.Sprintf("role must be one of %v", models.Roles), http.StatusBadRequest)
+		return
+	}
+	if user.ID == auth.UserFrom(r.Context()).ID {
+		http.Error(w, "You cannot change your own role", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.DB.Collection("users").UpdateOne(r.Context(), bson.M{"_id": user.ID}, bson.M{
+		"$set": bson.M{"role": req.Role},
+	}); err != nil {
+		log.Printf("RoleHandler: Failed to update user: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	recordEvent(h.Audit, r, "RoleHandler", audit.Entry{
+		Action:   "user.role",
+		TargetID: user.ID,
+		Changes:  audit.Diff(map[string]interface{}{"role": user.RoleName()}, map[string]interface{}{"role": req.Role}),
+		Details:  map[string]interface{}{"reason": req.Reason},
+	})
+
+	user.Role = req.Role
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// ImpersonateHandler returns a short-lived access token for a regular user
+// that names the caller as actor. A reason is required and recorded; no
+// token is issued if the audit entry cannot be written.
+func (h *AdminHandler) ImpersonateHandler(w http.ResponseWriter, r *http.Request) {
+	req, user, ok := h.target(w, r)
+	if !ok {
+		return
+	}
+	if req.Reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+	if !user.HasRole(models.RoleUser) {
+		http.Error(w, "Only regular users can be impersonated", http.StatusForbidden)
+		return
+	}
+	if user.Disabled {
+		http.Error(w, "User is disabled", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Audit.Request(r, audit.Entry{
+		Action:   "user.impersonate",
+		TargetID: user.ID,
+		Details:  map[string]interface{}{"reason": req.Reason},
+	}); err != nil {
+		log.Printf("ImpersonateHandler: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	actor := auth.UserFrom(r.Context())
+	token, err := h.Sessions.Tokens.IssueAs(user.ID, actor.ID)
+	if err != nil {
+		log.Printf("ImpersonateHandler: Failed to issue token: %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("ImpersonateHandler: %s impersonating %s", actor.Email, user.Email)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":     token,
+		"expiresIn": int64(h.Sessions.Tokens.TTL() / time.Second),
+		"user":      user,
+	})
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseUserQuery(t *testing.T) {
+	q, err := parseUserQuery(url.Values{
+		"q":        {"a.b+c@example.com"},
+		"role":     {"support"},
+		"disabled": {"false"},
+		"page":     {"3"},
+		"limit":    {"20"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Page != 3 || q.Limit != 20 {
+		t.Errorf("page %d limit %d, want 3 and 20", q.Page, q.Limit)
+	}
+	// Searches are literal, not regular expressions
+	if got := q.Filter["email"].(primitive.Regex).Pattern; got != `a\.b\+c@example\.com` {
+		t.Errorf("email pattern = %q", got)
+	}
+	if q.Filter["role"] != "support" {
+		t.Errorf("role filter = %v", q.Filter["role"])
+	}
+	if _, ok := q.Filter["disabled"].(bson.M); !ok {
+		t.Errorf("disabled=false filter = %v, want a $ne match", q.Filter["disabled"])
+	}
+
+	defaults, err := parseUserQuery(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defaults.Filter) != 0 || defaults.Page != 1 || defaults.Limit != defaultPageSize {
+		t.Errorf("defaults = %+v", defaults)
+	}
+}
+
+func TestParseUserQueryRejectsInvalidValues(t *testing.T) {
+	for _, values := range []url.Values{
+		{"role": {"root"}},
+		{"disabled": {"maybe"}},
+		{"page": {"0"}},
+		{"limit": {"1000"}},
+		{"limit": {"x"}},
+	} {
+		if _, err := parseUserQuery(values); err == nil {
+			t.Errorf("%v accepted", values)
+		}
+	}
+}
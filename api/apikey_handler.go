@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"watermark-generator/audit"
+	"watermark-generator/auth"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// APIKeyHandler lets users manage the API keys their scripts and CI use.
+// Its routes take access tokens only, so a key cannot create more keys.
+type APIKeyHandler struct {
+	Keys  *auth.APIKeys
+	Audit *audit.Log
+}
+
+func NewAPIKeyHandler(keys *auth.APIKeys, auditLog *audit.Log) *APIKeyHandler {
+	return &APIKeyHandler{Keys: keys, Audit: auditLog}
+}
+
+// KeysHandler lists the user's keys (GET) or creates one (POST) from
+// {"name", "scopes"}. The new key is in the response only this once.
+func (h *APIKeyHandler) KeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := auth.UserFrom(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		keys, err := h.Keys.Store.APIKeysByUser(r.Context(), user.ID)
+		if err != nil {
+			log.Printf("KeysHandler: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys, "scopes": auth.Scopes})
+		return
+	}
+
+	// A key outlives the impersonation token, so staff could keep access
+	// to the account after the token expires
+	if !auth.ActorFrom(r.Context()).IsZero() {
+		writeMessage(w, http.StatusForbidden, "API keys cannot be created while impersonating")
+		return
+	}
+	var body struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if err := auth.CheckAPIKeyRequest(body.Name, body.Scopes); err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	key, record, err := h.Keys.Create(r.Context(), user.ID, body.Name, body.Scopes)
+	if err == auth.ErrTooManyAPIKeys {
+		writeMessage(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("KeysHandler: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("KeysHandler: User %s created API key %s with scopes %v", user.ID.Hex(), record.Prefix, record.Scopes)
+	recordEvent(h.Audit, r, "KeysHandler", audit.Entry{
+		Action:   "apikey.create",
+		TargetID: record.ID,
+		Details:  map[string]interface{}{"name": record.Name, "prefix": record.Prefix, "scopes": record.Scopes},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"key": key, "apiKey": record})
+}
+
+// RevokeKeyHandler deletes the user's key named by {"id"}. Requests made
+// with it fail from then on.
+func (h *APIKeyHandler) RevokeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := auth.UserFrom(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(body.ID)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
+
+	err = h.Keys.Store.DeleteAPIKey(r.Context(), user.ID, id)
+	if err == auth.ErrAPIKeyNotFound {
+		writeMessage(w, http.StatusNotFound, "API key not found")
+		return
+	}
+	if err != nil {
+		log.Printf("RevokeKeyHandler: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("RevokeKeyHandler: User %s revoked API key %s", user.ID.Hex(), id.Hex())
+	recordEvent(h.Audit, r, "RevokeKeyHandler", audit.Entry{Action: "apikey.revoke", TargetID: id})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"watermark-generator/audit"
+	"watermark-generator/auth"
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testAPIKeys is an APIKeyStore for tests.
+type testAPIKeys map[primitive.ObjectID]*auth.APIKey
+
+func (s testAPIKeys) CreateAPIKey(_ context.Context, k *auth.APIKey) error {
+	s[k.ID] = k
+	return nil
+}
+
+func (s testAPIKeys) APIKeyByHash(_ context.Context, hash string) (*auth.APIKey, error) {
+	for _, k := range s {
+		if k.KeyHash == hash {
+			return k, nil
+		}
+	}
+	return nil, auth.ErrInvalidAPIKey
+}
+
+func (s testAPIKeys) APIKeysByUser(_ context.Context, userID primitive.ObjectID) ([]auth.APIKey, error) {
+	keys := []auth.APIKey{}
+	for _, k := range s {
+		if k.UserID == userID {
+			keys = append(keys, *k)
+		}
+	}
+	return keys, nil
+}
+
+func (s testAPIKeys) CountAPIKeys(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	keys, _ := s.APIKeysByUser(ctx, userID)
+	return int64(len(keys)), nil
+}
+
+func (s testAPIKeys) DeleteAPIKey(_ context.Context, userID, id primitive.ObjectID) error {
+	if k, ok := s[id]; ok && k.UserID == userID {
+		delete(s, id)
+		return nil
+	}
+	return auth.ErrAPIKeyNotFound
+}
+
+func (s testAPIKeys) DeleteUserAPIKeys(_ context.Context, userID primitive.ObjectID) (int64, error) {
+	var n int64
+	for id, k := range s {
+		if k.UserID == userID {
+			delete(s, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s testAPIKeys) RecordAPIKeyUse(_ context.Context, id primitive.ObjectID, at time.Time, ip string) error {
+	s[id].UseCount++
+	return nil
+}
+
+func TestAPIKeyHandlers(t *testing.T) {
+	tokens := auth.NewTokenIssuer([]byte("test-secret"), time.Hour)
+	store := testAPIKeys{}
+	keys := auth.NewAPIKeys(store)
+	user := &models.User{ID: primitive.NewObjectID(), Email: "ci@example.com"}
+	other := &models.User{ID: primitive.NewObjectID(), Email: "other@example.com"}
+	staff := &models.User{ID: primitive.NewObjectID(), Email: "support@example.com", Role: models.RoleSupport}
+	mw := auth.NewMiddleware(tokens, testUsers{user.ID: user, other.ID: other, staff.ID: staff}, keys)
+	events := &testAuditStore{}
+	h := NewAPIKeyHandler(keys, audit.NewLog(events))
+	userToken, _ := tokens.Issue(user.ID)
+
+	call := func(handler http.HandlerFunc, method, header, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/keys", strings.NewReader(body))
+		r.Header.Set("Authorization", header)
+		w := httptest.NewRecorder()
+		mw.Require(handler)(w, r)
+		return w
+	}
+
+	w := call(h.KeysHandler, http.MethodPost, "Bearer "+userToken, `{"name":"ci","scopes":["watermark:write"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	var created struct {
+		Key    string      `json:"key"`
+		APIKey auth.APIKey `json:"apiKey"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	if !strings.HasPrefix(created.Key, created.APIKey.Prefix) {
+		t.Errorf("created key %q with prefix %q", created.Key, created.APIKey.Prefix)
+	}
+
+	w = call(h.KeysHandler, http.MethodGet, "Bearer "+userToken, "")
+	if body := w.Body.String(); strings.Contains(body, created.Key) || strings.Contains(body, "keyHash") || !strings.Contains(body, created.APIKey.Prefix) {
+		t.Errorf("listing exposes the key or lacks its prefix: %s", body)
+	}
+
+	// Keys cannot manage keys
+	if w := call(h.KeysHandler, http.MethodGet, "ApiKey "+created.Key, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("listing with an API key: status %d, want 401", w.Code)
+	}
+	if w := call(h.KeysHandler, http.MethodPost, "Bearer "+userToken, `{"name":"ci","scopes":["users:admin"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown scope: status %d, want 400", w.Code)
+	}
+	impersonation, _ := tokens.IssueAs(user.ID, staff.ID)
+	if w := call(h.KeysHandler, http.MethodPost, "Bearer "+impersonation, `{"name":"x","scopes":["watermark:write"]}`); w.Code != http.StatusForbidden {
+		t.Errorf("create while impersonating: status %d, want 403", w.Code)
+	}
+
+	otherToken, _ := tokens.Issue(other.ID)
+	revoke := `{"id":"` + created.APIKey.ID.Hex() + `"}`
+	if w := call(h.RevokeKeyHandler, http.MethodPost, "Bearer "+otherToken, revoke); w.Code != http.StatusNotFound {
+		t.Errorf("revoking another user's key: status %d, want 404", w.Code)
+	}
+	if w := call(h.RevokeKeyHandler, http.MethodPost, "Bearer "+userToken, revoke); w.Code != http.StatusNoContent {
+		t.Errorf("revoke: status %d, want 204", w.Code)
+	}
+	if _, err := keys.Authenticate(context.Background(), created.Key); err != auth.ErrInvalidAPIKey {
+		t.Errorf("revoked key still authenticates: %v", err)
+	}
+
+	if got := events.actions(); strings.Join(got, " ") != "apikey.create apikey.revoke" {
+		t.Errorf("audited %v, want the creation and revocation", got)
+	}
+	for _, e := range events.entries {
+		if e.ActorID != user.ID || e.TargetID != created.APIKey.ID {
+			t.Errorf("%s by %s on %s, want the user's key", e.Action, e.ActorID.Hex(), e.TargetID.Hex())
+		}
+	}
+}
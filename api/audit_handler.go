@@ -0,0 +1,145 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"watermark-generator/audit"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// recordEvent adds e to the audit log on behalf of the request. A failure
+// is logged under handler's name but does not fail the request, which has
+// already taken effect.
+func recordEvent(l *audit.Log, r *http.Request, handler string, e audit.Entry) {
+	if err := l.Request(r, e); err != nil {
+		log.Printf("%s: %v", handler, err)
+	}
+}
+
+// parseAuditQuery reads the actor, target, action, from, to, page and limit
+// parameters of an audit log search. Times are RFC 3339.
+func parseAuditQuery(values url.Values) (audit.Query, error) {
+	q := audit.Query{Action: values.Get("action"), Page: 1, Limit: defaultPageSize}
+	for _, p := range []struct {
+		name string
+		dst  *primitive.ObjectID
+	}{{"actor", &q.ActorID}, {"target", &q.TargetID}} {
+		if v := values.Get(p.name); v != "" {
+			id, err := primitive.ObjectIDFromHex(v)
+			if err != nil {
+				return q, fmt.Errorf("%s must be an id", p.name)
+			}
+			*p.dst = id
+		}
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if v := values.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return q, fmt.Errorf("%s must be an RFC 3339 time such as 2024-01-31T00:00:00Z", p.name)
+			}
+			*p.dst = t
+		}
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		return q, fmt.Errorf("from must be before to")
+	}
+	if page := values.Get("page"); page != "" {
+		p, err := strconv.Atoi(page)
+		if err != nil || p < 1 {
+			return q, fmt.Errorf("page must be a positive number")
+		}
+		q.Page = p
+	}
+	if limit := values.Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 || l > maxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		q.Limit = l
+	}
+	return q, nil
+}
+
+// AuditHandler lists audit log entries matching the query parameters of
+// parseAuditQuery, newest first.
+func (h *AdminHandler) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseAuditQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	total, err := h.Audit.Store.Count(r.Context(), q)
+	if err != nil {
+		log.Printf("AuditHandler: %v", err)
+		http.Error(w, "Failed to fetch audit log", http.StatusInternalServerError)
+		return
+	}
+	entries, err := h.Audit.Store.Find(r.Context(), q)
+	if err != nil {
+		log.Printf("AuditHandler: %v", err)
+		http.Error(w, "Failed to fetch audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries": entries,
+		"total":   total,
+		"page":    q.Page,
+		"limit":   q.Limit,
+	})
+}
+
+// AuditExportHandler streams every entry matching the query parameters of
+// parseAuditQuery as JSON Lines, oldest first. Paging parameters are
+// ignored. The export itself is audited.
+func (h *AdminHandler) AuditExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseAuditQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.Audit.Request(r, audit.Entry{Action: "audit.export", Details: map[string]interface{}{"query": r.URL.RawQuery}}); err != nil {
+		log.Printf("AuditExportHandler: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%s.jsonl"`, time.Now().UTC().Format("20060102-150405")))
+	enc := json.NewEncoder(w)
+	n := 0
+	err = h.Audit.Store.Each(r.Context(), q, func(e *audit.Entry) error {
+		n++
+		return enc.Encode(e)
+	})
+	if err != nil && n == 0 {
+		log.Printf("AuditExportHandler: %v", err)
+		http.Error(w, "Failed to export audit log", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		// The status is already sent, so a cut-off export is only logged
+		log.Printf("AuditExportHandler: Export stopped after %d entries: %v", n, err)
+	}
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"watermark-generator/audit"
+	"watermark-generator/auth"
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testAuditStore is an audit.Store for tests. It filters by actor and
+// exact action only.
+type testAuditStore struct {
+	entries []audit.Entry
+}
+
+func (s *testAuditStore) matches(e *audit.Entry, q audit.Query) bool {
+	return (q.ActorID.IsZero() || e.ActorID == q.ActorID) && (q.Action == "" || e.Action == q.Action)
+}
+
+func (s *testAuditStore) Append(_ context.Context, e *audit.Entry) error {
+	s.entries = append(s.entries, *e)
+	return nil
+}
+
+func (s *testAuditStore) Find(_ context.Context, q audit.Query) ([]audit.Entry, error) {
+	entries := []audit.Entry{}
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		if s.matches(&s.entries[i], q) {
+			entries = append(entries, s.entries[i])
+		}
+	}
+	return entries, nil
+}
+
+func (s *testAuditStore) Count(ctx context.Context, q audit.Query) (int64, error) {
+	entries, _ := s.Find(ctx, q)
+	return int64(len(entries)), nil
+}
+
+func (s *testAuditStore) Each(_ context.Context, q audit.Query, fn func(*audit.Entry) error) error {
+	for i := range s.entries {
+		if s.matches(&s.entries[i], q) {
+			if err := fn(&s.entries[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *testAuditStore) actions() []string {
+	actions := []string{}
+	for _, e := range s.entries {
+		actions = append(actions, e.Action)
+	}
+	return actions
+}
+
+func TestParseAuditQuery(t *testing.T) {
+	actor := primitive.NewObjectID()
+	q, err := parseAuditQuery(url.Values{
+		"actor":  {actor.Hex()},
+		"action": {"auth.*"},
+		"from":   {"2026-01-01T00:00:00Z"},
+		"to":     {"2026-02-01T00:00:00+01:00"},
+		"limit":  {"20"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.ActorID != actor || q.Action != "auth.*" || q.Limit != 20 || q.Page != 1 {
+		t.Errorf("query = %+v", q)
+	}
+	if want := time.Date(2026, 1, 31, 23, 0, 0, 0, time.UTC); !q.To.Equal(want) {
+		t.Errorf("to = %v, want %v", q.To, want)
+	}
+
+	for _, values := range []url.Values{
+		{"actor": {"someone"}},
+		{"from": {"yesterday"}},
+		{"from": {"2026-02-01T00:00:00Z"}, "to": {"2026-01-01T00:00:00Z"}},
+		{"limit": {"1000"}},
+	} {
+		if _, err := parseAuditQuery(values); err == nil {
+			t.Errorf("%v accepted", values)
+		}
+	}
+}
+
+func TestAuditExportHandler(t *testing.T) {
+	store := &testAuditStore{}
+	h := &AdminHandler{Audit: audit.NewLog(store)}
+	admin := &models.User{ID: primitive.NewObjectID(), Role: models.RoleAdmin}
+	user := primitive.NewObjectID()
+	for _, action := range []string{"auth.login.failed", "auth.login", "apikey.create"} {
+		store.Append(context.Background(), &audit.Entry{ActorID: user, Action: action, CreatedAt: time.Now()})
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/admin/audit/export?actor="+user.Hex(), nil)
+	r = r.WithContext(auth.WithUser(r.Context(), admin))
+	w := httptest.NewRecorder()
+	h.AuditExportHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("content type %q", ct)
+	}
+
+	var actions []string
+	lines := bufio.NewScanner(w.Body)
+	for lines.Scan() {
+		var e map[string]interface{}
+		if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+			t.Fatalf("line %q: %v", lines.Text(), err)
+		}
+		actions = append(actions, e["action"].(string))
+	}
+	if len(actions) != 3 || actions[0] != "auth.login.failed" || actions[2] != "apikey.create" {
+		t.Errorf("exported %v, want the user's entries oldest first", actions)
+	}
+
+	last := store.entries[len(store.entries)-1]
+	if last.Action != "audit.export" || last.ActorID != admin.ID {
+		t.Errorf("last entry %s by %s, want the export by the admin", last.Action, last.ActorID.Hex())
+	}
+}
@@ -3,17 +3,22 @@ package api
 import (
 	"context"
 	"encoding/json"
-	"os"
-	"time"
+	"fmt"
 
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"watermark-generator/audit"
+	"watermark-generator/auth"
 	"watermark-generator/db"
+	"watermark-generator/mail"
 	"watermark-generator/models"
+	"watermark-generator/watermark"
 
-	"github.com/golang-jwt/jwt/v4"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -21,25 +26,77 @@ import (
 )
 
 type AuthHandler struct {
-	DB *mongo.Database
+	DB       *mongo.Database
+	Sessions *auth.Sessions
+	// Accounts finds and updates users for the email link flows
+	Accounts auth.AccountStore
+	// OneTime issues the tokens in verification and reset emails
+	OneTime *auth.OneTimeTokens
+	// APIKeys are revoked when the password is reset
+	APIKeys  *auth.APIKeys
+	Mail     mail.Sender
+	Policy   *auth.PasswordPolicy
+	Throttle *auth.Throttle
+	Audit    *audit.Log
 }
 
-func NewAuthHandler() *AuthHandler {
+func NewAuthHandler(sessions *auth.Sessions, oneTime *auth.OneTimeTokens, apiKeys *auth.APIKeys, sender mail.Sender, policy *auth.PasswordPolicy, throttle *auth.Throttle, auditLog *audit.Log) *AuthHandler {
+	database := db.GetDatabase()
 	return &AuthHandler{
-		DB: db.GetDatabase(),
+		DB:       database,
+		Sessions: sessions,
+		Accounts: auth.MongoUsers{DB: database},
+		OneTime:  oneTime,
+		APIKeys:  apiKeys,
+		Mail:     sender,
+		Policy:   policy,
+		Throttle: throttle,
+		Audit:    auditLog,
+	}
+}
+
+// dummyPasswordHash is a bcrypt hash at bcrypt.DefaultCost that sign-ins
+// without a password to check are compared against, to take as long as
+// a wrong password.
+var dummyPasswordHash = []byte("$2a$10$e/WR6IfmwcQNFLxn2wNnqeG3dqLZ5G6p/I4uCJxe.Uh8/6mGGAMd2")
+
+// comparePassword checks password against the user's hash. A nil user, or
+// one who only signs in with a provider, always fails, after the same
+// bcrypt work as a wrong password.
+func comparePassword(user *models.User, password string) error {
+	if user == nil || user.Password == "" {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return bcrypt.ErrMismatchedHashAndPassword
 	}
+	return bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+}
+
+// loginFailed records a rejected sign-in to email. userID is the account's
+// when the address has one.
+func (h *AuthHandler) loginFailed(r *http.Request, handler string, userID primitive.ObjectID, email, reason string) {
+	recordEvent(h.Audit, r, handler, audit.Entry{
+		Action:   "auth.login.failed",
+		TargetID: userID,
+		Details:  map[string]interface{}{"email": email, "reason": reason},
+	})
 }
 
 func (h *AuthHandler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
-	var user models.User
-	err := json.NewDecoder(r.Body).Decode(&user)
+	// Only the credentials are read so clients cannot set fields such as
+	// the role or subscription of the new account
+	var credentials struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&credentials)
 	if err != nil {
 		log.Printf("Error decoding request body: %v", err)
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
+	user := models.User{Email: credentials.Email, Password: credentials.Password, Role: models.RoleUser}
 
-	log.Printf("Received registration request for email: %s, password length: %d", user.Email, len(user.Password))
+	log.Printf("Received registration request for email: %s", user.Email)
 
 	// Check if email is empty
 	if user.Email == "" {
@@ -50,11 +107,14 @@ func (h *AuthHandler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check if password is empty
 	if user.Password == "" {
-		log.Printf("Password is empty for email: %s", user.Email)
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{"message": "Password cannot be empty"})
 		return
 	}
+	if err := h.Policy.Check(user.Password, user.Email); err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	// Check if email already exists
 	var existingUser models.User
@@ -96,112 +156,22 @@ func (h *AuthHandler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("User registered successfully: %s", user.Email)
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"message": "User registered successfully"})
-}
-
-func (h *AuthHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
-	var credentials struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
-
-	err := json.NewDecoder(r.Body).Decode(&credentials)
-	if err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
+	// The account is created even if the email fails; the user can ask
+	// for another one
+	if err := h.sendVerification(r.Context(), &user); err != nil {
+		log.Printf("RegisterHandler: Failed to send verification email: %v", err)
 	}
 
-	log.Printf("Password length before trim: %d", len(credentials.Password))
-	credentials.Password = strings.TrimSpace(credentials.Password)
-	log.Printf("Password length after trim: %d", len(credentials.Password))
-
-	log.Printf("Attempting to login user: %s", credentials.Email)
-	log.Printf("Provided password: %s", credentials.Password)
-
-	collection := h.DB.Collection("users")
-	var user models.User
-	err = collection.FindOne(context.Background(), bson.M{"email": credentials.Email}).Decode(&user)
-	if err != nil {
-		log.Printf("User not found: %s", credentials.Email)
-		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
-		return
-	}
-
-	log.Printf("Stored hashed password for user %s: %s", user.Email, user.Password)
-	log.Printf("Provided password: %s", credentials.Password)
-
-	// Check if the stored password looks like a bcrypt hash
-	if !strings.HasPrefix(user.Password, "$2a$") && !strings.HasPrefix(user.Password, "$2b$") && !strings.HasPrefix(user.Password, "$2y$") {
-		log.Printf("Warning: Stored password for user %s does not appear to be a bcrypt hash", user.Email)
-	}
-
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(credentials.Password))
-	if err != nil {
-		log.Printf("Password comparison failed for user %s: %v", user.Email, err)
-		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
-		return
-	}
-
-	log.Printf("Password match successful for user: %s", credentials.Email)
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Login successful"})
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "User registered successfully. Check your email to confirm your address."})
 }
 
 func (h *AuthHandler) CurrentUserHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("CurrentUserHandler called")
 
-	// Extract token from Authorization header
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		log.Println("No token provided")
-		http.Error(w, "No token provided", http.StatusUnauthorized)
-		return
-	}
-
-	// Remove 'Bearer ' prefix if present
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	log.Printf("Token received: %s", tokenString)
-
-	// Validate the token
-	claims := &jwt.StandardClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("JWT_SECRET")), nil
-	})
-
-	if err != nil || !token.Valid {
-		log.Printf("Invalid token: %v", err)
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
-	}
-
-	log.Printf("Token validated, subject: %s", claims.Subject)
-
-	if claims.Subject == "" {
-		log.Println("Empty subject in token")
-		http.Error(w, "Invalid token: empty subject", http.StatusUnauthorized)
-		return
-	}
-
-	// Use the subject as the user ID
-	objectID, err := primitive.ObjectIDFromHex(claims.Subject)
-	if err != nil {
-		log.Printf("Invalid ObjectID: %v", err)
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
-	}
-
-	// Fetch user from database using claims.Subject (which should be the user ID)
-	var user models.User
-	err = h.DB.Collection("users").FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&user)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			log.Printf("User not found for ID: %s", claims.Subject)
-			http.Error(w, "User not found", http.StatusNotFound)
-		} else {
-			log.Printf("Error fetching user: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-		}
+	user := auth.UserFrom(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
@@ -211,10 +181,14 @@ func (h *AuthHandler) CurrentUserHandler(w http.ResponseWriter, r *http.Request)
 	response := map[string]interface{}{
 		"id":                    user.ID.Hex(),
 		"email":                 user.Email,
+		"role":                  user.RoleName(),
+		"twoFactorEnabled":      user.TwoFactorEnabled(),
 		"stripeCustomerId":      user.StripeCustomerID,
 		"subscriptionStatus":    user.SubscriptionStatus,
 		"subscriptionId":        user.SubscriptionId,
 		"subscriptionExpiresAt": user.SubscriptionExpiresAt,
+		"seatExpiresAt":         user.SeatExpiresAt,
+		"isPaid":                user.IsPaid(),
 		"dailyDownloads":        user.DailyDownloads,
 		"lastDownloadDate":      user.LastDownloadDate,
 	}
@@ -247,120 +221,241 @@ func (h *AuthHandler) SignInHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	credentials.Password = strings.TrimSpace(credentials.Password)
+	ip := auth.ClientIP(r)
+	wait, err := h.Throttle.Locked(r.Context(), credentials.Email, ip)
+	if err != nil {
+		log.Printf("SignInHandler: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// Attempts rejected by the lockout are not audited, so that hammering
+	// a locked account cannot flood the log
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeMessage(w, http.StatusTooManyRequests, "Too many failed sign-in attempts, please try again later")
+		return
+	}
 
+	// Unknown addresses and wrong passwords count alike and both run
+	// bcrypt, so neither the lockout nor the response time reveals which
+	// addresses have accounts
 	collection := h.DB.Collection("users")
 	var user models.User
 	err = collection.FindOne(context.Background(), bson.M{"email": credentials.Email}).Decode(&user)
+	found := &user
 	if err != nil {
+		found = nil
+	}
+	if err := comparePassword(found, credentials.Password); err != nil {
+		if err := h.Throttle.Failure(r.Context(), credentials.Email, ip); err != nil {
+			log.Printf("SignInHandler: %v", err)
+		}
+		h.loginFailed(r, "SignInHandler", user.ID, credentials.Email, "invalid_credentials")
 		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
 		return
 	}
+	if user.Disabled {
+		h.loginFailed(r, "SignInHandler", user.ID, credentials.Email, "disabled")
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
+	if !user.EmailVerified {
+		h.loginFailed(r, "SignInHandler", user.ID, credentials.Email, "unverified")
+		writeMessage(w, http.StatusForbidden, "Please confirm your email address first")
+		return
+	}
+	if user.TwoFactorEnabled() {
+		// The account's failure count is only cleared after the second
+		// factor, so knowing the password does not reset the lockout on
+		// guessing codes
+		challenge, err := h.OneTime.Issue(r.Context(), user.ID, auth.PurposeTwoFactor, auth.TwoFactorChallengeTTL)
+		if err != nil {
+			log.Printf("SignInHandler: Failed to issue challenge: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		writeChallenge(w, http.StatusOK, "Enter the code from your authenticator app", challenge)
+		return
+	}
+	if err := h.Throttle.Success(r.Context(), credentials.Email); err != nil {
+		log.Printf("SignInHandler: %v", err)
+	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(credentials.Password))
+	tokens, err := h.Sessions.Start(r.Context(), user.ID)
 	if err != nil {
-		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+		log.Printf("SignInHandler: Failed to start session: %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
-
-	// Generate a token that lasts for a week
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": user.ID.Hex(), // Use "sub" instead of "user_id"
-		"exp": time.Now().Add(time.Hour * 24 * 7).Unix(),
+	recordEvent(h.Audit, r, "SignInHandler", audit.Entry{
+		Action:   "auth.login",
+		ActorID:  user.ID,
+		TargetID: user.ID,
+		Details:  map[string]interface{}{"method": "password"},
 	})
+	writeSignIn(w, &user, tokens)
+}
 
-	// Sign and get the complete encoded token as a string using the secret
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+// RefreshHandler exchanges a refresh token for a new access and refresh
+// token. A refresh token that was already used revokes its whole family.
+func (h *AuthHandler) RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	refreshToken, err := decodeRefreshToken(r)
 	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := h.Sessions.Refresh(r.Context(), refreshToken)
+	if err == auth.ErrInvalidRefreshToken || err == auth.ErrRefreshTokenReused {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("RefreshHandler: Failed to refresh session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// After successful authentication:
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"id":                    user.ID.Hex(),
-		"email":                 user.Email,
-		"token":                 tokenString,
-		"stripeCustomerId":      user.StripeCustomerID,
-		"subscriptionStatus":    user.SubscriptionStatus,
-		"subscriptionId":        user.SubscriptionId,
-		"subscriptionExpiresAt": user.SubscriptionExpiresAt,
-		"dailyDownloads":        user.DailyDownloads,
-		"lastDownloadDate":      user.LastDownloadDate,
-	})
+	json.NewEncoder(w).Encode(tokens)
 }
 
-func generateToken(userID string) (string, error) {
-	// Create a new token object, specifying signing method and the claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour * 24 * 7).Unix(), // Token expires in 7 days
-	})
-
-	// Sign and get the complete encoded token as a string using the secret
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+// LogoutHandler revokes the session of the given refresh token. The access
+// token is not needed, since it may already have expired.
+func (h *AuthHandler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	refreshToken, err := decodeRefreshToken(r)
 	if err != nil {
-		return "", err
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	return tokenString, nil
+	if err := h.Sessions.Revoke(r.Context(), refreshToken); err != nil {
+		log.Printf("LogoutHandler: Failed to revoke session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (h *AuthHandler) GetUsersHandler(w http.ResponseWriter, r *http.Request) {
-	// Ensure the request method is GET
-	if r.Method != http.MethodGet {
+// LogoutAllHandler revokes every session of the signed-in user and
+// invalidates the access tokens issued so far.
+func (h *AuthHandler) LogoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-
-	// Fetch all users from the database
-	collection := h.DB.Collection("users")
-	cursor, err := collection.Find(context.Background(), bson.M{})
-	if err != nil {
-		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+	user := auth.UserFrom(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	defer cursor.Close(context.Background())
 
-	var users []models.User
-	if err = cursor.All(context.Background(), &users); err != nil {
-		http.Error(w, "Failed to decode users", http.StatusInternalServerError)
+	if err := h.Sessions.RevokeAll(r.Context(), user.ID); err != nil {
+		log.Printf("LogoutAllHandler: Failed to revoke sessions: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if _, err := h.DB.Collection("users").UpdateOne(r.Context(), bson.M{"_id": user.ID}, bson.M{
+		"$set": bson.M{"tokensRevokedAt": time.Now()},
+	}); err != nil {
+		log.Printf("LogoutAllHandler: Failed to revoke access tokens: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	// Return the users as JSON
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(users)
+func decodeRefreshToken(r *http.Request) (string, error) {
+	var body struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid request body")
+	}
+	if body.RefreshToken == "" {
+		return "", fmt.Errorf("refreshToken is required")
+	}
+	return body.RefreshToken, nil
 }
 
-func (h *AuthHandler) DeleteAllUsersHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
+// FooterSettingsHandler reads (GET) or replaces (PUT) the footer settings
+// of the signed-in user. Settings can be saved on any plan but only take
+// effect while the subscription is active.
+func (h *AuthHandler) FooterSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	collection := h.DB.Collection("users")
-	result, err := collection.DeleteMany(context.Background(), bson.M{})
-	if err != nil {
-		http.Error(w, "Failed to delete users", http.StatusInternalServerError)
+	user := auth.UserFrom(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
+	if r.Method == http.MethodPut {
+		var settings models.FooterSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := validateFooterSettings(settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := h.DB.Collection("users").UpdateOne(r.Context(), bson.M{"_id": user.ID}, bson.M{
+			"$set": bson.M{"footer": settings},
+		}); err != nil {
+			log.Printf("Error updating footer settings: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		user.Footer = settings
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":      "All users deleted successfully",
-		"deletedCount": result.DeletedCount,
+		"footer":       user.Footer,
+		"customizable": user.IsPaid(),
 	})
 }
 
-func SetupAuthRoutes(mux *http.ServeMux, handler *AuthHandler) {
-	mux.HandleFunc("/api/register", handler.RegisterHandler)
-	mux.HandleFunc("/api/login", handler.LoginHandler)
-	mux.HandleFunc("/api/signin", handler.SignInHandler)
-	mux.HandleFunc("/api/current-user", handler.CurrentUserHandler)
-	mux.HandleFunc("/api/users", handler.GetUsersHandler)
-	mux.HandleFunc("/api/users/delete-all", handler.DeleteAllUsersHandler)
-	mux.HandleFunc("/api/user", handler.CurrentUserHandler)
+var footerPositions = []string{"bottom-left", "bottom-center", "bottom-right", "top-left", "top-center", "top-right"}
+
+func validateFooterSettings(s models.FooterSettings) error {
+	if s.Position != "" && !contains(footerPositions, s.Position) {
+		return fmt.Errorf("position must be one of %s", strings.Join(footerPositions, ", "))
+	}
+	if s.Font != "" && !contains(watermark.FontNames(), s.Font) {
+		return fmt.Errorf("font must be one of %s", strings.Join(watermark.FontNames(), ", "))
+	}
+	if s.Color != "" {
+		if _, err := parseColor(s.Color); err != nil {
+			return fmt.Errorf("invalid color: %v", err)
+		}
+	}
+	if s.FontSize < 0 || s.FontSize > 200 {
+		return fmt.Errorf("fontSize must be between 0 and 200")
+	}
+	if len(s.Text) > 200 {
+		return fmt.Errorf("text must be at most 200 characters")
+	}
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
 }
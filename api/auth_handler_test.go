@@ -0,0 +1,42 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"watermark-generator/models"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestComparePassword(t *testing.T) {
+	if cost, err := bcrypt.Cost(dummyPasswordHash); err != nil || cost != bcrypt.DefaultCost {
+		t.Fatalf("dummy hash cost %d, %v, want %d", cost, err, bcrypt.DefaultCost)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.DefaultCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{Password: string(hash)}
+	if err := comparePassword(user, "correct horse"); err != nil {
+		t.Errorf("right password rejected: %v", err)
+	}
+	if err := comparePassword(user, "wrong horse"); err == nil {
+		t.Error("wrong password accepted")
+	}
+	if err := comparePassword(&models.User{}, "no account has this password"); err == nil {
+		t.Error("account without a password accepted the dummy hash's password")
+	}
+
+	// An unknown address costs a bcrypt comparison like a wrong password
+	start := time.Now()
+	comparePassword(user, "wrong horse")
+	wrong := time.Since(start)
+	start = time.Now()
+	if err := comparePassword(nil, "no account has this password"); err == nil {
+		t.Error("unknown address accepted")
+	}
+	if unknown := time.Since(start); unknown < wrong/4 {
+		t.Errorf("unknown address took %v, a wrong password %v", unknown, wrong)
+	}
+}
@@ -0,0 +1,256 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"watermark-generator/audit"
+	"watermark-generator/auth"
+	"watermark-generator/db"
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// oidcStateCookie binds a sign-in flow to the browser that started it, so
+// a callback URL cannot be used to sign someone else into an account.
+const oidcStateCookie = "oidc_state"
+
+var (
+	errEmailNotVerified = errors.New("the provider has not verified this email address")
+	errAccountDisabled  = errors.New("account disabled")
+)
+
+// OIDCHandler signs users in through OpenID Connect providers and links
+// the external accounts to users.
+type OIDCHandler struct {
+	DB        *mongo.Database
+	Providers map[string]*auth.OIDCProvider
+	States    auth.OIDCStateStore
+	Sessions  *auth.Sessions
+	// OneTime issues the challenges of users with two-factor
+	// authentication
+	OneTime *auth.OneTimeTokens
+	Audit   *audit.Log
+}
+
+func NewOIDCHandler(providers map[string]*auth.OIDCProvider, states auth.OIDCStateStore, sessions *auth.Sessions, oneTime *auth.OneTimeTokens, auditLog *audit.Log) *OIDCHandler {
+	return &OIDCHandler{DB: db.GetDatabase(), Providers: providers, States: states, Sessions: sessions, OneTime: oneTime, Audit: auditLog}
+}
+
+// ProvidersHandler lists the configured provider names.
+func (h *OIDCHandler) ProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	names := []string{}
+	for name := range h.Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"providers": names})
+}
+
+// LoginHandler redirects to the provider named by the provider parameter.
+func (h *OIDCHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	provider, ok := h.Providers[r.URL.Query().Get("provider")]
+	if !ok {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+	state, authURL, err := provider.Begin(r.Context(), h.States)
+	if err != nil {
+		log.Printf("LoginHandler: Failed to start %s sign-in: %v", provider.Name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/oidc",
+		MaxAge:   int(auth.OIDCStateTTL / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		// Lax lets the cookie through on the provider's top-level redirect
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// CallbackHandler completes a sign-in and redirects to the frontend's
+// /oidc/callback page with the tokens in the URL fragment, which browsers
+// do not send to servers. Users with two-factor authentication get a
+// challenge for /api/signin/2fa instead. Failures redirect to /signin with
+// an error.
+func (h *OIDCHandler) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/oidc", MaxAge: -1})
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Printf("CallbackHandler: Provider returned %s: %s", e, q.Get("error_description"))
+		h.fail(w, r, "Sign-in was cancelled or refused by the provider")
+		return
+	}
+	state := q.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if state == "" || err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		h.fail(w, r, "Sign-in session expired, please try again")
+		return
+	}
+	saved, err := auth.TakeOIDCState(r.Context(), h.States, state)
+	if err != nil {
+		log.Printf("CallbackHandler: %v", err)
+		h.fail(w, r, "Sign-in session expired, please try again")
+		return
+	}
+	provider, ok := h.Providers[saved.Provider]
+	if !ok {
+		h.fail(w, r, "Unknown provider")
+		return
+	}
+	identity, err := provider.Finish(r.Context(), saved, q.Get("code"))
+	if err != nil {
+		log.Printf("CallbackHandler: %s sign-in failed: %v", provider.Name, err)
+		h.fail(w, r, "Sign-in failed, please try again")
+		return
+	}
+
+	user, err := h.linkAccount(r.Context(), identity)
+	switch {
+	case err == errEmailNotVerified:
+		h.fail(w, r, "Your email address is not verified with "+provider.Name)
+		return
+	case err == errAccountDisabled:
+		recordEvent(h.Audit, r, "CallbackHandler", audit.Entry{
+			Action:  "auth.login.failed",
+			Details: map[string]interface{}{"email": identity.Email, "provider": provider.Name, "reason": "disabled"},
+		})
+		h.fail(w, r, "Account disabled")
+		return
+	case err != nil:
+		log.Printf("CallbackHandler: %v", err)
+		h.fail(w, r, "Sign-in failed, please try again")
+		return
+	}
+
+	if user.TwoFactorEnabled() {
+		challenge, err := h.OneTime.Issue(r.Context(), user.ID, auth.PurposeTwoFactor, auth.TwoFactorChallengeTTL)
+		if err != nil {
+			log.Printf("CallbackHandler: Failed to issue challenge: %v", err)
+			h.fail(w, r, "Sign-in failed, please try again")
+			return
+		}
+		fragment := url.Values{"challenge": {challenge}}
+		http.Redirect(w, r, os.Getenv("VITE_API_URL")+"/oidc/callback#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+
+	tokens, err := h.Sessions.Start(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("CallbackHandler: Failed to start session: %v", err)
+		h.fail(w, r, "Sign-in failed, please try again")
+		return
+	}
+	recordEvent(h.Audit, r, "CallbackHandler", audit.Entry{
+		Action:   "auth.login",
+		ActorID:  user.ID,
+		TargetID: user.ID,
+		Details:  map[string]interface{}{"method": "oidc", "provider": provider.Name},
+	})
+	fragment := url.Values{
+		"token":        {tokens.AccessToken},
+		"refreshToken": {tokens.RefreshToken},
+		"expiresIn":    {strconv.FormatInt(tokens.ExpiresIn, 10)},
+	}
+	http.Redirect(w, r, os.Getenv("VITE_API_URL")+"/oidc/callback#"+fragment.Encode(), http.StatusFound)
+}
+
+func (h *OIDCHandler) fail(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, os.Getenv("VITE_API_URL")+"/signin?error="+url.QueryEscape(message), http.StatusFound)
+}
+
+// linkAccount returns the user for an external identity. A known identity
+// signs in its user. Otherwise the identity is linked to the user with the
+// same email address, or a new user is created, but only when the provider
+// has verified the address.
+func (h *OIDCHandler) linkAccount(ctx context.Context, identity *auth.OIDCIdentity) (*models.User, error) {
+	users := h.DB.Collection("users")
+	var user models.User
+	err := users.FindOne(ctx, bson.M{"identities": bson.M{"$elemMatch": bson.M{
+		"provider": identity.Provider,
+		"subject":  identity.Subject,
+	}}}).Decode(&user)
+	if err == nil {
+		if user.Disabled {
+			return nil, errAccountDisabled
+		}
+		return &user, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("failed to fetch user: %v", err)
+	}
+
+	if !identity.EmailVerified || identity.Email == "" {
+		return nil, errEmailNotVerified
+	}
+	link := models.Identity{Provider: identity.Provider, Subject: identity.Subject, LinkedAt: time.Now()}
+
+	err = users.FindOne(ctx, bson.M{"email": identity.Email}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		user = models.User{
+			ID:            primitive.NewObjectID(),
+			Email:         identity.Email,
+			Role:          models.RoleUser,
+			EmailVerified: true,
+			Identities:    []models.Identity{link},
+		}
+		if _, err := users.InsertOne(ctx, user); err != nil {
+			return nil, fmt.Errorf("failed to create user: %v", err)
+		}
+		log.Printf("linkAccount: Created user %s from %s", user.ID.Hex(), identity.Provider)
+		return &user, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch user: %v", err)
+	}
+	if user.Disabled {
+		return nil, errAccountDisabled
+	}
+
+	update := bson.M{"$push": bson.M{"identities": link}}
+	if !user.EmailVerified {
+		// Whoever registered the unverified account never proved they own
+		// the address, so the password they chose is dropped
+		update["$set"] = bson.M{"emailVerified": true, "password": ""}
+		user.EmailVerified = true
+		user.Password = ""
+	}
+	if _, err := users.UpdateOne(ctx, bson.M{"_id": user.ID}, update); err != nil {
+		return nil, fmt.Errorf("failed to link identity: %v", err)
+	}
+	user.Identities = append(user.Identities, link)
+	log.Printf("linkAccount: Linked %s identity to user %s", identity.Provider, user.ID.Hex())
+	return &user, nil
+}
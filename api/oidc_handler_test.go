@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"watermark-generator/auth"
+)
+
+type testOIDCStates struct {
+	mu     sync.Mutex
+	states map[string]*auth.OIDCState
+}
+
+func (s *testOIDCStates) CreateOIDCState(_ context.Context, state *auth.OIDCState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.states == nil {
+		s.states = make(map[string]*auth.OIDCState)
+	}
+	s.states[state.StateHash] = state
+	return nil
+}
+
+func (s *testOIDCStates) TakeOIDCState(_ context.Context, hash string, now time.Time) (*auth.OIDCState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[hash]
+	if !ok || !state.ExpiresAt.After(now) {
+		return nil, auth.ErrInvalidOIDCState
+	}
+	delete(s.states, hash)
+	return state, nil
+}
+
+// testOIDCHandler returns a handler with one provider whose discovery
+// document is served locally. The code exchange is not reachable; these
+// tests stop before it.
+func testOIDCHandler(t *testing.T) (*OIDCHandler, *testOIDCStates) {
+	t.Helper()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"jwks_uri":               server.URL + "/jwks",
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	provider, err := auth.NewOIDCProvider(context.Background(), auth.OIDCConfig{
+		Name:        "mock",
+		Issuer:      server.URL,
+		ClientID:    "client",
+		RedirectURL: "https://app.example.com/api/oidc/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := &testOIDCStates{}
+	return &OIDCHandler{Providers: map[string]*auth.OIDCProvider{"mock": provider}, States: states}, states
+}
+
+func TestOIDCProvidersHandler(t *testing.T) {
+	h, _ := testOIDCHandler(t)
+	w := httptest.NewRecorder()
+	h.ProvidersHandler(w, httptest.NewRequest(http.MethodGet, "/api/oidc/providers", nil))
+	if body := strings.TrimSpace(w.Body.String()); body != `{"providers":["mock"]}` {
+		t.Errorf("body = %s", body)
+	}
+}
+
+func TestOIDCLoginHandler(t *testing.T) {
+	h, states := testOIDCHandler(t)
+
+	w := httptest.NewRecorder()
+	h.LoginHandler(w, httptest.NewRequest(http.MethodGet, "/api/oidc/login?provider=other", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown provider: status %d, want 404", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.LoginHandler(w, httptest.NewRequest(http.MethodGet, "/api/oidc/login?provider=mock", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("status %d, want 302", w.Code)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookie || !cookies[0].HttpOnly {
+		t.Fatalf("cookies = %+v, want one HttpOnly %s cookie", cookies, oidcStateCookie)
+	}
+	if got := location.Query().Get("state"); got != cookies[0].Value {
+		t.Errorf("redirect state %q does not match cookie %q", got, cookies[0].Value)
+	}
+	if len(states.states) != 1 {
+		t.Errorf("%d states stored, want 1", len(states.states))
+	}
+}
+
+func TestOIDCCallbackRequiresStateCookie(t *testing.T) {
+	t.Setenv("VITE_API_URL", "https://app.example.com")
+	h, states := testOIDCHandler(t)
+
+	w := httptest.NewRecorder()
+	h.LoginHandler(w, httptest.NewRequest(http.MethodGet, "/api/oidc/login?provider=mock", nil))
+	location, _ := url.Parse(w.Header().Get("Location"))
+	state := location.Query().Get("state")
+
+	// A callback opened in a browser that did not start the sign-in
+	for name, cookie := range map[string]*http.Cookie{
+		"no cookie":    nil,
+		"other cookie": {Name: oidcStateCookie, Value: "someone-elses-state"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/oidc/callback?code=c&state="+url.QueryEscape(state), nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.CallbackHandler(w, r)
+		if w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), "https://app.example.com/signin?error=") {
+			t.Errorf("%s: status %d, location %q, want a redirect to /signin with an error", name, w.Code, w.Header().Get("Location"))
+		}
+	}
+	if len(states.states) != 1 {
+		t.Error("a rejected callback used up the state")
+	}
+}
@@ -0,0 +1,535 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"watermark-generator/audit"
+	"watermark-generator/auth"
+	"watermark-generator/mail"
+	"watermark-generator/org"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// OrgHandler serves the organization endpoints under /api/orgs: members,
+// invitations and the shared asset and preset library. Billing is in
+// StripeHandler.
+type OrgHandler struct {
+	Orgs  *org.Orgs
+	Mail  mail.Sender
+	Audit *audit.Log
+}
+
+func NewOrgHandler(orgs *org.Orgs, sender mail.Sender, auditLog *audit.Log) *OrgHandler {
+	return &OrgHandler{Orgs: orgs, Mail: sender, Audit: auditLog}
+}
+
+// writeOrgError answers a request that failed with err from the org
+// package, logging unexpected errors under the handler's name.
+func writeOrgError(w http.ResponseWriter, handler string, err error) {
+	var input *org.InputError
+	switch {
+	case errors.As(err, &input):
+		writeMessage(w, http.StatusBadRequest, input.Message)
+	case err == org.ErrInvalidInvitation:
+		writeMessage(w, http.StatusBadRequest, "This invitation is invalid or has expired")
+	case err == org.ErrNotFound, err == org.ErrNotMember, err == org.ErrAssetNotFound,
+		err == org.ErrPresetNotFound, err == org.ErrInvitationNotFound:
+		writeMessage(w, http.StatusNotFound, err.Error())
+	case err == org.ErrForbidden, err == org.ErrWrongRecipient:
+		writeMessage(w, http.StatusForbidden, err.Error())
+	case err == org.ErrLastOwner, err == org.ErrAlreadyMember, err == org.ErrTooManyInvitations,
+		err == org.ErrTooManyAssets, err == org.ErrTooManyPresets:
+		writeMessage(w, http.StatusConflict, err.Error())
+	default:
+		log.Printf("%s: %v", handler, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// member returns the signed-in user's membership of the organization with
+// the hex id. With manage set, the user must be an owner or admin. It
+// writes the error response and returns nil when there is no such member.
+func (h *OrgHandler) member(w http.ResponseWriter, r *http.Request, handler, id string, manage bool) *org.Member {
+	user := auth.UserFrom(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+	orgID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid organization id")
+		return nil
+	}
+	get := h.Orgs.Member
+	if manage {
+		get = h.Orgs.Manager
+	}
+	m, err := get(r.Context(), orgID, user.ID)
+	if err != nil {
+		writeOrgError(w, handler, err)
+		return nil
+	}
+	return m
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// OrgsHandler lists the user's organizations with their role (GET) or
+// creates one with the user as owner (POST) from {"name"}.
+func (h *OrgHandler) OrgsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := auth.UserFrom(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		memberships, err := h.Orgs.ForUser(r.Context(), user.ID)
+		if err != nil {
+			writeOrgError(w, "OrgsHandler", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"organizations": memberships})
+		return
+	}
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	created, err := h.Orgs.Create(r.Context(), user, body.Name)
+	if err != nil {
+		writeOrgError(w, "OrgsHandler", err)
+		return
+	}
+	log.Printf("OrgsHandler: User %s created organization %s", user.ID.Hex(), created.ID.Hex())
+	writeJSON(w, http.StatusCreated, org.Membership{Organization: *created, Role: org.RoleOwner})
+}
+
+// MembersHandler lists the members of the organization given by the org
+// parameter. Owners and admins also get the pending invitations.
+func (h *OrgHandler) MembersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m := h.member(w, r, "MembersHandler", r.URL.Query().Get("org"), false)
+	if m == nil {
+		return
+	}
+	members, err := h.Orgs.Store.Members(r.Context(), m.OrgID)
+	if err != nil {
+		writeOrgError(w, "MembersHandler", err)
+		return
+	}
+	response := map[string]interface{}{"members": members}
+	if m.CanManage() {
+		invitations, err := h.Orgs.Invitations.Invitations(r.Context(), m.OrgID, time.Now())
+		if err != nil {
+			writeOrgError(w, "MembersHandler", err)
+			return
+		}
+		response["invitations"] = invitations
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// memberRequest is the body of the member and invitation endpoints.
+type memberRequest struct {
+	Org    string `json:"org"`
+	UserID string `json:"userId"`
+	ID     string `json:"id"`
+	Email  string `json:"email"`
+	Role   string `json:"role"`
+}
+
+func decodeMemberRequest(w http.ResponseWriter, r *http.Request) (*memberRequest, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	var body memberRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request body")
+		return nil, false
+	}
+	return &body, true
+}
+
+// MemberRoleHandler changes a member's role from {"org", "userId", "role"}.
+func (h *OrgHandler) MemberRoleHandler(w http.ResponseWriter, r *http.Request) {
+	body, ok := decodeMemberRequest(w, r)
+	if !ok {
+		return
+	}
+	actor := h.member(w, r, "MemberRoleHandler", body.Org, true)
+	if actor == nil {
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(body.UserID)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid userId")
+		return
+	}
+	target, err := h.Orgs.Store.Member(r.Context(), actor.OrgID, userID)
+	if err != nil {
+		writeOrgError(w, "MemberRoleHandler", err)
+		return
+	}
+	if err := h.Orgs.SetRole(r.Context(), actor, userID, body.Role); err != nil {
+		writeOrgError(w, "MemberRoleHandler", err)
+		return
+	}
+	log.Printf("MemberRoleHandler: User %s made %s %s of organization %s", actor.UserID.Hex(), userID.Hex(), body.Role, actor.OrgID.Hex())
+	recordEvent(h.Audit, r, "MemberRoleHandler", audit.Entry{
+		Action:   "org.member.role",
+		TargetID: userID,
+		Changes:  audit.Diff(map[string]interface{}{"role": target.Role}, map[string]interface{}{"role": body.Role}),
+		Details:  map[string]interface{}{"org": actor.OrgID},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RemoveMemberHandler removes a member from {"org", "userId"}. Members
+// leave by removing themselves.
+func (h *OrgHandler) RemoveMemberHandler(w http.ResponseWriter, r *http.Request) {
+	body, ok := decodeMemberRequest(w, r)
+	if !ok {
+		return
+	}
+	actor := h.member(w, r, "RemoveMemberHandler", body.Org, false)
+	if actor == nil {
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(body.UserID)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid userId")
+		return
+	}
+	if err := h.Orgs.Remove(r.Context(), actor, userID); err != nil {
+		writeOrgError(w, "RemoveMemberHandler", err)
+		return
+	}
+	log.Printf("RemoveMemberHandler: User %s removed %s from organization %s", actor.UserID.Hex(), userID.Hex(), actor.OrgID.Hex())
+	recordEvent(h.Audit, r, "RemoveMemberHandler", audit.Entry{
+		Action:   "org.member.remove",
+		TargetID: userID,
+		Details:  map[string]interface{}{"org": actor.OrgID},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// InviteHandler emails an invitation from {"org", "email", "role"}.
+func (h *OrgHandler) InviteHandler(w http.ResponseWriter, r *http.Request) {
+	body, ok := decodeMemberRequest(w, r)
+	if !ok {
+		return
+	}
+	actor := h.member(w, r, "InviteHandler", body.Org, true)
+	if actor == nil {
+		return
+	}
+	organization, err := h.Orgs.Store.Org(r.Context(), actor.OrgID)
+	if err != nil {
+		writeOrgError(w, "InviteHandler", err)
+		return
+	}
+	token, inv, err := h.Orgs.Invite(r.Context(), actor, body.Email, body.Role)
+	if err != nil {
+		writeOrgError(w, "InviteHandler", err)
+		return
+	}
+
+	msg, err := mail.Render("invite.txt", inv.Email, map[string]string{
+		"Org":     organization.Name,
+		"Inviter": auth.UserFrom(r.Context()).Email,
+		"Role":    inv.Role,
+		"Link":    appLink("/invite", token),
+		"Expires": formatTTL(org.InvitationTTL),
+	})
+	if err == nil {
+		err = h.Mail.Send(r.Context(), msg)
+	}
+	if err != nil {
+		// Inviting the address again replaces this invitation
+		log.Printf("InviteHandler: Failed to send invitation: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to send the invitation email, please try again")
+		return
+	}
+	log.Printf("InviteHandler: User %s invited %s to organization %s", actor.UserID.Hex(), inv.Email, actor.OrgID.Hex())
+	writeJSON(w, http.StatusCreated, inv)
+}
+
+// RevokeInvitationHandler withdraws the invitation from {"org", "id"}.
+func (h *OrgHandler) RevokeInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	body, ok := decodeMemberRequest(w, r)
+	if !ok {
+		return
+	}
+	actor := h.member(w, r, "RevokeInvitationHandler", body.Org, true)
+	if actor == nil {
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(body.ID)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
+	if err := h.Orgs.RevokeInvitation(r.Context(), actor, id); err != nil {
+		writeOrgError(w, "RevokeInvitationHandler", err)
+		return
+	}
+	recordEvent(h.Audit, r, "RevokeInvitationHandler", audit.Entry{
+		Action:   "org.invitation.revoke",
+		TargetID: id,
+		Details:  map[string]interface{}{"org": actor.OrgID},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AcceptInvitationHandler makes the signed-in user a member of the
+// organization the invitation {"token"} is for.
+func (h *OrgHandler) AcceptInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := auth.UserFrom(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// Joining on someone else's behalf would outlast the impersonation
+	if !auth.ActorFrom(r.Context()).IsZero() {
+		writeMessage(w, http.StatusForbidden, "Invitations cannot be accepted while impersonating")
+		return
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" {
+		writeMessage(w, http.StatusBadRequest, "token is required")
+		return
+	}
+	joined, err := h.Orgs.Accept(r.Context(), user, body.Token)
+	if err != nil {
+		writeOrgError(w, "AcceptInvitationHandler", err)
+		return
+	}
+	log.Printf("AcceptInvitationHandler: User %s joined organization %s", user.ID.Hex(), joined.ID.Hex())
+	writeJSON(w, http.StatusOK, joined)
+}
+
+// AssetsHandler lists the assets of the organization given by the org
+// parameter (GET) or adds one (POST) from a multipart form with org, name
+// and the image in asset.
+func (h *OrgHandler) AssetsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		m := h.member(w, r, "AssetsHandler", r.URL.Query().Get("org"), false)
+		if m == nil {
+			return
+		}
+		assets, err := h.Orgs.Library.Assets(r.Context(), m.OrgID)
+		if err != nil {
+			writeOrgError(w, "AssetsHandler", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"assets": assets})
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, org.MaxAssetSize+(1<<20))
+	if err := r.ParseMultipartForm(org.MaxAssetSize + (1 << 20)); err != nil {
+		writeMessage(w, http.StatusBadRequest, "Unable to parse form")
+		return
+	}
+	m := h.member(w, r, "AssetsHandler", r.FormValue("org"), true)
+	if m == nil {
+		return
+	}
+	file, header, err := r.FormFile("asset")
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "No asset provided")
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, org.MaxAssetSize+1))
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Unable to read file")
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		name = header.Filename
+	}
+
+	asset, err := h.Orgs.AddAsset(r.Context(), m, name, data)
+	if err != nil {
+		writeOrgError(w, "AssetsHandler", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, asset)
+}
+
+// AssetFileHandler serves the image of the asset given by the id
+// parameter to members of its organization.
+func (h *OrgHandler) AssetFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := auth.UserFrom(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
+	asset, err := h.Orgs.AssetFor(r.Context(), user.ID, id)
+	if err != nil {
+		writeOrgError(w, "AssetFileHandler", err)
+		return
+	}
+	w.Header().Set("Content-Type", asset.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(asset.Data)))
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	// SVG assets are documents; keep their scripts from running
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(asset.Data)
+}
+
+// DeleteAssetHandler deletes the asset from {"org", "id"}.
+func (h *OrgHandler) DeleteAssetHandler(w http.ResponseWriter, r *http.Request) {
+	body, ok := decodeMemberRequest(w, r)
+	if !ok {
+		return
+	}
+	actor := h.member(w, r, "DeleteAssetHandler", body.Org, true)
+	if actor == nil {
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(body.ID)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
+	if err := h.Orgs.DeleteAsset(r.Context(), actor, id); err != nil {
+		writeOrgError(w, "DeleteAssetHandler", err)
+		return
+	}
+	recordEvent(h.Audit, r, "DeleteAssetHandler", audit.Entry{
+		Action:   "org.asset.delete",
+		TargetID: id,
+		Details:  map[string]interface{}{"org": actor.OrgID},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PresetsHandler lists the presets of the organization given by the org
+// parameter (GET), or saves one (POST) from {"org", "id", "name", "kind",
+// "settings"}; without an id a new preset is created.
+func (h *OrgHandler) PresetsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		m := h.member(w, r, "PresetsHandler", r.URL.Query().Get("org"), false)
+		if m == nil {
+			return
+		}
+		presets, err := h.Orgs.Library.Presets(r.Context(), m.OrgID)
+		if err != nil {
+			writeOrgError(w, "PresetsHandler", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"presets": presets})
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Org      string            `json:"org"`
+		ID       string            `json:"id"`
+		Name     string            `json:"name"`
+		Kind     string            `json:"kind"`
+		Settings map[string]string `json:"settings"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	m := h.member(w, r, "PresetsHandler", body.Org, true)
+	if m == nil {
+		return
+	}
+	preset := &org.Preset{Name: body.Name, Kind: body.Kind, Settings: body.Settings}
+	status := http.StatusCreated
+	if body.ID != "" {
+		id, err := primitive.ObjectIDFromHex(body.ID)
+		if err != nil {
+			writeMessage(w, http.StatusBadRequest, "Invalid id")
+			return
+		}
+		preset.ID = id
+		status = http.StatusOK
+	}
+	saved, err := h.Orgs.SavePreset(r.Context(), m, preset)
+	if err != nil {
+		writeOrgError(w, "PresetsHandler", err)
+		return
+	}
+	writeJSON(w, status, saved)
+}
+
+// DeletePresetHandler deletes the preset from {"org", "id"}.
+func (h *OrgHandler) DeletePresetHandler(w http.ResponseWriter, r *http.Request) {
+	body, ok := decodeMemberRequest(w, r)
+	if !ok {
+		return
+	}
+	actor := h.member(w, r, "DeletePresetHandler", body.Org, true)
+	if actor == nil {
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(body.ID)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
+	if err := h.Orgs.DeletePreset(r.Context(), actor, id); err != nil {
+		writeOrgError(w, "DeletePresetHandler", err)
+		return
+	}
+	recordEvent(h.Audit, r, "DeletePresetHandler", audit.Entry{
+		Action:   "org.preset.delete",
+		TargetID: id,
+		Details:  map[string]interface{}{"org": actor.OrgID},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"watermark-generator/audit"
+	"watermark-generator/auth"
+	"watermark-generator/models"
+	"watermark-generator/org"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testOrgStore is an org.Store for tests.
+type testOrgStore struct {
+	orgs    map[primitive.ObjectID]*org.Organization
+	members []org.Member
+}
+
+func (s *testOrgStore) CreateOrg(_ context.Context, o *org.Organization) error {
+	s.orgs[o.ID] = o
+	return nil
+}
+
+func (s *testOrgStore) Org(_ context.Context, id primitive.ObjectID) (*org.Organization, error) {
+	if o, ok := s.orgs[id]; ok {
+		return o, nil
+	}
+	return nil, org.ErrNotFound
+}
+
+func (s *testOrgStore) OrgByCustomer(_ context.Context, customerID string) (*org.Organization, error) {
+	for _, o := range s.orgs {
+		if o.StripeCustomerID == customerID {
+			return o, nil
+		}
+	}
+	return nil, org.ErrNotFound
+}
+
+func (s *testOrgStore) SetCustomer(_ context.Context, id primitive.ObjectID, customerID string) error {
+	s.orgs[id].StripeCustomerID = customerID
+	return nil
+}
+
+func (s *testOrgStore) SetSubscription(_ context.Context, id primitive.ObjectID, status, subscriptionID string, expiresAt time.Time, seats int64) error {
+	return nil
+}
+
+func (s *testOrgStore) AddMember(_ context.Context, m *org.Member) error {
+	s.members = append(s.members, *m)
+	return nil
+}
+
+func (s *testOrgStore) Member(_ context.Context, orgID, userID primitive.ObjectID) (*org.Member, error) {
+	for _, m := range s.members {
+		if m.OrgID == orgID && m.UserID == userID {
+			return &m, nil
+		}
+	}
+	return nil, org.ErrNotMember
+}
+
+func (s *testOrgStore) Members(_ context.Context, orgID primitive.ObjectID) ([]org.Member, error) {
+	members := []org.Member{}
+	for _, m := range s.members {
+		if m.OrgID == orgID {
+			members = append(members, m)
+		}
+	}
+	return members, nil
+}
+
+func (s *testOrgStore) Memberships(_ context.Context, userID primitive.ObjectID) ([]org.Member, error) {
+	members := []org.Member{}
+	for _, m := range s.members {
+		if m.UserID == userID {
+			members = append(members, m)
+		}
+	}
+	return members, nil
+}
+
+func (s *testOrgStore) SetMemberRole(_ context.Context, orgID, userID primitive.ObjectID, role string) error {
+	return nil
+}
+
+func (s *testOrgStore) RemoveMember(_ context.Context, orgID, userID primitive.ObjectID) error {
+	return nil
+}
+
+func (s *testOrgStore) SetSeatExpiry(_ context.Context, userID primitive.ObjectID, expiresAt time.Time) error {
+	return nil
+}
+
+func TestOrgHandlerMembership(t *testing.T) {
+	store := &testOrgStore{orgs: map[primitive.ObjectID]*org.Organization{}}
+	h := NewOrgHandler(org.NewOrgs(store, nil, nil, nil), nil, audit.NewLog(&testAuditStore{}))
+	owner := &models.User{ID: primitive.NewObjectID(), Email: "owner@example.com"}
+	outsider := &models.User{ID: primitive.NewObjectID(), Email: "outsider@example.com"}
+	as := func(user *models.User, r *http.Request) *http.Request {
+		return r.WithContext(auth.WithUser(r.Context(), user))
+	}
+
+	w := httptest.NewRecorder()
+	h.OrgsHandler(w, as(owner, httptest.NewRequest(http.MethodPost, "/api/orgs", strings.NewReader(`{"name":"Studio"}`))))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	var created org.Membership
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Name != "Studio" || created.Role != org.RoleOwner {
+		t.Errorf("created %+v, want Studio owned by the user", created)
+	}
+
+	w = httptest.NewRecorder()
+	h.OrgsHandler(w, as(owner, httptest.NewRequest(http.MethodPost, "/api/orgs", strings.NewReader(`{"name":""}`))))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("blank name: status %d, want 400", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.OrgsHandler(w, as(outsider, httptest.NewRequest(http.MethodGet, "/api/orgs", nil)))
+	if body := strings.TrimSpace(w.Body.String()); body != `{"organizations":[]}` {
+		t.Errorf("outsider's organizations = %s", body)
+	}
+
+	w = httptest.NewRecorder()
+	h.MembersHandler(w, as(outsider, httptest.NewRequest(http.MethodGet, "/api/orgs/members?org="+created.ID.Hex(), nil)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("outsider listing members: status %d, want 404", w.Code)
+	}
+
+	body := `{"org":"` + created.ID.Hex() + `","userId":"` + owner.ID.Hex() + `","role":"member"}`
+	w = httptest.NewRecorder()
+	h.MemberRoleHandler(w, as(outsider, httptest.NewRequest(http.MethodPost, "/api/orgs/members/role", strings.NewReader(body))))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("outsider changing roles: status %d, want 404", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h.MemberRoleHandler(w, as(owner, httptest.NewRequest(http.MethodPost, "/api/orgs/members/role", strings.NewReader(body))))
+	if w.Code != http.StatusConflict {
+		t.Errorf("last owner stepping down: status %d, want 409", w.Code)
+	}
+}
+
+func TestWriteOrgError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{&org.InputError{Message: "name must be 1 to 100 characters"}, http.StatusBadRequest},
+		{org.ErrInvalidInvitation, http.StatusBadRequest},
+		{org.ErrNotMember, http.StatusNotFound},
+		{org.ErrAssetNotFound, http.StatusNotFound},
+		{org.ErrForbidden, http.StatusForbidden},
+		{org.ErrWrongRecipient, http.StatusForbidden},
+		{org.ErrLastOwner, http.StatusConflict},
+		{org.ErrTooManyAssets, http.StatusConflict},
+		{context.DeadlineExceeded, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeOrgError(w, "TestWriteOrgError", tt.err)
+		if w.Code != tt.want {
+			t.Errorf("%v: status %d, want %d", tt.err, w.Code, tt.want)
+		}
+	}
+}
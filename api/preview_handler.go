@@ -0,0 +1,203 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+
+	"watermark-generator/auth"
+	"watermark-generator/watermark"
+)
+
+// maxPreviewSize bounds the longest side a client may ask for.
+const maxPreviewSize = 2000
+
+// previewEntry is the downsampled source of a preview request.
+type previewEntry struct {
+	id       string
+	preview  *watermark.Preview
+	filename string
+}
+
+// PreviewHandler renders the watermark onto a downsampled copy of the image
+// and returns it as a small JPEG. Uploaded images are stored like those sent
+// to UploadHandler, and the response's X-Source-Id header identifies them;
+// sending it back as sourceId instead of the image reuses the cached copy, so
+// adjusting a setting does not upload the image again.
+func (h *WatermarkHandler) PreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseMultipartForm(10 << 20) // 10 MB
+	if err != nil {
+		h.logger.Printf("PreviewHandler: Error parsing multipart form: %v", err)
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		return
+	}
+
+	size, err := strconv.Atoi(r.FormValue("maxSize"))
+	if err != nil || size <= 0 {
+		size = watermark.DefaultPreviewSize
+	}
+	size = min(size, maxPreviewSize)
+
+	entry, err := h.previewSource(r, size)
+	if err != nil {
+		h.logger.Printf("PreviewHandler: Error retrieving source image: %v", err)
+		http.Error(w, fmt.Sprintf("Unable to get source image: %v", err), sourceStatus(err))
+		return
+	}
+
+	opacity, err := strconv.ParseFloat(r.FormValue("opacity"), 64)
+	if err != nil {
+		opacity = 0.5 // Default opacity if parsing fails
+	}
+	opacity = math.Max(0, math.Min(1, opacity))
+
+	spacing, err := strconv.ParseFloat(r.FormValue("spacing"), 64)
+	if err != nil {
+		spacing = 100 // Default spacing if parsing fails
+	}
+
+	contrastThreshold, _ := strconv.ParseFloat(r.FormValue("contrastThreshold"), 64)
+	colorMode := watermark.ParseContrastMode(r.FormValue("colorMode"))
+	blendMode := watermark.ParseBlendMode(r.FormValue("blendMode"))
+	position := watermark.ParsePosition(r.FormValue("position"))
+	tiling := parseTiling(r)
+
+	logoFile, err := h.watermarkImage(r)
+	if err != nil && err != errNoWatermarkImage {
+		h.logger.Printf("PreviewHandler: Error retrieving watermark image: %v", err)
+		writeWatermarkImageError(w, err)
+		return
+	}
+
+	var result []byte
+	if logoFile != nil {
+		defer logoFile.Close()
+
+		watermarkSize, err := strconv.ParseFloat(r.FormValue("watermarkSize"), 64)
+		if err != nil || watermarkSize <= 0 {
+			watermarkSize = 25 // Default watermark size if parsing fails
+		}
+
+		result, err = h.service.PreviewImage(entry.preview, logoFile, watermark.ImageOptions{
+			Opacity:           opacity,
+			Spacing:           spacing,
+			WatermarkSize:     watermarkSize,
+			BlendMode:         blendMode,
+			LogoColorMode:     watermark.ParseLogoColorMode(r.FormValue("logoColorMode")),
+			TintColor:         r.FormValue("tintColor"),
+			Footer:            footerFor(auth.UserFrom(r.Context()), r),
+			ColorMode:         colorMode,
+			ContrastThreshold: contrastThreshold,
+			Position:          position,
+			Tiling:            tiling,
+		})
+		if err != nil {
+			h.logger.Printf("PreviewHandler: Error applying watermark: %v", err)
+			http.Error(w, fmt.Sprintf("Error applying watermark: %v", err), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		text := r.FormValue("text")
+		if text == "" {
+			http.Error(w, "No text or watermark image provided", http.StatusBadRequest)
+			return
+		}
+		textColor := r.FormValue("color")
+		if textColor == "auto" {
+			// "auto" picks black or white per tile
+			textColor = "#ffffff"
+			colorMode = watermark.ContrastAuto
+		}
+		if textColor == "" {
+			textColor = "#000000" // Default to black if no color is provided
+		}
+		sizeMode := watermark.ParseSizeMode(r.FormValue("sizeMode"))
+		fontSize, err := strconv.ParseFloat(r.FormValue("fontSize"), 64)
+		if err != nil || fontSize <= 0 {
+			fontSize = defaultFontSizes[sizeMode] // Default font size if parsing fails
+		}
+		lineHeight, err := strconv.ParseFloat(r.FormValue("lineHeight"), 64)
+		if err != nil {
+			lineHeight = 1.2 // Default line height if parsing fails
+		}
+
+		result, err = h.service.PreviewText(entry.preview, watermark.TextOptions{
+			Text:              text,
+			Color:             textColor,
+			Opacity:           opacity,
+			FontSize:          fontSize,
+			SizeMode:          sizeMode,
+			Spacing:           spacing,
+			LineHeight:        lineHeight,
+			Align:             watermark.ParseAlignment(r.FormValue("align")),
+			BlendMode:         blendMode,
+			ColorMode:         colorMode,
+			ContrastThreshold: contrastThreshold,
+			Position:          position,
+			Tiling:            tiling,
+			Template:          h.templateData(r, entry.filename),
+		})
+		if err != nil {
+			h.logger.Printf("PreviewHandler: Error applying watermark: %v", err)
+			http.Error(w, fmt.Sprintf("Error applying watermark: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("X-Source-Id", entry.id)
+	w.Header().Set("X-Seed", strconv.FormatInt(tiling.Seed, 10))
+	w.Write(result)
+}
+
+// previewSource returns the downsampled source for a preview request, from
+// the uploaded "image" file or the stored upload named by sourceId.
+func (h *WatermarkHandler) previewSource(r *http.Request, size int) (*previewEntry, error) {
+	id := r.FormValue("sourceId")
+	filename := r.FormValue("filename")
+	var data []byte
+	if file, header, err := r.FormFile("image"); err == nil {
+		defer file.Close()
+		if data, err = io.ReadAll(file); err != nil {
+			return nil, fmt.Errorf("unable to read file: %v", err)
+		}
+		id, filename = watermark.SourceID(data), header.Filename
+	} else if id == "" {
+		return nil, errors.New("no image or sourceId provided")
+	}
+
+	// Stored uploads keep their previews in the store's memory budget;
+	// without a store each preview decodes the upload again
+	var preview *watermark.Preview
+	var err error
+	switch {
+	case h.sources != nil:
+		if data != nil {
+			id, err = h.sources.Put(data)
+		}
+		if err == nil {
+			preview, err = h.sources.Preview(id, size)
+		}
+	case data != nil:
+		var src *watermark.Source
+		if src, err = watermark.DecodeSource(data); err == nil {
+			preview = src.Preview(size)
+		}
+	default:
+		err = watermark.ErrSourceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &previewEntry{id: id, preview: preview, filename: filename}, nil
+}
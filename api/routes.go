@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+
+	"watermark-generator/auth"
+	"watermark-generator/models"
+)
+
+// Routes registers the API endpoints on mux. Account, watermark, download,
+// subscription and payment endpoints go through the auth middleware, which rejects
+// requests without a valid bearer token and gives the handlers the user.
+// Watermark and download endpoints also take API keys with the matching
+// scope. Organization endpoints check the user's role in the organization
+// themselves. Admin endpoints additionally require a staff role.
+func Routes(mux *http.ServeMux, mw *auth.Middleware, authHandler *AuthHandler, adminHandler *AdminHandler, oidcHandler *OIDCHandler, apiKeyHandler *APIKeyHandler, orgHandler *OrgHandler, handler *WatermarkHandler, stripeHandler *StripeHandler) {
+	// Public endpoints
+	mux.HandleFunc("/api/register", authHandler.RegisterHandler)
+	mux.HandleFunc("/api/login", authHandler.SignInHandler)
+	mux.HandleFunc("/api/signin", authHandler.SignInHandler)
+	mux.HandleFunc("/api/signin/2fa", authHandler.TwoFactorSignInHandler)
+	mux.HandleFunc("/api/refresh", authHandler.RefreshHandler)
+	mux.HandleFunc("/api/logout", authHandler.LogoutHandler)
+	mux.HandleFunc("/api/verify-email", authHandler.VerifyEmailHandler)
+	mux.HandleFunc("/api/verify-email/resend", authHandler.ResendVerificationHandler)
+	mux.HandleFunc("/api/password/forgot", authHandler.ForgotPasswordHandler)
+	mux.HandleFunc("/api/password/reset", authHandler.ResetPasswordHandler)
+	mux.HandleFunc("/api/oidc/providers", oidcHandler.ProvidersHandler)
+	mux.HandleFunc("/api/oidc/login", oidcHandler.LoginHandler)
+	mux.HandleFunc("/api/oidc/callback", oidcHandler.CallbackHandler)
+	mux.HandleFunc("/api/webhook", stripeHandler.HandleWebhook)
+
+	// Endpoints for signed-in users
+	mux.HandleFunc("/api/current-user", mw.Require(authHandler.CurrentUserHandler))
+	mux.HandleFunc("/api/user", mw.Require(authHandler.CurrentUserHandler))
+	mux.HandleFunc("/api/logout-all", mw.Require(authHandler.LogoutAllHandler))
+	mux.HandleFunc("/api/2fa/setup", mw.Require(authHandler.TwoFactorSetupHandler))
+	mux.HandleFunc("/api/2fa/enable", mw.Require(authHandler.TwoFactorEnableHandler))
+	mux.HandleFunc("/api/2fa/disable", mw.Require(authHandler.TwoFactorDisableHandler))
+	mux.HandleFunc("/api/2fa/recovery-codes", mw.Require(authHandler.RecoveryCodesHandler))
+	mux.HandleFunc("/api/keys", mw.Require(apiKeyHandler.KeysHandler))
+	mux.HandleFunc("/api/keys/revoke", mw.Require(apiKeyHandler.RevokeKeyHandler))
+	mux.HandleFunc("/api/user/footer", mw.Require(authHandler.FooterSettingsHandler))
+	mux.HandleFunc("/api/orgs", mw.Require(orgHandler.OrgsHandler))
+	mux.HandleFunc("/api/orgs/members", mw.Require(orgHandler.MembersHandler))
+	mux.HandleFunc("/api/orgs/members/role", mw.Require(orgHandler.MemberRoleHandler))
+	mux.HandleFunc("/api/orgs/members/remove", mw.Require(orgHandler.RemoveMemberHandler))
+	mux.HandleFunc("/api/orgs/invitations", mw.Require(orgHandler.InviteHandler))
+	mux.HandleFunc("/api/orgs/invitations/revoke", mw.Require(orgHandler.RevokeInvitationHandler))
+	mux.HandleFunc("/api/orgs/invitations/accept", mw.Require(orgHandler.AcceptInvitationHandler))
+	mux.HandleFunc("/api/orgs/assets", mw.Require(orgHandler.AssetsHandler))
+	mux.HandleFunc("/api/orgs/assets/file", mw.Require(orgHandler.AssetFileHandler))
+	mux.HandleFunc("/api/orgs/assets/delete", mw.Require(orgHandler.DeleteAssetHandler))
+	mux.HandleFunc("/api/orgs/presets", mw.Require(orgHandler.PresetsHandler))
+	mux.HandleFunc("/api/orgs/presets/delete", mw.Require(orgHandler.DeletePresetHandler))
+	mux.HandleFunc("/api/orgs/subscription", mw.Require(stripeHandler.CreateOrgSubscription))
+	mux.HandleFunc("/api/orgs/subscription/cancel", mw.Require(stripeHandler.CancelOrgSubscription))
+	mux.HandleFunc("/api/process-payment", mw.Require(handler.ProcessPaymentHandler))
+	mux.HandleFunc("/api/create-checkout-session", mw.Require(handler.CreateCheckoutSessionHandler))
+	mux.HandleFunc("/api/download", mw.RequireScope(handler.DownloadHandler, auth.ScopeWatermarkWrite))
+	mux.HandleFunc("/api/watermark/text", mw.RequireScope(handler.TextWatermarkHandler, auth.ScopeWatermarkWrite))
+	mux.HandleFunc("/api/watermark/image", mw.RequireScope(handler.ImageWatermarkHandler, auth.ScopeWatermarkWrite))
+	mux.HandleFunc("/api/watermark/code", mw.RequireScope(handler.CodeWatermarkHandler, auth.ScopeWatermarkWrite))
+	mux.HandleFunc("/api/watermark/pdf", mw.RequireScope(handler.PDFWatermarkHandler, auth.ScopeWatermarkWrite))
+	mux.HandleFunc("/api/watermark/preview", mw.RequireScope(handler.PreviewHandler, auth.ScopeWatermarkWrite))
+	mux.HandleFunc("/api/watermark/upload", mw.RequireScope(handler.UploadHandler, auth.ScopeWatermarkWrite))
+	mux.HandleFunc("/api/watermark/bulk/text", mw.RequireScope(handler.BulkTextWatermarkHandler, auth.ScopeWatermarkWrite))
+	mux.HandleFunc("/api/watermark/bulk/image", mw.RequireScope(handler.BulkImageWatermarkHandler, auth.ScopeWatermarkWrite))
+	mux.HandleFunc("/api/create-subscription", mw.Require(stripeHandler.CreateSubscription))
+	mux.HandleFunc("/api/cancel-subscription", mw.Require(stripeHandler.CancelSubscription))
+
+	// Staff endpoints
+	mux.HandleFunc("/api/admin/users", mw.RequireRole(adminHandler.UsersHandler, models.RoleAdmin, models.RoleSupport))
+	mux.HandleFunc("/api/admin/users/impersonate", mw.RequireRole(adminHandler.ImpersonateHandler, models.RoleAdmin, models.RoleSupport))
+	mux.HandleFunc("/api/admin/users/disable", mw.RequireRole(adminHandler.DisableHandler, models.RoleAdmin))
+	mux.HandleFunc("/api/admin/users/role", mw.RequireRole(adminHandler.RoleHandler, models.RoleAdmin))
+	mux.HandleFunc("/api/admin/users/2fa/reset", mw.RequireRole(adminHandler.ResetTwoFactorHandler, models.RoleAdmin))
+	mux.HandleFunc("/api/admin/audit", mw.RequireRole(adminHandler.AuditHandler, models.RoleAdmin, models.RoleSupport))
+	mux.HandleFunc("/api/admin/audit/export", mw.RequireRole(adminHandler.AuditExportHandler, models.RoleAdmin))
+
+	devRoutes(mux, mw, adminHandler, handler)
+}
@@ -0,0 +1,51 @@
+//go:build dev
+
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"watermark-generator/audit"
+	"watermark-generator/auth"
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// devRoutes registers endpoints that only exist in builds with the dev tag
+// (go build -tags dev) and are left out of production binaries. They are
+// for admins only.
+func devRoutes(mux *http.ServeMux, mw *auth.Middleware, adminHandler *AdminHandler, handler *WatermarkHandler) {
+	mux.HandleFunc("/api/users/delete-all", mw.RequireRole(adminHandler.DeleteAllUsersHandler, models.RoleAdmin))
+	mux.HandleFunc("/api/test-db", mw.RequireRole(handler.TestDBConnectionHandler, models.RoleAdmin))
+}
+
+// DeleteAllUsersHandler deletes every account except the caller's, to reset
+// a development database.
+func (h *AdminHandler) DeleteAllUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	caller := auth.UserFrom(r.Context())
+	result, err := h.DB.Collection("users").DeleteMany(r.Context(), bson.M{"_id": bson.M{"$ne": caller.ID}})
+	if err != nil {
+		log.Printf("DeleteAllUsersHandler: Failed to delete users: %v", err)
+		http.Error(w, "Failed to delete users", http.StatusInternalServerError)
+		return
+	}
+	recordEvent(h.Audit, r, "DeleteAllUsersHandler", audit.Entry{
+		Action:   "user.delete-all",
+		TargetID: caller.ID,
+		Details:  map[string]interface{}{"deletedCount": result.DeletedCount},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":      "All users deleted successfully",
+		"deletedCount": result.DeletedCount,
+	})
+}
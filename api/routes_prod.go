@@ -0,0 +1,12 @@
+//go:build !dev
+
+package api
+
+import (
+	"net/http"
+
+	"watermark-generator/auth"
+)
+
+// devRoutes registers nothing in production builds; see routes_dev.go.
+func devRoutes(*http.ServeMux, *auth.Middleware, *AdminHandler, *WatermarkHandler) {}
@@ -0,0 +1,24 @@
+//go:build !dev
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"watermark-generator/models"
+)
+
+func TestDevRoutesNotRegistered(t *testing.T) {
+	mux, tokens := testRoutes(t)
+	for _, path := range []string{"/api/users/delete-all", "/api/users", "/api/test-db"} {
+		r := httptest.NewRequest(http.MethodDelete, path, nil)
+		r.Header.Set("Authorization", "Bearer "+tokens[models.RoleAdmin])
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("DELETE %s: status %d, want 404", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"watermark-generator/auth"
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type testUsers map[primitive.ObjectID]*models.User
+
+func (u testUsers) UserByID(_ context.Context, id primitive.ObjectID) (*models.User, error) {
+	if user, ok := u[id]; ok {
+		return user, nil
+	}
+	return nil, auth.ErrUserNotFound
+}
+
+// testRoutes returns the API routes backed by handlers without a database,
+// and tokens for a paid user of each role.
+func testRoutes(t *testing.T) (*http.ServeMux, map[string]string) {
+	t.Helper()
+	tokens := auth.NewTokenIssuer([]byte("test-secret"), time.Hour)
+	users := testUsers{}
+	roleTokens := map[string]string{}
+	for _, role := range models.Roles {
+		user := &models.User{
+			ID:                    primitive.NewObjectID(),
+			Email:                 role + "@example.com",
+			Role:                  role,
+			SubscriptionStatus:    "active",
+			SubscriptionExpiresAt: time.Now().Add(24 * time.Hour),
+		}
+		users[user.ID] = user
+		token, err := tokens.Issue(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roleTokens[role] = token
+	}
+
+	handler := testWatermarkHandler()
+	handler.uploadsDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(handler.uploadsDir, "result.png"), []byte("watermarked"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sessions := auth.NewSessions(tokens, nil)
+	mux := http.NewServeMux()
+	Routes(mux, auth.NewMiddleware(tokens, users, nil), &AuthHandler{Sessions: sessions}, &AdminHandler{Sessions: sessions}, &OIDCHandler{Sessions: sessions}, &APIKeyHandler{}, &OrgHandler{}, handler, &StripeHandler{})
+	return mux, roleTokens
+}
+
+// Each protected route is probed with a request its handler rejects before
+// doing any work, so reaching the handler shows in the status code.
+var protectedRoutes = []struct {
+	method, path string
+	want         int
+}{
+	{http.MethodGet, "/api/current-user", http.StatusOK},
+	{http.MethodGet, "/api/user", http.StatusOK},
+	{http.MethodGet, "/api/user/footer", http.StatusOK},
+	{http.MethodGet, "/api/logout-all", http.StatusMethodNotAllowed},
+	{http.MethodPut, "/api/keys", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/keys/revoke", http.StatusMethodNotAllowed},
+	{http.MethodPut, "/api/orgs", http.StatusMethodNotAllowed},
+	{http.MethodPut, "/api/orgs/members", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/orgs/members/role", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/orgs/members/remove", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/orgs/invitations", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/orgs/invitations/revoke", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/orgs/invitations/accept", http.StatusMethodNotAllowed},
+	{http.MethodPut, "/api/orgs/assets", http.StatusMethodNotAllowed},
+	{http.MethodPost, "/api/orgs/assets/file", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/orgs/assets/delete", http.StatusMethodNotAllowed},
+	{http.MethodPut, "/api/orgs/presets", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/orgs/presets/delete", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/orgs/subscription", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/orgs/subscription/cancel", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/2fa/setup", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/2fa/enable", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/2fa/disable", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/2fa/recovery-codes", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/download?path=result.png", http.StatusOK},
+	{http.MethodGet, "/api/watermark/text", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/watermark/image", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/watermark/code", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/watermark/pdf", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/watermark/preview", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/watermark/upload", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/watermark/bulk/text", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/watermark/bulk/image", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/create-subscription", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/cancel-subscription", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/process-payment", http.StatusMethodNotAllowed},
+	{http.MethodGet, "/api/create-checkout-session", http.StatusMethodNotAllowed},
+}
+
+func TestProtectedRoutesRequireToken(t *testing.T) {
+	mux, tokens := testRoutes(t)
+	token := tokens[models.RoleUser]
+	for _, route := range protectedRoutes {
+		// No header, an invalid token, and a valid token without its scheme
+		for _, header := range []string{"", "Bearer not-a-token", token} {
+			r := httptest.NewRequest(route.method, route.path, nil)
+			if header != "" {
+				r.Header.Set("Authorization", header)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("%s %s with %q: status %d, want 401", route.method, route.path, header, w.Code)
+			}
+		}
+	}
+}
+
+func TestProtectedRoutesAcceptToken(t *testing.T) {
+	mux, tokens := testRoutes(t)
+	for _, route := range protectedRoutes {
+		r := httptest.NewRequest(route.method, route.path, nil)
+		r.Header.Set("Authorization", "Bearer "+tokens[models.RoleUser])
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != route.want {
+			t.Errorf("%s %s: status %d, want %d: %s", route.method, route.path, w.Code, route.want, w.Body)
+		}
+	}
+}
+
+func TestPublicRoutes(t *testing.T) {
+	mux, _ := testRoutes(t)
+	for _, path := range []string{"/api/signin", "/api/signin/2fa", "/api/login", "/api/refresh", "/api/logout", "/api/verify-email", "/api/verify-email/resend", "/api/password/forgot", "/api/password/reset", "/api/webhook"} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s: status %d, want 405 from the handler", path, w.Code)
+		}
+	}
+}
+
+// Admin routes are probed like protectedRoutes, with a method their handlers
+// reject.
+var adminRoutes = []struct {
+	method, path string
+	roles        []string
+}{
+	{http.MethodPost, "/api/admin/users", []string{models.RoleAdmin, models.RoleSupport}},
+	{http.MethodGet, "/api/admin/users/impersonate", []string{models.RoleAdmin, models.RoleSupport}},
+	{http.MethodGet, "/api/admin/users/disable", []string{models.RoleAdmin}},
+	{http.MethodGet, "/api/admin/users/role", []string{models.RoleAdmin}},
+	{http.MethodGet, "/api/admin/users/2fa/reset", []string{models.RoleAdmin}},
+	{http.MethodPost, "/api/admin/audit", []string{models.RoleAdmin, models.RoleSupport}},
+	{http.MethodPost, "/api/admin/audit/export", []string{models.RoleAdmin}},
+}
+
+func TestAdminRoutesRequireRole(t *testing.T) {
+	mux, tokens := testRoutes(t)
+	for _, route := range adminRoutes {
+		for _, role := range models.Roles {
+			want := http.StatusForbidden
+			if contains(route.roles, role) {
+				want = http.StatusMethodNotAllowed
+			}
+			r := httptest.NewRequest(route.method, route.path, nil)
+			r.Header.Set("Authorization", "Bearer "+tokens[role])
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != want {
+				t.Errorf("%s %s as %s: status %d, want %d", route.method, route.path, role, w.Code, want)
+			}
+		}
+
+		r := httptest.NewRequest(route.method, route.path, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s without token: status %d, want 401", route.method, route.path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"watermark-generator/watermark"
+)
+
+const (
+	// defaultSourceTTL is how long uploads are kept unless SOURCE_TTL is set.
+	defaultSourceTTL = time.Hour
+	// defaultSourceCacheMB is the memory budget for decoded uploads unless
+	// SOURCE_CACHE_MB is set.
+	defaultSourceCacheMB = 256
+)
+
+// sourceStoreFromEnv opens the upload store configured by SOURCE_DIR,
+// SOURCE_TTL (a duration such as "30m") and SOURCE_CACHE_MB. It returns nil,
+// disabling sourceId, when the directory cannot be created.
+func sourceStoreFromEnv() *watermark.SourceStore {
+	dir := os.Getenv("SOURCE_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "watermark-sources")
+	}
+	ttl, err := time.ParseDuration(os.Getenv("SOURCE_TTL"))
+	if err != nil || ttl <= 0 {
+		ttl = defaultSourceTTL
+	}
+	budget, err := strconv.Atoi(os.Getenv("SOURCE_CACHE_MB"))
+	if err != nil || budget <= 0 {
+		budget = defaultSourceCacheMB
+	}
+
+	store, err := watermark.NewSourceStore(dir, ttl, budget<<20)
+	if err != nil {
+		log.Printf("sourceStoreFromEnv: Uploads will not be stored: %v", err)
+		return nil
+	}
+	return store
+}
+
+// UploadHandler stores an image so that later requests can refer to it by
+// the returned sourceId instead of uploading it again.
+func (h *WatermarkHandler) UploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.sources == nil {
+		http.Error(w, "Uploads are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	err := r.ParseMultipartForm(10 << 20) // 10 MB
+	if err != nil {
+		h.logger.Printf("UploadHandler: Error parsing multipart form: %v", err)
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		h.logger.Printf("UploadHandler: Error retrieving file: %v", err)
+		http.Error(w, "Unable to get file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		h.logger.Printf("UploadHandler: Error reading file: %v", err)
+		http.Error(w, "Unable to read file", http.StatusBadRequest)
+		return
+	}
+	id, err := h.sources.Put(data)
+	if err != nil {
+		h.logger.Printf("UploadHandler: Error storing source: %v", err)
+		http.Error(w, fmt.Sprintf("Error storing image: %v", err), http.StatusBadRequest)
+		return
+	}
+	src, err := h.sources.Get(id)
+	if err != nil {
+		h.logger.Printf("UploadHandler: Error loading stored source: %v", err)
+		http.Error(w, "Error storing image", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]interface{}{
+		"sourceId":  id,
+		"filename":  header.Filename,
+		"width":     src.Bounds().Dx(),
+		"height":    src.Bounds().Dy(),
+		"expiresAt": time.Now().Add(h.sources.TTL).UTC().Format(time.RFC3339),
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		h.logger.Printf("UploadHandler: Error encoding JSON response: %v", err)
+	}
+}
+
+// formSource returns the image to watermark and its file name: the uploaded
+// "image" file or, when sourceId is given instead, the stored upload. Stored
+// uploads take their name from the "filename" field.
+func (h *WatermarkHandler) formSource(r *http.Request) (*watermark.Source, string, error) {
+	if id := r.FormValue("sourceId"); id != "" {
+		if h.sources == nil {
+			return nil, "", watermark.ErrSourceNotFound
+		}
+		src, err := h.sources.Get(id)
+		return src, r.FormValue("filename"), err
+	}
+
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to get file: %v", err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to read file: %v", err)
+	}
+	src, err := watermark.DecodeSource(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode source image: %v", err)
+	}
+	return src, header.Filename, nil
+}
+
+// sourceStatus returns the HTTP status for an error from formSource.
+func sourceStatus(err error) int {
+	if errors.Is(err, watermark.ErrSourceNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
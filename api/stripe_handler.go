@@ -9,12 +9,17 @@ import (
 	"net/http"
 	"os"
 	"time"
+	"watermark-generator/audit"
+	"watermark-generator/auth"
 	"watermark-generator/models"
+	"watermark-generator/org"
 
 	"github.com/stripe/stripe-go/v75"
 	"github.com/stripe/stripe-go/v75/checkout/session"
 	"github.com/stripe/stripe-go/v75/customer"
 	"github.com/stripe/stripe-go/v75/subscription"
+	"github.com/stripe/stripe-go/v75/subscriptionitem"
+	"github.com/stripe/stripe-go/v75/webhook"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -22,44 +27,46 @@ import (
 
 type StripeHandler struct {
 	DB *mongo.Database
+	// Orgs holds the organizations whose subscriptions are billed per seat
+	Orgs  *org.Orgs
+	Audit *audit.Log
 }
 
-func NewStripeHandler(db *mongo.Database) *StripeHandler {
-	return &StripeHandler{DB: db}
+func NewStripeHandler(db *mongo.Database, orgs *org.Orgs, auditLog *audit.Log) *StripeHandler {
+	return &StripeHandler{DB: db, Orgs: orgs, Audit: auditLog}
 }
 
-func (h *StripeHandler) CreateSubscription(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var req struct {
-		UserID string `json:"userId"`
-	}
+// StripeSeats bills organization seats as the quantity of the
+// subscription's item.
+type StripeSeats struct{}
 
-	err := json.NewDecoder(r.Body).Decode(&req)
+func (StripeSeats) UpdateSeats(_ context.Context, subscriptionID string, seats int64) error {
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	sub, err := subscription.Get(subscriptionID, nil)
 	if err != nil {
-		log.Printf("Error decoding request body: %v", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+		return fmt.Errorf("failed to fetch subscription: %v", err)
 	}
+	if sub.Items == nil || len(sub.Items.Data) == 0 {
+		return fmt.Errorf("subscription %s has no items", subscriptionID)
+	}
+	if _, err := subscriptionitem.Update(sub.Items.Data[0].ID, &stripe.SubscriptionItemParams{
+		Quantity:          stripe.Int64(seats),
+		ProrationBehavior: stripe.String("create_prorations"),
+	}); err != nil {
+		return fmt.Errorf("failed to update subscription quantity: %v", err)
+	}
+	return nil
+}
 
-	log.Printf("Received request with UserID: %s", req.UserID)
-
-	// Fetch the user from the database
-	objectID, err := primitive.ObjectIDFromHex(req.UserID)
-	if err != nil {
-		log.Printf("Invalid UserID format: %v", err)
-		http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+func (h *StripeHandler) CreateSubscription(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var user models.User
-	err = h.DB.Collection("users").FindOne(r.Context(), bson.M{"_id": objectID}).Decode(&user)
-	if err != nil {
-		log.Printf("Error fetching user from database: %v", err)
-		http.Error(w, "User not found", http.StatusNotFound)
+	user := auth.UserFrom(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
@@ -82,7 +89,7 @@ func (h *StripeHandler) CreateSubscription(w http.ResponseWriter, r *http.Reques
 		// Update user in database with new Stripe Customer ID
 		_, err = h.DB.Collection("users").UpdateOne(
 			r.Context(),
-			bson.M{"_id": objectID},
+			bson.M{"_id": user.ID},
 			bson.M{"$set": bson.M{"stripeCustomerId": customer.ID}},
 		)
 		if err != nil {
@@ -126,6 +133,11 @@ func (h *StripeHandler) CreateSubscription(w http.ResponseWriter, r *http.Reques
 	}
 
 	log.Printf("Stripe session created: %+v", session)
+	recordEvent(h.Audit, r, "CreateSubscription", audit.Entry{
+		Action:   "subscription.checkout",
+		TargetID: user.ID,
+		Details:  map[string]interface{}{"sessionId": session.ID, "priceId": proPriceID},
+	})
 
 	w.Header().Set("Content-Type", "application/json")
 	response := map[string]string{
@@ -147,32 +159,15 @@ func (h *StripeHandler) CancelSubscription(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	var req struct {
-		UserID string `json:"userId"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Fetch the user from the database
-	objectID, err := primitive.ObjectIDFromHex(req.UserID)
-	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
-	}
-
-	var user models.User
-	err = h.DB.Collection("users").FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&user)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+	user := auth.UserFrom(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	// Cancel the subscription in Stripe
 	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-	_, err = subscription.Cancel(user.SubscriptionId, &stripe.SubscriptionCancelParams{
+	_, err := subscription.Cancel(user.SubscriptionId, &stripe.SubscriptionCancelParams{
 		Prorate: stripe.Bool(false),
 	})
 	if err != nil {
@@ -188,87 +183,292 @@ func (h *StripeHandler) CancelSubscription(w http.ResponseWriter, r *http.Reques
 			"subscriptionId":        "", // Clear the subscription ID
 		},
 	}
-	_, err = h.DB.Collection("users").UpdateOne(context.Background(), bson.M{"_id": objectID}, update)
+	_, err = h.DB.Collection("users").UpdateOne(context.Background(), bson.M{"_id": user.ID}, update)
 	if err != nil {
 		http.Error(w, "Failed to update user subscription status", http.StatusInternalServerError)
 		return
 	}
+	recordEvent(h.Audit, r, "CancelSubscription", audit.Entry{
+		Action:   "subscription.cancel",
+		TargetID: user.ID,
+		Changes: audit.Diff(
+			map[string]interface{}{"subscriptionStatus": user.SubscriptionStatus, "subscriptionId": user.SubscriptionId},
+			map[string]interface{}{"subscriptionStatus": "cancelled", "subscriptionId": ""},
+		),
+	})
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Subscription cancelled successfully"})
 }
 
-func (h *StripeHandler) HandleWebhook(w http.ResponseWriter, r *http.Request) {
-	log.Println("Webhook handler called")
-
-	if r.Method != http.MethodPost {
-		log.Printf("Invalid method: %s", r.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// CreateOrgSubscription starts a Checkout session for the organization
+// {"org"} with one seat per member. Only owners can subscribe. The price
+// is ORG_PRICE_ID, a per-seat price, or PRO_PRICE_ID when that is not set.
+func (h *StripeHandler) CreateOrgSubscription(w http.ResponseWriter, r *http.Request) {
+	owner, organization := h.orgOwner(w, r, "CreateOrgSubscription")
+	if owner == nil {
+		return
+	}
+	if organization.IsPaid() {
+		writeMessage(w, http.StatusConflict, "The organization already has a subscription")
 		return
 	}
+	priceID := os.Getenv("ORG_PRICE_ID")
+	if priceID == "" {
+		priceID = os.Getenv("PRO_PRICE_ID")
+	}
+	if priceID == "" {
+		log.Println("CreateOrgSubscription: ORG_PRICE_ID and PRO_PRICE_ID are not set")
+		http.Error(w, "Server configuration error", http.StatusInternalServerError)
+		return
+	}
+
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	if organization.StripeCustomerID == "" {
+		params := &stripe.CustomerParams{
+			Name:  stripe.String(organization.Name),
+			Email: stripe.String(auth.UserFrom(r.Context()).Email),
+		}
+		params.AddMetadata("org_id", organization.ID.Hex())
+		c, err := customer.New(params)
+		if err != nil {
+			log.Printf("CreateOrgSubscription: Error creating Stripe customer: %v", err)
+			http.Error(w, "Failed to create Stripe customer", http.StatusInternalServerError)
+			return
+		}
+		if err := h.Orgs.Store.SetCustomer(r.Context(), organization.ID, c.ID); err != nil {
+			log.Printf("CreateOrgSubscription: %v", err)
+			http.Error(w, "Failed to update organization with Stripe Customer ID", http.StatusInternalServerError)
+			return
+		}
+		organization.StripeCustomerID = c.ID
+	}
 
-	body, err := io.ReadAll(r.Body)
+	seats, err := h.Orgs.Seats(r.Context(), organization.ID)
+	if err != nil {
+		log.Printf("CreateOrgSubscription: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	s, err := session.New(&stripe.CheckoutSessionParams{
+		Customer:           stripe.String(organization.StripeCustomerID),
+		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
+		Mode:               stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{
+				Price:    stripe.String(priceID),
+				Quantity: stripe.Int64(seats),
+			},
+		},
+		SuccessURL: stripe.String(os.Getenv("VITE_API_URL") + "/subscribe/success?session_id={CHECKOUT_SESSION_ID}"),
+		CancelURL:  stripe.String(os.Getenv("VITE_API_URL") + "/subscribe/cancel"),
+	})
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		log.Printf("CreateOrgSubscription: Error creating Stripe session: %v", err)
+		http.Error(w, fmt.Sprintf("Error creating Stripe session: %v", err), http.StatusInternalServerError)
 		return
 	}
+	log.Printf("CreateOrgSubscription: Checkout for organization %s with %d seats", organization.ID.Hex(), seats)
+	recordEvent(h.Audit, r, "CreateOrgSubscription", audit.Entry{
+		Action:   "org.subscription.checkout",
+		TargetID: organization.ID,
+		Details:  map[string]interface{}{"sessionId": s.ID, "priceId": priceID, "seats": seats},
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sessionId": s.ID, "seats": seats})
+}
 
-	log.Printf("Received webhook body: %s", string(body))
+// CancelOrgSubscription cancels the subscription of the organization
+// {"org"}, which ends its members' paid seats. Only owners can cancel.
+func (h *StripeHandler) CancelOrgSubscription(w http.ResponseWriter, r *http.Request) {
+	owner, organization := h.orgOwner(w, r, "CancelOrgSubscription")
+	if owner == nil {
+		return
+	}
+	if organization.SubscriptionID == "" {
+		writeMessage(w, http.StatusConflict, "The organization has no subscription")
+		return
+	}
 
-	var rawEvent struct {
-		Type string `json:"type"`
-		Data struct {
-			Object json.RawMessage `json:"object"`
-		} `json:"data"`
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	if _, err := subscription.Cancel(organization.SubscriptionID, &stripe.SubscriptionCancelParams{
+		Prorate: stripe.Bool(false),
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to cancel subscription in Stripe: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := h.Orgs.SubscriptionCancelled(r.Context(), organization.ID); err != nil {
+		log.Printf("CancelOrgSubscription: %v", err)
+		http.Error(w, "Failed to update organization subscription status", http.StatusInternalServerError)
+		return
 	}
+	log.Printf("CancelOrgSubscription: User %s cancelled the subscription of organization %s", owner.UserID.Hex(), organization.ID.Hex())
+	recordEvent(h.Audit, r, "CancelOrgSubscription", audit.Entry{
+		Action:   "org.subscription.cancel",
+		TargetID: organization.ID,
+		Changes: audit.Diff(
+			map[string]interface{}{"subscriptionStatus": organization.SubscriptionStatus, "subscriptionId": organization.SubscriptionID},
+			map[string]interface{}{"subscriptionStatus": "cancelled", "subscriptionId": ""},
+		),
+	})
+	writeMessage(w, http.StatusOK, "Subscription cancelled successfully")
+}
 
-	if err := json.Unmarshal(body, &rawEvent); err != nil {
-		log.Printf("Error parsing webhook JSON: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+// orgOwner reads {"org"} from a POST body and returns the signed-in user's
+// membership, which must be an owner's, and the organization. It writes
+// the error response and returns nils otherwise.
+func (h *StripeHandler) orgOwner(w http.ResponseWriter, r *http.Request, handler string) (*org.Member, *org.Organization) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, nil
+	}
+	user := auth.UserFrom(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, nil
+	}
+	var body struct {
+		Org string `json:"org"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request body")
+		return nil, nil
+	}
+	orgID, err := primitive.ObjectIDFromHex(body.Org)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid organization id")
+		return nil, nil
+	}
+	owner, err := h.Orgs.Owner(r.Context(), orgID, user.ID)
+	if err != nil {
+		writeOrgError(w, handler, err)
+		return nil, nil
+	}
+	organization, err := h.Orgs.Store.Org(r.Context(), orgID)
+	if err != nil {
+		writeOrgError(w, handler, err)
+		return nil, nil
+	}
+	return owner, organization
+}
+
+// maxWebhookBytes bounds the webhook body read before its signature is
+// checked; Stripe events are far smaller.
+const maxWebhookBytes = 65536
+
+// HandleWebhook handles Stripe events. Only events signed with
+// STRIPE_WEBHOOK_SECRET are accepted.
+func (h *StripeHandler) HandleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		log.Printf("Invalid method: %s", r.Method)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	secret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+	if secret == "" {
+		log.Println("HandleWebhook: STRIPE_WEBHOOK_SECRET is not set")
+		http.Error(w, "Server configuration error", http.StatusInternalServerError)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBytes))
+	if err != nil {
+		log.Printf("HandleWebhook: Error reading request body: %v", err)
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	event, err := webhook.ConstructEvent(body, r.Header.Get("Stripe-Signature"), secret)
+	if err != nil {
+		log.Printf("HandleWebhook: Rejected event: %v", err)
+		http.Error(w, "Invalid signature", http.StatusBadRequest)
 		return
 	}
 
-	switch rawEvent.Type {
+	switch event.Type {
 	case "invoice.payment_succeeded":
-		var session stripe.CheckoutSession
-		if err := json.Unmarshal(rawEvent.Data.Object, &session); err != nil {
-			log.Printf("Error unmarshalling session data: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		var invoice stripe.Invoice
+		if err := json.Unmarshal(event.Data.Raw, &invoice); err != nil {
+			log.Printf("HandleWebhook: Error decoding invoice in event %s: %v", event.ID, err)
+			http.Error(w, "Invalid invoice", http.StatusBadRequest)
 			return
 		}
-		log.Printf("Unmarshalled session data: %+v", session)
-		err = h.handleSuccessfulSubscription(r.Context(), session)
-		if err != nil {
-			log.Printf("Error handling successful subscription: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		// One-off invoices have no subscription to activate
+		if invoice.Subscription == nil || invoice.Customer == nil {
+			log.Printf("HandleWebhook: Invoice %s has no subscription or customer, ignoring", invoice.ID)
+			break
+		}
+		if err := h.handleSuccessfulSubscription(r, invoice.Customer.ID, invoice.Subscription.ID); err != nil {
+			log.Printf("HandleWebhook: Error handling invoice %s: %v", invoice.ID, err)
+			http.Error(w, "Failed to handle invoice", http.StatusInternalServerError)
 			return
 		}
-		log.Println("Successfully handled subscription")
+		log.Printf("HandleWebhook: Activated subscription %s", invoice.Subscription.ID)
 	default:
-		log.Printf("Unhandled event type: %s", rawEvent.Type)
+		log.Printf("HandleWebhook: Unhandled event type: %s", event.Type)
 	}
 
-	log.Println("Webhook handled successfully")
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h *StripeHandler) handleSuccessfulSubscription(ctx context.Context, session stripe.CheckoutSession) error {
+// handleSuccessfulSubscription records a paid invoice for the subscription
+// on the organization or user billed to the customer. The webhook has no signed-in user, so
+// its audit entries have no actor.
+func (h *StripeHandler) handleSuccessfulSubscription(r *http.Request, customerID, subscriptionID string) error {
+	ctx := r.Context()
 	// Fetch subscription details
-	subscription, err := subscription.Get(session.Subscription.ID, nil)
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	subscription, err := subscription.Get(subscriptionID, nil)
 	if err != nil {
 		return err
 	}
+	expiresAt := time.Unix(subscription.CurrentPeriodEnd, 0)
+
+	// The customer is an organization's when one is billed to it
+	seats := int64(1)
+	if subscription.Items != nil && len(subscription.Items.Data) > 0 {
+		seats = subscription.Items.Data[0].Quantity
+	}
+	paid, err := h.Orgs.SubscriptionPaid(ctx, customerID, subscription.ID, expiresAt, seats)
+	if paid != nil {
+		recordEvent(h.Audit, r, "HandleWebhook", audit.Entry{
+			Action:   "org.subscription.activate",
+			TargetID: paid.ID,
+			Changes: audit.Diff(
+				map[string]interface{}{"subscriptionStatus": paid.SubscriptionStatus, "subscriptionExpiresAt": paid.SubscriptionExpiresAt, "seats": paid.Seats},
+				map[string]interface{}{"subscriptionStatus": "active", "subscriptionExpiresAt": expiresAt, "seats": seats},
+			),
+			Details: map[string]interface{}{"customerId": customerID, "subscriptionId": subscription.ID},
+		})
+	}
+	if err != nil || paid != nil {
+		return err
+	}
 
 	// Update user in database
-	_, err = h.DB.Collection("users").UpdateOne(
+	var user models.User
+	err = h.DB.Collection("users").FindOneAndUpdate(
 		ctx,
-		bson.M{"stripeCustomerId": session.Customer.ID},
+		bson.M{"stripeCustomerId": customerID},
 		bson.M{"$set": bson.M{
 			"subscriptionStatus":    "active",
 			"subscriptionId":        subscription.ID,
-			"subscriptionExpiresAt": time.Unix(subscription.CurrentPeriodEnd, 0),
+			"subscriptionExpiresAt": expiresAt,
 		}},
-	)
-	return err
+	).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		log.Printf("HandleWebhook: No user or organization is billed to customer %s", customerID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	recordEvent(h.Audit, r, "HandleWebhook", audit.Entry{
+		Action:   "subscription.activate",
+		TargetID: user.ID,
+		Changes: audit.Diff(
+			map[string]interface{}{"subscriptionStatus": user.SubscriptionStatus, "subscriptionExpiresAt": user.SubscriptionExpiresAt},
+			map[string]interface{}{"subscriptionStatus": "active", "subscriptionExpiresAt": expiresAt},
+		),
+		Details: map[string]interface{}{"customerId": customerID, "subscriptionId": subscription.ID},
+	})
+	return nil
 }
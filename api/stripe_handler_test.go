@@ -0,0 +1,161 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"watermark-generator/audit"
+	"watermark-generator/org"
+
+	"github.com/stripe/stripe-go/v75"
+	"github.com/stripe/stripe-go/v75/webhook"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const testWebhookSecret = "whsec_test"
+
+// testStripeAPI points the Stripe client at a server that answers
+// subscription lookups, and returns the paths it was asked for.
+func testStripeAPI(t *testing.T) *[]string {
+	t.Helper()
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		id := strings.TrimPrefix(r.URL.Path, "/v1/subscriptions/")
+		fmt.Fprintf(w, `{"id":%q,"object":"subscription","current_period_end":%d,"items":{"object":"list","data":[{"id":"si_1","object":"subscription_item","quantity":3}]}}`,
+			id, time.Now().Add(30*24*time.Hour).Unix())
+	}))
+	t.Cleanup(srv.Close)
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL:               stripe.String(srv.URL),
+		MaxNetworkRetries: stripe.Int64(0),
+	}))
+	t.Cleanup(func() { stripe.SetBackend(stripe.APIBackend, nil) })
+	t.Setenv("STRIPE_SECRET_KEY", "sk_test")
+	t.Setenv("STRIPE_WEBHOOK_SECRET", testWebhookSecret)
+	return &paths
+}
+
+// webhookRequest returns a webhook call carrying an event of type with
+// object, signed with secret.
+func webhookRequest(eventType, object, secret string) *http.Request {
+	payload := []byte(fmt.Sprintf(`{"id":"evt_1","object":"event","api_version":%q,"type":%q,"data":{"object":%s}}`,
+		stripe.APIVersion, eventType, object))
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: secret})
+	r := httptest.NewRequest(http.MethodPost, "/api/webhook", strings.NewReader(string(payload)))
+	r.Header.Set("Stripe-Signature", signed.Header)
+	return r
+}
+
+func TestHandleWebhookInvoicePaid(t *testing.T) {
+	paths := testStripeAPI(t)
+	store := &testOrgStore{orgs: map[primitive.ObjectID]*org.Organization{}}
+	organization := &org.Organization{ID: primitive.NewObjectID(), Name: "Studio", StripeCustomerID: "cus_org"}
+	store.orgs[organization.ID] = organization
+	events := &testAuditStore{}
+	h := NewStripeHandler(nil, org.NewOrgs(store, nil, nil, nil), audit.NewLog(events))
+
+	w := httptest.NewRecorder()
+	h.HandleWebhook(w, webhookRequest("invoice.payment_succeeded",
+		`{"id":"in_1","object":"invoice","customer":"cus_org","subscription":"sub_1"}`, testWebhookSecret))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if len(*paths) != 1 || (*paths)[0] != "/v1/subscriptions/sub_1" {
+		t.Errorf("Stripe calls %v, want the invoice's subscription", *paths)
+	}
+	if len(events.entries) != 1 || events.entries[0].Action != "org.subscription.activate" || events.entries[0].TargetID != organization.ID {
+		t.Fatalf("audit entries %v, want the organization's activation", events.actions())
+	}
+	if got := events.entries[0].Changes["seats"].To; got != int64(3) {
+		t.Errorf("seats changed to %v, want 3", got)
+	}
+
+	// Invoices without a subscription, such as one-off charges, are
+	// acknowledged and otherwise ignored
+	w = httptest.NewRecorder()
+	h.HandleWebhook(w, webhookRequest("invoice.payment_succeeded", `{"id":"in_2","object":"invoice","customer":"cus_org"}`, testWebhookSecret))
+	if w.Code != http.StatusOK || len(*paths) != 1 || len(events.entries) != 1 {
+		t.Errorf("invoice without subscription: status %d, %d Stripe calls, %d audit entries", w.Code, len(*paths), len(events.entries))
+	}
+}
+
+func TestHandleWebhookChecksSignature(t *testing.T) {
+	paths := testStripeAPI(t)
+	h := NewStripeHandler(nil, org.NewOrgs(&testOrgStore{orgs: map[primitive.ObjectID]*org.Organization{}}, nil, nil, nil), audit.NewLog(&testAuditStore{}))
+	invoice := `{"id":"in_1","object":"invoice","customer":"cus_org","subscription":"sub_1"}`
+
+	unsigned := webhookRequest("invoice.payment_succeeded", invoice, testWebhookSecret)
+	unsigned.Header.Del("Stripe-Signature")
+	for name, r := range map[string]*http.Request{
+		"unsigned":   unsigned,
+		"wrong key":  webhookRequest("invoice.payment_succeeded", invoice, "whsec_other"),
+		"no payload": httptest.NewRequest(http.MethodPost, "/api/webhook", nil),
+	} {
+		w := httptest.NewRecorder()
+		h.HandleWebhook(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, w.Code)
+		}
+	}
+	if len(*paths) != 0 {
+		t.Errorf("rejected events called Stripe: %v", *paths)
+	}
+
+	t.Setenv("STRIPE_WEBHOOK_SECRET", "")
+	w := httptest.NewRecorder()
+	h.HandleWebhook(w, webhookRequest("invoice.payment_succeeded", invoice, testWebhookSecret))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("without a secret: status %d, want 500", w.Code)
+	}
+}
+
+func TestHandleWebhookAuditsOnlySignedEvents(t *testing.T) {
+	paths := testStripeAPI(t)
+	store := &testOrgStore{orgs: map[primitive.ObjectID]*org.Organization{}}
+	organization := &org.Organization{ID: primitive.NewObjectID(), Name: "Studio", StripeCustomerID: "cus_org"}
+	store.orgs[organization.ID] = organization
+	events := &testAuditStore{}
+	h := NewStripeHandler(nil, org.NewOrgs(store, nil, nil, nil), audit.NewLog(events))
+	invoice := `{"id":"in_1","object":"invoice","customer":"cus_org","subscription":"sub_1"}`
+
+	// The body is changed after signing
+	tampered := webhookRequest("invoice.payment_succeeded", `{"id":"in_1","object":"invoice","customer":"cus_other","subscription":"sub_1"}`, testWebhookSecret)
+	tampered.Body = webhookRequest("invoice.payment_succeeded", invoice, testWebhookSecret).Body
+	// A captured event is replayed after the signature's tolerance
+	payload := []byte(fmt.Sprintf(`{"id":"evt_1","object":"event","api_version":%q,"type":"invoice.payment_succeeded","data":{"object":%s}}`, stripe.APIVersion, invoice))
+	stale := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: testWebhookSecret, Timestamp: time.Now().Add(-time.Hour)})
+	replayed := httptest.NewRequest(http.MethodPost, "/api/webhook", strings.NewReader(string(payload)))
+	replayed.Header.Set("Stripe-Signature", stale.Header)
+
+	for name, r := range map[string]*http.Request{
+		"tampered":  tampered,
+		"replayed":  replayed,
+		"wrong key": webhookRequest("invoice.payment_succeeded", invoice, "whsec_other"),
+	} {
+		w := httptest.NewRecorder()
+		h.HandleWebhook(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, w.Code)
+		}
+	}
+	if len(events.entries) != 0 || len(*paths) != 0 {
+		t.Fatalf("rejected events wrote %v to the audit log and called Stripe %v", events.actions(), *paths)
+	}
+
+	w := httptest.NewRecorder()
+	h.HandleWebhook(w, webhookRequest("invoice.payment_succeeded", invoice, testWebhookSecret))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if actions := events.actions(); len(actions) != 1 || actions[0] != "org.subscription.activate" {
+		t.Errorf("audit entries %v, want one activation", actions)
+	}
+	if !events.entries[0].ActorID.IsZero() {
+		t.Errorf("webhook entry has actor %s", events.entries[0].ActorID.Hex())
+	}
+}
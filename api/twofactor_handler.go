@@ -0,0 +1,462 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"watermark-generator/audit"
+	"watermark-generator/auth"
+	"watermark-generator/models"
+	"watermark-generator/watermark"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// totpIssuer names the account in authenticator apps.
+const totpIssuer = "Watermark Generator"
+
+// totpQRWidth is the width of the enrollment QR code in pixels.
+const totpQRWidth = 256
+
+// writeSignIn answers a completed sign-in with the tokens and the user.
+func writeSignIn(w http.ResponseWriter, user *models.User, tokens *auth.TokenPair) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":                    user.ID.Hex(),
+		"email":                 user.Email,
+		"role":                  user.RoleName(),
+		"twoFactorEnabled":      user.TwoFactorEnabled(),
+		"token":                 tokens.AccessToken,
+		"refreshToken":          tokens.RefreshToken,
+		"expiresIn":             tokens.ExpiresIn,
+		"stripeCustomerId":      user.StripeCustomerID,
+		"subscriptionStatus":    user.SubscriptionStatus,
+		"subscriptionId":        user.SubscriptionId,
+		"subscriptionExpiresAt": user.SubscriptionExpiresAt,
+		"seatExpiresAt":         user.SeatExpiresAt,
+		"isPaid":                user.IsPaid(),
+		"dailyDownloads":        user.DailyDownloads,
+		"lastDownloadDate":      user.LastDownloadDate,
+	})
+}
+
+// writeChallenge answers a correct password for an account with two-factor
+// authentication. The client posts the challenge and a code to
+// /api/signin/2fa.
+func writeChallenge(w http.ResponseWriter, status int, message, challenge string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":           message,
+		"twoFactorRequired": true,
+		"challenge":         challenge,
+		"expiresIn":         int64(auth.TwoFactorChallengeTTL / time.Second),
+	})
+}
+
+// verifySecondFactor checks a TOTP code or, failing that, a recovery code
+// and uses it up. Both are consumed with conditional updates so that two
+// requests racing with the same code cannot both succeed.
+func (h *AuthHandler) verifySecondFactor(ctx context.Context, user *models.User, code string) (bool, error) {
+	if !user.TwoFactorEnabled() {
+		return false, nil
+	}
+	key, err := auth.DecodeTOTPSecret(user.TwoFactor.Secret)
+	if err != nil {
+		return false, err
+	}
+	if counter, ok := auth.ValidateTOTP(key, code, time.Now()); ok {
+		result, err := h.DB.Collection("users").UpdateOne(ctx, bson.M{
+			"_id":                   user.ID,
+			"twoFactor.enabled":     true,
+			"twoFactor.lastCounter": bson.M{"$lt": int64(counter)},
+		}, bson.M{"$set": bson.M{"twoFactor.lastCounter": int64(counter)}})
+		if err != nil {
+			return false, fmt.Errorf("failed to record TOTP use: %v", err)
+		}
+		return result.MatchedCount == 1, nil
+	}
+
+	hash := auth.HashRecoveryCode(code)
+	result, err := h.DB.Collection("users").UpdateOne(ctx, bson.M{
+		"_id":                     user.ID,
+		"twoFactor.enabled":       true,
+		"twoFactor.recoveryCodes": hash,
+	}, bson.M{"$pull": bson.M{"twoFactor.recoveryCodes": hash}})
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %v", err)
+	}
+	if result.MatchedCount == 1 {
+		log.Printf("verifySecondFactor: User %s used a recovery code, %d left", user.ID.Hex(), len(user.TwoFactor.RecoveryCodes)-1)
+		return true, nil
+	}
+	return false, nil
+}
+
+// TwoFactorSignInHandler completes a sign-in with the challenge from
+// SignInHandler and a TOTP or recovery code. A wrong code counts as a
+// failed sign-in and returns a new challenge.
+func (h *AuthHandler) TwoFactorSignInHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Challenge == "" || body.Code == "" {
+		writeMessage(w, http.StatusBadRequest, "challenge and code are required")
+		return
+	}
+
+	userID, err := h.OneTime.Redeem(r.Context(), body.Challenge, auth.PurposeTwoFactor)
+	if err == auth.ErrInvalidToken {
+		writeMessage(w, http.StatusUnauthorized, "Sign-in expired, please sign in again")
+		return
+	}
+	if err != nil {
+		log.Printf("TwoFactorSignInHandler: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	user, err := auth.MongoUsers{DB: h.DB}.UserByID(r.Context(), userID)
+	if err != nil {
+		log.Printf("TwoFactorSignInHandler: %v", err)
+		writeMessage(w, http.StatusUnauthorized, "Sign-in expired, please sign in again")
+		return
+	}
+	if user.Disabled {
+		h.loginFailed(r, "TwoFactorSignInHandler", user.ID, user.Email, "disabled")
+		writeMessage(w, http.StatusForbidden, "Account disabled")
+		return
+	}
+
+	ip := auth.ClientIP(r)
+	wait, err := h.Throttle.Locked(r.Context(), user.Email, ip)
+	if err != nil {
+		log.Printf("TwoFactorSignInHandler: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeMessage(w, http.StatusTooManyRequests, "Too many failed sign-in attempts, please try again later")
+		return
+	}
+
+	ok, err := h.verifySecondFactor(r.Context(), user, body.Code)
+	if err != nil {
+		log.Printf("TwoFactorSignInHandler: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if !ok {
+		if err := h.Throttle.Failure(r.Context(), user.Email, ip); err != nil {
+			log.Printf("TwoFactorSignInHandler: %v", err)
+		}
+		h.loginFailed(r, "TwoFactorSignInHandler", user.ID, user.Email, "invalid_code")
+		challenge, err := h.OneTime.Issue(r.Context(), user.ID, auth.PurposeTwoFactor, auth.TwoFactorChallengeTTL)
+		if err != nil {
+			log.Printf("TwoFactorSignInHandler: Failed to issue challenge: %v", err)
+			writeMessage(w, http.StatusUnauthorized, "Invalid code, please sign in again")
+			return
+		}
+		writeChallenge(w, http.StatusUnauthorized, "Invalid code", challenge)
+		return
+	}
+	if err := h.Throttle.Success(r.Context(), user.Email); err != nil {
+		log.Printf("TwoFactorSignInHandler: %v", err)
+	}
+
+	tokens, err := h.Sessions.Start(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("TwoFactorSignInHandler: Failed to start session: %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	recordEvent(h.Audit, r, "TwoFactorSignInHandler", audit.Entry{
+		Action:   "auth.login",
+		ActorID:  user.ID,
+		TargetID: user.ID,
+		Details:  map[string]interface{}{"twoFactor": true},
+	})
+	writeSignIn(w, user, tokens)
+}
+
+// twoFactorUser returns the signed-in user for the enrollment endpoints.
+// Staff impersonating a user cannot change the user's second factor.
+func twoFactorUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	user := auth.UserFrom(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	if !auth.ActorFrom(r.Context()).IsZero() {
+		writeMessage(w, http.StatusForbidden, "Two-factor settings cannot be changed while impersonating")
+		return nil, false
+	}
+	return user, true
+}
+
+func decodeCode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Code == "" {
+		writeMessage(w, http.StatusBadRequest, "code is required")
+		return "", false
+	}
+	return body.Code, true
+}
+
+// TwoFactorSetupHandler starts an enrollment: it stores a new pending
+// secret and returns it with its otpauth URI and a QR code of the URI.
+// Two-factor authentication stays off until TwoFactorEnableHandler
+// confirms a code.
+func (h *AuthHandler) TwoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TwoFactorEnabled() {
+		writeMessage(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		log.Printf("TwoFactorSetupHandler: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	uri := auth.TOTPURI(totpIssuer, user.Email, secret)
+	qrCode, err := watermark.RenderQRCode(uri, totpQRWidth)
+	if err != nil {
+		log.Printf("TwoFactorSetupHandler: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if _, err := h.DB.Collection("users").UpdateOne(r.Context(), bson.M{"_id": user.ID}, bson.M{
+		"$set": bson.M{"twoFactor": models.TwoFactor{Secret: secret}},
+	}); err != nil {
+		log.Printf("TwoFactorSetupHandler: Failed to update user: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret": secret,
+		"uri":    uri,
+		"qrCode": "data:image/png;base64," + base64.StdEncoding.EncodeToString(qrCode),
+	})
+}
+
+// TwoFactorEnableHandler turns on two-factor authentication once the user
+// proves their app has the pending secret, and returns the recovery codes.
+// They are shown only this once.
+func (h *AuthHandler) TwoFactorEnableHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	code, ok := decodeCode(w, r)
+	if !ok {
+		return
+	}
+	if user.TwoFactorEnabled() {
+		writeMessage(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if user.TwoFactor == nil || user.TwoFactor.Secret == "" {
+		writeMessage(w, http.StatusBadRequest, "Start the setup first")
+		return
+	}
+
+	key, err := auth.DecodeTOTPSecret(user.TwoFactor.Secret)
+	if err != nil {
+		log.Printf("TwoFactorEnableHandler: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	counter, valid := auth.ValidateTOTP(key, code, time.Now())
+	if !valid {
+		writeMessage(w, http.StatusBadRequest, "Invalid code, check the time on your device")
+		return
+	}
+	codes, hashes, err := auth.NewRecoveryCodes()
+	if err != nil {
+		log.Printf("TwoFactorEnableHandler: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	// Matching the secret keeps a setup started meanwhile in another tab
+	// from being enabled with this code
+	result, err := h.DB.Collection("users").UpdateOne(r.Context(), bson.M{
+		"_id":               user.ID,
+		"twoFactor.secret":  user.TwoFactor.Secret,
+		"twoFactor.enabled": false,
+	}, bson.M{"$set": bson.M{
+		"twoFactor.enabled":       true,
+		"twoFactor.enabledAt":     time.Now(),
+		"twoFactor.lastCounter":   int64(counter),
+		"twoFactor.recoveryCodes": hashes,
+	}})
+	if err != nil {
+		log.Printf("TwoFactorEnableHandler: Failed to update user: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if result.MatchedCount == 0 {
+		writeMessage(w, http.StatusConflict, "The setup changed, please start again")
+		return
+	}
+	log.Printf("TwoFactorEnableHandler: Enabled two-factor authentication for user %s", user.ID.Hex())
+	recordEvent(h.Audit, r, "TwoFactorEnableHandler", audit.Entry{Action: "auth.2fa.enable", TargetID: user.ID})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recoveryCodes": codes})
+}
+
+// TwoFactorDisableHandler turns off two-factor authentication. It takes a
+// current TOTP or recovery code rather than the password, which accounts
+// created through an OpenID Connect provider do not have.
+func (h *AuthHandler) TwoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	code, ok := decodeCode(w, r)
+	if !ok {
+		return
+	}
+	if !h.checkCode(w, r, user, code) {
+		return
+	}
+	if _, err := h.DB.Collection("users").UpdateOne(r.Context(), bson.M{"_id": user.ID}, bson.M{
+		"$unset": bson.M{"twoFactor": ""},
+	}); err != nil {
+		log.Printf("TwoFactorDisableHandler: Failed to update user: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	log.Printf("TwoFactorDisableHandler: Disabled two-factor authentication for user %s", user.ID.Hex())
+	recordEvent(h.Audit, r, "TwoFactorDisableHandler", audit.Entry{Action: "auth.2fa.disable", TargetID: user.ID})
+	writeMessage(w, http.StatusOK, "Two-factor authentication disabled")
+}
+
+// RecoveryCodesHandler replaces the recovery codes, for example when they
+// run low, and returns the new ones.
+func (h *AuthHandler) RecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	code, ok := decodeCode(w, r)
+	if !ok {
+		return
+	}
+	if !h.checkCode(w, r, user, code) {
+		return
+	}
+	codes, hashes, err := auth.NewRecoveryCodes()
+	if err != nil {
+		log.Printf("RecoveryCodesHandler: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if _, err := h.DB.Collection("users").UpdateOne(r.Context(), bson.M{"_id": user.ID}, bson.M{
+		"$set": bson.M{"twoFactor.recoveryCodes": hashes},
+	}); err != nil {
+		log.Printf("RecoveryCodesHandler: Failed to update user: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	recordEvent(h.Audit, r, "RecoveryCodesHandler", audit.Entry{Action: "auth.2fa.recovery-codes", TargetID: user.ID})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recoveryCodes": codes})
+}
+
+// checkCode verifies a code for a signed-in user changing their settings.
+// Wrong codes count towards the sign-in lockout, since a stolen access
+// token should not allow guessing codes either.
+func (h *AuthHandler) checkCode(w http.ResponseWriter, r *http.Request, user *models.User, code string) bool {
+	if !user.TwoFactorEnabled() {
+		writeMessage(w, http.StatusBadRequest, "Two-factor authentication is not enabled")
+		return false
+	}
+	ip := auth.ClientIP(r)
+	wait, err := h.Throttle.Locked(r.Context(), user.Email, ip)
+	if err != nil {
+		log.Printf("checkCode: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Internal server error")
+		return false
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeMessage(w, http.StatusTooManyRequests, "Too many failed attempts, please try again later")
+		return false
+	}
+	ok, err := h.verifySecondFactor(r.Context(), user, code)
+	if err != nil {
+		log.Printf("checkCode: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Internal server error")
+		return false
+	}
+	if !ok {
+		if err := h.Throttle.Failure(r.Context(), user.Email, ip); err != nil {
+			log.Printf("checkCode: %v", err)
+		}
+		writeMessage(w, http.StatusBadRequest, "Invalid code")
+		return false
+	}
+	return true
+}
+
+// ResetTwoFactorHandler turns off two-factor authentication for a user who
+// lost their device and recovery codes. A reason is required and recorded.
+func (h *AdminHandler) ResetTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	req, user, ok := h.target(w, r)
+	if !ok {
+		return
+	}
+	if req.Reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+	if !user.TwoFactorEnabled() {
+		http.Error(w, "Two-factor authentication is not enabled for this user", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.DB.Collection("users").UpdateOne(r.Context(), bson.M{"_id": user.ID}, bson.M{
+		"$unset": bson.M{"twoFactor": ""},
+	}); err != nil {
+		log.Printf("ResetTwoFactorHandler: Failed to update user: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	recordEvent(h.Audit, r, "ResetTwoFactorHandler", audit.Entry{
+		Action:   "user.2fa.reset",
+		TargetID: user.ID,
+		Details:  map[string]interface{}{"reason": req.Reason},
+	})
+
+	user.TwoFactor = nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
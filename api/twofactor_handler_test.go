@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"watermark-generator/auth"
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestTwoFactorSettingsRejectImpersonation(t *testing.T) {
+	tokens := auth.NewTokenIssuer([]byte("test-secret"), time.Hour)
+	user := &models.User{ID: primitive.NewObjectID(), Email: "user@example.com"}
+	staff := &models.User{ID: primitive.NewObjectID(), Email: "support@example.com", Role: models.RoleSupport}
+	mw := auth.NewMiddleware(tokens, testUsers{user.ID: user, staff.ID: staff}, nil)
+	token, err := tokens.IssueAs(user.ID, staff.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &AuthHandler{}
+	for path, handler := range map[string]http.HandlerFunc{
+		"/api/2fa/setup":          h.TwoFactorSetupHandler,
+		"/api/2fa/enable":         h.TwoFactorEnableHandler,
+		"/api/2fa/disable":        h.TwoFactorDisableHandler,
+		"/api/2fa/recovery-codes": h.RecoveryCodesHandler,
+	} {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		mw.Require(handler)(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s while impersonating: status %d, want 403", path, w.Code)
+		}
+	}
+}
+
+func TestWriteChallenge(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeChallenge(w, http.StatusUnauthorized, "Invalid code", "next")
+	var body struct {
+		TwoFactorRequired bool   `json:"twoFactorRequired"`
+		Challenge         string `json:"challenge"`
+		ExpiresIn         int64  `json:"expiresIn"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusUnauthorized || !body.TwoFactorRequired || body.Challenge != "next" || body.ExpiresIn != 300 {
+		t.Errorf("status %d, body %+v", w.Code, body)
+	}
+}
@@ -1,11 +1,14 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image/color"
+	"io"
 	"log"
 	"math"
 	"mime/multipart"
@@ -17,8 +20,10 @@ import (
 	"strings"
 	"time"
 
+	"watermark-generator/auth"
 	"watermark-generator/db"
 	"watermark-generator/models"
+	"watermark-generator/org"
 	"watermark-generator/watermark"
 
 	"github.com/google/uuid"
@@ -32,28 +37,21 @@ type WatermarkHandler struct {
 	service *watermark.Service
 	logger  *log.Logger
 	DB      *mongo.Database
+	sources *watermark.SourceStore
+	// Orgs holds the organization assets usable as watermark images
+	Orgs *org.Orgs
+	// uploadsDir is the directory DownloadHandler serves files from
+	uploadsDir string
 }
 
-func NewWatermarkHandler(service *watermark.Service) *WatermarkHandler {
+func NewWatermarkHandler(service *watermark.Service, orgs *org.Orgs) *WatermarkHandler {
 	return &WatermarkHandler{
-		service: service,
-		logger:  log.New(os.Stdout, "API: ", log.LstdFlags),
-		DB:      db.GetDatabase(),
-	}
-}
-
-func (h *WatermarkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch r.URL.Path {
-	case "/api/watermark/text":
-		h.TextWatermarkHandler(w, r)
-	case "/api/watermark/image":
-		h.ImageWatermarkHandler(w, r)
-	case "/api/watermark/bulk/text":
-		h.BulkTextWatermarkHandler(w, r)
-	case "/api/watermark/bulk/image":
-		h.BulkImageWatermarkHandler(w, r)
-	default:
-		http.Error(w, "Not found", http.StatusNotFound)
+		service:    service,
+		logger:     log.New(os.Stdout, "API: ", log.LstdFlags),
+		DB:         db.GetDatabase(),
+		sources:    sourceStoreFromEnv(),
+		Orgs:       orgs,
+		uploadsDir: "uploads",
 	}
 }
 
@@ -96,16 +94,15 @@ func (h *WatermarkHandler) TextWatermarkHandler(w http.ResponseWriter, r *http.R
 		h.logger.Printf("%s: %v", key, values)
 	}
 
-	h.logger.Println("TextWatermarkHandler: Retrieving file from form")
-	file, header, err := r.FormFile("image")
+	h.logger.Println("TextWatermarkHandler: Retrieving source image")
+	src, filename, err := h.formSource(r)
 	if err != nil {
-		h.logger.Printf("TextWatermarkHandler: Error retrieving file: %v", err)
-		http.Error(w, "Unable to get file", http.StatusBadRequest)
+		h.logger.Printf("TextWatermarkHandler: Error retrieving source image: %v", err)
+		http.Error(w, fmt.Sprintf("Unable to get source image: %v", err), sourceStatus(err))
 		return
 	}
-	defer file.Close()
 
-	h.logger.Printf("TextWatermarkHandler: File received: %s", header.Filename)
+	h.logger.Printf("TextWatermarkHandler: Source received: %s", filename)
 
 	opacity, err := strconv.ParseFloat(r.FormValue("opacity"), 64)
 	if err != nil {
@@ -127,18 +124,48 @@ func (h *WatermarkHandler) TextWatermarkHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 	textColor := r.FormValue("color")
+	colorMode := watermark.ParseContrastMode(r.FormValue("colorMode"))
+	if textColor == "auto" {
+		// "auto" picks black or white per tile
+		textColor = "#ffffff"
+		colorMode = watermark.ContrastAuto
+	}
 	if textColor == "" {
 		textColor = "#000000" // Default to black if no color is provided
 	}
+	contrastThreshold, _ := strconv.ParseFloat(r.FormValue("contrastThreshold"), 64)
+	sizeMode := watermark.ParseSizeMode(r.FormValue("sizeMode"))
 	fontSize, err := strconv.ParseFloat(r.FormValue("fontSize"), 64)
-	if err != nil {
+	if err != nil || fontSize <= 0 {
 		h.logger.Printf("TextWatermarkHandler: Error parsing fontSize: %v", err)
-		fontSize = 32 // Default font size if parsing fails
+		fontSize = defaultFontSizes[sizeMode] // Default font size if parsing fails
+	}
+
+	lineHeight, err := strconv.ParseFloat(r.FormValue("lineHeight"), 64)
+	if err != nil {
+		lineHeight = 1.2 // Default line height if parsing fails
 	}
 
+	tiling := parseTiling(r)
+
 	h.logger.Println("TextWatermarkHandler: Calling ApplyWatermark")
 	var result []byte
-	result, err = h.service.ApplyWatermark(file, text, textColor, opacity, fontSize, spacing)
+	result, err = h.service.ApplyWatermarkSource(src, watermark.TextOptions{
+		Text:              text,
+		Color:             textColor,
+		Opacity:           opacity,
+		FontSize:          fontSize,
+		SizeMode:          sizeMode,
+		Spacing:           spacing,
+		LineHeight:        lineHeight,
+		Align:             watermark.ParseAlignment(r.FormValue("align")),
+		BlendMode:         watermark.ParseBlendMode(r.FormValue("blendMode")),
+		ColorMode:         colorMode,
+		ContrastThreshold: contrastThreshold,
+		Position:          watermark.ParsePosition(r.FormValue("position")),
+		Tiling:            tiling,
+		Template:          h.templateData(r, filename),
+	})
 
 	if err != nil {
 		h.logger.Printf("TextWatermarkHandler: Error applying watermark: %v", err)
@@ -164,9 +191,10 @@ func (h *WatermarkHandler) TextWatermarkHandler(w http.ResponseWriter, r *http.R
 		"message": "Watermark applied successfully",
 		"results": []map[string]interface{}{
 			{
-				"filename": header.Filename,
-				"data":     fmt.Sprintf("data:image/png;base64,%s", base64.StdEncoding.EncodeToString(result)),
+				"filename": filename,
+				"data":     fmt.Sprintf("data:%s;base64,%s", http.DetectContentType(result), base64.StdEncoding.EncodeToString(result)),
 				"uniqueId": uniqueId,
+				"seed":     strconv.FormatInt(tiling.Seed, 10),
 			},
 		},
 	}
@@ -181,6 +209,266 @@ func (h *WatermarkHandler) TextWatermarkHandler(w http.ResponseWriter, r *http.R
 	h.logger.Println("TextWatermarkHandler: Response written successfully")
 }
 
+// CodeWatermarkHandler adds a QR code or Code 128 barcode to an image. The
+// content is a template, so "{id}" links each image to its own page.
+func (h *WatermarkHandler) CodeWatermarkHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Println("CodeWatermarkHandler: Started processing request")
+	defer h.logger.Println("CodeWatermarkHandler: Finished processing request")
+
+	if r.Method != http.MethodPost {
+		h.logger.Println("CodeWatermarkHandler: Method not allowed")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseMultipartForm(10 << 20) // 10 MB
+	if err != nil {
+		h.logger.Printf("CodeWatermarkHandler: Error parsing multipart form: %v", err)
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		return
+	}
+
+	uniqueId := r.FormValue("uniqueId")
+	if uniqueId == "" {
+		uniqueId = uuid.New().String()
+	}
+
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		h.logger.Printf("CodeWatermarkHandler: Error retrieving file: %v", err)
+		http.Error(w, "Unable to get file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	content := r.FormValue("content")
+	if content == "" {
+		h.logger.Println("CodeWatermarkHandler: No content provided for code")
+		http.Error(w, "No content provided for code", http.StatusBadRequest)
+		return
+	}
+
+	opacity, err := strconv.ParseFloat(r.FormValue("opacity"), 64)
+	if err != nil {
+		opacity = 1 // Codes must stay readable, so default to opaque
+	}
+	opacity = math.Max(0, math.Min(1, opacity))
+
+	size, err := strconv.ParseFloat(r.FormValue("size"), 64)
+	if err != nil || size <= 0 {
+		size = 15 // Default code width as a percentage of the image width
+	}
+
+	spacing, err := strconv.ParseFloat(r.FormValue("spacing"), 64)
+	if err != nil {
+		spacing = 50 // Default gap between tiled codes
+	}
+
+	quietZone := 0 // The minimum the symbology requires
+	if v := r.FormValue("quietZone"); v != "" {
+		quietZone, err = strconv.Atoi(v)
+		if err != nil || quietZone < 0 || quietZone > watermark.MaxQuietZone {
+			h.logger.Printf("CodeWatermarkHandler: Invalid quietZone %q", v)
+			http.Error(w, fmt.Sprintf("quietZone must be a whole number from 0 to %d", watermark.MaxQuietZone), http.StatusBadRequest)
+			return
+		}
+	}
+
+	position := watermark.PositionBottomRight
+	if r.FormValue("position") != "" {
+		position = watermark.ParsePosition(r.FormValue("position"))
+	}
+
+	template := h.templateData(r, header.Filename)
+	template.ID = uniqueId
+	tiling := parseTiling(r)
+
+	result, err := h.service.ApplyCodeWatermark(file, watermark.CodeOptions{
+		Content:    content,
+		Kind:       watermark.ParseCodeKind(r.FormValue("codeType")),
+		Level:      watermark.ParseErrorCorrection(r.FormValue("errorCorrection")),
+		Size:       size,
+		Foreground: r.FormValue("foreground"),
+		Background: r.FormValue("background"),
+		QuietZone:  quietZone,
+		Opacity:    opacity,
+		BlendMode:  watermark.ParseBlendMode(r.FormValue("blendMode")),
+		Spacing:    spacing,
+		Position:   position,
+		Tiling:     tiling,
+		Template:   template,
+	})
+	if err != nil {
+		h.logger.Printf("CodeWatermarkHandler: Error applying watermark: %v", err)
+		http.Error(w, fmt.Sprintf("Error applying watermark: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Unique-Id", uniqueId)
+
+	response := map[string]interface{}{
+		"message": "Watermark applied successfully",
+		"results": []map[string]interface{}{
+			{
+				"filename": header.Filename,
+				"data":     fmt.Sprintf("data:%s;base64,%s", http.DetectContentType(result), base64.StdEncoding.EncodeToString(result)),
+				"uniqueId": uniqueId,
+				"seed":     strconv.FormatInt(tiling.Seed, 10),
+			},
+		},
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		h.logger.Printf("CodeWatermarkHandler: Error encoding JSON response: %v", err)
+	}
+}
+
+// PDFWatermarkHandler adds a text watermark, or a logo when a
+// watermarkImage is uploaded, to every page of a PDF. The overlay is
+// appended as vector content, so the document's text stays selectable.
+func (h *WatermarkHandler) PDFWatermarkHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Println("PDFWatermarkHandler: Started processing request")
+	defer h.logger.Println("PDFWatermarkHandler: Finished processing request")
+
+	if r.Method != http.MethodPost {
+		h.logger.Println("PDFWatermarkHandler: Method not allowed")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseMultipartForm(32 << 20) // 32 MB, documents are larger than images
+	if err != nil {
+		h.logger.Printf("PDFWatermarkHandler: Error parsing multipart form: %v", err)
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		return
+	}
+
+	uniqueId := r.FormValue("uniqueId")
+	if uniqueId == "" {
+		uniqueId = uuid.New().String()
+	}
+
+	file, header, err := r.FormFile("pdf")
+	if err != nil {
+		h.logger.Printf("PDFWatermarkHandler: Error retrieving file: %v", err)
+		http.Error(w, "Unable to get file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	opacity, err := strconv.ParseFloat(r.FormValue("opacity"), 64)
+	if err != nil {
+		opacity = 0.5 // Default opacity if parsing fails
+	}
+	opacity = math.Max(0, math.Min(1, opacity))
+
+	spacing, err := strconv.ParseFloat(r.FormValue("spacing"), 64)
+	if err != nil {
+		spacing = 100 // Default spacing if parsing fails
+	}
+
+	position := watermark.ParsePosition(r.FormValue("position"))
+	blendMode := watermark.ParseBlendMode(r.FormValue("blendMode"))
+	tiling := parseTiling(r)
+
+	logoFile, err := h.watermarkImage(r)
+	if err != nil && err != errNoWatermarkImage {
+		h.logger.Printf("PDFWatermarkHandler: Error retrieving watermark image: %v", err)
+		writeWatermarkImageError(w, err)
+		return
+	}
+
+	var result []byte
+	if logoFile != nil {
+		defer logoFile.Close()
+
+		watermarkSize, err := strconv.ParseFloat(r.FormValue("watermarkSize"), 64)
+		if err != nil || watermarkSize <= 0 {
+			watermarkSize = 25 // Default watermark size if parsing fails
+		}
+
+		result, err = h.service.ApplyPDFImageWatermark(file, logoFile, watermark.ImageOptions{
+			Opacity:       opacity,
+			Spacing:       spacing,
+			WatermarkSize: watermarkSize,
+			BlendMode:     blendMode,
+			LogoColorMode: watermark.ParseLogoColorMode(r.FormValue("logoColorMode")),
+			TintColor:     r.FormValue("tintColor"),
+			Position:      position,
+			Tiling:        tiling,
+			Footer:        footerFor(auth.UserFrom(r.Context()), r),
+			UniqueId:      uniqueId,
+		})
+		if err != nil {
+			h.logger.Printf("PDFWatermarkHandler: Error applying watermark: %v", err)
+			http.Error(w, fmt.Sprintf("Error applying watermark: %v", err), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		text := r.FormValue("text")
+		if text == "" {
+			h.logger.Println("PDFWatermarkHandler: No text or watermark image provided")
+			http.Error(w, "No text or watermark image provided", http.StatusBadRequest)
+			return
+		}
+		textColor := r.FormValue("color")
+		if textColor == "" || textColor == "auto" {
+			textColor = "#000000" // Pages are not rendered, so adaptive colors fall back to black
+		}
+		sizeMode := watermark.ParseSizeMode(r.FormValue("sizeMode"))
+		fontSize, err := strconv.ParseFloat(r.FormValue("fontSize"), 64)
+		if err != nil || fontSize <= 0 {
+			fontSize = defaultFontSizes[sizeMode] // Default font size if parsing fails
+		}
+		lineHeight, err := strconv.ParseFloat(r.FormValue("lineHeight"), 64)
+		if err != nil {
+			lineHeight = 1.2 // Default line height if parsing fails
+		}
+
+		result, err = h.service.ApplyPDFWatermark(file, watermark.TextOptions{
+			Text:       text,
+			Color:      textColor,
+			Opacity:    opacity,
+			FontSize:   fontSize,
+			SizeMode:   sizeMode,
+			Spacing:    spacing,
+			LineHeight: lineHeight,
+			Align:      watermark.ParseAlignment(r.FormValue("align")),
+			BlendMode:  blendMode,
+			Position:   position,
+			Tiling:     tiling,
+			Template:   h.templateData(r, header.Filename),
+		})
+		if err != nil {
+			h.logger.Printf("PDFWatermarkHandler: Error applying watermark: %v", err)
+			http.Error(w, fmt.Sprintf("Error applying watermark: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	h.logger.Printf("PDFWatermarkHandler: Watermark applied successfully. Result length: %d", len(result))
+
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Unique-Id", uniqueId)
+
+	response := map[string]interface{}{
+		"message": "Watermark applied successfully",
+		"results": []map[string]interface{}{
+			{
+				"filename": header.Filename,
+				"data":     fmt.Sprintf("data:application/pdf;base64,%s", base64.StdEncoding.EncodeToString(result)),
+				"uniqueId": uniqueId,
+				"seed":     strconv.FormatInt(tiling.Seed, 10),
+			},
+		},
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		h.logger.Printf("PDFWatermarkHandler: Error encoding JSON response: %v", err)
+	}
+}
+
 func (h *WatermarkHandler) ImageWatermarkHandler(w http.ResponseWriter, r *http.Request) {
 	h.logger.Println("ImageWatermarkHandler: Started processing request")
 	defer h.logger.Println("ImageWatermarkHandler: Finished processing request")
@@ -214,16 +502,15 @@ func (h *WatermarkHandler) ImageWatermarkHandler(w http.ResponseWriter, r *http.
 
 	h.logger.Printf("ImageWatermarkHandler: Processing request with uniqueId: %s", uniqueId)
 
-	h.logger.Println("ImageWatermarkHandler: Retrieving file from form")
-	file, header, err := r.FormFile("image")
+	h.logger.Println("ImageWatermarkHandler: Retrieving source image")
+	src, filename, err := h.formSource(r)
 	if err != nil {
-		h.logger.Printf("ImageWatermarkHandler: Error retrieving file: %v", err)
-		http.Error(w, "Unable to get file", http.StatusBadRequest)
+		h.logger.Printf("ImageWatermarkHandler: Error retrieving source image: %v", err)
+		http.Error(w, fmt.Sprintf("Unable to get source image: %v", err), sourceStatus(err))
 		return
 	}
-	defer file.Close()
 
-	h.logger.Printf("ImageWatermarkHandler: File received: %s", header.Filename)
+	h.logger.Printf("ImageWatermarkHandler: Source received: %s", filename)
 
 	opacity, err := strconv.ParseFloat(r.FormValue("opacity"), 64)
 	if err != nil {
@@ -239,23 +526,38 @@ func (h *WatermarkHandler) ImageWatermarkHandler(w http.ResponseWriter, r *http.
 	}
 
 	watermarkSize, err := strconv.ParseFloat(r.FormValue("watermarkSize"), 64)
-	if err != nil {
-		h.logger.Printf("ImageWatermarkHandler: Error parsing watermarkSize: %v", err)
+	if err != nil || watermarkSize <= 0 {
+		h.logger.Printf("ImageWatermarkHandler: Invalid watermarkSize %q, using the default", r.FormValue("watermarkSize"))
 		watermarkSize = 25 // Default watermark size if parsing fails
 	}
 
-	watermarkImageFile, watermarkHeader, err := r.FormFile("watermarkImage")
+	contrastThreshold, _ := strconv.ParseFloat(r.FormValue("contrastThreshold"), 64)
+
+	watermarkImageFile, err := h.watermarkImage(r)
 	if err != nil {
 		h.logger.Printf("ImageWatermarkHandler: Error retrieving watermark image: %v", err)
-		http.Error(w, "No watermark image provided", http.StatusBadRequest)
+		writeWatermarkImageError(w, err)
 		return
 	}
 	defer watermarkImageFile.Close()
 
-	h.logger.Printf("ImageWatermarkHandler: Watermark image received: %s", watermarkHeader.Filename)
+	tiling := parseTiling(r)
 
 	h.logger.Println("ImageWatermarkHandler: Calling ApplyImageWatermark")
-	result, err := h.service.ApplyImageWatermark(file, watermarkImageFile, opacity, spacing, watermarkSize, uniqueId)
+	result, err := h.service.ApplyImageWatermarkSource(src, watermarkImageFile, watermark.ImageOptions{
+		Opacity:           opacity,
+		Spacing:           spacing,
+		WatermarkSize:     watermarkSize,
+		BlendMode:         watermark.ParseBlendMode(r.FormValue("blendMode")),
+		LogoColorMode:     watermark.ParseLogoColorMode(r.FormValue("logoColorMode")),
+		TintColor:         r.FormValue("tintColor"),
+		ColorMode:         watermark.ParseContrastMode(r.FormValue("colorMode")),
+		ContrastThreshold: contrastThreshold,
+		Position:          watermark.ParsePosition(r.FormValue("position")),
+		Tiling:            tiling,
+		Footer:            footerFor(auth.UserFrom(r.Context()), r),
+		UniqueId:          uniqueId,
+	})
 	if err != nil {
 		h.logger.Printf("ImageWatermarkHandler: Error applying watermark: %v", err)
 		http.Error(w, fmt.Sprintf("Error applying watermark: %v", err), http.StatusInternalServerError)
@@ -280,9 +582,10 @@ func (h *WatermarkHandler) ImageWatermarkHandler(w http.ResponseWriter, r *http.
 		"message": "Watermark applied successfully",
 		"results": []map[string]interface{}{
 			{
-				"filename": header.Filename,
-				"data":     fmt.Sprintf("data:image/png;base64,%s", base64.StdEncoding.EncodeToString(result)),
+				"filename": filename,
+				"data":     fmt.Sprintf("data:%s;base64,%s", http.DetectContentType(result), base64.StdEncoding.EncodeToString(result)),
 				"uniqueId": uniqueId,
+				"seed":     strconv.FormatInt(tiling.Seed, 10),
 			},
 		},
 	}
@@ -315,13 +618,6 @@ func (h *WatermarkHandler) BulkTextWatermarkHandler(w http.ResponseWriter, r *ht
 		return
 	}
 
-	userId := r.FormValue("userId")
-	if userId == "" {
-		h.logger.Println("BulkTextWatermarkHandler: No userId provided")
-		http.Error(w, "No userId provided", http.StatusBadRequest)
-		return
-	}
-
 	files := r.MultipartForm.File["images"]
 	if len(files) == 0 {
 		h.logger.Println("BulkTextWatermarkHandler: No files provided")
@@ -330,7 +626,7 @@ func (h *WatermarkHandler) BulkTextWatermarkHandler(w http.ResponseWriter, r *ht
 	}
 
 	var results []map[string]interface{}
-	for _, fileHeader := range files {
+	for i, fileHeader := range files {
 		uniqueId := uuid.New().String()
 
 		// Create a new context with the uniqueId
@@ -344,8 +640,9 @@ func (h *WatermarkHandler) BulkTextWatermarkHandler(w http.ResponseWriter, r *ht
 			},
 			Value: r.MultipartForm.Value,
 		}
-		// Add uniqueId to form values
+		// Add uniqueId and the 1-based position in the batch to form values
 		fileRequest.MultipartForm.Value["uniqueId"] = []string{uniqueId}
+		fileRequest.MultipartForm.Value["index"] = []string{strconv.Itoa(i + 1)}
 
 		// Create a ResponseRecorder to capture the response
 		rr := httptest.NewRecorder()
@@ -400,13 +697,6 @@ func (h *WatermarkHandler) BulkImageWatermarkHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	userId := r.FormValue("userId")
-	if userId == "" {
-		h.logger.Println("BulkImageWatermarkHandler: No userId provided")
-		http.Error(w, "No userId provided", http.StatusBadRequest)
-		return
-	}
-
 	files := r.MultipartForm.File["images"]
 	if len(files) == 0 {
 		h.logger.Println("BulkImageWatermarkHandler: No files provided")
@@ -414,14 +704,13 @@ func (h *WatermarkHandler) BulkImageWatermarkHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	// Get the watermark image once
-	watermarkImageFile, watermarkImageHeader, err := r.FormFile("watermarkImage")
-	if err != nil {
+	// Each image gets the same watermark image or asset
+	watermarkImageHeaders := r.MultipartForm.File["watermarkImage"]
+	if len(watermarkImageHeaders) == 0 && r.FormValue("watermarkAssetId") == "" {
 		h.logger.Println("BulkImageWatermarkHandler: No watermark image provided")
 		http.Error(w, "No watermark image provided", http.StatusBadRequest)
 		return
 	}
-	defer watermarkImageFile.Close()
 
 	var results []map[string]interface{}
 	for _, fileHeader := range files {
@@ -435,7 +724,7 @@ func (h *WatermarkHandler) BulkImageWatermarkHandler(w http.ResponseWriter, r *h
 		fileRequest.MultipartForm = &multipart.Form{
 			File: map[string][]*multipart.FileHeader{
 				"image":          {fileHeader},
-				"watermarkImage": {watermarkImageHeader},
+				"watermarkImage": watermarkImageHeaders,
 			},
 			Value: r.MultipartForm.Value,
 		}
@@ -483,28 +772,32 @@ func (h *WatermarkHandler) DownloadHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Extract user ID from the request context or token
-	userID := r.Context().Value("userID").(string)
-	if userID == "" {
-		http.Error(w, "User ID is required", http.StatusBadRequest)
+	user := auth.UserFrom(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// Fetch the user from the database
-	var user models.User
-	objectID, err := primitive.ObjectIDFromHex(userID)
-	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+	imagePath := r.URL.Query().Get("path")
+	if imagePath == "" {
+		http.Error(w, "Image path is required", http.StatusBadRequest)
 		return
 	}
-	err = h.DB.Collection("users").FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&user)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+
+	// Ensure the path is within the uploads directory and names a file
+	// before counting the download
+	fullPath := filepath.Join(h.uploadsDir, imagePath)
+	if rel, err := filepath.Rel(h.uploadsDir, fullPath); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if info, err := os.Stat(fullPath); err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
 
 	// Check subscription status and daily download limit
-	if user.SubscriptionStatus != "active" || user.SubscriptionExpiresAt.Before(time.Now()) {
+	if !user.IsPaid() {
 		today := time.Now().Truncate(24 * time.Hour)
 		if user.LastDownloadDate.Before(today) {
 			// Reset daily downloads if it's a new day
@@ -516,7 +809,7 @@ func (h *WatermarkHandler) DownloadHandler(w http.ResponseWriter, r *http.Reques
 		}
 		user.DailyDownloads++
 		user.LastDownloadDate = time.Now()
-		_, err = h.DB.Collection("users").UpdateOne(context.Background(), bson.M{"_id": objectID}, bson.M{
+		_, err := h.DB.Collection("users").UpdateOne(r.Context(), bson.M{"_id": user.ID}, bson.M{
 			"$set": bson.M{
 				"dailyDownloads":   user.DailyDownloads,
 				"lastDownloadDate": user.LastDownloadDate,
@@ -528,21 +821,139 @@ func (h *WatermarkHandler) DownloadHandler(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	imagePath := r.URL.Query().Get("path")
-	if imagePath == "" {
-		http.Error(w, "Image path is required", http.StatusBadRequest)
-		return
+	// Serve the file
+	http.ServeFile(w, r, fullPath)
+}
+
+// defaultFontSizes is the fontSize used for each size mode when the request
+// does not give one: points for absolute sizes, percentages otherwise.
+var defaultFontSizes = map[watermark.SizeMode]float64{
+	watermark.SizeAbsolute:  32,
+	watermark.SizeWidth:     5,
+	watermark.SizeShortSide: 8,
+	watermark.SizeFit:       50,
+}
+
+// parseTiling reads the tiling pattern and jitter settings. When no seed is
+// given a new one is drawn; it is returned with the result so the same
+// layout can be reproduced later.
+func parseTiling(r *http.Request) watermark.TilingOptions {
+	parse := func(key string) float64 {
+		v, err := strconv.ParseFloat(r.FormValue(key), 64)
+		if err != nil || v < 0 {
+			return 0
+		}
+		return v
 	}
 
-	// Ensure the path is within the uploads directory
-	fullPath := filepath.Join("./uploads", filepath.Clean(imagePath))
-	if !strings.HasPrefix(fullPath, "./uploads/") {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
-		return
+	seed, err := strconv.ParseInt(r.FormValue("seed"), 10, 64)
+	if err != nil {
+		seed = time.Now().UnixNano()
 	}
 
-	// Serve the file
-	http.ServeFile(w, r, fullPath)
+	return watermark.TilingOptions{
+		Pattern:        watermark.ParseTilePattern(r.FormValue("pattern")),
+		Seed:           seed,
+		PositionJitter: parse("positionJitter"),
+		AngleJitter:    parse("angleJitter"),
+		ScaleJitter:    parse("scaleJitter"),
+		OpacityJitter:  parse("opacityJitter"),
+	}
+}
+
+// templateData collects the per-image values available to text watermark
+// templates, including the signed-in user's email.
+func (h *WatermarkHandler) templateData(r *http.Request, filename string) watermark.TemplateData {
+	data := watermark.TemplateData{
+		Filename: filename,
+		Index:    1,
+		Now:      time.Now(),
+	}
+
+	if index, err := strconv.Atoi(r.FormValue("index")); err == nil && index > 0 {
+		data.Index = index
+	}
+
+	if user := auth.UserFrom(r.Context()); user != nil {
+		data.UserEmail = user.Email
+	}
+
+	return data
+}
+
+// footerFor decides the footer for an image watermark. Free and anonymous
+// users always get the default footer. Paid users get the footer from their
+// account settings, and may drop it for a single request with footer=false.
+func footerFor(user *models.User, r *http.Request) *watermark.FooterOptions {
+	footer := watermark.DefaultFooter()
+	if user == nil || !user.IsPaid() {
+		return footer
+	}
+
+	settings := user.Footer
+	if settings.Disabled {
+		return nil
+	}
+	if optOut, err := strconv.ParseBool(r.FormValue("footer")); err == nil && !optOut {
+		return nil
+	}
+
+	if settings.Text != "" {
+		footer.Text = settings.Text
+	}
+	if settings.Color != "" {
+		footer.Color = settings.Color
+	}
+	if settings.Position != "" {
+		footer.Position = settings.Position
+	}
+	if settings.FontSize > 0 {
+		footer.FontSize = settings.FontSize
+	}
+	if settings.Font != "" {
+		footer.Font = settings.Font
+	}
+	return footer
+}
+
+// errNoWatermarkImage is returned by watermarkImage when the request has
+// neither a watermark image nor an asset.
+var errNoWatermarkImage = errors.New("no watermark image provided")
+
+// watermarkImage returns the image for an image watermark: the uploaded
+// watermarkImage file or, when watermarkAssetId is given instead, the
+// organization asset, which the user must be a member of.
+func (h *WatermarkHandler) watermarkImage(r *http.Request) (io.ReadCloser, error) {
+	if id := r.FormValue("watermarkAssetId"); id != "" {
+		assetID, err := primitive.ObjectIDFromHex(id)
+		user := auth.UserFrom(r.Context())
+		if err != nil || user == nil || h.Orgs == nil {
+			return nil, org.ErrAssetNotFound
+		}
+		asset, err := h.Orgs.AssetFor(r.Context(), user.ID, assetID)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(asset.Data)), nil
+	}
+	file, _, err := r.FormFile("watermarkImage")
+	if err != nil {
+		return nil, errNoWatermarkImage
+	}
+	return file, nil
+}
+
+// writeWatermarkImageError answers a request that failed with err from
+// watermarkImage.
+func writeWatermarkImageError(w http.ResponseWriter, err error) {
+	switch err {
+	case errNoWatermarkImage:
+		http.Error(w, "No watermark image provided", http.StatusBadRequest)
+	case org.ErrAssetNotFound:
+		http.Error(w, "Watermark asset not found", http.StatusNotFound)
+	default:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
 }
 
 func parseColor(s string) (color.Color, error) {
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"watermark-generator/auth"
+	"watermark-generator/models"
+	"watermark-generator/watermark"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func testWatermarkHandler() *WatermarkHandler {
+	return &WatermarkHandler{
+		service: &watermark.Service{},
+		logger:  log.New(io.Discard, "", 0),
+	}
+}
+
+func TestCodeWatermarkHandlerQuietZone(t *testing.T) {
+	h := testWatermarkHandler()
+	for _, quietZone := range []string{"-1", "41", "4.5", "wide"} {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("image", "photo.png")
+		part.Write([]byte("not decoded before the options are checked"))
+		form.WriteField("content", "https://example.com")
+		form.WriteField("quietZone", quietZone)
+		form.Close()
+
+		r := httptest.NewRequest(http.MethodPost, "/api/watermark/code", &body)
+		r.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		h.CodeWatermarkHandler(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("quietZone %q: status %d, want 400", quietZone, w.Code)
+		}
+	}
+}
+
+func TestDownloadHandler(t *testing.T) {
+	h := testWatermarkHandler()
+	h.uploadsDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(h.uploadsDir, "result.png"), []byte("watermarked"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(h.uploadsDir, "batch"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	paid := &models.User{ID: primitive.NewObjectID(), SubscriptionStatus: "active", SubscriptionExpiresAt: time.Now().Add(time.Hour)}
+	// A free user's download is counted in the database, which the handler
+	// does not have here, so it must answer before counting
+	free := &models.User{ID: primitive.NewObjectID()}
+
+	tests := []struct {
+		user *models.User
+		path string
+		want int
+	}{
+		{paid, "result.png", http.StatusOK},
+		{paid, "./batch/../result.png", http.StatusOK},
+		{paid, "../result.png", http.StatusBadRequest},
+		{free, "../../etc/passwd", http.StatusBadRequest},
+		{free, "missing.png", http.StatusNotFound},
+		{free, "batch", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/download?path="+url.QueryEscape(tt.path), nil)
+		r = r.WithContext(auth.WithUser(r.Context(), tt.user))
+		w := httptest.NewRecorder()
+		h.DownloadHandler(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%q: status %d, want %d", tt.path, w.Code, tt.want)
+		}
+		if tt.want == http.StatusOK && w.Body.String() != "watermarked" {
+			t.Errorf("%q: body %q", tt.path, w.Body)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+// Package audit keeps an append-only log of security and billing events:
+// sign-ins, credential changes, subscription changes, staff actions and
+// deletions. Entries are only ever added; the store has no way to change
+// or remove them.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"watermark-generator/auth"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxUserAgentLength is the longest user agent stored; clients choose
+// the header, so it is cut short rather than stored whole.
+const maxUserAgentLength = 512
+
+// Change is the value of a field before and after an event.
+type Change struct {
+	From interface{} `bson:"from" json:"from"`
+	To   interface{} `bson:"to" json:"to"`
+}
+
+// Entry is one event. ActorID is the user who caused it and is zero for
+// events from outside, such as payment webhooks and failed sign-ins to
+// unknown addresses. ImpersonatorID is the staff member acting as
+// ActorID, if any.
+type Entry struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	ActorID        primitive.ObjectID `bson:"actorId,omitempty" json:"actorId"`
+	ImpersonatorID primitive.ObjectID `bson:"impersonatorId,omitempty" json:"impersonatorId"`
+	// Action names the event, such as "auth.login" or "apikey.create"
+	Action   string             `bson:"action" json:"action"`
+	TargetID primitive.ObjectID `bson:"targetId,omitempty" json:"targetId"`
+	// Changes holds the fields the event changed on its target
+	Changes map[string]Change `bson:"changes,omitempty" json:"changes,omitempty"`
+	// Details holds anything else worth keeping, such as a reason
+	Details   map[string]interface{} `bson:"details,omitempty" json:"details,omitempty"`
+	IP        string                 `bson:"ip,omitempty" json:"ip,omitempty"`
+	UserAgent string                 `bson:"userAgent,omitempty" json:"userAgent,omitempty"`
+	CreatedAt time.Time              `bson:"createdAt" json:"createdAt"`
+}
+
+// MarshalJSON leaves out the IDs an entry does not have, rather than
+// writing them as zeros.
+func (e Entry) MarshalJSON() ([]byte, error) {
+	type entry Entry
+	v := struct {
+		entry
+		ActorID        string `json:"actorId,omitempty"`
+		ImpersonatorID string `json:"impersonatorId,omitempty"`
+		TargetID       string `json:"targetId,omitempty"`
+	}{entry: entry(e)}
+	for _, id := range []struct {
+		dst *string
+		src primitive.ObjectID
+	}{{&v.ActorID, e.ActorID}, {&v.ImpersonatorID, e.ImpersonatorID}, {&v.TargetID, e.TargetID}} {
+		if !id.src.IsZero() {
+			*id.dst = id.src.Hex()
+		}
+	}
+	return json.Marshal(v)
+}
+
+// Diff returns the fields whose values differ between before and after,
+// or nil if none do. A field missing on one side changes from or to nil.
+func Diff(before, after map[string]interface{}) map[string]Change {
+	var changes map[string]Change
+	add := func(field string) {
+		if reflect.DeepEqual(before[field], after[field]) {
+			return
+		}
+		if changes == nil {
+			changes = map[string]Change{}
+		}
+		changes[field] = Change{From: before[field], To: after[field]}
+	}
+	for field := range before {
+		add(field)
+	}
+	for field := range after {
+		if _, ok := before[field]; !ok {
+			add(field)
+		}
+	}
+	return changes
+}
+
+// Query selects entries. Zero fields match everything. Action matches
+// exactly, or by prefix when it ends in ".*", so "auth.*" matches every
+// sign-in event. From is inclusive and To exclusive.
+type Query struct {
+	ActorID  primitive.ObjectID
+	TargetID primitive.ObjectID
+	Action   string
+	From     time.Time
+	To       time.Time
+	// Page and Limit page through Find; Each ignores them
+	Page  int
+	Limit int
+}
+
+func (q Query) filter() bson.M {
+	filter := bson.M{}
+	if !q.ActorID.IsZero() {
+		filter["actorId"] = q.ActorID
+	}
+	if !q.TargetID.IsZero() {
+		filter["targetId"] = q.TargetID
+	}
+	if prefix, ok := strings.CutSuffix(q.Action, ".*"); ok {
+		filter["action"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix+".")}
+	} else if q.Action != "" {
+		filter["action"] = q.Action
+	}
+	createdAt := bson.M{}
+	if !q.From.IsZero() {
+		createdAt["$gte"] = q.From
+	}
+	if !q.To.IsZero() {
+		createdAt["$lt"] = q.To
+	}
+	if len(createdAt) > 0 {
+		filter["createdAt"] = createdAt
+	}
+	return filter
+}
+
+// Store persists entries. It can only add and read them.
+type Store interface {
+	Append(ctx context.Context, e *Entry) error
+	// Find returns a page of the entries matching q, newest first.
+	Find(ctx context.Context, q Query) ([]Entry, error)
+	Count(ctx context.Context, q Query) (int64, error)
+	// Each calls fn with every entry matching q, oldest first, and stops
+	// at the first error.
+	Each(ctx context.Context, q Query, fn func(*Entry) error) error
+}
+
+// MongoStore is a Store backed by the audit_log collection.
+type MongoStore struct {
+	DB *mongo.Database
+}
+
+func (s MongoStore) collection() *mongo.Collection {
+	return s.DB.Collection("audit_log")
+}
+
+// EnsureIndexes creates the indexes for queries by time, actor, action and
+// target.
+func (s MongoStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "actorId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "action", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "targetId", Value: 1}, {Key: "createdAt", Value: -1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create audit log indexes: %v", err)
+	}
+	return nil
+}
+
+func (s MongoStore) Append(ctx context.Context, e *Entry) error {
+	if _, err := s.collection().InsertOne(ctx, e); err != nil {
+		return fmt.Errorf("failed to write audit entry: %v", err)
+	}
+	return nil
+}
+
+func (s MongoStore) Find(ctx context.Context, q Query) ([]Entry, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}})
+	if q.Limit > 0 {
+		opts.SetLimit(int64(q.Limit))
+		if q.Page > 1 {
+			opts.SetSkip(int64((q.Page - 1) * q.Limit))
+		}
+	}
+	cursor, err := s.collection().Find(ctx, q.filter(), opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch audit entries: %v", err)
+	}
+	entries := []Entry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, fmt.Errorf("failed to decode audit entries: %v", err)
+	}
+	return entries, nil
+}
+
+func (s MongoStore) Count(ctx context.Context, q Query) (int64, error) {
+	n, err := s.collection().CountDocuments(ctx, q.filter())
+	if err != nil {
+		return 0, fmt.Errorf("failed to count audit entries: %v", err)
+	}
+	return n, nil
+}
+
+func (s MongoStore) Each(ctx context.Context, q Query, fn func(*Entry) error) error {
+	cursor, err := s.collection().Find(ctx, q.filter(), options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return fmt.Errorf("failed to fetch audit entries: %v", err)
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var e Entry
+		if err := cursor.Decode(&e); err != nil {
+			return fmt.Errorf("failed to decode audit entry: %v", err)
+		}
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("failed to read audit entries: %v", err)
+	}
+	return nil
+}
+
+// Log records entries in a Store.
+type Log struct {
+	Store Store
+	now   func() time.Time
+}
+
+func NewLog(store Store) *Log {
+	return &Log{Store: store, now: time.Now}
+}
+
+// Record adds e to the log with a new ID and the current time.
+func (l *Log) Record(ctx context.Context, e *Entry) error {
+	e.ID = primitive.NewObjectID()
+	e.CreatedAt = l.now()
+	return l.Store.Append(ctx, e)
+}
+
+// Request records e as caused by the request: the signed-in user is the
+// actor unless e already names one, and the staff member impersonating
+// them, the client address and the user agent are filled in.
+func (l *Log) Request(r *http.Request, e Entry) error {
+	if user := auth.UserFrom(r.Context()); user != nil && e.ActorID.IsZero() {
+		e.ActorID = user.ID
+	}
+	e.ImpersonatorID = auth.ActorFrom(r.Context())
+	e.IP = auth.ClientIP(r)
+	e.UserAgent = r.UserAgent()
+	if len(e.UserAgent) > maxUserAgentLength {
+		e.UserAgent = e.UserAgent[:maxUserAgentLength]
+	}
+	return l.Record(r.Context(), &e)
+}
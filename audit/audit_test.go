@@ -0,0 +1,155 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"watermark-generator/auth"
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryStore is a Store for tests. It only supports queries by actor.
+type memoryStore struct {
+	entries []Entry
+}
+
+func (m *memoryStore) Append(_ context.Context, e *Entry) error {
+	m.entries = append(m.entries, *e)
+	return nil
+}
+
+func (m *memoryStore) Find(_ context.Context, q Query) ([]Entry, error) {
+	entries := []Entry{}
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		if q.ActorID.IsZero() || m.entries[i].ActorID == q.ActorID {
+			entries = append(entries, m.entries[i])
+		}
+	}
+	return entries, nil
+}
+
+func (m *memoryStore) Count(ctx context.Context, q Query) (int64, error) {
+	entries, _ := m.Find(ctx, q)
+	return int64(len(entries)), nil
+}
+
+func (m *memoryStore) Each(_ context.Context, q Query, fn func(*Entry) error) error {
+	for i := range m.entries {
+		if q.ActorID.IsZero() || m.entries[i].ActorID == q.ActorID {
+			if err := fn(&m.entries[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestRequestFillsInClient(t *testing.T) {
+	store := &memoryStore{}
+	l := NewLog(store)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	user := &models.User{ID: primitive.NewObjectID()}
+	r := httptest.NewRequest("POST", "/api/keys", nil)
+	r.RemoteAddr = "203.0.113.7:4321"
+	r.Header.Set("User-Agent", "curl/8.0 "+strings.Repeat("x", 1000))
+	r = r.WithContext(auth.WithUser(r.Context(), user))
+	if err := l.Request(r, Entry{Action: "apikey.create", Details: map[string]interface{}{"prefix": "wmk_1a2b3c4d"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	e := store.entries[0]
+	if e.ID.IsZero() || !e.CreatedAt.Equal(now) {
+		t.Errorf("entry %s at %v, want an ID and %v", e.ID.Hex(), e.CreatedAt, now)
+	}
+	if e.ActorID != user.ID || !e.ImpersonatorID.IsZero() {
+		t.Errorf("actor %s impersonator %s, want the signed-in user alone", e.ActorID.Hex(), e.ImpersonatorID.Hex())
+	}
+	if e.IP != "203.0.113.7" {
+		t.Errorf("ip = %q", e.IP)
+	}
+	if len(e.UserAgent) != maxUserAgentLength || !strings.HasPrefix(e.UserAgent, "curl/8.0") {
+		t.Errorf("user agent of %d bytes, want it cut to %d", len(e.UserAgent), maxUserAgentLength)
+	}
+
+	// An explicit actor wins, for sign-ins before there is a user
+	signedOut := httptest.NewRequest("POST", "/api/signin", nil)
+	actor := primitive.NewObjectID()
+	if err := l.Request(signedOut, Entry{Action: "auth.login", ActorID: actor}); err != nil {
+		t.Fatal(err)
+	}
+	if store.entries[1].ActorID != actor {
+		t.Errorf("actor = %s, want %s", store.entries[1].ActorID.Hex(), actor.Hex())
+	}
+}
+
+func TestDiff(t *testing.T) {
+	changes := Diff(
+		map[string]interface{}{"role": "user", "disabled": false, "status": "active"},
+		map[string]interface{}{"role": "admin", "disabled": false, "seats": int64(3)},
+	)
+	want := map[string]Change{
+		"role":   {From: "user", To: "admin"},
+		"status": {From: "active", To: nil},
+		"seats":  {From: nil, To: int64(3)},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("changes = %v, want %v", changes, want)
+	}
+	for field, c := range want {
+		if changes[field] != c {
+			t.Errorf("%s: %v, want %v", field, changes[field], c)
+		}
+	}
+	if changes := Diff(map[string]interface{}{"role": "user"}, map[string]interface{}{"role": "user"}); changes != nil {
+		t.Errorf("no change gave %v", changes)
+	}
+}
+
+func TestQueryFilter(t *testing.T) {
+	actor := primitive.NewObjectID()
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	filter := Query{ActorID: actor, Action: "auth.*", From: from}.filter()
+	if filter["actorId"] != actor {
+		t.Errorf("actorId = %v", filter["actorId"])
+	}
+	if got := filter["action"].(primitive.Regex).Pattern; got != `^auth\.` {
+		t.Errorf("action pattern = %q", got)
+	}
+	if got := filter["createdAt"].(bson.M); got["$gte"] != from || got["$lt"] != nil {
+		t.Errorf("createdAt = %v", got)
+	}
+
+	if filter := (Query{Action: "user.role"}).filter(); filter["action"] != "user.role" || len(filter) != 1 {
+		t.Errorf("exact action filter = %v", filter)
+	}
+	if filter := (Query{}).filter(); len(filter) != 0 {
+		t.Errorf("empty query filter = %v", filter)
+	}
+}
+
+func TestEntryJSONLeavesOutMissingIDs(t *testing.T) {
+	target := primitive.NewObjectID()
+	b, err := json.Marshal(Entry{Action: "subscription.activate", TargetID: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got["actorId"]; ok {
+		t.Errorf("actorId in %s", b)
+	}
+	if got["targetId"] != target.Hex() || got["action"] != "subscription.activate" {
+		t.Errorf("entry = %s", b)
+	}
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// AccountStore finds and updates users for the email verification and
+// password reset flows.
+type AccountStore interface {
+	UserStore
+	// UserByEmail returns the user with email, or ErrUserNotFound.
+	UserByEmail(ctx context.Context, email string) (*models.User, error)
+	MarkEmailVerified(ctx context.Context, id primitive.ObjectID) error
+	// ResetPassword stores a new password hash, marks the address as
+	// verified and revokes the access tokens issued before at.
+	ResetPassword(ctx context.Context, id primitive.ObjectID, hash string, at time.Time) error
+}
+
+func (s MongoUsers) UserByEmail(ctx context.Context, email string) (*models.User, error) {
+	var user models.User
+	err := s.DB.Collection("users").FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch user: %v", err)
+	}
+	return &user, nil
+}
+
+func (s MongoUsers) MarkEmailVerified(ctx context.Context, id primitive.ObjectID) error {
+	if _, err := s.DB.Collection("users").UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$set": bson.M{"emailVerified": true},
+	}); err != nil {
+		return fmt.Errorf("failed to update user: %v", err)
+	}
+	return nil
+}
+
+func (s MongoUsers) ResetPassword(ctx context.Context, id primitive.ObjectID, hash string, at time.Time) error {
+	if _, err := s.DB.Collection("users").UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$set": bson.M{
+			"password":        hash,
+			"emailVerified":   true,
+			"tokensRevokedAt": at,
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to update user: %v", err)
+	}
+	return nil
+}
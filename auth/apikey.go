@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Scopes an API key can be granted. A key only works on routes that accept
+// one of its scopes. Keys created with the retired "history:read" scope
+// keep it in their record, but no route accepts it.
+const (
+	ScopeWatermarkWrite = "watermark:write"
+)
+
+// Scopes lists the valid API key scopes.
+var Scopes = []string{ScopeWatermarkWrite}
+
+const (
+	// apiKeyMarker starts every key so leaked keys are easy to spot, for
+	// example by secret scanners.
+	apiKeyMarker = "wmk_"
+	// apiKeyPrefixBytes is the random part of the visible prefix.
+	apiKeyPrefixBytes = 4
+	// MaxAPIKeys is how many keys a user can have.
+	MaxAPIKeys = 20
+	// MaxAPIKeyNameLength is the longest key name accepted.
+	MaxAPIKeyNameLength = 100
+)
+
+var (
+	// ErrInvalidAPIKey is returned for unknown or malformed keys.
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	// ErrAPIKeyNotFound is returned when revoking a key the user does not
+	// have.
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	// ErrTooManyAPIKeys is returned when a user with MaxAPIKeys keys
+	// creates another.
+	ErrTooManyAPIKeys = fmt.Errorf("you can have at most %d API keys", MaxAPIKeys)
+)
+
+// APIKey is a long-lived credential for scripts and CI. The key is shown
+// once at creation; only its SHA-256 and the prefix that identifies it in
+// listings are stored.
+type APIKey struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID primitive.ObjectID `bson:"userId" json:"-"`
+	Name   string             `bson:"name" json:"name"`
+	// Prefix is the start of the key, such as "wmk_1a2b3c4d"
+	Prefix     string     `bson:"prefix" json:"prefix"`
+	KeyHash    string     `bson:"keyHash" json:"-"`
+	Scopes     []string   `bson:"scopes" json:"scopes"`
+	CreatedAt  time.Time  `bson:"createdAt" json:"createdAt"`
+	LastUsedAt *time.Time `bson:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty"`
+	LastUsedIP string     `bson:"lastUsedIp,omitempty" json:"lastUsedIp,omitempty"`
+	// UseCount is the number of requests authenticated with the key
+	UseCount int64 `bson:"useCount" json:"useCount"`
+}
+
+// HasScope reports whether the key was granted scope.
+func (k *APIKey) HasScope(scope string) bool {
+	return contains(k.Scopes, scope)
+}
+
+// APIKeyStore persists API keys.
+type APIKeyStore interface {
+	CreateAPIKey(ctx context.Context, k *APIKey) error
+	APIKeyByHash(ctx context.Context, hash string) (*APIKey, error)
+	// APIKeysByUser returns the user's keys, newest first.
+	APIKeysByUser(ctx context.Context, userID primitive.ObjectID) ([]APIKey, error)
+	CountAPIKeys(ctx context.Context, userID primitive.ObjectID) (int64, error)
+	// DeleteAPIKey deletes the user's key with id, or returns
+	// ErrAPIKeyNotFound.
+	DeleteAPIKey(ctx context.Context, userID, id primitive.ObjectID) error
+	// DeleteUserAPIKeys deletes every key of the user and returns how many
+	// there were.
+	DeleteUserAPIKeys(ctx context.Context, userID primitive.ObjectID) (int64, error)
+	// RecordAPIKeyUse counts a request made with the key.
+	RecordAPIKeyUse(ctx context.Context, id primitive.ObjectID, at time.Time, ip string) error
+}
+
+// MongoAPIKeys is an APIKeyStore backed by the api_keys collection.
+type MongoAPIKeys struct {
+	DB *mongo.Database
+}
+
+func (s MongoAPIKeys) collection() *mongo.Collection {
+	return s.DB.Collection("api_keys")
+}
+
+// EnsureIndexes creates the lookup indexes.
+func (s MongoAPIKeys) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "keyHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userId", Value: 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create API key indexes: %v", err)
+	}
+	return nil
+}
+
+func (s MongoAPIKeys) CreateAPIKey(ctx context.Context, k *APIKey) error {
+	if _, err := s.collection().InsertOne(ctx, k); err != nil {
+		return fmt.Errorf("failed to store API key: %v", err)
+	}
+	return nil
+}
+
+func (s MongoAPIKeys) APIKeyByHash(ctx context.Context, hash string) (*APIKey, error) {
+	var k APIKey
+	err := s.collection().FindOne(ctx, bson.M{"keyHash": hash}).Decode(&k)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch API key: %v", err)
+	}
+	return &k, nil
+}
+
+func (s MongoAPIKeys) APIKeysByUser(ctx context.Context, userID primitive.ObjectID) ([]APIKey, error) {
+	cursor, err := s.collection().Find(ctx, bson.M{"userId": userID}, options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch API keys: %v", err)
+	}
+	keys := []APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, fmt.Errorf("failed to decode API keys: %v", err)
+	}
+	return keys, nil
+}
+
+func (s MongoAPIKeys) CountAPIKeys(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	n, err := s.collection().CountDocuments(ctx, bson.M{"userId": userID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count API keys: %v", err)
+	}
+	return n, nil
+}
+
+func (s MongoAPIKeys) DeleteAPIKey(ctx context.Context, userID, id primitive.ObjectID) error {
+	result, err := s.collection().DeleteOne(ctx, bson.M{"_id": id, "userId": userID})
+	if err != nil {
+		return fmt.Errorf("failed to delete API key: %v", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (s MongoAPIKeys) DeleteUserAPIKeys(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	result, err := s.collection().DeleteMany(ctx, bson.M{"userId": userID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete API keys: %v", err)
+	}
+	return result.DeletedCount, nil
+}
+
+func (s MongoAPIKeys) RecordAPIKeyUse(ctx context.Context, id primitive.ObjectID, at time.Time, ip string) error {
+	if _, err := s.collection().UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$set": bson.M{"lastUsedAt": at, "lastUsedIp": ip},
+		"$inc": bson.M{"useCount": 1},
+	}); err != nil {
+		return fmt.Errorf("failed to record API key use: %v", err)
+	}
+	return nil
+}
+
+// APIKeys creates and checks API keys.
+type APIKeys struct {
+	Store APIKeyStore
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewAPIKeys returns API keys kept in store.
+func NewAPIKeys(store APIKeyStore) *APIKeys {
+	return &APIKeys{Store: store, now: time.Now}
+}
+
+// CheckAPIKeyRequest returns an error, suitable for showing to the user,
+// when name or scopes are not acceptable for a new key.
+func CheckAPIKeyRequest(name string, scopes []string) error {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > MaxAPIKeyNameLength {
+		return fmt.Errorf("name must be 1 to %d characters", MaxAPIKeyNameLength)
+	}
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !contains(Scopes, scope) {
+			return fmt.Errorf("scopes must be among %v", Scopes)
+		}
+	}
+	return nil
+}
+
+// Create returns a new key for the user and its record. Keys look like
+// "wmk_1a2b3c4d_<43 characters>"; the part before the second underscore is
+// the prefix shown in listings. Callers check the request with
+// CheckAPIKeyRequest first.
+func (a *APIKeys) Create(ctx context.Context, userID primitive.ObjectID, name string, scopes []string) (string, *APIKey, error) {
+	if err := CheckAPIKeyRequest(name, scopes); err != nil {
+		return "", nil, err
+	}
+	n, err := a.Store.CountAPIKeys(ctx, userID)
+	if err != nil {
+		return "", nil, err
+	}
+	if n >= MaxAPIKeys {
+		return "", nil, ErrTooManyAPIKeys
+	}
+
+	b := make([]byte, apiKeyPrefixBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	secret, err := RandomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	prefix := apiKeyMarker + hex.EncodeToString(b)
+	key := prefix + "_" + secret
+	record := &APIKey{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Name:      strings.TrimSpace(name),
+		Prefix:    prefix,
+		KeyHash:   HashToken(key),
+		Scopes:    dedupe(scopes),
+		CreatedAt: a.now(),
+	}
+	if err := a.Store.CreateAPIKey(ctx, record); err != nil {
+		return "", nil, err
+	}
+	return key, record, nil
+}
+
+// Authenticate returns the record of key, or ErrInvalidAPIKey.
+func (a *APIKeys) Authenticate(ctx context.Context, key string) (*APIKey, error) {
+	if !strings.HasPrefix(key, apiKeyMarker) {
+		return nil, ErrInvalidAPIKey
+	}
+	return a.Store.APIKeyByHash(ctx, HashToken(key))
+}
+
+// RevokeAll revokes every key of the user, as after a password reset, and
+// returns how many were revoked.
+func (a *APIKeys) RevokeAll(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	return a.Store.DeleteUserAPIKeys(ctx, userID)
+}
+
+// RecordUse counts a request made with the key.
+func (a *APIKeys) RecordUse(ctx context.Context, k *APIKey, ip string) error {
+	return a.Store.RecordAPIKeyUse(ctx, k.ID, a.now(), ip)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func dedupe(list []string) []string {
+	out := []string{}
+	for _, v := range list {
+		if !contains(out, v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
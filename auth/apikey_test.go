@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryAPIKeys is an APIKeyStore for tests.
+type memoryAPIKeys struct {
+	mu   sync.Mutex
+	keys []*APIKey
+}
+
+func (m *memoryAPIKeys) CreateAPIKey(_ context.Context, k *APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	copied := *k
+	m.keys = append(m.keys, &copied)
+	return nil
+}
+
+func (m *memoryAPIKeys) APIKeyByHash(_ context.Context, hash string) (*APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range m.keys {
+		if k.KeyHash == hash {
+			copied := *k
+			return &copied, nil
+		}
+	}
+	return nil, ErrInvalidAPIKey
+}
+
+func (m *memoryAPIKeys) APIKeysByUser(_ context.Context, userID primitive.ObjectID) ([]APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := []APIKey{}
+	for i := len(m.keys) - 1; i >= 0; i-- {
+		if m.keys[i].UserID == userID {
+			keys = append(keys, *m.keys[i])
+		}
+	}
+	return keys, nil
+}
+
+func (m *memoryAPIKeys) CountAPIKeys(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	keys, _ := m.APIKeysByUser(ctx, userID)
+	return int64(len(keys)), nil
+}
+
+func (m *memoryAPIKeys) DeleteAPIKey(_ context.Context, userID, id primitive.ObjectID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, k := range m.keys {
+		if k.ID == id && k.UserID == userID {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			return nil
+		}
+	}
+	return ErrAPIKeyNotFound
+}
+
+func (m *memoryAPIKeys) DeleteUserAPIKeys(_ context.Context, userID primitive.ObjectID) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.keys[:0]
+	for _, k := range m.keys {
+		if k.UserID != userID {
+			kept = append(kept, k)
+		}
+	}
+	n := int64(len(m.keys) - len(kept))
+	m.keys = kept
+	return n, nil
+}
+
+func (m *memoryAPIKeys) RecordAPIKeyUse(_ context.Context, id primitive.ObjectID, at time.Time, ip string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range m.keys {
+		if k.ID == id {
+			k.LastUsedAt = &at
+			k.LastUsedIP = ip
+			k.UseCount++
+		}
+	}
+	return nil
+}
+
+func TestAPIKeyCreate(t *testing.T) {
+	store := &memoryAPIKeys{}
+	keys := NewAPIKeys(store)
+	userID := primitive.NewObjectID()
+
+	key, record, err := keys.Create(context.Background(), userID, " ci ", []string{ScopeWatermarkWrite, ScopeWatermarkWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, record.Prefix+"_") || !strings.HasPrefix(record.Prefix, "wmk_") || len(record.Prefix) != 12 {
+		t.Errorf("key %q with prefix %q", key, record.Prefix)
+	}
+	if strings.Contains(store.keys[0].KeyHash, key) || store.keys[0].KeyHash != HashToken(key) {
+		t.Error("key not stored as its hash")
+	}
+	if record.Name != "ci" || len(record.Scopes) != 1 {
+		t.Errorf("record = %+v", record)
+	}
+
+	got, err := keys.Authenticate(context.Background(), key)
+	if err != nil || got.ID != record.ID {
+		t.Errorf("Authenticate = %v, %v", got, err)
+	}
+	for _, bad := range []string{"", "wmk_", key + "x", strings.TrimPrefix(key, "wmk_")} {
+		if _, err := keys.Authenticate(context.Background(), bad); err != ErrInvalidAPIKey {
+			t.Errorf("Authenticate(%q) err = %v", bad, err)
+		}
+	}
+}
+
+func TestCheckAPIKeyRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		ok     bool
+	}{
+		{"ci", []string{ScopeWatermarkWrite, ScopeWatermarkWrite}, true},
+		{"ci", []string{"history:read"}, false},
+		{"", []string{ScopeWatermarkWrite}, false},
+		{"   ", []string{ScopeWatermarkWrite}, false},
+		{strings.Repeat("n", MaxAPIKeyNameLength+1), []string{ScopeWatermarkWrite}, false},
+		{"ci", nil, false},
+		{"ci", []string{"admin"}, false},
+	}
+	for _, tt := range tests {
+		if err := CheckAPIKeyRequest(tt.name, tt.scopes); (err == nil) != tt.ok {
+			t.Errorf("CheckAPIKeyRequest(%q, %v) = %v", tt.name, tt.scopes, err)
+		}
+	}
+}
+
+func TestAPIKeyLimit(t *testing.T) {
+	keys := NewAPIKeys(&memoryAPIKeys{})
+	userID := primitive.NewObjectID()
+	for i := 0; i < MaxAPIKeys; i++ {
+		if _, _, err := keys.Create(context.Background(), userID, "key", []string{ScopeWatermarkWrite}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := keys.Create(context.Background(), userID, "key", []string{ScopeWatermarkWrite}); err != ErrTooManyAPIKeys {
+		t.Errorf("key over the limit: err = %v", err)
+	}
+	// The limit is per user
+	if _, _, err := keys.Create(context.Background(), primitive.NewObjectID(), "key", []string{ScopeWatermarkWrite}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequireScopeWithAPIKey(t *testing.T) {
+	tokens := NewTokenIssuer([]byte("secret"), time.Hour)
+	store := &memoryAPIKeys{}
+	keys := NewAPIKeys(store)
+	user := &models.User{ID: primitive.NewObjectID(), Email: "ci@example.com"}
+	disabled := &models.User{ID: primitive.NewObjectID(), Email: "gone@example.com", Disabled: true}
+	mw := NewMiddleware(tokens, memoryUsers{user.ID: user, disabled.ID: disabled}, keys)
+
+	writeKey, writeRecord, _ := keys.Create(context.Background(), user.ID, "ci", []string{ScopeWatermarkWrite})
+	// A key from before the history:read scope was retired
+	readKey, readRecord, _ := keys.Create(context.Background(), user.ID, "reports", []string{ScopeWatermarkWrite})
+	for _, k := range store.keys {
+		if k.ID == readRecord.ID {
+			k.Scopes = []string{"history:read"}
+		}
+	}
+	disabledKey, _, _ := keys.Create(context.Background(), disabled.ID, "old", []string{ScopeWatermarkWrite})
+
+	var gotKey *APIKey
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		gotKey = APIKeyFrom(r.Context())
+		if UserFrom(r.Context()) != user {
+			t.Error("handler did not get the key's user")
+		}
+	}
+	scoped := mw.RequireScope(ok, ScopeWatermarkWrite)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		header  string
+		value   string
+		want    int
+	}{
+		{"authorization header", scoped, "Authorization", "ApiKey " + writeKey, http.StatusOK},
+		{"x-api-key header", scoped, "X-API-Key", writeKey, http.StatusOK},
+		{"key as bearer token", scoped, "Authorization", "Bearer " + writeKey, http.StatusUnauthorized},
+		{"unknown key", scoped, "X-API-Key", "wmk_00000000_nope", http.StatusUnauthorized},
+		{"missing scope", scoped, "X-API-Key", readKey, http.StatusForbidden},
+		{"disabled user", scoped, "X-API-Key", disabledKey, http.StatusUnauthorized},
+		{"route without scope", mw.Require(ok), "X-API-Key", writeKey, http.StatusUnauthorized},
+		{"admin route", mw.RequireRole(ok, models.RoleUser), "X-API-Key", writeKey, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		gotKey = nil
+		r := httptest.NewRequest(http.MethodPost, "/api/watermark/text", nil)
+		r.Header.Set(tt.header, tt.value)
+		w := httptest.NewRecorder()
+		tt.handler(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if tt.want == http.StatusOK && (gotKey == nil || gotKey.ID != writeRecord.ID) {
+			t.Errorf("%s: handler got key %v", tt.name, gotKey)
+		}
+	}
+
+	used, _ := store.APIKeyByHash(context.Background(), HashToken(writeKey))
+	if used.UseCount != 2 || used.LastUsedAt == nil || used.LastUsedIP != "192.0.2.1" {
+		t.Errorf("usage = %d at %v from %q, want 2 uses from 192.0.2.1", used.UseCount, used.LastUsedAt, used.LastUsedIP)
+	}
+
+	// Access tokens still work on scoped routes
+	token, _ := tokens.Issue(user.ID)
+	r := httptest.NewRequest(http.MethodPost, "/api/watermark/text", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	scoped(w, r)
+	if w.Code != http.StatusOK || gotKey != nil {
+		t.Errorf("access token on scoped route: status %d, key %v", w.Code, gotKey)
+	}
+}
@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrUserNotFound is returned by a UserStore for unknown IDs.
+var ErrUserNotFound = errors.New("user not found")
+
+// UserStore looks up the user a token was issued to.
+type UserStore interface {
+	UserByID(ctx context.Context, id primitive.ObjectID) (*models.User, error)
+}
+
+// MongoUsers is a UserStore backed by the users collection.
+type MongoUsers struct {
+	DB *mongo.Database
+}
+
+func (s MongoUsers) UserByID(ctx context.Context, id primitive.ObjectID) (*models.User, error) {
+	var user models.User
+	err := s.DB.Collection("users").FindOne(ctx, bson.M{"_id": id}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch user: %v", err)
+	}
+	return &user, nil
+}
+
+type contextKey struct{}
+
+type actorKey struct{}
+
+type apiKeyKey struct{}
+
+// WithUser returns a copy of ctx carrying user.
+func WithUser(ctx context.Context, user *models.User) context.Context {
+	return context.WithValue(ctx, contextKey{}, user)
+}
+
+// ActorFrom returns the ID of the staff member impersonating the user, or
+// the zero ID when the request is not impersonated.
+func ActorFrom(ctx context.Context) primitive.ObjectID {
+	id, _ := ctx.Value(actorKey{}).(primitive.ObjectID)
+	return id
+}
+
+// APIKeyFrom returns the API key the request was authenticated with, or
+// nil for requests with an access token.
+func APIKeyFrom(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyKey{}).(*APIKey)
+	return key
+}
+
+// UserFrom returns the user stored by the middleware, or nil when the
+// request was not authenticated.
+func UserFrom(ctx context.Context) *models.User {
+	user, _ := ctx.Value(contextKey{}).(*models.User)
+	return user
+}
+
+// Middleware authenticates requests by their bearer token or, on routes
+// that accept them, an API key.
+type Middleware struct {
+	Tokens *TokenIssuer
+	Users  UserStore
+	// Keys checks API keys; nil disables them
+	Keys *APIKeys
+}
+
+// NewMiddleware returns a middleware verifying tokens with tokens and API
+// keys with keys, and loading their users from users.
+func NewMiddleware(tokens *TokenIssuer, users UserStore, keys *APIKeys) *Middleware {
+	return &Middleware{Tokens: tokens, Users: users, Keys: keys}
+}
+
+// Require rejects requests without a valid token for an existing user with
+// 401 and otherwise calls next with the user in the request context. API
+// keys are not accepted.
+func (m *Middleware) Require(next http.HandlerFunc) http.HandlerFunc {
+	return m.require(next, "")
+}
+
+// RequireScope is Require that also accepts API keys granted scope, sent
+// as "Authorization: ApiKey <key>" or in the X-API-Key header. Keys
+// without the scope get 403.
+func (m *Middleware) RequireScope(next http.HandlerFunc, scope string) http.HandlerFunc {
+	return m.require(next, scope)
+}
+
+func (m *Middleware) require(next http.HandlerFunc, scope string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key, ok := apiKeyFrom(r); ok {
+			m.requireKey(w, r, next, key, scope)
+			return
+		}
+		user, claims, err := m.authenticate(r)
+		if err != nil {
+			log.Printf("Require: Rejected request for %s: %v", r.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ctx := WithUser(r.Context(), user)
+		if claims.Actor != nil {
+			log.Printf("Require: %s acting as user %s on %s", claims.Actor.Subject, user.ID.Hex(), r.URL.Path)
+			actor, _ := primitive.ObjectIDFromHex(claims.Actor.Subject)
+			ctx = context.WithValue(ctx, actorKey{}, actor)
+		}
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// RequireRole is Require for users with one of roles; other users get 403.
+// Impersonation tokens are refused so staff cannot gain the rights of the
+// account they act as.
+func (m *Middleware) RequireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return m.Require(func(w http.ResponseWriter, r *http.Request) {
+		user := UserFrom(r.Context())
+		if !user.HasRole(roles...) || !ActorFrom(r.Context()).IsZero() {
+			log.Printf("RequireRole: User %s with role %s denied %s", user.ID.Hex(), user.RoleName(), r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// apiKeyFrom returns the API key a request carries, if any.
+func apiKeyFrom(r *http.Request) (string, bool) {
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey "); ok {
+		return strings.TrimSpace(key), true
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return strings.TrimSpace(key), true
+	}
+	return "", false
+}
+
+func (m *Middleware) requireKey(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, rawKey, scope string) {
+	reject := func(status int, reason string) {
+		log.Printf("RequireScope: Rejected API key request for %s: %s", r.URL.Path, reason)
+		w.Header().Set("WWW-Authenticate", "ApiKey")
+		http.Error(w, http.StatusText(status), status)
+	}
+	if scope == "" {
+		reject(http.StatusUnauthorized, "route does not accept API keys")
+		return
+	}
+	if m.Keys == nil {
+		reject(http.StatusUnauthorized, "API keys are not enabled")
+		return
+	}
+	key, err := m.Keys.Authenticate(r.Context(), rawKey)
+	if err != nil {
+		reject(http.StatusUnauthorized, err.Error())
+		return
+	}
+	user, err := m.Users.UserByID(r.Context(), key.UserID)
+	if err != nil {
+		reject(http.StatusUnauthorized, err.Error())
+		return
+	}
+	if user.Disabled {
+		reject(http.StatusUnauthorized, "user disabled")
+		return
+	}
+	if !key.HasScope(scope) {
+		reject(http.StatusForbidden, fmt.Sprintf("key %s lacks scope %s", key.Prefix, scope))
+		return
+	}
+	if err := m.Keys.RecordUse(r.Context(), key, ClientIP(r)); err != nil {
+		log.Printf("RequireScope: %v", err)
+	}
+	ctx := context.WithValue(WithUser(r.Context(), user), apiKeyKey{}, key)
+	next(w, r.WithContext(ctx))
+}
+
+func (m *Middleware) authenticate(r *http.Request) (*models.User, *Claims, error) {
+	header := r.Header.Get("Authorization")
+	tokenString, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || tokenString == "" {
+		return nil, nil, errors.New("no bearer token")
+	}
+	claims, err := m.Tokens.Parse(tokenString)
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := claims.UserID()
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := m.Users.UserByID(r.Context(), id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Disabled {
+		return nil, nil, errors.New("user disabled")
+	}
+	if revoked(claims, user) {
+		return nil, nil, errors.New("token revoked")
+	}
+	return user, claims, nil
+}
+
+// ClientIP returns the address of the client. Behind a reverse proxy, set
+// TRUST_PROXY_HEADERS=true to use the last X-Forwarded-For entry, the one
+// added by the proxy itself.
+func ClientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			parts := strings.Split(forwarded, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// revoked reports whether the token was issued before the user logged out
+// of all devices. Token times have second precision, so tokens from the
+// same second as the logout stay valid.
+func revoked(claims *Claims, user *models.User) bool {
+	if user.TokensRevokedAt.IsZero() {
+		return false
+	}
+	return claims.IssuedAt == nil || claims.IssuedAt.Time.Before(user.TokensRevokedAt.Truncate(time.Second))
+}
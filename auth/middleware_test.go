@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryUsers is a UserStore for tests.
+type memoryUsers map[primitive.ObjectID]*models.User
+
+func (m memoryUsers) UserByID(_ context.Context, id primitive.ObjectID) (*models.User, error) {
+	if user, ok := m[id]; ok {
+		return user, nil
+	}
+	return nil, ErrUserNotFound
+}
+
+func TestRequire(t *testing.T) {
+	tokens := NewTokenIssuer([]byte("secret"), time.Hour)
+	user := &models.User{ID: primitive.NewObjectID(), Email: "a@example.com"}
+	mw := NewMiddleware(tokens, memoryUsers{user.ID: user}, nil)
+
+	var got *models.User
+	handler := mw.Require(func(w http.ResponseWriter, r *http.Request) {
+		got = UserFrom(r.Context())
+	})
+
+	valid, _ := tokens.Issue(user.ID)
+	unknown, _ := tokens.Issue(primitive.NewObjectID())
+	tests := []struct {
+		name, header string
+		want         int
+	}{
+		{"no header", "", http.StatusUnauthorized},
+		{"no scheme", valid, http.StatusUnauthorized},
+		{"unknown user", "Bearer " + unknown, http.StatusUnauthorized},
+		{"bad token", "Bearer nonsense", http.StatusUnauthorized},
+		{"valid", "Bearer " + valid, http.StatusOK},
+	}
+	for _, tt := range tests {
+		got = nil
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if tt.want == http.StatusOK && got != user {
+			t.Errorf("%s: handler got user %v, want %v", tt.name, got, user)
+		}
+		if tt.want != http.StatusOK && got != nil {
+			t.Errorf("%s: handler ran for a rejected request", tt.name)
+		}
+	}
+}
+
+func TestRequireRejectsRevokedTokens(t *testing.T) {
+	tokens := NewTokenIssuer([]byte("secret"), time.Hour)
+	revokedAt := time.Now().Add(-time.Minute)
+	user := &models.User{ID: primitive.NewObjectID(), TokensRevokedAt: revokedAt}
+	mw := NewMiddleware(tokens, memoryUsers{user.ID: user}, nil)
+
+	tokens.now = func() time.Time { return revokedAt.Add(-time.Minute) }
+	before, _ := tokens.Issue(user.ID)
+	tokens.now = time.Now
+	after, _ := tokens.Issue(user.ID)
+
+	tests := []struct {
+		name, token string
+		want        int
+	}{
+		{"issued before logout", before, http.StatusUnauthorized},
+		{"issued after logout", after, http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		mw.Require(func(http.ResponseWriter, *http.Request) {})(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	tokens := NewTokenIssuer([]byte("secret"), time.Hour)
+	admin := &models.User{ID: primitive.NewObjectID(), Role: models.RoleAdmin}
+	support := &models.User{ID: primitive.NewObjectID(), Role: models.RoleSupport}
+	legacy := &models.User{ID: primitive.NewObjectID()}
+	disabled := &models.User{ID: primitive.NewObjectID(), Role: models.RoleAdmin, Disabled: true}
+	mw := NewMiddleware(tokens, memoryUsers{admin.ID: admin, support.ID: support, legacy.ID: legacy, disabled.ID: disabled}, nil)
+	handler := mw.RequireRole(func(http.ResponseWriter, *http.Request) {}, models.RoleAdmin)
+
+	token := func(id primitive.ObjectID) string {
+		t, _ := tokens.Issue(id)
+		return t
+	}
+	// Support staff acting as an admin do not get the admin's rights
+	impersonated, _ := tokens.IssueAs(admin.ID, support.ID)
+
+	tests := []struct {
+		name, token string
+		want        int
+	}{
+		{"admin", token(admin.ID), http.StatusOK},
+		{"support", token(support.ID), http.StatusForbidden},
+		{"no stored role", token(legacy.ID), http.StatusForbidden},
+		{"disabled", token(disabled.ID), http.StatusUnauthorized},
+		{"impersonation", impersonated, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestRequireSetsActor(t *testing.T) {
+	tokens := NewTokenIssuer([]byte("secret"), time.Hour)
+	user := &models.User{ID: primitive.NewObjectID()}
+	actorID := primitive.NewObjectID()
+	mw := NewMiddleware(tokens, memoryUsers{user.ID: user}, nil)
+
+	var got primitive.ObjectID
+	handler := mw.Require(func(w http.ResponseWriter, r *http.Request) {
+		got = ActorFrom(r.Context())
+	})
+	token, err := tokens.IssueAs(user.ID, actorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	handler(httptest.NewRecorder(), r)
+	if got != actorID {
+		t.Errorf("actor = %s, want %s", got.Hex(), actorID.Hex())
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/signin", nil)
+	r.RemoteAddr = "10.0.0.1:4321"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+
+	if got := ClientIP(r); got != "10.0.0.1" {
+		t.Errorf("without TRUST_PROXY_HEADERS: %q, want the peer address", got)
+	}
+	t.Setenv("TRUST_PROXY_HEADERS", "true")
+	// The first entry is whatever the client sent; the last is the proxy's
+	if got := ClientIP(r); got != "5.6.7.8" {
+		t.Errorf("behind a proxy: %q, want 5.6.7.8", got)
+	}
+}
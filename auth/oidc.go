@@ -0,0 +1,449 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/oauth2"
+)
+
+// OIDCStateTTL is how long a user has to complete a sign-in at the
+// provider.
+const OIDCStateTTL = 10 * time.Minute
+
+// ErrInvalidOIDCState is returned for unknown, expired or reused states.
+var ErrInvalidOIDCState = errors.New("invalid or expired sign-in state")
+
+// OIDCConfig configures an OpenID Connect provider.
+type OIDCConfig struct {
+	// Name identifies the provider in URLs and linked identities.
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// Scopes are requested in addition to openid.
+	Scopes []string
+}
+
+// OIDCProvidersFromEnv reads the providers named in OIDC_PROVIDERS, a comma
+// separated list. For a provider "google" it reads OIDC_GOOGLE_ISSUER,
+// OIDC_GOOGLE_CLIENT_ID, OIDC_GOOGLE_CLIENT_SECRET and optionally
+// OIDC_GOOGLE_SCOPES (space separated, default "email profile"). All
+// providers redirect to baseURL + /api/oidc/callback; the stored state
+// tells which provider a callback belongs to. Providers that cannot be
+// reached are skipped.
+func OIDCProvidersFromEnv(ctx context.Context, baseURL string) map[string]*OIDCProvider {
+	providers := make(map[string]*OIDCProvider)
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		scopes := strings.Fields(os.Getenv(prefix + "SCOPES"))
+		if len(scopes) == 0 {
+			scopes = []string{"email", "profile"}
+		}
+		provider, err := NewOIDCProvider(ctx, OIDCConfig{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  strings.TrimSuffix(baseURL, "/") + "/api/oidc/callback",
+			Scopes:       scopes,
+		})
+		if err != nil {
+			log.Printf("OIDCProvidersFromEnv: Skipping provider %s: %v", name, err)
+			continue
+		}
+		providers[name] = provider
+	}
+	return providers
+}
+
+// OIDCProvider runs the authorization code flow with PKCE against an
+// OpenID Connect provider and verifies the ID tokens it returns.
+type OIDCProvider struct {
+	Name   string
+	issuer string
+	oauth  *oauth2.Config
+	keys   *jwks
+	client *http.Client
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// discovery is the part of the provider metadata the flow needs.
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewOIDCProvider fetches the provider's discovery document from
+// Issuer/.well-known/openid-configuration.
+func NewOIDCProvider(ctx context.Context, cfg OIDCConfig) (*OIDCProvider, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" {
+		return nil, errors.New("issuer and client ID are required")
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	var meta discovery
+	if err := getJSON(ctx, client, strings.TrimSuffix(cfg.Issuer, "/")+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, fmt.Errorf("failed to fetch provider metadata: %v", err)
+	}
+	if meta.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("provider metadata is for issuer %q, want %q", meta.Issuer, cfg.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("provider metadata lacks endpoints")
+	}
+	return &OIDCProvider{
+		Name:   cfg.Name,
+		issuer: meta.Issuer,
+		oauth: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       append([]string{"openid"}, cfg.Scopes...),
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  meta.AuthorizationEndpoint,
+				TokenURL: meta.TokenEndpoint,
+			},
+		},
+		keys:   &jwks{url: meta.JWKSURI, client: client},
+		client: client,
+		now:    time.Now,
+	}, nil
+}
+
+// OIDCState is what the server remembers between redirecting the user to
+// the provider and the provider redirecting back.
+type OIDCState struct {
+	// StateHash is the SHA-256 of the state parameter.
+	StateHash string    `bson:"_id"`
+	Provider  string    `bson:"provider"`
+	Nonce     string    `bson:"nonce"`
+	Verifier  string    `bson:"verifier"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// OIDCStateStore persists flows in progress.
+type OIDCStateStore interface {
+	CreateOIDCState(ctx context.Context, s *OIDCState) error
+	// TakeOIDCState removes and returns the unexpired state with hash, or
+	// returns ErrInvalidOIDCState.
+	TakeOIDCState(ctx context.Context, hash string, now time.Time) (*OIDCState, error)
+}
+
+// MongoOIDCStates is an OIDCStateStore backed by the oidc_states
+// collection.
+type MongoOIDCStates struct {
+	DB *mongo.Database
+}
+
+func (s MongoOIDCStates) collection() *mongo.Collection {
+	return s.DB.Collection("oidc_states")
+}
+
+// EnsureIndexes creates the TTL index on expiresAt.
+func (s MongoOIDCStates) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create OIDC state index: %v", err)
+	}
+	return nil
+}
+
+func (s MongoOIDCStates) CreateOIDCState(ctx context.Context, state *OIDCState) error {
+	if _, err := s.collection().InsertOne(ctx, state); err != nil {
+		return fmt.Errorf("failed to store sign-in state: %v", err)
+	}
+	return nil
+}
+
+func (s MongoOIDCStates) TakeOIDCState(ctx context.Context, hash string, now time.Time) (*OIDCState, error) {
+	var state OIDCState
+	err := s.collection().FindOneAndDelete(ctx, bson.M{"_id": hash, "expiresAt": bson.M{"$gt": now}}).Decode(&state)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidOIDCState
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sign-in state: %v", err)
+	}
+	return &state, nil
+}
+
+// OIDCIdentity is the verified result of a sign-in at a provider.
+type OIDCIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// idTokenClaims are the ID token claims the flow checks.
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce           string `json:"nonce"`
+	AuthorizedParty string `json:"azp"`
+	Email           string `json:"email"`
+	// EmailVerified is a bool, but some providers send "true" as a string
+	EmailVerified interface{} `json:"email_verified"`
+}
+
+func (c *idTokenClaims) emailVerified() bool {
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// Begin starts a sign-in. It stores a new state with its nonce and PKCE
+// verifier and returns the state, which the caller also binds to the
+// browser, and the URL to send the user to.
+func (p *OIDCProvider) Begin(ctx context.Context, store OIDCStateStore) (state, authURL string, err error) {
+	if state, err = RandomToken(); err != nil {
+		return "", "", err
+	}
+	nonce, err := RandomToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+	if err := store.CreateOIDCState(ctx, &OIDCState{
+		StateHash: HashToken(state),
+		Provider:  p.Name,
+		Nonce:     nonce,
+		Verifier:  verifier,
+		ExpiresAt: p.now().Add(OIDCStateTTL),
+	}); err != nil {
+		return "", "", err
+	}
+	authURL = p.oauth.AuthCodeURL(state,
+		oauth2.S256ChallengeOption(verifier),
+		oauth2.SetAuthURLParam("nonce", nonce),
+	)
+	return state, authURL, nil
+}
+
+// TakeOIDCState redeems the state parameter of a callback. Each state
+// works once.
+func TakeOIDCState(ctx context.Context, store OIDCStateStore, state string) (*OIDCState, error) {
+	return store.TakeOIDCState(ctx, HashToken(state), time.Now())
+}
+
+// Finish completes a sign-in started with Begin: it exchanges the code
+// using the saved PKCE verifier and verifies the returned ID token against
+// the saved nonce.
+func (p *OIDCProvider) Finish(ctx context.Context, saved *OIDCState, code string) (*OIDCIdentity, error) {
+	if saved.Provider != p.Name {
+		return nil, ErrInvalidOIDCState
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.client)
+	token, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(saved.Verifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange code: %v", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return nil, errors.New("token response has no ID token")
+	}
+	claims, err := p.verifyIDToken(ctx, rawIDToken, saved.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &OIDCIdentity{
+		Provider:      p.Name,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.emailVerified(),
+	}, nil
+}
+
+// verifyIDToken checks the signature against the provider's keys and the
+// issuer, audience, expiry and nonce of an ID token.
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, raw, nonce string) (*idTokenClaims, error) {
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.keys.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "PS256"}),
+		jwt.WithIssuer(p.issuer),
+		jwt.WithAudience(p.oauth.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(p.now),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %v", err)
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.oauth.ClientID {
+		return nil, errors.New("invalid ID token: authorized party is not this client")
+	}
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return nil, errors.New("invalid ID token: nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("invalid ID token: no subject")
+	}
+	return claims, nil
+}
+
+// jwksRefreshInterval limits how often an unknown key ID triggers a fetch.
+const jwksRefreshInterval = time.Minute
+
+// jwks caches a provider's signing keys and refetches them when a token
+// names a key it does not know, which is how providers rotate keys.
+type jwks struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func (j *jwks) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if key, ok := j.lookup(kid); ok {
+		return key, nil
+	}
+	if time.Since(j.fetched) < jwksRefreshInterval && j.keys != nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if err := j.fetch(ctx); err != nil {
+		return nil, err
+	}
+	if key, ok := j.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookup finds the key by ID, or the only key when the token has none.
+func (j *jwks) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (j *jwks) fetch(ctx context.Context) error {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, j.client, j.url, &set); err != nil {
+		return fmt.Errorf("failed to fetch signing keys: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("jwks: Skipping key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	j.keys = keys
+	j.fetched = time.Now()
+	return nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %v", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil {
+			return nil, errors.New("invalid coordinates")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,307 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// memoryOIDCStates is an OIDCStateStore for tests.
+type memoryOIDCStates struct {
+	mu     sync.Mutex
+	states map[string]*OIDCState
+}
+
+func (m *memoryOIDCStates) CreateOIDCState(_ context.Context, s *OIDCState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.states == nil {
+		m.states = make(map[string]*OIDCState)
+	}
+	m.states[s.StateHash] = s
+	return nil
+}
+
+func (m *memoryOIDCStates) TakeOIDCState(_ context.Context, hash string, now time.Time) (*OIDCState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.states[hash]
+	if !ok || !s.ExpiresAt.After(now) {
+		return nil, ErrInvalidOIDCState
+	}
+	delete(m.states, hash)
+	return s, nil
+}
+
+// mockOIDC is a minimal OpenID Connect provider. Authorize stands in for
+// the user signing in at the provider and returns the code the provider
+// would redirect back with.
+type mockOIDC struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+	// claims returns the ID token claims for a grant; tests change it to
+	// produce invalid tokens
+	claims func(g mockGrant) jwt.MapClaims
+	// signKey signs ID tokens; tests replace it to forge signatures
+	signKey *rsa.PrivateKey
+}
+
+type mockGrant struct {
+	nonce, challenge, clientID string
+}
+
+const mockClientID = "watermark-client"
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockOIDC{t: t, key: key, signKey: key, codes: make(map[string]mockGrant)}
+	m.claims = func(g mockGrant) jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":            m.server.URL,
+			"sub":            "subject-1",
+			"aud":            g.clientID,
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"iat":            time.Now().Unix(),
+			"nonce":          g.nonce,
+			"email":          "someone@example.com",
+			"email_verified": true,
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", m.token)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+func (m *mockOIDC) provider() *OIDCProvider {
+	p, err := NewOIDCProvider(context.Background(), OIDCConfig{
+		Name:         "mock",
+		Issuer:       m.server.URL,
+		ClientID:     mockClientID,
+		ClientSecret: "secret",
+		RedirectURL:  "https://app.example.com/api/oidc/callback",
+		Scopes:       []string{"email"},
+	})
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return p
+}
+
+// Authorize checks the authorization request and returns a code.
+func (m *mockOIDC) Authorize(authURL string) (state, code string) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	q := u.Query()
+	for param, want := range map[string]string{
+		"response_type":         "code",
+		"client_id":             mockClientID,
+		"code_challenge_method": "S256",
+		"redirect_uri":          "https://app.example.com/api/oidc/callback",
+		"scope":                 "openid email",
+	} {
+		if got := q.Get(param); got != want {
+			m.t.Errorf("authorization request %s = %q, want %q", param, got, want)
+		}
+	}
+	if q.Get("state") == "" || q.Get("nonce") == "" || q.Get("code_challenge") == "" {
+		m.t.Fatalf("authorization request lacks state, nonce or challenge: %s", authURL)
+	}
+	code = "code-" + q.Get("state")[:8]
+	m.mu.Lock()
+	m.codes[code] = mockGrant{nonce: q.Get("nonce"), challenge: q.Get("code_challenge"), clientID: q.Get("client_id")}
+	m.mu.Unlock()
+	return q.Get("state"), code
+}
+
+func (m *mockOIDC) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	m.mu.Lock()
+	grant, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, m.claims(grant))
+	token.Header["kid"] = "key-1"
+	idToken, err := token.SignedString(m.signKey)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// signIn runs a whole flow and returns the result of Finish.
+func (m *mockOIDC) signIn(p *OIDCProvider, store OIDCStateStore) (*OIDCIdentity, error) {
+	ctx := context.Background()
+	state, authURL, err := p.Begin(ctx, store)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	returned, code := m.Authorize(authURL)
+	if returned != state {
+		m.t.Fatalf("authorization URL carries state %q, Begin returned %q", returned, state)
+	}
+	saved, err := TakeOIDCState(ctx, store, state)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return p.Finish(ctx, saved, code)
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	m := newMockOIDC(t)
+	identity, err := m.signIn(m.provider(), &memoryOIDCStates{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := OIDCIdentity{Provider: "mock", Subject: "subject-1", Email: "someone@example.com", EmailVerified: true}
+	if *identity != want {
+		t.Errorf("identity = %+v, want %+v", *identity, want)
+	}
+}
+
+func TestOIDCStateIsSingleUse(t *testing.T) {
+	m := newMockOIDC(t)
+	store := &memoryOIDCStates{}
+	state, _, err := m.provider().Begin(context.Background(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TakeOIDCState(context.Background(), store, state); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TakeOIDCState(context.Background(), store, state); err != ErrInvalidOIDCState {
+		t.Errorf("state redeemed twice: err = %v", err)
+	}
+	if _, err := TakeOIDCState(context.Background(), store, "forged"); err != ErrInvalidOIDCState {
+		t.Errorf("unknown state: err = %v", err)
+	}
+}
+
+func TestOIDCRejectsWrongVerifier(t *testing.T) {
+	m := newMockOIDC(t)
+	p := m.provider()
+	store := &memoryOIDCStates{}
+	ctx := context.Background()
+
+	state, authURL, _ := p.Begin(ctx, store)
+	_, code := m.Authorize(authURL)
+	saved, _ := TakeOIDCState(ctx, store, state)
+	saved.Verifier = "intercepted-code-without-the-verifier-000000000"
+	if _, err := p.Finish(ctx, saved, code); err == nil {
+		t.Error("code exchanged without the PKCE verifier")
+	}
+}
+
+func TestOIDCRejectsInvalidIDTokens(t *testing.T) {
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]func(m *mockOIDC, c jwt.MapClaims){
+		"wrong nonce":    func(m *mockOIDC, c jwt.MapClaims) { c["nonce"] = "replayed" },
+		"no nonce":       func(m *mockOIDC, c jwt.MapClaims) { delete(c, "nonce") },
+		"wrong audience": func(m *mockOIDC, c jwt.MapClaims) { c["aud"] = "another-client" },
+		"wrong issuer":   func(m *mockOIDC, c jwt.MapClaims) { c["iss"] = "https://evil.example.com" },
+		"expired":        func(m *mockOIDC, c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no subject":     func(m *mockOIDC, c jwt.MapClaims) { delete(c, "sub") },
+		"other azp": func(m *mockOIDC, c jwt.MapClaims) {
+			c["aud"] = []string{mockClientID, "another-client"}
+			c["azp"] = "another-client"
+		},
+		"forged signature": func(m *mockOIDC, c jwt.MapClaims) { m.signKey = other },
+	}
+	for name, modify := range tests {
+		m := newMockOIDC(t)
+		claims := m.claims
+		m.claims = func(g mockGrant) jwt.MapClaims {
+			c := claims(g)
+			modify(m, c)
+			return c
+		}
+		if _, err := m.signIn(m.provider(), &memoryOIDCStates{}); err == nil {
+			t.Errorf("%s: ID token accepted", name)
+		}
+	}
+}
+
+func TestOIDCEmailVerifiedString(t *testing.T) {
+	m := newMockOIDC(t)
+	claims := m.claims
+	m.claims = func(g mockGrant) jwt.MapClaims {
+		c := claims(g)
+		c["email_verified"] = "false"
+		return c
+	}
+	identity, err := m.signIn(m.provider(), &memoryOIDCStates{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.EmailVerified {
+		t.Error(`email_verified "false" read as verified`)
+	}
+}
+
+func TestNewOIDCProviderChecksIssuer(t *testing.T) {
+	m := newMockOIDC(t)
+	if _, err := NewOIDCProvider(context.Background(), OIDCConfig{
+		Name:     "mock",
+		Issuer:   m.server.URL + "/",
+		ClientID: mockClientID,
+	}); err == nil {
+		t.Error("provider accepted metadata for a different issuer")
+	}
+}
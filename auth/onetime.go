@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Purposes of one-time tokens. A token only works for the purpose it was
+// issued for.
+const (
+	PurposeVerifyEmail   = "verify-email"
+	PurposeResetPassword = "reset-password"
+)
+
+// Lifetimes of one-time tokens.
+const (
+	VerifyEmailTTL   = 48 * time.Hour
+	ResetPasswordTTL = time.Hour
+)
+
+// ErrInvalidToken is returned for unknown, expired or already used one-time
+// tokens.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// OneTimeToken is a single-use token sent by email. Only the SHA-256 of the
+// token is stored.
+type OneTimeToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	Purpose   string             `bson:"purpose"`
+	TokenHash string             `bson:"tokenHash"`
+	CreatedAt time.Time          `bson:"createdAt"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+}
+
+// OneTimeStore persists one-time tokens.
+type OneTimeStore interface {
+	CreateOneTimeToken(ctx context.Context, t *OneTimeToken) error
+	// TakeOneTimeToken removes and returns the unexpired token with hash
+	// and purpose, or returns ErrInvalidToken.
+	TakeOneTimeToken(ctx context.Context, hash, purpose string, now time.Time) (*OneTimeToken, error)
+	// FindOneTimeToken returns the unexpired token with hash and purpose
+	// without removing it, or returns ErrInvalidToken.
+	FindOneTimeToken(ctx context.Context, hash, purpose string, now time.Time) (*OneTimeToken, error)
+	DeleteOneTimeTokens(ctx context.Context, userID primitive.ObjectID, purpose string) error
+}
+
+// MongoOneTimeTokens is a OneTimeStore backed by the user_tokens collection.
+type MongoOneTimeTokens struct {
+	DB *mongo.Database
+}
+
+func (s MongoOneTimeTokens) collection() *mongo.Collection {
+	return s.DB.Collection("user_tokens")
+}
+
+// EnsureIndexes creates the lookup indexes and the TTL index on expiresAt.
+func (s MongoOneTimeTokens) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tokenHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "purpose", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create user token indexes: %v", err)
+	}
+	return nil
+}
+
+func (s MongoOneTimeTokens) CreateOneTimeToken(ctx context.Context, t *OneTimeToken) error {
+	if _, err := s.collection().InsertOne(ctx, t); err != nil {
+		return fmt.Errorf("failed to store token: %v", err)
+	}
+	return nil
+}
+
+func (s MongoOneTimeTokens) TakeOneTimeToken(ctx context.Context, hash, purpose string, now time.Time) (*OneTimeToken, error) {
+	var t OneTimeToken
+	err := s.collection().FindOneAndDelete(ctx, bson.M{
+		"tokenHash": hash,
+		"purpose":   purpose,
+		"expiresAt": bson.M{"$gt": now},
+	}).Decode(&t)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch token: %v", err)
+	}
+	return &t, nil
+}
+
+func (s MongoOneTimeTokens) FindOneTimeToken(ctx context.Context, hash, purpose string, now time.Time) (*OneTimeToken, error) {
+	var t OneTimeToken
+	err := s.collection().FindOne(ctx, bson.M{
+		"tokenHash": hash,
+		"purpose":   purpose,
+		"expiresAt": bson.M{"$gt": now},
+	}).Decode(&t)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch token: %v", err)
+	}
+	return &t, nil
+}
+
+func (s MongoOneTimeTokens) DeleteOneTimeTokens(ctx context.Context, userID primitive.ObjectID, purpose string) error {
+	if _, err := s.collection().DeleteMany(ctx, bson.M{"userId": userID, "purpose": purpose}); err != nil {
+		return fmt.Errorf("failed to delete tokens: %v", err)
+	}
+	return nil
+}
+
+// OneTimeTokens issues and redeems single-use tokens for email links.
+type OneTimeTokens struct {
+	Store OneTimeStore
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewOneTimeTokens returns one-time tokens kept in store.
+func NewOneTimeTokens(store OneTimeStore) *OneTimeTokens {
+	return &OneTimeTokens{Store: store, now: time.Now}
+}
+
+// Issue returns a new token for the user and purpose that expires after
+// ttl. Earlier tokens for the same purpose stop working, so only the link
+// from the latest email is valid.
+func (t *OneTimeTokens) Issue(ctx context.Context, userID primitive.ObjectID, purpose string, ttl time.Duration) (string, error) {
+	if err := t.Store.DeleteOneTimeTokens(ctx, userID, purpose); err != nil {
+		return "", err
+	}
+	token, err := RandomToken()
+	if err != nil {
+		return "", err
+	}
+	now := t.now()
+	if err := t.Store.CreateOneTimeToken(ctx, &OneTimeToken{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: HashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Lookup returns the user the token was issued to without using it up, so
+// that a request can be checked before the token is redeemed.
+func (t *OneTimeTokens) Lookup(ctx context.Context, token, purpose string) (primitive.ObjectID, error) {
+	record, err := t.Store.FindOneTimeToken(ctx, HashToken(token), purpose, t.now())
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return record.UserID, nil
+}
+
+// Redeem uses up the token and returns the user it was issued to.
+func (t *OneTimeTokens) Redeem(ctx context.Context, token, purpose string) (primitive.ObjectID, error) {
+	record, err := t.Store.TakeOneTimeToken(ctx, HashToken(token), purpose, t.now())
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return record.UserID, nil
+}
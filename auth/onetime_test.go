@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryOneTimeTokens is a OneTimeStore for tests.
+type memoryOneTimeTokens struct {
+	mu     sync.Mutex
+	tokens map[string]*OneTimeToken
+}
+
+func newMemoryOneTimeTokens() *memoryOneTimeTokens {
+	return &memoryOneTimeTokens{tokens: make(map[string]*OneTimeToken)}
+}
+
+func (m *memoryOneTimeTokens) CreateOneTimeToken(_ context.Context, t *OneTimeToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[t.TokenHash] = t
+	return nil
+}
+
+func (m *memoryOneTimeTokens) TakeOneTimeToken(_ context.Context, hash, purpose string, now time.Time) (*OneTimeToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[hash]
+	if !ok || t.Purpose != purpose || !t.ExpiresAt.After(now) {
+		return nil, ErrInvalidToken
+	}
+	delete(m.tokens, hash)
+	return t, nil
+}
+
+func (m *memoryOneTimeTokens) FindOneTimeToken(_ context.Context, hash, purpose string, now time.Time) (*OneTimeToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[hash]
+	if !ok || t.Purpose != purpose || !t.ExpiresAt.After(now) {
+		return nil, ErrInvalidToken
+	}
+	return t, nil
+}
+
+func (m *memoryOneTimeTokens) DeleteOneTimeTokens(_ context.Context, userID primitive.ObjectID, purpose string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for hash, t := range m.tokens {
+		if t.UserID == userID && t.Purpose == purpose {
+			delete(m.tokens, hash)
+		}
+	}
+	return nil
+}
+
+func TestOneTimeTokens(t *testing.T) {
+	tokens := NewOneTimeTokens(newMemoryOneTimeTokens())
+	ctx := context.Background()
+	userID := primitive.NewObjectID()
+
+	token, err := tokens.Issue(ctx, userID, PurposeResetPassword, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.Redeem(ctx, token, PurposeVerifyEmail); err != ErrInvalidToken {
+		t.Errorf("token redeemed for another purpose: err = %v", err)
+	}
+	// Looking a token up leaves it usable
+	if got, err := tokens.Lookup(ctx, token, PurposeResetPassword); err != nil || got != userID {
+		t.Errorf("Lookup = %s, %v, want %s", got.Hex(), err, userID.Hex())
+	}
+	got, err := tokens.Redeem(ctx, token, PurposeResetPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != userID {
+		t.Errorf("token is for %s, want %s", got.Hex(), userID.Hex())
+	}
+	if _, err := tokens.Redeem(ctx, token, PurposeResetPassword); err != ErrInvalidToken {
+		t.Errorf("token redeemed twice: err = %v", err)
+	}
+	if _, err := tokens.Lookup(ctx, token, PurposeResetPassword); err != ErrInvalidToken {
+		t.Errorf("redeemed token looked up: err = %v", err)
+	}
+}
+
+func TestOneTimeTokensExpireAndSupersede(t *testing.T) {
+	tokens := NewOneTimeTokens(newMemoryOneTimeTokens())
+	ctx := context.Background()
+	userID := primitive.NewObjectID()
+
+	first, _ := tokens.Issue(ctx, userID, PurposeVerifyEmail, time.Hour)
+	second, _ := tokens.Issue(ctx, userID, PurposeVerifyEmail, time.Hour)
+	if _, err := tokens.Redeem(ctx, first, PurposeVerifyEmail); err != ErrInvalidToken {
+		t.Errorf("superseded token accepted: err = %v", err)
+	}
+
+	tokens.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, err := tokens.Redeem(ctx, second, PurposeVerifyEmail); err != ErrInvalidToken {
+		t.Errorf("expired token accepted: err = %v", err)
+	}
+}
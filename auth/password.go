@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// bcryptMaxBytes is the longest password bcrypt hashes; longer ones are
+// rejected rather than silently truncated.
+const bcryptMaxBytes = 72
+
+// ErrBreachedPassword is returned for passwords found in the breached
+// password list.
+var ErrBreachedPassword = errors.New("this password has appeared in a data breach, please choose another one")
+
+// PasswordPolicy decides which passwords are accepted for new accounts and
+// password changes. Existing passwords keep working when it is tightened.
+type PasswordPolicy struct {
+	MinLength int
+	// MinClasses is how many of lower case, upper case, digits and other
+	// characters a password must contain.
+	MinClasses int
+	// Breached rejects known passwords when set.
+	Breached *BreachedPasswords
+}
+
+// DefaultPasswordPolicy requires 10 characters and checks the bundled
+// breached password list.
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{MinLength: 10, MinClasses: 1, Breached: BundledBreachedPasswords()}
+}
+
+// PasswordPolicyFromEnv returns DefaultPasswordPolicy adjusted by
+// PASSWORD_MIN_LENGTH, PASSWORD_MIN_CLASSES and BREACHED_PASSWORDS_FILE, a
+// larger list in the same format as the bundled one that replaces it. When
+// the file is unset or cannot be read, the bundled list is used and a
+// warning logged.
+func PasswordPolicyFromEnv() *PasswordPolicy {
+	p := DefaultPasswordPolicy()
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && n > 0 {
+		p.MinLength = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_CLASSES")); err == nil && n >= 0 && n <= 4 {
+		p.MinClasses = n
+	}
+	path := os.Getenv("BREACHED_PASSWORDS_FILE")
+	if path == "" {
+		log.Printf("PasswordPolicyFromEnv: Warning: BREACHED_PASSWORDS_FILE is not set, only the %d bundled breached passwords are rejected", p.Breached.Len())
+		return p
+	}
+	list, err := LoadBreachedPasswordsFile(path)
+	if err != nil {
+		log.Printf("PasswordPolicyFromEnv: Warning: using the %d bundled breached passwords: %v", p.Breached.Len(), err)
+		return p
+	}
+	p.Breached = list
+	return p
+}
+
+// Check returns an error describing why password is not acceptable for the
+// account with email, or nil.
+func (p *PasswordPolicy) Check(password, email string) error {
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters", p.MinLength)
+	}
+	if len(password) > bcryptMaxBytes {
+		return fmt.Errorf("password must be at most %d bytes", bcryptMaxBytes)
+	}
+	if classes := characterClasses(password); classes < p.MinClasses {
+		return fmt.Errorf("password must mix at least %d of lower case letters, upper case letters, digits and symbols", p.MinClasses)
+	}
+	if email != "" && strings.EqualFold(password, email) {
+		return errors.New("password must not be your email address")
+	}
+	if local, _, ok := strings.Cut(email, "@"); ok && len(local) >= 4 && strings.EqualFold(password, local) {
+		return errors.New("password must not be your email address")
+	}
+	if p.Breached != nil && p.Breached.Contains(password) {
+		return ErrBreachedPassword
+	}
+	return nil
+}
+
+func characterClasses(s string) int {
+	var lower, upper, digit, other int
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// hashPrefixLength is the length of the SHA-1 hex prefix the list is
+// partitioned by, as in the Pwned Passwords range API.
+const hashPrefixLength = 5
+
+// BreachedPasswords is an offline list of SHA-1 password hashes, split into
+// ranges by the first five hex digits of the hash. Lookups fetch a range by
+// prefix and compare suffixes, the k-anonymity model of the Pwned Passwords
+// API, so the same lookup works against a remote range source.
+type BreachedPasswords struct {
+	ranges map[string]map[string]struct{}
+	size   int
+}
+
+//go:embed breached.txt
+var bundledBreached string
+
+// BundledBreachedPasswords returns the list of common passwords compiled
+// into the binary.
+func BundledBreachedPasswords() *BreachedPasswords {
+	list, err := ReadBreachedPasswords(strings.NewReader(bundledBreached))
+	if err != nil {
+		panic(fmt.Sprintf("bundled breached password list: %v", err))
+	}
+	return list
+}
+
+// LoadBreachedPasswordsFile reads a list from path.
+func LoadBreachedPasswordsFile(path string) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached password list: %v", err)
+	}
+	defer f.Close()
+	return ReadBreachedPasswords(f)
+}
+
+// ReadBreachedPasswords parses one upper- or lower-case SHA-1 hex hash per
+// line, optionally followed by ":count". Blank lines and lines starting with
+// # are skipped.
+func ReadBreachedPasswords(r io.Reader) (*BreachedPasswords, error) {
+	list := &BreachedPasswords{ranges: make(map[string]map[string]struct{})}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		hash, _, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+		if len(hash) != 2*sha1.Size {
+			return nil, fmt.Errorf("line %d: not a SHA-1 hash", line)
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return nil, fmt.Errorf("line %d: not a SHA-1 hash", line)
+		}
+		prefix, suffix := hash[:hashPrefixLength], hash[hashPrefixLength:]
+		if list.ranges[prefix] == nil {
+			list.ranges[prefix] = make(map[string]struct{})
+		}
+		if _, ok := list.ranges[prefix][suffix]; !ok {
+			list.ranges[prefix][suffix] = struct{}{}
+			list.size++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read breached password list: %v", err)
+	}
+	return list, nil
+}
+
+// Len returns the number of distinct hashes in the list.
+func (b *BreachedPasswords) Len() int {
+	return b.size
+}
+
+// Range returns the hash suffixes in the list that start with prefix.
+func (b *BreachedPasswords) Range(prefix string) map[string]struct{} {
+	return b.ranges[strings.ToUpper(prefix)]
+}
+
+// Contains reports whether password is in the list.
+func (b *BreachedPasswords) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	_, ok := b.Range(hash[:hashPrefixLength])[hash[hashPrefixLength:]]
+	return ok
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	p := &PasswordPolicy{MinLength: 10, MinClasses: 2, Breached: BundledBreachedPasswords()}
+	tests := []struct {
+		password string
+		ok       bool
+	}{
+		{"short1", false},
+		{"onlylowercaseletters", false},
+		{"lowercase and spaces", true},
+		{"correct horse 7", true},
+		{"ÄÖÜäöüßéèê", true},
+		{strings.Repeat("a1", 37), false}, // over bcrypt's 72 bytes
+		{"Password123", false},            // breached
+		{"Someone@Example.com", false},    // the email address
+		{"someone12345", true},
+	}
+	for _, tt := range tests {
+		err := p.Check(tt.password, "someone@example.com")
+		if (err == nil) != tt.ok {
+			t.Errorf("Check(%q) = %v, want ok %v", tt.password, err, tt.ok)
+		}
+	}
+}
+
+func TestBundledBreachedPasswords(t *testing.T) {
+	list := BundledBreachedPasswords()
+	for _, password := range []string{"123456", "password", "qwerty123", "P@ssw0rd"} {
+		if !list.Contains(password) {
+			t.Errorf("%q not in the bundled list", password)
+		}
+	}
+	if list.Contains("a password nobody has used 8d1f") {
+		t.Error("unlisted password reported as breached")
+	}
+}
+
+func TestReadBreachedPasswords(t *testing.T) {
+	sum := sha1.Sum([]byte("hunter2"))
+	hash := hex.EncodeToString(sum[:])
+	list, err := ReadBreachedPasswords(strings.NewReader("# comment\n\n" + hash + ":17\n" + strings.ToUpper(hash) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !list.Contains("hunter2") {
+		t.Error("lower-case hash with count not matched")
+	}
+	if got := len(list.Range(hash[:5])); got != 1 {
+		t.Errorf("range has %d suffixes, want 1", got)
+	}
+	if list.Len() != 1 {
+		t.Errorf("Len = %d, want the repeated hash counted once", list.Len())
+	}
+	if _, err := ReadBreachedPasswords(strings.NewReader("not-a-hash\n")); err == nil {
+		t.Error("invalid line accepted")
+	}
+}
+
+func TestPasswordPolicyFromEnvFallsBack(t *testing.T) {
+	t.Setenv("BREACHED_PASSWORDS_FILE", "")
+	if p := PasswordPolicyFromEnv(); !p.Breached.Contains("123456") {
+		t.Error("bundled list not used without BREACHED_PASSWORDS_FILE")
+	}
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	t.Setenv("BREACHED_PASSWORDS_FILE", path)
+	if p := PasswordPolicyFromEnv(); !p.Breached.Contains("123456") {
+		t.Error("bundled list not used when the file is missing")
+	}
+
+	sum := sha1.Sum([]byte("hunter2"))
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(sum[:])+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if p := PasswordPolicyFromEnv(); !p.Breached.Contains("hunter2") || p.Breached.Contains("123456") {
+		t.Error("list from BREACHED_PASSWORDS_FILE not used")
+	}
+}
@@ -0,0 +1,260 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// DefaultRefreshTTL is how long a refresh token stays valid. Every
+	// refresh issues a new token with a fresh lifetime.
+	DefaultRefreshTTL = 30 * 24 * time.Hour
+	// tokenBytes is the amount of randomness in tokens from RandomToken.
+	tokenBytes = 32
+)
+
+var (
+	// ErrSessionNotFound is returned by a SessionStore for unknown tokens.
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrInvalidRefreshToken is returned for unknown or expired refresh
+	// tokens.
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when a refresh token that was
+	// already exchanged is presented again. The whole family is revoked.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// Session is one refresh token. Refreshing marks the session used and
+// starts a new one in the same family, so a family is the chain of tokens
+// descending from one sign-in. Only the SHA-256 of the token is stored.
+type Session struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	Family    primitive.ObjectID `bson:"family"`
+	TokenHash string             `bson:"tokenHash"`
+	CreatedAt time.Time          `bson:"createdAt"`
+	// ExpiresAt carries the TTL index that removes old sessions.
+	ExpiresAt time.Time `bson:"expiresAt"`
+	// UsedAt is set once the token has been exchanged for a new one.
+	UsedAt *time.Time `bson:"usedAt,omitempty"`
+}
+
+// SessionStore persists sessions.
+type SessionStore interface {
+	CreateSession(ctx context.Context, s *Session) error
+	SessionByHash(ctx context.Context, hash string) (*Session, error)
+	// MarkSessionUsed sets UsedAt unless it is already set and reports
+	// whether it did, so two concurrent refreshes cannot both succeed.
+	MarkSessionUsed(ctx context.Context, id primitive.ObjectID, at time.Time) (bool, error)
+	DeleteFamily(ctx context.Context, family primitive.ObjectID) error
+	DeleteUserSessions(ctx context.Context, userID primitive.ObjectID) error
+}
+
+// MongoSessions is a SessionStore backed by the sessions collection.
+type MongoSessions struct {
+	DB *mongo.Database
+}
+
+func (s MongoSessions) collection() *mongo.Collection {
+	return s.DB.Collection("sessions")
+}
+
+// EnsureIndexes creates the lookup indexes and the TTL index that lets
+// MongoDB delete sessions once they expire.
+func (s MongoSessions) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tokenHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "family", Value: 1}}},
+		{Keys: bson.D{{Key: "userId", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create session indexes: %v", err)
+	}
+	return nil
+}
+
+func (s MongoSessions) CreateSession(ctx context.Context, session *Session) error {
+	if session.ID.IsZero() {
+		session.ID = primitive.NewObjectID()
+	}
+	if _, err := s.collection().InsertOne(ctx, session); err != nil {
+		return fmt.Errorf("failed to store session: %v", err)
+	}
+	return nil
+}
+
+func (s MongoSessions) SessionByHash(ctx context.Context, hash string) (*Session, error) {
+	var session Session
+	err := s.collection().FindOne(ctx, bson.M{"tokenHash": hash}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch session: %v", err)
+	}
+	return &session, nil
+}
+
+func (s MongoSessions) MarkSessionUsed(ctx context.Context, id primitive.ObjectID, at time.Time) (bool, error) {
+	result, err := s.collection().UpdateOne(ctx,
+		bson.M{"_id": id, "usedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"usedAt": at}},
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to update session: %v", err)
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+func (s MongoSessions) DeleteFamily(ctx context.Context, family primitive.ObjectID) error {
+	if _, err := s.collection().DeleteMany(ctx, bson.M{"family": family}); err != nil {
+		return fmt.Errorf("failed to delete sessions: %v", err)
+	}
+	return nil
+}
+
+func (s MongoSessions) DeleteUserSessions(ctx context.Context, userID primitive.ObjectID) error {
+	if _, err := s.collection().DeleteMany(ctx, bson.M{"userId": userID}); err != nil {
+		return fmt.Errorf("failed to delete sessions: %v", err)
+	}
+	return nil
+}
+
+// TokenPair is what a client receives on sign-in and refresh.
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	// ExpiresIn is the access token lifetime in seconds.
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+// Sessions issues access tokens together with rotating refresh tokens.
+type Sessions struct {
+	Tokens *TokenIssuer
+	Store  SessionStore
+	// TTL is the lifetime of a refresh token.
+	TTL time.Duration
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewSessions returns sessions signing access tokens with tokens and
+// keeping refresh tokens in store.
+func NewSessions(tokens *TokenIssuer, store SessionStore) *Sessions {
+	return &Sessions{Tokens: tokens, Store: store, TTL: DefaultRefreshTTL, now: time.Now}
+}
+
+// Start begins a new token family for the user, as on sign-in.
+func (s *Sessions) Start(ctx context.Context, userID primitive.ObjectID) (*TokenPair, error) {
+	return s.issue(ctx, userID, primitive.NewObjectID())
+}
+
+// Refresh exchanges a refresh token for a new pair. Each token can be
+// exchanged once; presenting it again means it leaked, so the whole family
+// is revoked and the legitimate client has to sign in again too.
+func (s *Sessions) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	session, err := s.Store.SessionByHash(ctx, HashToken(refreshToken))
+	if err == ErrSessionNotFound {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	if !session.ExpiresAt.After(now) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if session.UsedAt != nil {
+		return nil, s.revokeReused(ctx, session)
+	}
+	ok, err := s.Store.MarkSessionUsed(ctx, session.ID, now)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, s.revokeReused(ctx, session)
+	}
+	return s.issue(ctx, session.UserID, session.Family)
+}
+
+func (s *Sessions) revokeReused(ctx context.Context, session *Session) error {
+	log.Printf("Refresh: Refresh token reused for user %s, revoking family %s", session.UserID.Hex(), session.Family.Hex())
+	if err := s.Store.DeleteFamily(ctx, session.Family); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+// Revoke ends the family the refresh token belongs to, as on logout.
+// Unknown tokens are not an error since the session is gone either way.
+func (s *Sessions) Revoke(ctx context.Context, refreshToken string) error {
+	session, err := s.Store.SessionByHash(ctx, HashToken(refreshToken))
+	if err == ErrSessionNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.Store.DeleteFamily(ctx, session.Family)
+}
+
+// RevokeAll ends every session of the user.
+func (s *Sessions) RevokeAll(ctx context.Context, userID primitive.ObjectID) error {
+	return s.Store.DeleteUserSessions(ctx, userID)
+}
+
+func (s *Sessions) issue(ctx context.Context, userID, family primitive.ObjectID) (*TokenPair, error) {
+	access, err := s.Tokens.Issue(userID)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := RandomToken()
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	if err := s.Store.CreateSession(ctx, &Session{
+		UserID:    userID,
+		Family:    family,
+		TokenHash: HashToken(refresh),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.TTL),
+	}); err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresIn:    int64(s.Tokens.TTL() / time.Second),
+	}, nil
+}
+
+// RandomToken returns a new unguessable token for refresh tokens, email
+// links, invitations and the like, to be stored only as its HashToken.
+func RandomToken() (string, error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex SHA-256 of token, the form tokens are stored
+// and looked up in.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
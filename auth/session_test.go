@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memorySessions is a SessionStore for tests.
+type memorySessions struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func newMemorySessions() *memorySessions {
+	return &memorySessions{sessions: make(map[string]*Session)}
+}
+
+func (m *memorySessions) CreateSession(_ context.Context, s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s.ID = primitive.NewObjectID()
+	copied := *s
+	m.sessions[s.TokenHash] = &copied
+	return nil
+}
+
+func (m *memorySessions) SessionByHash(_ context.Context, hash string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[hash]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	copied := *s
+	return &copied, nil
+}
+
+func (m *memorySessions) MarkSessionUsed(_ context.Context, id primitive.ObjectID, at time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.sessions {
+		if s.ID == id && s.UsedAt == nil {
+			s.UsedAt = &at
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memorySessions) DeleteFamily(_ context.Context, family primitive.ObjectID) error {
+	return m.deleteWhere(func(s *Session) bool { return s.Family == family })
+}
+
+func (m *memorySessions) DeleteUserSessions(_ context.Context, userID primitive.ObjectID) error {
+	return m.deleteWhere(func(s *Session) bool { return s.UserID == userID })
+}
+
+func (m *memorySessions) deleteWhere(match func(*Session) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for hash, s := range m.sessions {
+		if match(s) {
+			delete(m.sessions, hash)
+		}
+	}
+	return nil
+}
+
+func testSessions() (*Sessions, *memorySessions) {
+	store := newMemorySessions()
+	return NewSessions(NewTokenIssuer([]byte("secret"), DefaultAccessTTL), store), store
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	sessions, store := testSessions()
+	ctx := context.Background()
+	userID := primitive.NewObjectID()
+
+	first, err := sessions.Start(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ExpiresIn != int64(DefaultAccessTTL/time.Second) {
+		t.Errorf("expiresIn = %d, want %d", first.ExpiresIn, int64(DefaultAccessTTL/time.Second))
+	}
+	if _, ok := store.sessions[first.RefreshToken]; ok {
+		t.Error("refresh token stored in plain text")
+	}
+
+	second, err := sessions.Refresh(ctx, first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Error("refresh token was not rotated")
+	}
+	claims, err := sessions.Tokens.Parse(second.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := claims.UserID(); got != userID {
+		t.Errorf("access token is for %s, want %s", got.Hex(), userID.Hex())
+	}
+	if _, err := sessions.Refresh(ctx, second.RefreshToken); err != nil {
+		t.Errorf("rotated token rejected: %v", err)
+	}
+}
+
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	sessions, _ := testSessions()
+	ctx := context.Background()
+	userID := primitive.NewObjectID()
+
+	first, _ := sessions.Start(ctx, userID)
+	other, _ := sessions.Start(ctx, userID)
+	second, err := sessions.Refresh(ctx, first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sessions.Refresh(ctx, first.RefreshToken); err != ErrRefreshTokenReused {
+		t.Fatalf("reusing a token: err = %v, want %v", err, ErrRefreshTokenReused)
+	}
+	if _, err := sessions.Refresh(ctx, second.RefreshToken); err != ErrInvalidRefreshToken {
+		t.Errorf("token from a revoked family: err = %v, want %v", err, ErrInvalidRefreshToken)
+	}
+	if _, err := sessions.Refresh(ctx, other.RefreshToken); err != nil {
+		t.Errorf("token from another sign-in rejected: %v", err)
+	}
+}
+
+func TestRefreshRejectsExpiredTokens(t *testing.T) {
+	sessions, _ := testSessions()
+	ctx := context.Background()
+
+	pair, _ := sessions.Start(ctx, primitive.NewObjectID())
+	sessions.now = func() time.Time { return time.Now().Add(DefaultRefreshTTL + time.Minute) }
+	if _, err := sessions.Refresh(ctx, pair.RefreshToken); err != ErrInvalidRefreshToken {
+		t.Errorf("err = %v, want %v", err, ErrInvalidRefreshToken)
+	}
+	if _, err := sessions.Refresh(ctx, "unknown"); err != ErrInvalidRefreshToken {
+		t.Errorf("unknown token: err = %v, want %v", err, ErrInvalidRefreshToken)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	sessions, _ := testSessions()
+	ctx := context.Background()
+	userID := primitive.NewObjectID()
+
+	first, _ := sessions.Start(ctx, userID)
+	second, _ := sessions.Start(ctx, userID)
+	if err := sessions.Revoke(ctx, first.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessions.Refresh(ctx, first.RefreshToken); err != ErrInvalidRefreshToken {
+		t.Errorf("logged out token: err = %v, want %v", err, ErrInvalidRefreshToken)
+	}
+	third, err := sessions.Refresh(ctx, second.RefreshToken)
+	if err != nil {
+		t.Fatalf("other device logged out too: %v", err)
+	}
+
+	if err := sessions.RevokeAll(ctx, userID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessions.Refresh(ctx, third.RefreshToken); err != ErrInvalidRefreshToken {
+		t.Errorf("after logging out everywhere: err = %v, want %v", err, ErrInvalidRefreshToken)
+	}
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LoginAttempts counts recent failed sign-ins for one account or address.
+type LoginAttempts struct {
+	Key         string    `bson:"_id"`
+	Failures    int       `bson:"failures"`
+	LockedUntil time.Time `bson:"lockedUntil"`
+	// ExpiresAt carries the TTL index; the counter is forgotten once no
+	// failure happened for a while.
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// AttemptStore persists failed sign-in counters.
+type AttemptStore interface {
+	LoginAttempts(ctx context.Context, key string) (*LoginAttempts, error)
+	// AddFailure increments the counter for key and returns it.
+	AddFailure(ctx context.Context, key string, expiresAt time.Time) (*LoginAttempts, error)
+	LockUntil(ctx context.Context, key string, until time.Time) error
+	ResetAttempts(ctx context.Context, key string) error
+}
+
+// MongoAttempts is an AttemptStore backed by the login_attempts collection.
+type MongoAttempts struct {
+	DB *mongo.Database
+}
+
+func (s MongoAttempts) collection() *mongo.Collection {
+	return s.DB.Collection("login_attempts")
+}
+
+// EnsureIndexes creates the TTL index on expiresAt.
+func (s MongoAttempts) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create login attempt index: %v", err)
+	}
+	return nil
+}
+
+func (s MongoAttempts) LoginAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	var a LoginAttempts
+	err := s.collection().FindOne(ctx, bson.M{"_id": key}).Decode(&a)
+	if err == mongo.ErrNoDocuments {
+		return &LoginAttempts{Key: key}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch login attempts: %v", err)
+	}
+	return &a, nil
+}
+
+func (s MongoAttempts) AddFailure(ctx context.Context, key string, expiresAt time.Time) (*LoginAttempts, error) {
+	var a LoginAttempts
+	err := s.collection().FindOneAndUpdate(ctx,
+		bson.M{"_id": key},
+		bson.M{"$inc": bson.M{"failures": 1}, "$set": bson.M{"expiresAt": expiresAt}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&a)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record login failure: %v", err)
+	}
+	return &a, nil
+}
+
+func (s MongoAttempts) LockUntil(ctx context.Context, key string, until time.Time) error {
+	if _, err := s.collection().UpdateOne(ctx, bson.M{"_id": key}, bson.M{"$set": bson.M{"lockedUntil": until}}); err != nil {
+		return fmt.Errorf("failed to lock login: %v", err)
+	}
+	return nil
+}
+
+func (s MongoAttempts) ResetAttempts(ctx context.Context, key string) error {
+	if _, err := s.collection().DeleteOne(ctx, bson.M{"_id": key}); err != nil {
+		return fmt.Errorf("failed to reset login attempts: %v", err)
+	}
+	return nil
+}
+
+// Throttle locks out accounts and client addresses after repeated failed
+// sign-ins. Each failure past the limit doubles the lockout, up to
+// MaxLockout. Accounts get a lower limit than addresses, which may be
+// shared by many users behind one NAT.
+type Throttle struct {
+	Store        AttemptStore
+	AccountLimit int
+	IPLimit      int
+	BaseLockout  time.Duration
+	MaxLockout   time.Duration
+	// Window is how long failures are remembered after the last one.
+	Window time.Duration
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewThrottle returns a throttle allowing 5 failures per account and 20
+// per address before locking for one minute, doubling up to an hour.
+func NewThrottle(store AttemptStore) *Throttle {
+	return &Throttle{
+		Store:        store,
+		AccountLimit: 5,
+		IPLimit:      20,
+		BaseLockout:  time.Minute,
+		MaxLockout:   time.Hour,
+		Window:       24 * time.Hour,
+		now:          time.Now,
+	}
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Locked returns how long sign-ins for email from ip must wait, or zero.
+func (t *Throttle) Locked(ctx context.Context, email, ip string) (time.Duration, error) {
+	now := t.now()
+	var wait time.Duration
+	for _, key := range []string{accountKey(email), ipKey(ip)} {
+		a, err := t.Store.LoginAttempts(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if d := a.LockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// Failure records a failed sign-in for email from ip, locking either once
+// it is over its limit.
+func (t *Throttle) Failure(ctx context.Context, email, ip string) error {
+	now := t.now()
+	for _, k := range []struct {
+		key   string
+		limit int
+	}{{accountKey(email), t.AccountLimit}, {ipKey(ip), t.IPLimit}} {
+		a, err := t.Store.AddFailure(ctx, k.key, now.Add(t.Window))
+		if err != nil {
+			return err
+		}
+		if a.Failures < k.limit {
+			continue
+		}
+		if err := t.Store.LockUntil(ctx, k.key, now.Add(t.lockout(a.Failures-k.limit))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockout returns BaseLockout doubled n times, capped at MaxLockout.
+func (t *Throttle) lockout(n int) time.Duration {
+	d := t.BaseLockout
+	for i := 0; i < n && d < t.MaxLockout; i++ {
+		d *= 2
+	}
+	if d > t.MaxLockout {
+		d = t.MaxLockout
+	}
+	return d
+}
+
+// Success clears the account's failures. The address keeps its count so
+// one valid account cannot be used to reset guessing at others.
+func (t *Throttle) Success(ctx context.Context, email string) error {
+	return t.Store.ResetAttempts(ctx, accountKey(email))
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryAttempts is an AttemptStore for tests.
+type memoryAttempts struct {
+	mu       sync.Mutex
+	attempts map[string]*LoginAttempts
+}
+
+func (m *memoryAttempts) LoginAttempts(_ context.Context, key string) (*LoginAttempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if a, ok := m.attempts[key]; ok {
+		copied := *a
+		return &copied, nil
+	}
+	return &LoginAttempts{Key: key}, nil
+}
+
+func (m *memoryAttempts) AddFailure(_ context.Context, key string, expiresAt time.Time) (*LoginAttempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.attempts[key]
+	if !ok {
+		a = &LoginAttempts{Key: key}
+		m.attempts[key] = a
+	}
+	a.Failures++
+	a.ExpiresAt = expiresAt
+	copied := *a
+	return &copied, nil
+}
+
+func (m *memoryAttempts) LockUntil(_ context.Context, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.attempts[key].LockedUntil = until
+	return nil
+}
+
+func (m *memoryAttempts) ResetAttempts(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, key)
+	return nil
+}
+
+func TestThrottleLocksAccount(t *testing.T) {
+	throttle := NewThrottle(&memoryAttempts{attempts: make(map[string]*LoginAttempts)})
+	now := time.Now()
+	throttle.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < throttle.AccountLimit-1; i++ {
+		throttle.Failure(ctx, "a@example.com", "10.0.0.1")
+	}
+	if wait, _ := throttle.Locked(ctx, "a@example.com", "10.0.0.2"); wait != 0 {
+		t.Fatalf("locked after %d failures", throttle.AccountLimit-1)
+	}
+
+	// The limit is reached: one minute, then doubling per failure
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		throttle.Failure(ctx, "A@example.com", "10.0.0.1")
+		wait, err := throttle.Locked(ctx, "a@example.com", "10.0.0.2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != want {
+			t.Errorf("after %d failures over the limit: wait %v, want %v", i, wait, want)
+		}
+	}
+	if wait, _ := throttle.Locked(ctx, "b@example.com", "10.0.0.2"); wait != 0 {
+		t.Error("other account locked")
+	}
+
+	throttle.Success(ctx, "a@example.com")
+	if wait, _ := throttle.Locked(ctx, "a@example.com", "10.0.0.2"); wait != 0 {
+		t.Error("account still locked after a successful sign-in")
+	}
+}
+
+func TestThrottleLocksAddress(t *testing.T) {
+	throttle := NewThrottle(&memoryAttempts{attempts: make(map[string]*LoginAttempts)})
+	ctx := context.Background()
+
+	// Spread over many accounts so only the address limit is hit
+	for i := 0; i < throttle.IPLimit; i++ {
+		throttle.Failure(ctx, string(rune('a'+i))+"@example.com", "10.0.0.1")
+	}
+	if wait, _ := throttle.Locked(ctx, "new@example.com", "10.0.0.1"); wait <= 0 {
+		t.Error("address not locked")
+	}
+	if wait, _ := throttle.Locked(ctx, "new@example.com", "10.0.0.2"); wait != 0 {
+		t.Error("other address locked")
+	}
+}
+
+func TestThrottleLockoutIsCapped(t *testing.T) {
+	throttle := NewThrottle(nil)
+	if got := throttle.lockout(100); got != throttle.MaxLockout {
+		t.Errorf("lockout(100) = %v, want %v", got, throttle.MaxLockout)
+	}
+}
@@ -0,0 +1,131 @@
+// Package auth issues and verifies the access tokens used by the API and
+// provides the middleware that resolves them to users.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Issuer is the iss claim of every token this package signs.
+	Issuer = "watermark-generator"
+	// DefaultAccessTTL is how long an access token stays valid. Tokens are
+	// short-lived; clients renew them with a refresh token.
+	DefaultAccessTTL = 15 * time.Minute
+)
+
+// Claims are the contents of an access token. The subject is the user's
+// ObjectID in hex.
+type Claims struct {
+	jwt.RegisteredClaims
+	// Actor is set on impersonation tokens and names the staff member
+	// acting as the subject, as in the act claim of RFC 8693.
+	Actor *Actor `json:"act,omitempty"`
+}
+
+// Actor identifies who is acting on behalf of a token's subject.
+type Actor struct {
+	Subject string `json:"sub"`
+}
+
+// UserID returns the subject as an ObjectID.
+func (c *Claims) UserID() (primitive.ObjectID, error) {
+	return primitive.ObjectIDFromHex(c.Subject)
+}
+
+// TokenIssuer signs and verifies HS256 access tokens.
+type TokenIssuer struct {
+	secret []byte
+	ttl    time.Duration
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewTokenIssuer returns an issuer signing with secret whose tokens expire
+// after ttl.
+func NewTokenIssuer(secret []byte, ttl time.Duration) *TokenIssuer {
+	return &TokenIssuer{secret: secret, ttl: ttl, now: time.Now}
+}
+
+// TokenIssuerFromEnv returns an issuer using the JWT_SECRET environment
+// variable.
+func TokenIssuerFromEnv() *TokenIssuer {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		log.Println("TokenIssuerFromEnv: JWT_SECRET is not set, tokens cannot be issued")
+	}
+	return NewTokenIssuer([]byte(secret), DefaultAccessTTL)
+}
+
+// Issue returns a signed token for the user.
+func (i *TokenIssuer) Issue(userID primitive.ObjectID) (string, error) {
+	return i.issue(userID, nil)
+}
+
+// IssueAs returns a token for the user carrying actorID as the actor, for
+// staff impersonating a user. Such tokens cannot be refreshed.
+func (i *TokenIssuer) IssueAs(userID, actorID primitive.ObjectID) (string, error) {
+	return i.issue(userID, &Actor{Subject: actorID.Hex()})
+}
+
+// TTL returns how long issued tokens stay valid.
+func (i *TokenIssuer) TTL() time.Duration {
+	return i.ttl
+}
+
+func (i *TokenIssuer) issue(userID primitive.ObjectID, actor *Actor) (string, error) {
+	if len(i.secret) == 0 {
+		return "", errors.New("no signing secret configured")
+	}
+	now := i.now()
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Issuer,
+			Subject:   userID.Hex(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(i.ttl)),
+		},
+		Actor: actor,
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(i.secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %v", err)
+	}
+	return token, nil
+}
+
+// Parse verifies a token's signature, issuer and expiry and returns its
+// claims.
+func (i *TokenIssuer) Parse(tokenString string) (*Claims, error) {
+	if len(i.secret) == 0 {
+		return nil, errors.New("no signing secret configured")
+	}
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(*jwt.Token) (interface{}, error) {
+		return i.secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(i.now),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+	if _, err := claims.UserID(); err != nil {
+		return nil, fmt.Errorf("invalid token subject: %v", err)
+	}
+	if claims.Actor != nil {
+		if _, err := primitive.ObjectIDFromHex(claims.Actor.Subject); err != nil {
+			return nil, fmt.Errorf("invalid token actor: %v", err)
+		}
+	}
+	return claims, nil
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestTokenRoundTrip(t *testing.T) {
+	tokens := NewTokenIssuer([]byte("secret"), time.Hour)
+	id := primitive.NewObjectID()
+
+	token, err := tokens.Issue(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := tokens.Parse(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := claims.UserID(); got != id {
+		t.Errorf("token is for %s, want %s", got.Hex(), id.Hex())
+	}
+	if claims.Issuer != Issuer {
+		t.Errorf("issuer = %q, want %q", claims.Issuer, Issuer)
+	}
+}
+
+func TestParseRejectsInvalidTokens(t *testing.T) {
+	tokens := NewTokenIssuer([]byte("secret"), time.Hour)
+	id := primitive.NewObjectID()
+	sign := func(method jwt.SigningMethod, key interface{}, claims jwt.Claims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := func() jwt.RegisteredClaims {
+		return jwt.RegisteredClaims{
+			Issuer:    Issuer,
+			Subject:   id.Hex(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		}
+	}
+
+	expired := valid()
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	noExpiry := valid()
+	noExpiry.ExpiresAt = nil
+	otherIssuer := valid()
+	otherIssuer.Issuer = "someone-else"
+	badSubject := valid()
+	badSubject.Subject = "not-an-object-id"
+
+	tests := map[string]string{
+		"expired":      sign(jwt.SigningMethodHS256, []byte("secret"), expired),
+		"no expiry":    sign(jwt.SigningMethodHS256, []byte("secret"), noExpiry),
+		"other issuer": sign(jwt.SigningMethodHS256, []byte("secret"), otherIssuer),
+		"bad subject":  sign(jwt.SigningMethodHS256, []byte("secret"), badSubject),
+		"wrong secret": sign(jwt.SigningMethodHS256, []byte("other"), valid()),
+		"wrong alg":    sign(jwt.SigningMethodHS512, []byte("secret"), valid()),
+		"unsigned":     sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, valid()),
+		// Tokens from the old scheme carried the ID in user_id
+		"legacy claims": sign(jwt.SigningMethodHS256, []byte("secret"), jwt.MapClaims{
+			"user_id": id.Hex(),
+			"exp":     time.Now().Add(time.Hour).Unix(),
+		}),
+		"garbage": "not.a.token",
+	}
+	for name, token := range tests {
+		if _, err := tokens.Parse(token); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+}
+
+func TestIssueRequiresSecret(t *testing.T) {
+	tokens := NewTokenIssuer(nil, time.Hour)
+	if _, err := tokens.Issue(primitive.NewObjectID()); err == nil {
+		t.Error("token issued without a secret")
+	}
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters. They are the defaults of RFC 6238 and the only ones
+// authenticator apps reliably support.
+const (
+	TOTPDigits = 6
+	TOTPPeriod = 30 * time.Second
+	// TOTPSkew is how many periods before or after the current one are
+	// accepted, to allow for clock drift and slow typing.
+	TOTPSkew = 1
+
+	totpSecretBytes = 20
+)
+
+// PurposeTwoFactor is the one-time token purpose of sign-in challenges:
+// the password was right and a TOTP or recovery code is still needed.
+const PurposeTwoFactor = "two-factor"
+
+// TwoFactorChallengeTTL is how long the user has to enter a code after
+// the password.
+const TwoFactorChallengeTTL = 5 * time.Minute
+
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random 160-bit secret in base32, the length
+// RFC 4226 recommends for HMAC-SHA1.
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %v", err)
+	}
+	return secretEncoding.EncodeToString(b), nil
+}
+
+// DecodeTOTPSecret decodes a base32 secret, ignoring case, spaces and
+// padding as authenticator apps do.
+func DecodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.TrimRight(strings.ToUpper(strings.ReplaceAll(secret, " ", "")), "=")
+	b, err := secretEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TOTP secret: %v", err)
+	}
+	return b, nil
+}
+
+// TOTPURI returns the otpauth:// URI that authenticator apps scan to add
+// the account.
+func TOTPURI(issuer, account, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(TOTPDigits))
+	q.Set("period", fmt.Sprint(int(TOTPPeriod/time.Second)))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// HOTP computes the RFC 4226 one-time password for counter.
+func HOTP(key []byte, counter uint64, digits int, h func() hash.Hash) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(h, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// TOTPCounter returns the RFC 6238 time step containing t.
+func TOTPCounter(t time.Time) uint64 {
+	return uint64(t.Unix()) / uint64(TOTPPeriod/time.Second)
+}
+
+// TOTPCode returns the code for t.
+func TOTPCode(key []byte, t time.Time) string {
+	return HOTP(key, TOTPCounter(t), TOTPDigits, sha1.New)
+}
+
+// ValidateTOTP checks code against the time steps around now and returns
+// the step it matched. Callers store the step and reject codes for steps
+// at or before it, so that a code cannot be used twice.
+func ValidateTOTP(key []byte, code string, now time.Time) (uint64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+	current := TOTPCounter(now)
+	for i := -TOTPSkew; i <= TOTPSkew; i++ {
+		counter := current + uint64(i)
+		if subtle.ConstantTimeCompare([]byte(HOTP(key, counter, TOTPDigits, sha1.New)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// RecoveryCodeCount is how many recovery codes a user gets.
+const RecoveryCodeCount = 10
+
+// NewRecoveryCodes returns RecoveryCodeCount random codes such as
+// "k3jd-8fhq-p2xm-r7tn" and their hashes for storage. Each code carries
+// about 79 bits, so a fast hash is enough.
+func NewRecoveryCodes() (codes, hashes []string, err error) {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate recovery code: %v", err)
+		}
+		var code strings.Builder
+		for j, c := range b {
+			if j > 0 && j%4 == 0 {
+				code.WriteByte('-')
+			}
+			// 256 is not a multiple of 31, but the modulo bias costs
+			// well under a bit per code
+			code.WriteByte(alphabet[int(c)%len(alphabet)])
+		}
+		codes = append(codes, code.String())
+		hashes = append(hashes, HashRecoveryCode(code.String()))
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode returns the stored form of a recovery code. Case,
+// spaces and dashes are ignored.
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return HashToken(code)
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The test vectors of RFC 6238 appendix B. The seeds are the ASCII digits
+// "1234567890" repeated to the hash's block-size key length.
+func TestTOTPVectors(t *testing.T) {
+	seeds := map[string]struct {
+		key []byte
+		h   func() hash.Hash
+	}{
+		"SHA1":   {[]byte("12345678901234567890"), sha1.New},
+		"SHA256": {[]byte("12345678901234567890123456789012"), sha256.New},
+		"SHA512": {[]byte("1234567890123456789012345678901234567890123456789012345678901234"), sha512.New},
+	}
+	vectors := []struct {
+		unix int64
+		algo string
+		want string
+	}{
+		{59, "SHA1", "94287082"},
+		{59, "SHA256", "46119246"},
+		{59, "SHA512", "90693936"},
+		{1111111109, "SHA1", "07081804"},
+		{1111111109, "SHA256", "68084774"},
+		{1111111109, "SHA512", "25091201"},
+		{1111111111, "SHA1", "14050471"},
+		{1111111111, "SHA256", "67062674"},
+		{1111111111, "SHA512", "99943326"},
+		{1234567890, "SHA1", "89005924"},
+		{1234567890, "SHA256", "91819424"},
+		{1234567890, "SHA512", "93441116"},
+		{2000000000, "SHA1", "69279037"},
+		{2000000000, "SHA256", "90698825"},
+		{2000000000, "SHA512", "38618901"},
+		{20000000000, "SHA1", "65353130"},
+		{20000000000, "SHA256", "77737706"},
+		{20000000000, "SHA512", "47863826"},
+	}
+	for _, v := range vectors {
+		seed := seeds[v.algo]
+		got := HOTP(seed.key, TOTPCounter(time.Unix(v.unix, 0)), 8, seed.h)
+		if got != v.want {
+			t.Errorf("%s at %d: got %s, want %s", v.algo, v.unix, got, v.want)
+		}
+	}
+}
+
+// The first values of RFC 4226 appendix D.
+func TestHOTPVectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	for counter, want := range []string{"755224", "287082", "359152", "969429", "338314"} {
+		if got := HOTP(key, uint64(counter), 6, sha1.New); got != want {
+			t.Errorf("counter %d: got %s, want %s", counter, got, want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := DecodeTOTPSecret(strings.ToLower(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+
+	for _, offset := range []time.Duration{-TOTPPeriod, 0, TOTPPeriod} {
+		counter, ok := ValidateTOTP(key, TOTPCode(key, now.Add(offset)), now)
+		if !ok {
+			t.Errorf("code from %v away rejected", offset)
+		}
+		if want := TOTPCounter(now.Add(offset)); counter != want {
+			t.Errorf("code from %v away matched step %d, want %d", offset, counter, want)
+		}
+	}
+	for _, offset := range []time.Duration{-2 * TOTPPeriod, 2 * TOTPPeriod} {
+		if _, ok := ValidateTOTP(key, TOTPCode(key, now.Add(offset)), now); ok {
+			t.Errorf("code from %v away accepted", offset)
+		}
+	}
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := ValidateTOTP(key, code, now); ok {
+			t.Errorf("code %q accepted", code)
+		}
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("Watermark Generator", "someone@example.com", "JBSWY3DPEHPK3PXP")
+	want := "otpauth://totp/Watermark%20Generator:someone@example.com?algorithm=SHA1&digits=6&issuer=Watermark+Generator&period=30&secret=JBSWY3DPEHPK3PXP"
+	if uri != want {
+		t.Errorf("uri = %s\nwant  %s", uri, want)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := NewRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount || len(hashes) != RecoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), RecoveryCodeCount)
+	}
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if len(code) != 19 || strings.Count(code, "-") != 3 {
+			t.Errorf("code %q is not four groups of four", code)
+		}
+		if seen[code] {
+			t.Errorf("duplicate code %q", code)
+		}
+		seen[code] = true
+		typed := strings.ToUpper(strings.ReplaceAll(code, "-", " "))
+		if HashRecoveryCode(typed) != hashes[i] {
+			t.Errorf("code %q typed as %q does not match its hash", code, typed)
+		}
+	}
+}
@@ -30,11 +30,16 @@ import ImagePreview from './components/ImagePreview';
 import AppBarComponent from './components/AppBarComponent';
 import { useAuth } from './hooks/useAuth';
 import AdminPage from './components/AdminPage';
+import ForgotPassword from './components/ForgotPassword';
+import ResetPassword from './components/ResetPassword';
+import VerifyEmail from './components/VerifyEmail';
+import OIDCCallback from './components/OIDCCallback';
 import AuthModal from './components/AuthModal';
 import Subscription from './components/Subscription';
 import SubscriptionSuccess from './components/SubscriptionSuccess';
 import SubscriptionCancel from './components/SubscriptionCancel';
 import SettingsPage from './components/SettingsPage';
+import AcceptInvite from './components/AcceptInvite';
 import BackgroundBlobs from './components/BackgroundBlobs';
 import SEO from './components/SEO';
 
@@ -72,7 +77,7 @@ function App() {
   useEffect(() => {
     if (!user) {
       setIsDownloadDisabled(true);
-    } else if (user.subscriptionStatus !== "active" && user.dailyDownloads >= 1) {
+    } else if (!user.isPaid && user.dailyDownloads >= 1) {
       setIsDownloadDisabled(true);
     } else {
       setIsDownloadDisabled(false);
@@ -110,7 +115,6 @@ function App() {
     formData.append('uniqueId', Date.now().toString());
     formData.append('opacity', opacity.toString());
     formData.append('spacing', spacing.toString());
-    formData.append('userId', user.id);
 
     if (tabIndex === 0) {
       // Text watermark
@@ -134,6 +138,7 @@ function App() {
         }
         response = await fetch('/api/watermark/bulk/' + (tabIndex === 0 ? 'text' : 'image'), {
           method: 'POST',
+          headers: { 'Authorization': `Bearer ${user.token}` },
           body: formData,
         });
       } else if (file) {
@@ -141,6 +146,7 @@ function App() {
         formData.append('image', file);
         response = await fetch('/api/watermark/' + (tabIndex === 0 ? 'text' : 'image'), {
           method: 'POST',
+          headers: { 'Authorization': `Bearer ${user.token}` },
           body: formData,
         });
       } else {
@@ -266,7 +272,7 @@ function App() {
                                       <Checkbox
                                         checked={isBulkUpload}
                                         onChange={(e) => setIsBulkUpload(e.target.checked)}
-                                        disabled={user?.subscriptionStatus !== "active"}
+                                        disabled={!user?.isPaid}
                                       />
                                     }
                                     label="Bulk Upload"
@@ -436,11 +442,16 @@ function App() {
                 } />
                 <Route path="/signin" element={<SignIn />} />
                 <Route path="/signup" element={<SignUp />} />
+                <Route path="/forgot-password" element={<ForgotPassword />} />
+                <Route path="/reset-password" element={<ResetPassword />} />
+                <Route path="/verify-email" element={<VerifyEmail />} />
+                <Route path="/oidc/callback" element={<OIDCCallback />} />
                 <Route path="/admin" element={<AdminPage />} />
                 <Route path="/subscription" element={<Subscription />} />
                 <Route path="/subscribe/success" element={<SubscriptionSuccess />} />
                 <Route path="/subscribe/cancel" element={<SubscriptionCancel />} />
                 <Route path="/settings" element={<SettingsPage />} />
+                <Route path="/invite" element={<AcceptInvite />} />
               </Routes>
             </Container>
             <Box
@@ -0,0 +1,61 @@
+import { useState } from 'react';
+import { Box, Typography, Alert, Button, Link } from '@mui/material';
+import { useSearchParams } from 'react-router-dom';
+import { useAuth } from '../hooks/useAuth';
+import SEO from './SEO';
+
+const AcceptInvite = () => {
+  const { user, refreshUser } = useAuth();
+  const [searchParams] = useSearchParams();
+  const token = searchParams.get('token') || '';
+  const [status, setStatus] = useState<'idle' | 'done' | 'failed'>('idle');
+  const [message, setMessage] = useState('');
+
+  const accept = async () => {
+    try {
+      const response = await fetch(`${import.meta.env.VITE_API_URL}/api/orgs/invitations/accept`, {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json',
+          'Authorization': `Bearer ${user?.token}`,
+        },
+        body: JSON.stringify({ token }),
+      });
+      const data = await response.json();
+      if (response.ok) {
+        setMessage(`You joined ${data.name}.`);
+        setStatus('done');
+        refreshUser();
+      } else {
+        setMessage(data.message);
+        setStatus('failed');
+      }
+    } catch (err) {
+      console.error('Error accepting invitation:', err);
+      setMessage('An error occurred, please try again');
+      setStatus('failed');
+    }
+  };
+
+  return (
+    <>
+      <SEO title="Join Organization" description="Accept an invitation to a Watermark Generator organization." canonicalUrl="https://watermark-generator.com/invite" />
+      <Box sx={{ maxWidth: 400, mx: 'auto', mt: 8 }}>
+        <Typography component="h1" variant="h5" gutterBottom>Organization invitation</Typography>
+        {!user && (
+          <Alert severity="info">
+            <Link href="/signin">Sign in</Link> or <Link href="/signup">create an account</Link> with
+            the email address the invitation was sent to, then open the link again.
+          </Alert>
+        )}
+        {user && status === 'idle' && (
+          <Button variant="contained" onClick={accept}>Join as {user.email}</Button>
+        )}
+        {status === 'done' && <Alert severity="success">{message} <Link href="/settings">Open settings</Link></Alert>}
+        {status === 'failed' && <Alert severity="error">{message}</Alert>}
+      </Box>
+    </>
+  );
+};
+
+export default AcceptInvite;
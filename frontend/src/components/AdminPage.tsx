@@ -1,26 +1,31 @@
 import { useEffect, useState } from 'react';
+import { useAuth } from '../hooks/useAuth';
 import { Table, TableBody, TableCell, TableContainer, TableHead, TableRow, Paper, Typography } from '@mui/material';
 
 interface User {
   id: string;
-  username: string;
-  firstName: string;
   email: string;
+  role: string;
+  disabled: boolean;
 }
 
 const AdminPage = () => {
   const [users, setUsers] = useState<User[]>([]);
   const [error, setError] = useState<string | null>(null);
+  const { user } = useAuth();
 
   useEffect(() => {
+    if (!user) return;
     const fetchUsers = async () => {
       try {
-        const response = await fetch(`${import.meta.env.VITE_API_URL}/api/users`, {
-          credentials: 'include',
+        const response = await fetch(`${import.meta.env.VITE_API_URL}/api/admin/users`, {
+          headers: { 'Authorization': `Bearer ${user.token}` },
         });
         if (response.ok) {
           const usersData = await response.json();
-          setUsers(usersData);
+          setUsers(usersData.users);
+        } else if (response.status === 403) {
+          setError('You do not have access to this page');
         } else {
           setError('Failed to fetch users');
         }
@@ -31,7 +36,7 @@ const AdminPage = () => {
     };
 
     fetchUsers();
-  }, []);
+  }, [user?.token]);
 
   return (
     <TableContainer component={Paper}>
@@ -43,18 +48,18 @@ const AdminPage = () => {
         <TableHead>
           <TableRow>
             <TableCell>ID</TableCell>
-            <TableCell>Username</TableCell>
-            <TableCell>First Name</TableCell>
             <TableCell>Email</TableCell>
+            <TableCell>Role</TableCell>
+            <TableCell>Status</TableCell>
           </TableRow>
         </TableHead>
         <TableBody>
-          {users.map((user) => (
-            <TableRow key={user.id}>
-              <TableCell>{user.id}</TableCell>
-              <TableCell>{user.username}</TableCell>
-              <TableCell>{user.firstName}</TableCell>
-              <TableCell>{user.email}</TableCell>
+          {users.map((row) => (
+            <TableRow key={row.id}>
+              <TableCell>{row.id}</TableCell>
+              <TableCell>{row.email}</TableCell>
+              <TableCell>{row.role}</TableCell>
+              <TableCell>{row.disabled ? 'Disabled' : 'Active'}</TableCell>
             </TableRow>
           ))}
         </TableBody>
@@ -0,0 +1,135 @@
+import React, { useEffect, useState } from 'react';
+import {
+  Alert,
+  Box,
+  Button,
+  Checkbox,
+  FormControlLabel,
+  Table,
+  TableBody,
+  TableCell,
+  TableHead,
+  TableRow,
+  TextField,
+} from '@mui/material';
+import { useAuth } from '../hooks/useAuth';
+
+interface ApiKey {
+  id: string;
+  name: string;
+  prefix: string;
+  scopes: string[];
+  createdAt: string;
+  lastUsedAt?: string;
+  useCount: number;
+}
+
+const ApiKeysSettings: React.FC = () => {
+  const { user } = useAuth();
+  const [keys, setKeys] = useState<ApiKey[]>([]);
+  const [scopes, setScopes] = useState<string[]>([]);
+  const [name, setName] = useState('');
+  const [selected, setSelected] = useState<string[]>(['watermark:write']);
+  const [newKey, setNewKey] = useState('');
+  const [error, setError] = useState('');
+
+  const request = (path: string, init: RequestInit = {}) =>
+    fetch(`${import.meta.env.VITE_API_URL}/api/keys${path}`, {
+      ...init,
+      headers: {
+        'Content-Type': 'application/json',
+        'Authorization': `Bearer ${user?.token}`,
+      },
+    });
+
+  const load = async () => {
+    try {
+      const response = await request('');
+      if (response.ok) {
+        const data = await response.json();
+        setKeys(data.keys);
+        setScopes(data.scopes);
+      }
+    } catch (err) {
+      console.error('Error fetching API keys:', err);
+    }
+  };
+
+  useEffect(() => {
+    if (user?.token) load();
+  }, [user?.token]);
+
+  const create = async () => {
+    setError('');
+    const response = await request('', { method: 'POST', body: JSON.stringify({ name, scopes: selected }) });
+    const data = await response.json();
+    if (!response.ok) {
+      setError(data.message || 'Failed to create key');
+      return;
+    }
+    setNewKey(data.key);
+    setName('');
+    load();
+  };
+
+  const revoke = async (id: string) => {
+    const response = await request('/revoke', { method: 'POST', body: JSON.stringify({ id }) });
+    if (response.ok) load();
+  };
+
+  const toggle = (scope: string) =>
+    setSelected(selected.includes(scope) ? selected.filter((s) => s !== scope) : [...selected, scope]);
+
+  return (
+    <Box>
+      {newKey && (
+        <Alert severity="success" sx={{ mb: 2 }} onClose={() => setNewKey('')}>
+          Copy your new key now, it will not be shown again:
+          <Box component="pre" sx={{ mt: 1, fontFamily: 'monospace', whiteSpace: 'pre-wrap', wordBreak: 'break-all' }}>{newKey}</Box>
+        </Alert>
+      )}
+      {error && <Alert severity="error" sx={{ mb: 2 }}>{error}</Alert>}
+
+      <Box sx={{ display: 'flex', alignItems: 'center', gap: 2, flexWrap: 'wrap' }}>
+        <TextField label="Key name" size="small" value={name} onChange={(e) => setName(e.target.value)} />
+        {scopes.map((scope) => (
+          <FormControlLabel
+            key={scope}
+            control={<Checkbox checked={selected.includes(scope)} onChange={() => toggle(scope)} />}
+            label={scope}
+          />
+        ))}
+        <Button variant="contained" onClick={create} disabled={!name || selected.length === 0}>Create key</Button>
+      </Box>
+
+      {keys.length > 0 && (
+        <Table size="small" sx={{ mt: 2 }}>
+          <TableHead>
+            <TableRow>
+              <TableCell>Name</TableCell>
+              <TableCell>Key</TableCell>
+              <TableCell>Scopes</TableCell>
+              <TableCell>Last used</TableCell>
+              <TableCell>Requests</TableCell>
+              <TableCell />
+            </TableRow>
+          </TableHead>
+          <TableBody>
+            {keys.map((key) => (
+              <TableRow key={key.id}>
+                <TableCell>{key.name}</TableCell>
+                <TableCell><code>{key.prefix}…</code></TableCell>
+                <TableCell>{key.scopes.join(', ')}</TableCell>
+                <TableCell>{key.lastUsedAt ? new Date(key.lastUsedAt).toLocaleString() : 'Never'}</TableCell>
+                <TableCell>{key.useCount}</TableCell>
+                <TableCell><Button color="secondary" onClick={() => revoke(key.id)}>Revoke</Button></TableCell>
+              </TableRow>
+            ))}
+          </TableBody>
+        </Table>
+      )}
+    </Box>
+  );
+};
+
+export default ApiKeysSettings;
@@ -74,7 +74,7 @@ const AppBarComponent = () => {
           <Typography variant="h6" component="div" sx={{ flexGrow: 1 }}>
             Watermark Generator
           </Typography>
-          {user && user.subscriptionStatus === 'active' ? (
+          {user && user.isPaid ? (
             <Chip
               icon={<StarIcon fontSize="small" />}
               label="PRO"
@@ -13,8 +13,10 @@ import {
 import { Favorite as FavoriteIcon } from '@mui/icons-material';
 import axios from 'axios';
 import { loadStripe } from '@stripe/stripe-js';
+import { useAuth } from '../hooks/useAuth';
 
 const DonationForm = () => {
+  const { user } = useAuth();
   const [amount, setAmount] = useState(5.00);
   const [isProcessing, setIsProcessing] = useState(false);
   const [open, setOpen] = useState(false);
@@ -28,6 +30,10 @@ const DonationForm = () => {
 
   const handleSubmit = useCallback(async (event: React.FormEvent<HTMLFormElement>) => {
     event.preventDefault();
+    if (!user) {
+      setError('Please sign in to make a donation.');
+      return;
+    }
     setIsProcessing(true);
     setError(null);
 
@@ -35,6 +41,8 @@ const DonationForm = () => {
       const response = await axios.post('/api/create-checkout-session', {
         amount: Math.round(amount * 100),
         currency: 'usd',
+      }, {
+        headers: { 'Authorization': `Bearer ${user.token}` },
       });
 
       const { sessionId } = response.data;
@@ -54,7 +62,7 @@ const DonationForm = () => {
     } finally {
       setIsProcessing(false);
     }
-  }, [amount]);
+  }, [amount, user]);
 
   return (
     <>
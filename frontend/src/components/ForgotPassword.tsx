@@ -0,0 +1,47 @@
+import React, { useState } from 'react';
+import { Box, Button, TextField, Typography, Alert } from '@mui/material';
+import SEO from './SEO';
+
+const ForgotPassword = () => {
+  const [email, setEmail] = useState('');
+  const [message, setMessage] = useState('');
+  const [error, setError] = useState('');
+
+  const handleSubmit = async (event: React.FormEvent<HTMLFormElement>) => {
+    event.preventDefault();
+    setError('');
+    setMessage('');
+    try {
+      const response = await fetch(`${import.meta.env.VITE_API_URL}/api/password/forgot`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ email }),
+      });
+      const data = await response.json();
+      if (response.ok) {
+        setMessage(data.message);
+      } else {
+        setError(data.message || 'Request failed');
+      }
+    } catch (err) {
+      console.error('Error requesting password reset:', err);
+      setError('An error occurred, please try again');
+    }
+  };
+
+  return (
+    <>
+      <SEO title="Forgot Password" description="Reset your Watermark Generator password." canonicalUrl="https://watermark-generator.com/forgot-password" />
+      <Box component="form" onSubmit={handleSubmit} sx={{ maxWidth: 400, mx: 'auto', mt: 8 }}>
+        <Typography component="h1" variant="h5" gutterBottom>Forgot your password?</Typography>
+        <Typography variant="body2" color="text.secondary">Enter your email address and we will send you a link to choose a new password.</Typography>
+        <TextField margin="normal" required fullWidth label="Email Address" type="email" autoComplete="email" value={email} onChange={(e) => setEmail(e.target.value)} />
+        {message && <Alert severity="success">{message}</Alert>}
+        {error && <Alert severity="error">{error}</Alert>}
+        <Button type="submit" fullWidth variant="contained" sx={{ mt: 2 }}>Send reset link</Button>
+      </Box>
+    </>
+  );
+};
+
+export default ForgotPassword;
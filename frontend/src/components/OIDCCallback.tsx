@@ -0,0 +1,64 @@
+import { useEffect, useState } from 'react';
+import { Box, Typography, Alert, Link, CircularProgress } from '@mui/material';
+import { useNavigate } from 'react-router-dom';
+import { useAuth } from '../hooks/useAuth';
+import TwoFactorPrompt from './TwoFactorPrompt';
+
+// The API redirects here after a provider sign-in with the tokens in the
+// URL fragment, which never reaches a server.
+const OIDCCallback = () => {
+  const navigate = useNavigate();
+  const { login } = useAuth();
+  const [error, setError] = useState('');
+  const [challenge, setChallenge] = useState('');
+
+  useEffect(() => {
+    const params = new URLSearchParams(window.location.hash.slice(1));
+    const token = params.get('token');
+    // Drop the tokens from the address bar and history
+    window.history.replaceState(null, '', window.location.pathname);
+    if (params.get('challenge')) {
+      setChallenge(params.get('challenge') || '');
+      return;
+    }
+    if (!token) {
+      setError('Sign in failed, please try again');
+      return;
+    }
+    const finish = async () => {
+      try {
+        const response = await fetch(`${import.meta.env.VITE_API_URL}/api/current-user`, {
+          headers: { 'Authorization': `Bearer ${token}` },
+        });
+        if (!response.ok) {
+          setError('Sign in failed, please try again');
+          return;
+        }
+        const userData = await response.json();
+        login({
+          ...userData,
+          token,
+          refreshToken: params.get('refreshToken') || '',
+          expiresIn: Number(params.get('expiresIn')) || 900,
+        });
+        navigate('/');
+      } catch (err) {
+        console.error('Error completing sign in:', err);
+        setError('An error occurred during sign in');
+      }
+    };
+    finish();
+  }, []);
+
+  return (
+    <Box sx={{ maxWidth: 400, mx: 'auto', mt: 8 }}>
+      <Typography component="h1" variant="h5" gutterBottom>Signing in</Typography>
+      {challenge && !error && (
+        <TwoFactorPrompt challenge={challenge} onSignedIn={(data) => { login(data); navigate('/'); }} />
+      )}
+      {error ? <Alert severity="error">{error} <Link href="/signin">Back to sign in</Link></Alert> : !challenge && <CircularProgress />}
+    </Box>
+  );
+};
+
+export default OIDCCallback;
@@ -0,0 +1,313 @@
+import React, { useEffect, useState } from 'react';
+import {
+  Alert,
+  Box,
+  Button,
+  FormControl,
+  InputLabel,
+  MenuItem,
+  Select,
+  Table,
+  TableBody,
+  TableCell,
+  TableHead,
+  TableRow,
+  TextField,
+  Typography,
+} from '@mui/material';
+import { loadStripe } from '@stripe/stripe-js';
+import { useAuth } from '../hooks/useAuth';
+
+export interface Organization {
+  id: string;
+  name: string;
+  role: string;
+  subscriptionStatus?: string;
+  subscriptionExpiresAt?: string;
+  seats: number;
+}
+
+interface Member {
+  userId: string;
+  email: string;
+  role: string;
+  joinedAt: string;
+}
+
+interface Invitation {
+  id: string;
+  email: string;
+  role: string;
+  expiresAt: string;
+}
+
+interface Asset {
+  id: string;
+  name: string;
+  contentType: string;
+  size: number;
+}
+
+interface Preset {
+  id: string;
+  name: string;
+  kind: string;
+}
+
+const roles = ['member', 'admin', 'owner'];
+
+const OrganizationSettings: React.FC = () => {
+  const { user } = useAuth();
+  const [orgs, setOrgs] = useState<Organization[]>([]);
+  const [selected, setSelected] = useState('');
+  const [members, setMembers] = useState<Member[]>([]);
+  const [invitations, setInvitations] = useState<Invitation[]>([]);
+  const [assets, setAssets] = useState<Asset[]>([]);
+  const [presets, setPresets] = useState<Preset[]>([]);
+  const [newName, setNewName] = useState('');
+  const [inviteEmail, setInviteEmail] = useState('');
+  const [inviteRole, setInviteRole] = useState('member');
+  const [assetName, setAssetName] = useState('');
+  const [error, setError] = useState('');
+  const [message, setMessage] = useState('');
+
+  const org = orgs.find((o) => o.id === selected);
+  const canManage = org?.role === 'owner' || org?.role === 'admin';
+
+  const request = (path: string, init: RequestInit = {}) =>
+    fetch(`${import.meta.env.VITE_API_URL}/api/orgs${path}`, {
+      ...init,
+      headers: {
+        ...(init.body instanceof FormData ? {} : { 'Content-Type': 'application/json' }),
+        'Authorization': `Bearer ${user?.token}`,
+      },
+    });
+
+  // post sends body to path and shows the server's message when it fails
+  const post = async (path: string, body: object | FormData) => {
+    setError('');
+    setMessage('');
+    const response = await request(path, {
+      method: 'POST',
+      body: body instanceof FormData ? body : JSON.stringify(body),
+    });
+    if (!response.ok) {
+      const data = await response.json().catch(() => ({}));
+      setError(data.message || 'Request failed');
+      return null;
+    }
+    return response.status === 204 ? {} : response.json();
+  };
+
+  const loadOrgs = async () => {
+    const response = await request('');
+    if (response.ok) {
+      const data = await response.json();
+      setOrgs(data.organizations);
+      if (!selected && data.organizations.length > 0) setSelected(data.organizations[0].id);
+    }
+  };
+
+  const loadOrg = async (id: string) => {
+    const [membersResponse, assetsResponse, presetsResponse] = await Promise.all([
+      request(`/members?org=${id}`),
+      request(`/assets?org=${id}`),
+      request(`/presets?org=${id}`),
+    ]);
+    if (membersResponse.ok) {
+      const data = await membersResponse.json();
+      setMembers(data.members);
+      setInvitations(data.invitations || []);
+    }
+    if (assetsResponse.ok) setAssets((await assetsResponse.json()).assets);
+    if (presetsResponse.ok) setPresets((await presetsResponse.json()).presets);
+  };
+
+  useEffect(() => {
+    if (user?.token) loadOrgs();
+  }, [user?.token]);
+
+  useEffect(() => {
+    if (selected) loadOrg(selected);
+  }, [selected]);
+
+  const create = async () => {
+    const created = await post('', { name: newName });
+    if (created) {
+      setNewName('');
+      setSelected(created.id);
+      loadOrgs();
+    }
+  };
+
+  const invite = async () => {
+    if (await post('/invitations', { org: selected, email: inviteEmail, role: inviteRole })) {
+      setMessage(`Invitation sent to ${inviteEmail}`);
+      setInviteEmail('');
+      loadOrg(selected);
+    }
+  };
+
+  const setRole = async (userId: string, role: string) => {
+    if (await post('/members/role', { org: selected, userId, role })) loadOrg(selected);
+  };
+
+  const remove = async (userId: string) => {
+    if (await post('/members/remove', { org: selected, userId })) {
+      if (userId === user?.id) {
+        setSelected('');
+        setOrgs(orgs.filter((o) => o.id !== selected));
+      } else {
+        loadOrg(selected);
+      }
+    }
+  };
+
+  const uploadAsset = async (file: File) => {
+    const form = new FormData();
+    form.append('org', selected);
+    form.append('name', assetName || file.name);
+    form.append('asset', file);
+    if (await post('/assets', form)) {
+      setAssetName('');
+      loadOrg(selected);
+    }
+  };
+
+  const subscribe = async () => {
+    const data = await post('/subscription', { org: selected });
+    if (data?.sessionId) {
+      const stripe = await loadStripe(import.meta.env.VITE_STRIPE_PUBLISHABLE_KEY);
+      await stripe?.redirectToCheckout({ sessionId: data.sessionId });
+    }
+  };
+
+  const cancelSubscription = async () => {
+    if (await post('/subscription/cancel', { org: selected })) loadOrgs();
+  };
+
+  return (
+    <Box>
+      {error && <Alert severity="error" sx={{ mb: 2 }} onClose={() => setError('')}>{error}</Alert>}
+      {message && <Alert severity="success" sx={{ mb: 2 }} onClose={() => setMessage('')}>{message}</Alert>}
+
+      <Box sx={{ display: 'flex', gap: 2, alignItems: 'center', flexWrap: 'wrap', mb: 2 }}>
+        {orgs.length > 0 && (
+          <FormControl size="small" sx={{ minWidth: 200 }}>
+            <InputLabel>Organization</InputLabel>
+            <Select label="Organization" value={selected} onChange={(e) => setSelected(e.target.value)}>
+              {orgs.map((o) => <MenuItem key={o.id} value={o.id}>{o.name}</MenuItem>)}
+            </Select>
+          </FormControl>
+        )}
+        <TextField label="New organization" size="small" value={newName} onChange={(e) => setNewName(e.target.value)} />
+        <Button variant="outlined" onClick={create} disabled={!newName}>Create</Button>
+      </Box>
+
+      {org && (
+        <>
+          <Typography variant="subtitle1" sx={{ mt: 2 }}>Subscription</Typography>
+          <Typography variant="body2" sx={{ mb: 1 }}>
+            {org.subscriptionStatus === 'active'
+              ? `Active for ${org.seats} seats until ${new Date(org.subscriptionExpiresAt || '').toLocaleDateString()}`
+              : `No subscription. Subscribing bills one seat per member (${members.length}).`}
+          </Typography>
+          {org.role === 'owner' && (org.subscriptionStatus === 'active'
+            ? <Button color="secondary" onClick={cancelSubscription}>Cancel subscription</Button>
+            : <Button variant="contained" onClick={subscribe}>Subscribe</Button>)}
+
+          <Typography variant="subtitle1" sx={{ mt: 3 }}>Members</Typography>
+          <Table size="small">
+            <TableHead>
+              <TableRow>
+                <TableCell>Email</TableCell>
+                <TableCell>Role</TableCell>
+                <TableCell />
+              </TableRow>
+            </TableHead>
+            <TableBody>
+              {members.map((m) => (
+                <TableRow key={m.userId}>
+                  <TableCell>{m.email}</TableCell>
+                  <TableCell>
+                    {canManage ? (
+                      <Select size="small" value={m.role} onChange={(e) => setRole(m.userId, e.target.value)}>
+                        {roles.map((role) => <MenuItem key={role} value={role}>{role}</MenuItem>)}
+                      </Select>
+                    ) : m.role}
+                  </TableCell>
+                  <TableCell>
+                    {(canManage || m.userId === user?.id) && (
+                      <Button color="secondary" onClick={() => remove(m.userId)}>
+                        {m.userId === user?.id ? 'Leave' : 'Remove'}
+                      </Button>
+                    )}
+                  </TableCell>
+                </TableRow>
+              ))}
+              {invitations.map((inv) => (
+                <TableRow key={inv.id}>
+                  <TableCell>{inv.email} (invited)</TableCell>
+                  <TableCell>{inv.role}</TableCell>
+                  <TableCell>
+                    <Button color="secondary" onClick={async () => {
+                      if (await post('/invitations/revoke', { org: selected, id: inv.id })) loadOrg(selected);
+                    }}>Revoke</Button>
+                  </TableCell>
+                </TableRow>
+              ))}
+            </TableBody>
+          </Table>
+          {canManage && (
+            <Box sx={{ display: 'flex', gap: 2, alignItems: 'center', mt: 2, flexWrap: 'wrap' }}>
+              <TextField label="Email" size="small" value={inviteEmail} onChange={(e) => setInviteEmail(e.target.value)} />
+              <Select size="small" value={inviteRole} onChange={(e) => setInviteRole(e.target.value)}>
+                {roles.filter((role) => org.role === 'owner' || role !== 'owner').map((role) => (
+                  <MenuItem key={role} value={role}>{role}</MenuItem>
+                ))}
+              </Select>
+              <Button variant="outlined" onClick={invite} disabled={!inviteEmail}>Invite</Button>
+            </Box>
+          )}
+
+          <Typography variant="subtitle1" sx={{ mt: 3 }}>Brand assets</Typography>
+          {assets.length === 0 && <Typography variant="body2">No assets yet.</Typography>}
+          {assets.map((asset) => (
+            <Box key={asset.id} sx={{ display: 'flex', alignItems: 'center', gap: 2 }}>
+              <Typography variant="body2" sx={{ flexGrow: 1 }}>{asset.name} ({Math.ceil(asset.size / 1024)} KB)</Typography>
+              {canManage && (
+                <Button color="secondary" onClick={async () => {
+                  if (await post('/assets/delete', { org: selected, id: asset.id })) loadOrg(selected);
+                }}>Delete</Button>
+              )}
+            </Box>
+          ))}
+          {canManage && (
+            <Box sx={{ display: 'flex', gap: 2, alignItems: 'center', mt: 1 }}>
+              <TextField label="Asset name" size="small" value={assetName} onChange={(e) => setAssetName(e.target.value)} />
+              <Button variant="outlined" component="label">
+                Upload image
+                <input type="file" hidden accept="image/*" onChange={(e) => e.target.files?.[0] && uploadAsset(e.target.files[0])} />
+              </Button>
+            </Box>
+          )}
+
+          <Typography variant="subtitle1" sx={{ mt: 3 }}>Presets</Typography>
+          {presets.length === 0 && <Typography variant="body2">Save presets from the watermark editor.</Typography>}
+          {presets.map((preset) => (
+            <Box key={preset.id} sx={{ display: 'flex', alignItems: 'center', gap: 2 }}>
+              <Typography variant="body2" sx={{ flexGrow: 1 }}>{preset.name} ({preset.kind})</Typography>
+              {canManage && (
+                <Button color="secondary" onClick={async () => {
+                  if (await post('/presets/delete', { org: selected, id: preset.id })) loadOrg(selected);
+                }}>Delete</Button>
+              )}
+            </Box>
+          ))}
+        </>
+      )}
+    </Box>
+  );
+};
+
+export default OrganizationSettings;
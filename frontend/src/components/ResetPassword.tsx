@@ -0,0 +1,59 @@
+import React, { useState } from 'react';
+import { Box, Button, TextField, Typography, Alert, Link } from '@mui/material';
+import { useSearchParams } from 'react-router-dom';
+import SEO from './SEO';
+
+const ResetPassword = () => {
+  const [searchParams] = useSearchParams();
+  const token = searchParams.get('token') || '';
+  const [password, setPassword] = useState('');
+  const [confirm, setConfirm] = useState('');
+  const [message, setMessage] = useState('');
+  const [error, setError] = useState('');
+
+  const handleSubmit = async (event: React.FormEvent<HTMLFormElement>) => {
+    event.preventDefault();
+    setError('');
+    if (password !== confirm) {
+      setError('Passwords do not match');
+      return;
+    }
+    try {
+      const response = await fetch(`${import.meta.env.VITE_API_URL}/api/password/reset`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ token, password }),
+      });
+      const data = await response.json();
+      if (response.ok) {
+        setMessage(data.message);
+      } else {
+        setError(data.message || 'Password reset failed');
+      }
+    } catch (err) {
+      console.error('Error resetting password:', err);
+      setError('An error occurred, please try again');
+    }
+  };
+
+  return (
+    <>
+      <SEO title="Reset Password" description="Choose a new password for your Watermark Generator account." canonicalUrl="https://watermark-generator.com/reset-password" />
+      <Box component="form" onSubmit={handleSubmit} sx={{ maxWidth: 400, mx: 'auto', mt: 8 }}>
+        <Typography component="h1" variant="h5" gutterBottom>Choose a new password</Typography>
+        {message ? (
+          <Alert severity="success">{message} <Link href="/signin">Sign in</Link></Alert>
+        ) : (
+          <>
+            <TextField margin="normal" required fullWidth label="New password" type="password" autoComplete="new-password" value={password} onChange={(e) => setPassword(e.target.value)} />
+            <TextField margin="normal" required fullWidth label="Confirm password" type="password" autoComplete="new-password" value={confirm} onChange={(e) => setConfirm(e.target.value)} />
+            {error && <Alert severity="error">{error}</Alert>}
+            <Button type="submit" fullWidth variant="contained" sx={{ mt: 2 }} disabled={!token}>Set password</Button>
+          </>
+        )}
+      </Box>
+    </>
+  );
+};
+
+export default ResetPassword;
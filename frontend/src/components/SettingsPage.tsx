@@ -14,6 +14,9 @@ import {
 } from '@mui/material';
 import { useAuth } from '../hooks/useAuth';
 import { useNavigate } from 'react-router-dom';
+import TwoFactorSettings from './TwoFactorSettings';
+import ApiKeysSettings from './ApiKeysSettings';
+import OrganizationSettings from './OrganizationSettings';
 
 const SettingsPage: React.FC = () => {
   const { user, refreshUser } = useAuth();
@@ -64,6 +67,21 @@ const SettingsPage: React.FC = () => {
             <Divider sx={{ my: 2 }} />
             <Typography><strong>Email:</strong> {user?.email}</Typography>
           </Grid>
+          <Grid item xs={12}>
+            <Typography variant="h6">Two-Factor Authentication</Typography>
+            <Divider sx={{ my: 2 }} />
+            <TwoFactorSettings />
+          </Grid>
+          <Grid item xs={12}>
+            <Typography variant="h6">API Keys</Typography>
+            <Divider sx={{ my: 2 }} />
+            <ApiKeysSettings />
+          </Grid>
+          <Grid item xs={12}>
+            <Typography variant="h6">Organizations</Typography>
+            <Divider sx={{ my: 2 }} />
+            <OrganizationSettings />
+          </Grid>
           <Grid item xs={12}>
             <Typography variant="h6">Subscription Details</Typography>
             <Divider sx={{ my: 2 }} />
@@ -81,7 +99,10 @@ const SettingsPage: React.FC = () => {
                 </Button>
               </>
             )}
-            {user?.subscriptionStatus !== 'active' && (
+            {user?.subscriptionStatus !== 'active' && user?.isPaid && user.seatExpiresAt && (
+              <Typography><strong>Organization seat until:</strong> {new Date(user.seatExpiresAt).toLocaleString()}</Typography>
+            )}
+            {user?.subscriptionStatus !== 'active' && !user?.isPaid && (
               <Button 
                 variant="contained" 
                 color="primary" 
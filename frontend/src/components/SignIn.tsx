@@ -1,9 +1,10 @@
-import React, { useState } from 'react';
+import React, { useEffect, useState } from 'react';
 import { Box, Button, TextField, Typography, Link, Grid } from '@mui/material';
 import { keyframes } from '@emotion/react';
-import { useNavigate } from 'react-router-dom';
+import { useNavigate, useSearchParams } from 'react-router-dom';
 import { useAuth } from '../hooks/useAuth';
 import SEO from './SEO';
+import TwoFactorPrompt from './TwoFactorPrompt';
 
 const waveAnimation = keyframes`
   0% {
@@ -30,7 +31,17 @@ const SignIn = () => {
   const { login } = useAuth();
   const [email, setEmail] = useState('');
   const [password, setPassword] = useState('');
-  const [error, setError] = useState('');
+  const [searchParams] = useSearchParams();
+  const [error, setError] = useState(searchParams.get('error') || '');
+  const [providers, setProviders] = useState<string[]>([]);
+  const [challenge, setChallenge] = useState('');
+
+  useEffect(() => {
+    fetch(`${import.meta.env.VITE_API_URL}/api/oidc/providers`)
+      .then((response) => (response.ok ? response.json() : { providers: [] }))
+      .then((data) => setProviders(data.providers || []))
+      .catch((err) => console.error('Error fetching sign-in providers:', err));
+  }, []);
 
   const handleSubmit = async (event: React.FormEvent<HTMLFormElement>) => {
     event.preventDefault();
@@ -39,7 +50,7 @@ const SignIn = () => {
       const response = await fetch(`${import.meta.env.VITE_API_URL}/api/signin`, {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ email, password: password.trim() }),
+        body: JSON.stringify({ email, password }),
       });
 
       if (!response.ok) {
@@ -49,6 +60,10 @@ const SignIn = () => {
       }
 
       const data = await response.json();
+      if (data.twoFactorRequired) {
+        setChallenge(data.challenge);
+        return;
+      }
       login(data);
       navigate('/');
     } catch (err) {
@@ -79,6 +94,9 @@ const SignIn = () => {
             <Typography variant="body1" sx={{ mb: 4, color: 'text.secondary' }}>
               Sign in to dive into your creative flow.
             </Typography>
+            {challenge ? (
+              <TwoFactorPrompt challenge={challenge} onSignedIn={(data) => { login(data); navigate('/'); }} />
+            ) : (
             <Box component="form" onSubmit={handleSubmit}>
               <TextField
                 fullWidth
@@ -108,15 +126,27 @@ const SignIn = () => {
               >
                 Sign In
               </Button>
+              {providers.map((provider) => (
+                <Button
+                  key={provider}
+                  fullWidth
+                  variant="outlined"
+                  href={`${import.meta.env.VITE_API_URL}/api/oidc/login?provider=${encodeURIComponent(provider)}`}
+                  sx={{ mb: 1, textTransform: 'none' }}
+                >
+                  Continue with {provider.charAt(0).toUpperCase() + provider.slice(1)}
+                </Button>
+              ))}
               <Grid container justifyContent="space-between">
                 <Grid item>
-                  <Link href="#" variant="body2" sx={{color: 'primary.main'}}>Forgot password?</Link>
+                  <Link href="/forgot-password" variant="body2" sx={{color: 'primary.main'}}>Forgot password?</Link>
                 </Grid>
                 <Grid item>
                   <Link href="/signup" variant="body2" sx={{color: 'primary.main'}}>Don't have an account? Sign Up</Link>
                 </Grid>
               </Grid>
             </Box>
+            )}
           </Box>
         </Grid>
         <Grid item xs={12} md={6} sx={{
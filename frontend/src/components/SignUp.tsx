@@ -34,8 +34,7 @@ const SignUp = () => {
     event.preventDefault();
     setError('');
 
-    const payload = { email, password: password.trim() };
-    console.log('Sending payload:', payload);
+    const payload = { email, password };
 
     try {
       const response = await fetch(`${import.meta.env.VITE_API_URL}/api/register`, {
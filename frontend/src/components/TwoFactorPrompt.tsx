@@ -0,0 +1,64 @@
+import React, { useState } from 'react';
+import { Box, Button, TextField, Typography } from '@mui/material';
+
+interface TwoFactorPromptProps {
+  challenge: string;
+  // Called with the sign-in response once the code is accepted
+  onSignedIn: (data: any) => void;
+}
+
+// TwoFactorPrompt asks for the authenticator or recovery code after the
+// password or provider sign-in was accepted.
+const TwoFactorPrompt: React.FC<TwoFactorPromptProps> = ({ challenge: initialChallenge, onSignedIn }) => {
+  const [challenge, setChallenge] = useState(initialChallenge);
+  const [code, setCode] = useState('');
+  const [error, setError] = useState('');
+
+  const handleSubmit = async (event: React.FormEvent<HTMLFormElement>) => {
+    event.preventDefault();
+    setError('');
+    try {
+      const response = await fetch(`${import.meta.env.VITE_API_URL}/api/signin/2fa`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ challenge, code: code.trim() }),
+      });
+      const data = await response.json();
+      if (!response.ok) {
+        // A wrong code comes with a new challenge for the next attempt
+        if (data.challenge) setChallenge(data.challenge);
+        setError(data.message || 'Verification failed');
+        return;
+      }
+      onSignedIn(data);
+    } catch (err) {
+      console.error('Error verifying code:', err);
+      setError('An error occurred during sign in');
+    }
+  };
+
+  return (
+    <Box component="form" onSubmit={handleSubmit}>
+      <Typography variant="body1" sx={{ mb: 2, color: 'text.secondary' }}>
+        Enter the 6-digit code from your authenticator app, or one of your recovery codes.
+      </Typography>
+      <TextField
+        fullWidth
+        autoFocus
+        label="Code"
+        variant="outlined"
+        margin="normal"
+        value={code}
+        onChange={(e) => setCode(e.target.value)}
+        inputProps={{ autoComplete: 'one-time-code' }}
+        required
+      />
+      {error && <Typography color="error" sx={{ mt: 2 }}>{error}</Typography>}
+      <Button type="submit" fullWidth variant="contained" sx={{ mt: 3, mb: 2, py: 1.5 }}>
+        Verify
+      </Button>
+    </Box>
+  );
+};
+
+export default TwoFactorPrompt;
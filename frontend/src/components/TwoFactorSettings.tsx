@@ -0,0 +1,117 @@
+import React, { useState } from 'react';
+import { Alert, Box, Button, TextField, Typography } from '@mui/material';
+import { useAuth } from '../hooks/useAuth';
+
+interface Setup {
+  secret: string;
+  uri: string;
+  qrCode: string;
+}
+
+const TwoFactorSettings: React.FC = () => {
+  const { user, refreshUser } = useAuth();
+  const [setup, setSetup] = useState<Setup | null>(null);
+  const [code, setCode] = useState('');
+  const [recoveryCodes, setRecoveryCodes] = useState<string[]>([]);
+  const [error, setError] = useState('');
+
+  const post = async (path: string, body?: object) => {
+    setError('');
+    const response = await fetch(`${import.meta.env.VITE_API_URL}/api/2fa/${path}`, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+        'Authorization': `Bearer ${user?.token}`,
+      },
+      body: JSON.stringify(body || {}),
+    });
+    const data = await response.json();
+    if (!response.ok) {
+      setError(data.message || 'Request failed');
+      return null;
+    }
+    return data;
+  };
+
+  const startSetup = async () => {
+    const data = await post('setup');
+    if (data) setSetup(data);
+  };
+
+  const enable = async () => {
+    const data = await post('enable', { code: code.trim() });
+    if (!data) return;
+    setSetup(null);
+    setCode('');
+    setRecoveryCodes(data.recoveryCodes);
+    await refreshUser();
+  };
+
+  const disable = async () => {
+    const data = await post('disable', { code: code.trim() });
+    if (!data) return;
+    setCode('');
+    setRecoveryCodes([]);
+    await refreshUser();
+  };
+
+  const regenerate = async () => {
+    const data = await post('recovery-codes', { code: code.trim() });
+    if (!data) return;
+    setCode('');
+    setRecoveryCodes(data.recoveryCodes);
+  };
+
+  return (
+    <Box>
+      {recoveryCodes.length > 0 && (
+        <Alert severity="warning" sx={{ mb: 2 }}>
+          Save these recovery codes somewhere safe. Each works once if you lose your device, and they will not be shown again.
+          <Box component="pre" sx={{ mt: 1, fontFamily: 'monospace' }}>{recoveryCodes.join('\n')}</Box>
+        </Alert>
+      )}
+      {error && <Alert severity="error" sx={{ mb: 2 }}>{error}</Alert>}
+
+      {!user?.twoFactorEnabled && !setup && (
+        <>
+          <Typography sx={{ mb: 2 }}>Protect your account with a code from an authenticator app when you sign in.</Typography>
+          <Button variant="contained" onClick={startSetup}>Set up two-factor authentication</Button>
+        </>
+      )}
+
+      {setup && (
+        <>
+          <Typography>Scan this code with your authenticator app, then enter the code it shows.</Typography>
+          <Box component="img" src={setup.qrCode} alt="Authenticator QR code" sx={{ display: 'block', my: 2, width: 200 }} />
+          <Typography variant="body2" sx={{ color: 'text.secondary' }}>
+            Or enter this key manually: <code>{setup.secret}</code>
+          </Typography>
+        </>
+      )}
+
+      {(setup || user?.twoFactorEnabled) && (
+        <TextField
+          label={setup ? 'Code from your app' : 'Authenticator or recovery code'}
+          value={code}
+          onChange={(e) => setCode(e.target.value)}
+          margin="normal"
+          inputProps={{ autoComplete: 'one-time-code' }}
+        />
+      )}
+      {setup && (
+        <Box sx={{ display: 'flex', gap: 2, mt: 1 }}>
+          <Button variant="contained" onClick={enable} disabled={!code}>Enable</Button>
+          <Button onClick={() => setSetup(null)}>Cancel</Button>
+        </Box>
+      )}
+      {user?.twoFactorEnabled && !setup && (
+        <Box sx={{ display: 'flex', gap: 2, mt: 1 }}>
+          <Button variant="outlined" onClick={regenerate} disabled={!code}>New recovery codes</Button>
+          <Button variant="outlined" color="secondary" onClick={disable} disabled={!code}>Turn off</Button>
+        </Box>
+      )}
+    </Box>
+  );
+};
+
+export default TwoFactorSettings;
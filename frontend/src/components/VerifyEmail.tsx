@@ -0,0 +1,45 @@
+import { useEffect, useState } from 'react';
+import { Box, Typography, Alert, Link, CircularProgress } from '@mui/material';
+import { useSearchParams } from 'react-router-dom';
+import SEO from './SEO';
+
+const VerifyEmail = () => {
+  const [searchParams] = useSearchParams();
+  const token = searchParams.get('token') || '';
+  const [status, setStatus] = useState<'pending' | 'done' | 'failed'>('pending');
+  const [message, setMessage] = useState('');
+
+  useEffect(() => {
+    const verify = async () => {
+      try {
+        const response = await fetch(`${import.meta.env.VITE_API_URL}/api/verify-email`, {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ token }),
+        });
+        const data = await response.json();
+        setMessage(data.message);
+        setStatus(response.ok ? 'done' : 'failed');
+      } catch (err) {
+        console.error('Error verifying email:', err);
+        setMessage('An error occurred, please try again');
+        setStatus('failed');
+      }
+    };
+    verify();
+  }, [token]);
+
+  return (
+    <>
+      <SEO title="Verify Email" description="Confirm your Watermark Generator email address." canonicalUrl="https://watermark-generator.com/verify-email" />
+      <Box sx={{ maxWidth: 400, mx: 'auto', mt: 8 }}>
+        <Typography component="h1" variant="h5" gutterBottom>Email verification</Typography>
+        {status === 'pending' && <CircularProgress />}
+        {status === 'done' && <Alert severity="success">{message} <Link href="/signin">Sign in</Link></Alert>}
+        {status === 'failed' && <Alert severity="error">{message}</Alert>}
+      </Box>
+    </>
+  );
+};
+
+export default VerifyEmail;
@@ -4,8 +4,13 @@ interface User {
   id: string;
   email: string;
   token: string;
+  refreshToken: string;
+  expiresIn: number;
+  twoFactorEnabled?: boolean;
   subscriptionStatus: string;
   subscriptionExpiresAt: string;
+  seatExpiresAt?: string;
+  isPaid?: boolean;
   dailyDownloads: number;
   lastDownloadDate: string;
 }
@@ -26,7 +31,10 @@ export const AuthProvider: React.FC<{ children: ReactNode }> = ({ children }) =>
     const storedUser = localStorage.getItem('user');
     if (storedUser) {
       try {
-        setUser(JSON.parse(storedUser));
+        const parsed = JSON.parse(storedUser);
+        setUser(parsed);
+        // The stored access token may have expired while the app was closed
+        refreshTokens(parsed);
       } catch (error) {
         console.error('Error parsing stored user data:', error);
         localStorage.removeItem('user'); // Remove invalid data
@@ -36,12 +44,52 @@ export const AuthProvider: React.FC<{ children: ReactNode }> = ({ children }) =>
     }
   }, []);
 
+  // Renew the access token a minute before it expires
+  useEffect(() => {
+    if (!user?.refreshToken) return;
+    const delay = Math.max((user.expiresIn || 900) - 60, 10) * 1000;
+    const timer = setTimeout(() => refreshTokens(user), delay);
+    return () => clearTimeout(timer);
+  }, [user?.refreshToken]);
+
+  const refreshTokens = async (current: User) => {
+    if (!current.refreshToken) return;
+    try {
+      const response = await fetch(`${import.meta.env.VITE_API_URL}/api/refresh`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ refreshToken: current.refreshToken }),
+      });
+      if (response.status === 401) {
+        // Revoked or reused refresh token: sign in again
+        setUser(null);
+        localStorage.removeItem('user');
+        return;
+      }
+      if (response.ok) {
+        const tokens = await response.json();
+        const updatedUser = { ...current, ...tokens };
+        setUser(updatedUser);
+        localStorage.setItem('user', JSON.stringify(updatedUser));
+      }
+    } catch (error) {
+      console.error('Error refreshing session:', error);
+    }
+  };
+
   const login = (userData: User) => {
     setUser(userData);
     localStorage.setItem('user', JSON.stringify(userData));
   };
 
   const logout = () => {
+    if (user?.refreshToken) {
+      fetch(`${import.meta.env.VITE_API_URL}/api/logout`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ refreshToken: user.refreshToken }),
+      }).catch((error) => console.error('Error logging out:', error));
+    }
     setUser(null);
     localStorage.removeItem('user');
   };
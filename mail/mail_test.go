@@ -0,0 +1,71 @@
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderTemplates(t *testing.T) {
+	data := map[string]string{
+		"Link":    "https://example.com/t?token=abc",
+		"Expires": "1 hour",
+		"Org":     "Studio",
+		"Inviter": "owner@example.com",
+		"Role":    "member",
+	}
+	for _, name := range []string{"verify.txt", "reset.txt", "invite.txt"} {
+		msg, err := Render(name, "a@example.com", data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if msg.To != "a@example.com" || msg.Subject == "" {
+			t.Errorf("%s: message %+v", name, msg)
+		}
+		if !strings.Contains(msg.Body, data["Link"]) || !strings.Contains(msg.Body, "1 hour") {
+			t.Errorf("%s: body misses the link or expiry:\n%s", name, msg.Body)
+		}
+	}
+}
+
+func TestFileSender(t *testing.T) {
+	dir := t.TempDir()
+	s := &FileSender{Dir: dir, From: "Test <test@example.com>"}
+	if err := s.Send(context.Background(), Message{To: "a@example.com", Subject: "Hi", Body: "line 1\nline 2"}); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("%d files written, want 1", len(files))
+	}
+	data, _ := os.ReadFile(files[0])
+	for _, want := range []string{"From: Test <test@example.com>\r\n", "To: a@example.com\r\n", "Subject: Hi\r\n", "\r\n\r\nline 1\r\nline 2"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("message lacks %q:\n%s", want, data)
+		}
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	for from, want := range map[string]string{
+		"Name <a@example.com>": "a@example.com",
+		"a@example.com":        "a@example.com",
+	} {
+		if got := envelope(from); got != want {
+			t.Errorf("envelope(%q) = %q, want %q", from, got, want)
+		}
+	}
+}
+
+func TestSendRejectsHeaderInjection(t *testing.T) {
+	var s MemorySender
+	msg := Message{To: "a@example.com\r\nBcc: b@example.com", Subject: "Hi", Body: "body"}
+	if err := s.Send(context.Background(), msg); err == nil {
+		t.Error("message with a line break in To accepted")
+	}
+	if len(s.Messages()) != 0 {
+		t.Error("rejected message was kept")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"io/fs"
 	"log"
@@ -9,7 +10,11 @@ import (
 	"strings"
 
 	"watermark-generator/api"
+	"watermark-generator/audit"
+	"watermark-generator/auth"
 	"watermark-generator/db"
+	"watermark-generator/mail"
+	"watermark-generator/org"
 	"watermark-generator/watermark"
 
 	"github.com/rs/cors"
@@ -28,24 +33,64 @@ func main() {
 	db.Connect()
 
 	watermarkService := watermark.NewService()
-	authHandler := api.NewAuthHandler()
-	handler := api.NewWatermarkHandler(watermarkService)
-	stripeHandler := api.NewStripeHandler(db.GetDatabase())
+	auditStore := audit.MongoStore{DB: db.GetDatabase()}
+	if err := auditStore.EnsureIndexes(context.Background()); err != nil {
+		log.Printf("main: %v", err)
+	}
+	auditLog := audit.NewLog(auditStore)
+	tokens := auth.TokenIssuerFromEnv()
+	sessionStore := auth.MongoSessions{DB: db.GetDatabase()}
+	if err := sessionStore.EnsureIndexes(context.Background()); err != nil {
+		log.Printf("main: %v", err)
+	}
+	oneTimeStore := auth.MongoOneTimeTokens{DB: db.GetDatabase()}
+	if err := oneTimeStore.EnsureIndexes(context.Background()); err != nil {
+		log.Printf("main: %v", err)
+	}
+	sessions := auth.NewSessions(tokens, sessionStore)
+	attempts := auth.MongoAttempts{DB: db.GetDatabase()}
+	if err := attempts.EnsureIndexes(context.Background()); err != nil {
+		log.Printf("main: %v", err)
+	}
+	oneTime := auth.NewOneTimeTokens(oneTimeStore)
+	apiKeyStore := auth.MongoAPIKeys{DB: db.GetDatabase()}
+	if err := apiKeyStore.EnsureIndexes(context.Background()); err != nil {
+		log.Printf("main: %v", err)
+	}
+	apiKeys := auth.NewAPIKeys(apiKeyStore)
+	mailer := mail.SenderFromEnv()
+	authHandler := api.NewAuthHandler(sessions, oneTime, apiKeys, mailer, auth.PasswordPolicyFromEnv(), auth.NewThrottle(attempts), auditLog)
+	if err := authHandler.MigrateEmailVerification(context.Background()); err != nil {
+		log.Printf("main: %v", err)
+	}
+	adminHandler := api.NewAdminHandler(sessions, auditLog)
+	oidcStates := auth.MongoOIDCStates{DB: db.GetDatabase()}
+	if err := oidcStates.EnsureIndexes(context.Background()); err != nil {
+		log.Printf("main: %v", err)
+	}
+	oidcHandler := api.NewOIDCHandler(auth.OIDCProvidersFromEnv(context.Background(), os.Getenv("VITE_API_URL")), oidcStates, sessions, oneTime, auditLog)
+	orgStore := org.MongoOrgs{DB: db.GetDatabase()}
+	if err := orgStore.EnsureIndexes(context.Background()); err != nil {
+		log.Printf("main: %v", err)
+	}
+	invitations := org.MongoInvitations{DB: db.GetDatabase()}
+	if err := invitations.EnsureIndexes(context.Background()); err != nil {
+		log.Printf("main: %v", err)
+	}
+	library := org.MongoLibrary{DB: db.GetDatabase()}
+	if err := library.EnsureIndexes(context.Background()); err != nil {
+		log.Printf("main: %v", err)
+	}
+	orgs := org.NewOrgs(orgStore, invitations, library, api.StripeSeats{})
+	orgHandler := api.NewOrgHandler(orgs, mailer, auditLog)
+	handler := api.NewWatermarkHandler(watermarkService, orgs)
+	stripeHandler := api.NewStripeHandler(db.GetDatabase(), orgs, auditLog)
+	apiKeyHandler := api.NewAPIKeyHandler(apiKeys, auditLog)
+	middleware := auth.NewMiddleware(tokens, auth.MongoUsers{DB: db.GetDatabase()}, apiKeys)
 
 	// Create a new mux for API routes
 	apiMux := http.NewServeMux()
-	api.SetupAuthRoutes(apiMux, authHandler)
-	apiMux.HandleFunc("/api/process-payment", handler.ProcessPaymentHandler)
-	apiMux.HandleFunc("/api/create-checkout-session", handler.CreateCheckoutSessionHandler)
-	apiMux.HandleFunc("/api/test-db", handler.TestDBConnectionHandler)
-	apiMux.HandleFunc("/api/download", handler.DownloadHandler)
-	apiMux.HandleFunc("/api/watermark/text", handler.TextWatermarkHandler)
-	apiMux.HandleFunc("/api/watermark/image", handler.ImageWatermarkHandler)
-	apiMux.HandleFunc("/api/create-subscription", stripeHandler.CreateSubscription)
-	apiMux.HandleFunc("/api/cancel-subscription", stripeHandler.CancelSubscription)
-	apiMux.HandleFunc("/api/webhook", stripeHandler.HandleWebhook)
-	apiMux.HandleFunc("/api/watermark/bulk/text", handler.BulkTextWatermarkHandler)
-	apiMux.HandleFunc("/api/watermark/bulk/image", handler.BulkImageWatermarkHandler)
+	api.Routes(apiMux, middleware, authHandler, adminHandler, oidcHandler, apiKeyHandler, orgHandler, handler, stripeHandler)
 
 	// Create the main mux
 	mux := http.NewServeMux()
@@ -86,6 +131,7 @@ func main() {
 		}, // Add your frontend URL here
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
+		ExposedHeaders:   []string{"X-Unique-Id", "X-Source-Id", "X-Seed"},
 		AllowCredentials: true,
 	})
 
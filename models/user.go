@@ -9,11 +9,100 @@ import (
 type User struct {
 	ID                    primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
 	Email                 string             `bson:"email" json:"email"`
-	Password              string             `bson:"password" json:"password"` // Make sure this line exists
+	Password              string             `bson:"password" json:"-"` // bcrypt hash, never sent to clients
+	Role                  string             `bson:"role,omitempty" json:"role"`
+	Disabled              bool               `bson:"disabled,omitempty" json:"disabled"`
+	EmailVerified         bool               `bson:"emailVerified" json:"emailVerified"`
 	StripeCustomerID      string             `bson:"stripeCustomerId" json:"stripeCustomerId,omitempty"`
 	SubscriptionStatus    string             `bson:"subscriptionStatus" json:"subscriptionStatus"`
 	SubscriptionId        string             `bson:"subscriptionId" json:"subscriptionId,omitempty"`
 	SubscriptionExpiresAt time.Time          `bson:"subscriptionExpiresAt" json:"subscriptionExpiresAt"`
 	DailyDownloads        int                `bson:"dailyDownloads" json:"dailyDownloads"`
 	LastDownloadDate      time.Time          `bson:"lastDownloadDate" json:"lastDownloadDate"`
+	Footer                FooterSettings     `bson:"footer" json:"footer"`
+	// SeatExpiresAt is the end of the paid period of the latest paying
+	// organization the user is a member of
+	SeatExpiresAt time.Time `bson:"seatExpiresAt,omitempty" json:"seatExpiresAt,omitempty"`
+	// Identities are the external sign-in accounts linked to the user
+	Identities []Identity `bson:"identities,omitempty" json:"identities,omitempty"`
+	// TwoFactor is the TOTP enrollment, nil until the user starts one
+	TwoFactor *TwoFactor `bson:"twoFactor,omitempty" json:"twoFactor,omitempty"`
+	// TokensRevokedAt invalidates access tokens issued before it, set when
+	// the user logs out of all devices.
+	TokensRevokedAt time.Time `bson:"tokensRevokedAt,omitempty" json:"-"`
+}
+
+// Identity is an account at an OpenID Connect provider, identified by the
+// provider's subject claim.
+type Identity struct {
+	Provider string    `bson:"provider" json:"provider"`
+	Subject  string    `bson:"subject" json:"-"`
+	LinkedAt time.Time `bson:"linkedAt" json:"linkedAt"`
+}
+
+// TwoFactor is a user's TOTP second factor. Until the user confirms a
+// code from their app, Enabled is false and Secret is only pending.
+type TwoFactor struct {
+	Enabled   bool      `bson:"enabled" json:"enabled"`
+	EnabledAt time.Time `bson:"enabledAt,omitempty" json:"enabledAt,omitempty"`
+	// Secret is the base32 TOTP secret
+	Secret string `bson:"secret" json:"-"`
+	// LastCounter is the time step of the last accepted code; codes for
+	// it or earlier steps are rejected so a code works only once
+	LastCounter int64 `bson:"lastCounter" json:"-"`
+	// RecoveryCodes are the SHA-256 hashes of the unused recovery codes
+	RecoveryCodes []string `bson:"recoveryCodes,omitempty" json:"-"`
+}
+
+// FooterSettings is the account's choice for the footer line drawn on image
+// watermarks. Free accounts always get the default footer; the settings only
+// take effect while a subscription is active.
+type FooterSettings struct {
+	// Disabled removes the footer altogether.
+	Disabled bool    `bson:"disabled" json:"disabled"`
+	Text     string  `bson:"text,omitempty" json:"text,omitempty"`
+	Color    string  `bson:"color,omitempty" json:"color,omitempty"`
+	Position string  `bson:"position,omitempty" json:"position,omitempty"`
+	FontSize float64 `bson:"fontSize,omitempty" json:"fontSize,omitempty"`
+	Font     string  `bson:"font,omitempty" json:"font,omitempty"`
+}
+
+// Roles a user can have. Users without a stored role are RoleUser.
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
+// Roles lists the valid roles.
+var Roles = []string{RoleUser, RoleSupport, RoleAdmin}
+
+// RoleName returns the user's role, defaulting to RoleUser.
+func (u *User) RoleName() string {
+	if u.Role == "" {
+		return RoleUser
+	}
+	return u.Role
+}
+
+// HasRole reports whether the user has one of roles.
+func (u *User) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if u.RoleName() == role {
+			return true
+		}
+	}
+	return false
+}
+
+// TwoFactorEnabled reports whether sign-in needs a second factor.
+func (u *User) TwoFactorEnabled() bool {
+	return u.TwoFactor != nil && u.TwoFactor.Enabled
+}
+
+// IsPaid reports whether the user has an active, unexpired subscription of
+// their own or a seat in a paying organization.
+func (u *User) IsPaid() bool {
+	now := time.Now()
+	return u.SubscriptionStatus == "active" && u.SubscriptionExpiresAt.After(now) || u.SeatExpiresAt.After(now)
 }
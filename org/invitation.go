@@ -0,0 +1,239 @@
+package org
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"watermark-generator/auth"
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// InvitationTTL is how long an invitation link works.
+	InvitationTTL = 7 * 24 * time.Hour
+	// MaxInvitations is how many invitations an organization can have
+	// pending.
+	MaxInvitations = 50
+)
+
+var (
+	// ErrInvalidInvitation is returned for unknown, expired or already
+	// used invitation tokens.
+	ErrInvalidInvitation = errors.New("invalid or expired invitation")
+	// ErrInvitationNotFound is returned when revoking an invitation the
+	// organization does not have.
+	ErrInvitationNotFound = errors.New("invitation not found")
+	// ErrWrongRecipient is returned when a user accepts an invitation sent
+	// to another email address.
+	ErrWrongRecipient = errors.New("this invitation was sent to another email address")
+	// ErrTooManyInvitations is returned when an organization with
+	// MaxInvitations pending invitations invites someone else.
+	ErrTooManyInvitations = fmt.Errorf("an organization can have at most %d pending invitations", MaxInvitations)
+)
+
+// Invitation asks the owner of an email address to join an organization.
+// The token is emailed to them; only its SHA-256 is stored.
+type Invitation struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	OrgID     primitive.ObjectID `bson:"orgId" json:"-"`
+	Email     string             `bson:"email" json:"email"`
+	Role      string             `bson:"role" json:"role"`
+	TokenHash string             `bson:"tokenHash" json:"-"`
+	InvitedBy primitive.ObjectID `bson:"invitedBy" json:"invitedBy"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+	ExpiresAt time.Time          `bson:"expiresAt" json:"expiresAt"`
+}
+
+// InvitationStore persists invitations.
+type InvitationStore interface {
+	CreateInvitation(ctx context.Context, inv *Invitation) error
+	// InvitationByHash returns the unexpired invitation with the token
+	// hash, or ErrInvalidInvitation.
+	InvitationByHash(ctx context.Context, hash string, now time.Time) (*Invitation, error)
+	// Invitations returns the organization's unexpired invitations, newest
+	// first.
+	Invitations(ctx context.Context, orgID primitive.ObjectID, now time.Time) ([]Invitation, error)
+	// DeleteInvitation deletes the organization's invitation with id, or
+	// returns ErrInvitationNotFound.
+	DeleteInvitation(ctx context.Context, orgID, id primitive.ObjectID) error
+	// DeleteInvitationsTo deletes the organization's invitations to email.
+	DeleteInvitationsTo(ctx context.Context, orgID primitive.ObjectID, email string) error
+}
+
+// MongoInvitations is an InvitationStore backed by the org_invitations
+// collection.
+type MongoInvitations struct {
+	DB *mongo.Database
+}
+
+func (s MongoInvitations) collection() *mongo.Collection {
+	return s.DB.Collection("org_invitations")
+}
+
+// EnsureIndexes creates the lookup indexes and the TTL index on expiresAt.
+func (s MongoInvitations) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tokenHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "orgId", Value: 1}, {Key: "email", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create invitation indexes: %v", err)
+	}
+	return nil
+}
+
+func (s MongoInvitations) CreateInvitation(ctx context.Context, inv *Invitation) error {
+	if _, err := s.collection().InsertOne(ctx, inv); err != nil {
+		return fmt.Errorf("failed to store invitation: %v", err)
+	}
+	return nil
+}
+
+func (s MongoInvitations) InvitationByHash(ctx context.Context, hash string, now time.Time) (*Invitation, error) {
+	var inv Invitation
+	err := s.collection().FindOne(ctx, bson.M{"tokenHash": hash, "expiresAt": bson.M{"$gt": now}}).Decode(&inv)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidInvitation
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch invitation: %v", err)
+	}
+	return &inv, nil
+}
+
+func (s MongoInvitations) Invitations(ctx context.Context, orgID primitive.ObjectID, now time.Time) ([]Invitation, error) {
+	cursor, err := s.collection().Find(ctx,
+		bson.M{"orgId": orgID, "expiresAt": bson.M{"$gt": now}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch invitations: %v", err)
+	}
+	invitations := []Invitation{}
+	if err := cursor.All(ctx, &invitations); err != nil {
+		return nil, fmt.Errorf("failed to decode invitations: %v", err)
+	}
+	return invitations, nil
+}
+
+func (s MongoInvitations) DeleteInvitation(ctx context.Context, orgID, id primitive.ObjectID) error {
+	result, err := s.collection().DeleteOne(ctx, bson.M{"_id": id, "orgId": orgID})
+	if err != nil {
+		return fmt.Errorf("failed to delete invitation: %v", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrInvitationNotFound
+	}
+	return nil
+}
+
+func (s MongoInvitations) DeleteInvitationsTo(ctx context.Context, orgID primitive.ObjectID, email string) error {
+	if _, err := s.collection().DeleteMany(ctx, bson.M{"orgId": orgID, "email": email}); err != nil {
+		return fmt.Errorf("failed to delete invitations: %v", err)
+	}
+	return nil
+}
+
+// Invite invites email to the organization with role on behalf of actor
+// and returns the token for the invitation link. Only owners can invite
+// owners. A new invitation to the same address replaces the earlier one.
+func (o *Orgs) Invite(ctx context.Context, actor *Member, email, role string) (string, *Invitation, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !strings.Contains(email, "@") || len(email) > 254 {
+		return "", nil, invalid("a valid email address is required")
+	}
+	if err := checkRole(role); err != nil {
+		return "", nil, err
+	}
+	if !actor.CanManage() || (role == RoleOwner && actor.Role != RoleOwner) {
+		return "", nil, ErrForbidden
+	}
+
+	members, err := o.Store.Members(ctx, actor.OrgID)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, m := range members {
+		if strings.EqualFold(m.Email, email) {
+			return "", nil, ErrAlreadyMember
+		}
+	}
+	if err := o.Invitations.DeleteInvitationsTo(ctx, actor.OrgID, email); err != nil {
+		return "", nil, err
+	}
+	now := o.now()
+	pending, err := o.Invitations.Invitations(ctx, actor.OrgID, now)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(pending) >= MaxInvitations {
+		return "", nil, ErrTooManyInvitations
+	}
+
+	token, err := auth.RandomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	inv := &Invitation{
+		ID:        primitive.NewObjectID(),
+		OrgID:     actor.OrgID,
+		Email:     email,
+		Role:      role,
+		TokenHash: auth.HashToken(token),
+		InvitedBy: actor.UserID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(InvitationTTL),
+	}
+	if err := o.Invitations.CreateInvitation(ctx, inv); err != nil {
+		return "", nil, err
+	}
+	return token, inv, nil
+}
+
+// Accept makes the user a member of the organization the invitation token
+// is for. The invitation must have been sent to the user's email address.
+func (o *Orgs) Accept(ctx context.Context, user *models.User, token string) (*Organization, error) {
+	inv, err := o.Invitations.InvitationByHash(ctx, auth.HashToken(token), o.now())
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(inv.Email, user.Email) {
+		return nil, ErrWrongRecipient
+	}
+	org, err := o.Store.Org(ctx, inv.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.Store.AddMember(ctx, &Member{
+		ID:       primitive.NewObjectID(),
+		OrgID:    inv.OrgID,
+		UserID:   user.ID,
+		Email:    user.Email,
+		Role:     inv.Role,
+		JoinedAt: o.now(),
+	}); err != nil {
+		return nil, err
+	}
+	if err := o.Invitations.DeleteInvitation(ctx, inv.OrgID, inv.ID); err != nil && err != ErrInvitationNotFound {
+		return nil, err
+	}
+	o.membersChanged(ctx, inv.OrgID, user.ID)
+	return org, nil
+}
+
+// RevokeInvitation deletes an invitation on behalf of actor.
+func (o *Orgs) RevokeInvitation(ctx context.Context, actor *Member, id primitive.ObjectID) error {
+	if !actor.CanManage() {
+		return ErrForbidden
+	}
+	return o.Invitations.DeleteInvitation(ctx, actor.OrgID, id)
+}
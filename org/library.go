@@ -0,0 +1,385 @@
+package org
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// MaxAssetSize is the largest asset accepted, in bytes.
+	MaxAssetSize = 2 << 20
+	// MaxAssets is how many assets an organization can have.
+	MaxAssets = 50
+	// MaxPresets is how many presets an organization can have.
+	MaxPresets = 100
+	// MaxPresetSettings is how many settings a preset can hold.
+	MaxPresetSettings = 50
+	// maxPresetValueLength is the longest setting value accepted.
+	maxPresetValueLength = 2000
+)
+
+// Kinds of presets, named after the watermark endpoint they are for.
+const (
+	PresetText  = "text"
+	PresetImage = "image"
+	PresetCode  = "code"
+)
+
+// PresetKinds lists the valid preset kinds.
+var PresetKinds = []string{PresetText, PresetImage, PresetCode}
+
+// assetTypes are the content types accepted for assets, the image formats
+// the watermark service reads.
+var assetTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp", "image/svg+xml"}
+
+var (
+	// ErrAssetNotFound is returned for assets that do not exist or belong
+	// to an organization the user is not a member of.
+	ErrAssetNotFound = errors.New("asset not found")
+	// ErrPresetNotFound is returned for presets the organization does not
+	// have.
+	ErrPresetNotFound = errors.New("preset not found")
+	// ErrTooManyAssets is returned when an organization with MaxAssets
+	// assets adds another.
+	ErrTooManyAssets = fmt.Errorf("an organization can have at most %d assets", MaxAssets)
+	// ErrTooManyPresets is returned when an organization with MaxPresets
+	// presets adds another.
+	ErrTooManyPresets = fmt.Errorf("an organization can have at most %d presets", MaxPresets)
+)
+
+// Asset is an image, such as a logo, shared by an organization for use as
+// an image watermark.
+type Asset struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	OrgID       primitive.ObjectID `bson:"orgId" json:"-"`
+	Name        string             `bson:"name" json:"name"`
+	ContentType string             `bson:"contentType" json:"contentType"`
+	Size        int64              `bson:"size" json:"size"`
+	Data        []byte             `bson:"data,omitempty" json:"-"`
+	CreatedBy   primitive.ObjectID `bson:"createdBy" json:"createdBy"`
+	CreatedAt   time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// Preset is a named set of watermark form values shared by an
+// organization, such as {"text": "© Studio", "opacity": "0.4"}. Image
+// presets can refer to an asset with watermarkAssetId.
+type Preset struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	OrgID     primitive.ObjectID `bson:"orgId" json:"-"`
+	Name      string             `bson:"name" json:"name"`
+	Kind      string             `bson:"kind" json:"kind"`
+	Settings  map[string]string  `bson:"settings" json:"settings"`
+	UpdatedBy primitive.ObjectID `bson:"updatedBy" json:"updatedBy"`
+	UpdatedAt time.Time          `bson:"updatedAt" json:"updatedAt"`
+}
+
+// LibraryStore persists organizations' assets and presets.
+type LibraryStore interface {
+	CreateAsset(ctx context.Context, a *Asset) error
+	// Asset returns the asset with id and its data, or ErrAssetNotFound.
+	Asset(ctx context.Context, id primitive.ObjectID) (*Asset, error)
+	// Assets returns the organization's assets without their data, newest
+	// first.
+	Assets(ctx context.Context, orgID primitive.ObjectID) ([]Asset, error)
+	CountAssets(ctx context.Context, orgID primitive.ObjectID) (int64, error)
+	// DeleteAsset deletes the organization's asset with id, or returns
+	// ErrAssetNotFound.
+	DeleteAsset(ctx context.Context, orgID, id primitive.ObjectID) error
+	// SavePreset creates p, or replaces the organization's preset with its
+	// ID.
+	SavePreset(ctx context.Context, p *Preset) error
+	// Preset returns the organization's preset with id, or
+	// ErrPresetNotFound.
+	Preset(ctx context.Context, orgID, id primitive.ObjectID) (*Preset, error)
+	// Presets returns the organization's presets sorted by name.
+	Presets(ctx context.Context, orgID primitive.ObjectID) ([]Preset, error)
+	CountPresets(ctx context.Context, orgID primitive.ObjectID) (int64, error)
+	// DeletePreset deletes the organization's preset with id, or returns
+	// ErrPresetNotFound.
+	DeletePreset(ctx context.Context, orgID, id primitive.ObjectID) error
+}
+
+// MongoLibrary is a LibraryStore backed by the org_assets and org_presets
+// collections.
+type MongoLibrary struct {
+	DB *mongo.Database
+}
+
+func (s MongoLibrary) assets() *mongo.Collection {
+	return s.DB.Collection("org_assets")
+}
+
+func (s MongoLibrary) presets() *mongo.Collection {
+	return s.DB.Collection("org_presets")
+}
+
+// EnsureIndexes creates the lookup indexes.
+func (s MongoLibrary) EnsureIndexes(ctx context.Context) error {
+	if _, err := s.assets().Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "orgId", Value: 1}}}); err != nil {
+		return fmt.Errorf("failed to create asset indexes: %v", err)
+	}
+	if _, err := s.presets().Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "orgId", Value: 1}, {Key: "name", Value: 1}}}); err != nil {
+		return fmt.Errorf("failed to create preset indexes: %v", err)
+	}
+	return nil
+}
+
+func (s MongoLibrary) CreateAsset(ctx context.Context, a *Asset) error {
+	if _, err := s.assets().InsertOne(ctx, a); err != nil {
+		return fmt.Errorf("failed to store asset: %v", err)
+	}
+	return nil
+}
+
+func (s MongoLibrary) Asset(ctx context.Context, id primitive.ObjectID) (*Asset, error) {
+	var a Asset
+	err := s.assets().FindOne(ctx, bson.M{"_id": id}).Decode(&a)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrAssetNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch asset: %v", err)
+	}
+	return &a, nil
+}
+
+func (s MongoLibrary) Assets(ctx context.Context, orgID primitive.ObjectID) ([]Asset, error) {
+	cursor, err := s.assets().Find(ctx, bson.M{"orgId": orgID}, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: -1}}).
+		SetProjection(bson.M{"data": 0}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch assets: %v", err)
+	}
+	assets := []Asset{}
+	if err := cursor.All(ctx, &assets); err != nil {
+		return nil, fmt.Errorf("failed to decode assets: %v", err)
+	}
+	return assets, nil
+}
+
+func (s MongoLibrary) CountAssets(ctx context.Context, orgID primitive.ObjectID) (int64, error) {
+	n, err := s.assets().CountDocuments(ctx, bson.M{"orgId": orgID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count assets: %v", err)
+	}
+	return n, nil
+}
+
+func (s MongoLibrary) DeleteAsset(ctx context.Context, orgID, id primitive.ObjectID) error {
+	result, err := s.assets().DeleteOne(ctx, bson.M{"_id": id, "orgId": orgID})
+	if err != nil {
+		return fmt.Errorf("failed to delete asset: %v", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrAssetNotFound
+	}
+	return nil
+}
+
+func (s MongoLibrary) SavePreset(ctx context.Context, p *Preset) error {
+	if _, err := s.presets().ReplaceOne(ctx,
+		bson.M{"_id": p.ID, "orgId": p.OrgID}, p,
+		options.Replace().SetUpsert(true),
+	); err != nil {
+		return fmt.Errorf("failed to store preset: %v", err)
+	}
+	return nil
+}
+
+func (s MongoLibrary) Preset(ctx context.Context, orgID, id primitive.ObjectID) (*Preset, error) {
+	var p Preset
+	err := s.presets().FindOne(ctx, bson.M{"_id": id, "orgId": orgID}).Decode(&p)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrPresetNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch preset: %v", err)
+	}
+	return &p, nil
+}
+
+func (s MongoLibrary) Presets(ctx context.Context, orgID primitive.ObjectID) ([]Preset, error) {
+	cursor, err := s.presets().Find(ctx, bson.M{"orgId": orgID}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch presets: %v", err)
+	}
+	presets := []Preset{}
+	if err := cursor.All(ctx, &presets); err != nil {
+		return nil, fmt.Errorf("failed to decode presets: %v", err)
+	}
+	return presets, nil
+}
+
+func (s MongoLibrary) CountPresets(ctx context.Context, orgID primitive.ObjectID) (int64, error) {
+	n, err := s.presets().CountDocuments(ctx, bson.M{"orgId": orgID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count presets: %v", err)
+	}
+	return n, nil
+}
+
+func (s MongoLibrary) DeletePreset(ctx context.Context, orgID, id primitive.ObjectID) error {
+	result, err := s.presets().DeleteOne(ctx, bson.M{"_id": id, "orgId": orgID})
+	if err != nil {
+		return fmt.Errorf("failed to delete preset: %v", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrPresetNotFound
+	}
+	return nil
+}
+
+// assetType returns the content type of an image asset, sniffing the data
+// since browsers send SVGs and WebPs with a variety of types.
+func assetType(data []byte) (string, error) {
+	contentType := http.DetectContentType(data)
+	if strings.HasPrefix(contentType, "text/xml") || strings.HasPrefix(contentType, "text/plain") {
+		if strings.Contains(string(data[:min(len(data), 1024)]), "<svg") {
+			contentType = "image/svg+xml"
+		}
+	}
+	for _, t := range assetTypes {
+		if contentType == t {
+			return t, nil
+		}
+	}
+	return "", invalid("assets must be PNG, JPEG, GIF, WebP or SVG images")
+}
+
+// AddAsset stores an image for the organization on behalf of actor.
+func (o *Orgs) AddAsset(ctx context.Context, actor *Member, name string, data []byte) (*Asset, error) {
+	if !actor.CanManage() {
+		return nil, ErrForbidden
+	}
+	name, err := checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data) > MaxAssetSize {
+		return nil, invalid("assets must be at most %d MB", MaxAssetSize>>20)
+	}
+	contentType, err := assetType(data)
+	if err != nil {
+		return nil, err
+	}
+	n, err := o.Library.CountAssets(ctx, actor.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	if n >= MaxAssets {
+		return nil, ErrTooManyAssets
+	}
+
+	asset := &Asset{
+		ID:          primitive.NewObjectID(),
+		OrgID:       actor.OrgID,
+		Name:        name,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Data:        data,
+		CreatedBy:   actor.UserID,
+		CreatedAt:   o.now(),
+	}
+	if err := o.Library.CreateAsset(ctx, asset); err != nil {
+		return nil, err
+	}
+	return asset, nil
+}
+
+// AssetFor returns the asset with id and its data when the user is a
+// member of the organization that has it, and ErrAssetNotFound otherwise.
+func (o *Orgs) AssetFor(ctx context.Context, userID, id primitive.ObjectID) (*Asset, error) {
+	asset, err := o.Library.Asset(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := o.Store.Member(ctx, asset.OrgID, userID); err == ErrNotMember {
+		return nil, ErrAssetNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return asset, nil
+}
+
+// DeleteAsset deletes an asset on behalf of actor. Presets that refer to
+// it are kept; using them fails until they are changed.
+func (o *Orgs) DeleteAsset(ctx context.Context, actor *Member, id primitive.ObjectID) error {
+	if !actor.CanManage() {
+		return ErrForbidden
+	}
+	return o.Library.DeleteAsset(ctx, actor.OrgID, id)
+}
+
+func checkPreset(p *Preset) error {
+	name, err := checkName(p.Name)
+	if err != nil {
+		return err
+	}
+	p.Name = name
+	kindOK := false
+	for _, kind := range PresetKinds {
+		kindOK = kindOK || p.Kind == kind
+	}
+	if !kindOK {
+		return invalid("kind must be one of %v", PresetKinds)
+	}
+	if len(p.Settings) > MaxPresetSettings {
+		return invalid("a preset can hold at most %d settings", MaxPresetSettings)
+	}
+	for key, value := range p.Settings {
+		if key == "" || len(key) > MaxNameLength || len(value) > maxPresetValueLength {
+			return invalid("preset settings must have names of 1 to %d characters and values of at most %d", MaxNameLength, maxPresetValueLength)
+		}
+	}
+	return nil
+}
+
+// SavePreset creates the preset, or updates the organization's preset with
+// its ID, on behalf of actor.
+func (o *Orgs) SavePreset(ctx context.Context, actor *Member, p *Preset) (*Preset, error) {
+	if !actor.CanManage() {
+		return nil, ErrForbidden
+	}
+	if err := checkPreset(p); err != nil {
+		return nil, err
+	}
+	if p.Settings == nil {
+		p.Settings = map[string]string{}
+	}
+	if p.ID.IsZero() {
+		n, err := o.Library.CountPresets(ctx, actor.OrgID)
+		if err != nil {
+			return nil, err
+		}
+		if n >= MaxPresets {
+			return nil, ErrTooManyPresets
+		}
+		p.ID = primitive.NewObjectID()
+	} else if _, err := o.Library.Preset(ctx, actor.OrgID, p.ID); err != nil {
+		return nil, err
+	}
+	p.OrgID = actor.OrgID
+	p.UpdatedBy = actor.UserID
+	p.UpdatedAt = o.now()
+	if err := o.Library.SavePreset(ctx, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// DeletePreset deletes a preset on behalf of actor.
+func (o *Orgs) DeletePreset(ctx context.Context, actor *Member, id primitive.ObjectID) error {
+	if !actor.CanManage() {
+		return ErrForbidden
+	}
+	return o.Library.DeletePreset(ctx, actor.OrgID, id)
+}
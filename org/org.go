@@ -0,0 +1,589 @@
+// Package org lets users work together in organizations. Members share the
+// organization's brand assets and watermark presets, and its subscription,
+// which is billed per seat, gives every member the paid features.
+package org
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Roles a member can have. Owners manage billing and can make other owners;
+// admins manage members, invitations, assets and presets; members use the
+// assets and presets.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// Roles lists the valid member roles.
+var Roles = []string{RoleOwner, RoleAdmin, RoleMember}
+
+// MaxNameLength is the longest organization, asset or preset name accepted.
+const MaxNameLength = 100
+
+var (
+	// ErrNotFound is returned for unknown organizations.
+	ErrNotFound = errors.New("organization not found")
+	// ErrNotMember is returned when the user is not a member of the
+	// organization.
+	ErrNotMember = errors.New("not a member of the organization")
+	// ErrAlreadyMember is returned when adding or inviting a member twice.
+	ErrAlreadyMember = errors.New("already a member of the organization")
+	// ErrForbidden is returned when the member's role does not allow the
+	// change.
+	ErrForbidden = errors.New("your role in the organization does not allow this")
+	// ErrLastOwner is returned when a change would leave the organization
+	// without an owner.
+	ErrLastOwner = errors.New("an organization needs at least one owner")
+)
+
+// InputError is returned for requests with invalid values. Its message is
+// suitable for showing to the user.
+type InputError struct {
+	Message string
+}
+
+func (e *InputError) Error() string {
+	return e.Message
+}
+
+func invalid(format string, args ...interface{}) error {
+	return &InputError{Message: fmt.Sprintf(format, args...)}
+}
+
+// Organization is a group of users sharing assets, presets and a
+// subscription.
+type Organization struct {
+	ID                    primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name                  string             `bson:"name" json:"name"`
+	CreatedAt             time.Time          `bson:"createdAt" json:"createdAt"`
+	StripeCustomerID      string             `bson:"stripeCustomerId,omitempty" json:"-"`
+	SubscriptionStatus    string             `bson:"subscriptionStatus,omitempty" json:"subscriptionStatus"`
+	SubscriptionID        string             `bson:"subscriptionId,omitempty" json:"-"`
+	SubscriptionExpiresAt time.Time          `bson:"subscriptionExpiresAt,omitempty" json:"subscriptionExpiresAt"`
+	// Seats is the quantity the subscription is billed for
+	Seats int64 `bson:"seats,omitempty" json:"seats"`
+}
+
+// IsPaid reports whether the organization has an active, unexpired
+// subscription.
+func (o *Organization) IsPaid() bool {
+	return o.SubscriptionStatus == "active" && o.SubscriptionExpiresAt.After(time.Now())
+}
+
+// Member is a user's membership of an organization.
+type Member struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	OrgID  primitive.ObjectID `bson:"orgId" json:"-"`
+	UserID primitive.ObjectID `bson:"userId" json:"userId"`
+	// Email is the user's address when they joined, for member lists
+	Email    string    `bson:"email" json:"email"`
+	Role     string    `bson:"role" json:"role"`
+	JoinedAt time.Time `bson:"joinedAt" json:"joinedAt"`
+}
+
+// CanManage reports whether the member can manage members, invitations,
+// assets and presets.
+func (m *Member) CanManage() bool {
+	return m.Role == RoleOwner || m.Role == RoleAdmin
+}
+
+// Membership is an organization as seen by one of its members.
+type Membership struct {
+	Organization
+	Role string `json:"role"`
+}
+
+// Store persists organizations and their members.
+type Store interface {
+	CreateOrg(ctx context.Context, o *Organization) error
+	// Org returns the organization with id, or ErrNotFound.
+	Org(ctx context.Context, id primitive.ObjectID) (*Organization, error)
+	// OrgByCustomer returns the organization billed to the Stripe
+	// customer, or ErrNotFound.
+	OrgByCustomer(ctx context.Context, customerID string) (*Organization, error)
+	SetCustomer(ctx context.Context, id primitive.ObjectID, customerID string) error
+	SetSubscription(ctx context.Context, id primitive.ObjectID, status, subscriptionID string, expiresAt time.Time, seats int64) error
+	// AddMember adds m, or returns ErrAlreadyMember.
+	AddMember(ctx context.Context, m *Member) error
+	// Member returns the user's membership, or ErrNotMember.
+	Member(ctx context.Context, orgID, userID primitive.ObjectID) (*Member, error)
+	// Members returns the organization's members, oldest first.
+	Members(ctx context.Context, orgID primitive.ObjectID) ([]Member, error)
+	// Memberships returns the user's memberships, oldest first.
+	Memberships(ctx context.Context, userID primitive.ObjectID) ([]Member, error)
+	SetMemberRole(ctx context.Context, orgID, userID primitive.ObjectID, role string) error
+	// RemoveMember removes the membership, or returns ErrNotMember.
+	RemoveMember(ctx context.Context, orgID, userID primitive.ObjectID) error
+	// SetSeatExpiry records until when the user has a paid seat; the zero
+	// time clears it.
+	SetSeatExpiry(ctx context.Context, userID primitive.ObjectID, expiresAt time.Time) error
+}
+
+// MongoOrgs is a Store backed by the organizations and org_members
+// collections. Seats are recorded on the users collection.
+type MongoOrgs struct {
+	DB *mongo.Database
+}
+
+func (s MongoOrgs) orgs() *mongo.Collection {
+	return s.DB.Collection("organizations")
+}
+
+func (s MongoOrgs) members() *mongo.Collection {
+	return s.DB.Collection("org_members")
+}
+
+// EnsureIndexes creates the lookup indexes and the unique index that keeps
+// a user from joining an organization twice.
+func (s MongoOrgs) EnsureIndexes(ctx context.Context) error {
+	if _, err := s.orgs().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "stripeCustomerId", Value: 1}},
+		Options: options.Index().SetSparse(true),
+	}); err != nil {
+		return fmt.Errorf("failed to create organization indexes: %v", err)
+	}
+	if _, err := s.members().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "orgId", Value: 1}, {Key: "userId", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userId", Value: 1}}},
+	}); err != nil {
+		return fmt.Errorf("failed to create member indexes: %v", err)
+	}
+	return nil
+}
+
+func (s MongoOrgs) CreateOrg(ctx context.Context, o *Organization) error {
+	if _, err := s.orgs().InsertOne(ctx, o); err != nil {
+		return fmt.Errorf("failed to store organization: %v", err)
+	}
+	return nil
+}
+
+func (s MongoOrgs) findOrg(ctx context.Context, filter bson.M) (*Organization, error) {
+	var o Organization
+	err := s.orgs().FindOne(ctx, filter).Decode(&o)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch organization: %v", err)
+	}
+	return &o, nil
+}
+
+func (s MongoOrgs) Org(ctx context.Context, id primitive.ObjectID) (*Organization, error) {
+	return s.findOrg(ctx, bson.M{"_id": id})
+}
+
+func (s MongoOrgs) OrgByCustomer(ctx context.Context, customerID string) (*Organization, error) {
+	return s.findOrg(ctx, bson.M{"stripeCustomerId": customerID})
+}
+
+func (s MongoOrgs) SetCustomer(ctx context.Context, id primitive.ObjectID, customerID string) error {
+	if _, err := s.orgs().UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"stripeCustomerId": customerID}}); err != nil {
+		return fmt.Errorf("failed to update organization: %v", err)
+	}
+	return nil
+}
+
+func (s MongoOrgs) SetSubscription(ctx context.Context, id primitive.ObjectID, status, subscriptionID string, expiresAt time.Time, seats int64) error {
+	if _, err := s.orgs().UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"subscriptionStatus":    status,
+		"subscriptionId":        subscriptionID,
+		"subscriptionExpiresAt": expiresAt,
+		"seats":                 seats,
+	}}); err != nil {
+		return fmt.Errorf("failed to update subscription: %v", err)
+	}
+	return nil
+}
+
+func (s MongoOrgs) AddMember(ctx context.Context, m *Member) error {
+	_, err := s.members().InsertOne(ctx, m)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAlreadyMember
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add member: %v", err)
+	}
+	return nil
+}
+
+func (s MongoOrgs) Member(ctx context.Context, orgID, userID primitive.ObjectID) (*Member, error) {
+	var m Member
+	err := s.members().FindOne(ctx, bson.M{"orgId": orgID, "userId": userID}).Decode(&m)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotMember
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch member: %v", err)
+	}
+	return &m, nil
+}
+
+func (s MongoOrgs) findMembers(ctx context.Context, filter bson.M) ([]Member, error) {
+	cursor, err := s.members().Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch members: %v", err)
+	}
+	members := []Member{}
+	if err := cursor.All(ctx, &members); err != nil {
+		return nil, fmt.Errorf("failed to decode members: %v", err)
+	}
+	return members, nil
+}
+
+func (s MongoOrgs) Members(ctx context.Context, orgID primitive.ObjectID) ([]Member, error) {
+	return s.findMembers(ctx, bson.M{"orgId": orgID})
+}
+
+func (s MongoOrgs) Memberships(ctx context.Context, userID primitive.ObjectID) ([]Member, error) {
+	return s.findMembers(ctx, bson.M{"userId": userID})
+}
+
+func (s MongoOrgs) SetMemberRole(ctx context.Context, orgID, userID primitive.ObjectID, role string) error {
+	result, err := s.members().UpdateOne(ctx, bson.M{"orgId": orgID, "userId": userID}, bson.M{"$set": bson.M{"role": role}})
+	if err != nil {
+		return fmt.Errorf("failed to update member: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotMember
+	}
+	return nil
+}
+
+func (s MongoOrgs) RemoveMember(ctx context.Context, orgID, userID primitive.ObjectID) error {
+	result, err := s.members().DeleteOne(ctx, bson.M{"orgId": orgID, "userId": userID})
+	if err != nil {
+		return fmt.Errorf("failed to remove member: %v", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotMember
+	}
+	return nil
+}
+
+func (s MongoOrgs) SetSeatExpiry(ctx context.Context, userID primitive.ObjectID, expiresAt time.Time) error {
+	update := bson.M{"$set": bson.M{"seatExpiresAt": expiresAt}}
+	if expiresAt.IsZero() {
+		update = bson.M{"$unset": bson.M{"seatExpiresAt": ""}}
+	}
+	if _, err := s.DB.Collection("users").UpdateOne(ctx, bson.M{"_id": userID}, update); err != nil {
+		return fmt.Errorf("failed to update seat: %v", err)
+	}
+	return nil
+}
+
+// SeatBilling changes the number of seats a subscription is billed for.
+type SeatBilling interface {
+	UpdateSeats(ctx context.Context, subscriptionID string, seats int64) error
+}
+
+// Orgs manages organizations, their members, invitations and libraries.
+type Orgs struct {
+	Store       Store
+	Invitations InvitationStore
+	Library     LibraryStore
+	// Billing keeps the subscription's seats in step with the members; nil
+	// leaves them alone
+	Billing SeatBilling
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewOrgs returns organizations kept in the stores.
+func NewOrgs(store Store, invitations InvitationStore, library LibraryStore, billing SeatBilling) *Orgs {
+	return &Orgs{Store: store, Invitations: invitations, Library: library, Billing: billing, now: time.Now}
+}
+
+// checkName trims name and rejects it when it is empty, too long or holds
+// control characters such as line breaks, which would let it inject lines
+// into invitation emails and logs.
+func checkName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > MaxNameLength {
+		return "", invalid("name must be 1 to %d characters", MaxNameLength)
+	}
+	if !utf8.ValidString(name) || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "", invalid("name must not contain control characters")
+	}
+	return name, nil
+}
+
+func checkRole(role string) error {
+	for _, r := range Roles {
+		if r == role {
+			return nil
+		}
+	}
+	return invalid("role must be one of %v", Roles)
+}
+
+// Create creates an organization with the user as its owner.
+func (o *Orgs) Create(ctx context.Context, user *models.User, name string) (*Organization, error) {
+	name, err := checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	now := o.now()
+	org := &Organization{ID: primitive.NewObjectID(), Name: name, CreatedAt: now}
+	if err := o.Store.CreateOrg(ctx, org); err != nil {
+		return nil, err
+	}
+	if err := o.Store.AddMember(ctx, &Member{
+		ID:       primitive.NewObjectID(),
+		OrgID:    org.ID,
+		UserID:   user.ID,
+		Email:    user.Email,
+		Role:     RoleOwner,
+		JoinedAt: now,
+	}); err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+// ForUser returns the organizations the user is a member of.
+func (o *Orgs) ForUser(ctx context.Context, userID primitive.ObjectID) ([]Membership, error) {
+	members, err := o.Store.Memberships(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	memberships := []Membership{}
+	for _, m := range members {
+		org, err := o.Store.Org(ctx, m.OrgID)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, Membership{Organization: *org, Role: m.Role})
+	}
+	return memberships, nil
+}
+
+// Member returns the user's membership of the organization, or
+// ErrNotMember.
+func (o *Orgs) Member(ctx context.Context, orgID, userID primitive.ObjectID) (*Member, error) {
+	return o.Store.Member(ctx, orgID, userID)
+}
+
+// Manager returns the user's membership when it allows managing the
+// organization, and ErrForbidden when it does not.
+func (o *Orgs) Manager(ctx context.Context, orgID, userID primitive.ObjectID) (*Member, error) {
+	m, err := o.Store.Member(ctx, orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !m.CanManage() {
+		return nil, ErrForbidden
+	}
+	return m, nil
+}
+
+// Owner returns the user's membership when they own the organization, and
+// ErrForbidden when they do not.
+func (o *Orgs) Owner(ctx context.Context, orgID, userID primitive.ObjectID) (*Member, error) {
+	m, err := o.Store.Member(ctx, orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if m.Role != RoleOwner {
+		return nil, ErrForbidden
+	}
+	return m, nil
+}
+
+// otherOwner reports whether the organization has an owner besides userID.
+func (o *Orgs) otherOwner(ctx context.Context, orgID, userID primitive.ObjectID) (bool, error) {
+	members, err := o.Store.Members(ctx, orgID)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range members {
+		if m.Role == RoleOwner && m.UserID != userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SetRole changes a member's role on behalf of actor. Only owners can make
+// or unmake owners, and the last owner cannot step down.
+func (o *Orgs) SetRole(ctx context.Context, actor *Member, userID primitive.ObjectID, role string) error {
+	if err := checkRole(role); err != nil {
+		return err
+	}
+	if !actor.CanManage() {
+		return ErrForbidden
+	}
+	target, err := o.Store.Member(ctx, actor.OrgID, userID)
+	if err != nil {
+		return err
+	}
+	if (target.Role == RoleOwner || role == RoleOwner) && actor.Role != RoleOwner {
+		return ErrForbidden
+	}
+	if target.Role == RoleOwner && role != RoleOwner {
+		ok, err := o.otherOwner(ctx, actor.OrgID, userID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrLastOwner
+		}
+	}
+	return o.Store.SetMemberRole(ctx, actor.OrgID, userID, role)
+}
+
+// Remove removes a member on behalf of actor. Every member can leave;
+// removing others takes an owner, or an admin when the target is not an
+// owner. The last owner cannot leave.
+func (o *Orgs) Remove(ctx context.Context, actor *Member, userID primitive.ObjectID) error {
+	target, err := o.Store.Member(ctx, actor.OrgID, userID)
+	if err != nil {
+		return err
+	}
+	if target.UserID != actor.UserID {
+		if !actor.CanManage() || (target.Role == RoleOwner && actor.Role != RoleOwner) {
+			return ErrForbidden
+		}
+	}
+	if target.Role == RoleOwner {
+		ok, err := o.otherOwner(ctx, actor.OrgID, userID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrLastOwner
+		}
+	}
+	if err := o.Store.RemoveMember(ctx, actor.OrgID, userID); err != nil {
+		return err
+	}
+	o.membersChanged(ctx, actor.OrgID, userID)
+	return nil
+}
+
+// membersChanged updates the seat of the user who joined or left and the
+// number of seats billed. The membership change stands when this fails;
+// the seats are corrected by the next change or payment.
+func (o *Orgs) membersChanged(ctx context.Context, orgID, userID primitive.ObjectID) {
+	if err := o.refreshSeat(ctx, userID); err != nil {
+		log.Printf("membersChanged: %v", err)
+	}
+	if err := o.syncSeats(ctx, orgID); err != nil {
+		log.Printf("membersChanged: %v", err)
+	}
+}
+
+// refreshSeat records the latest end of the paid periods of the user's
+// organizations on the user, which makes models.User.IsPaid true for
+// members of paying organizations.
+func (o *Orgs) refreshSeat(ctx context.Context, userID primitive.ObjectID) error {
+	memberships, err := o.ForUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	var expiresAt time.Time
+	for _, m := range memberships {
+		if m.IsPaid() && m.SubscriptionExpiresAt.After(expiresAt) {
+			expiresAt = m.SubscriptionExpiresAt
+		}
+	}
+	return o.Store.SetSeatExpiry(ctx, userID, expiresAt)
+}
+
+// refreshSeats refreshes the seats of all members of the organization.
+func (o *Orgs) refreshSeats(ctx context.Context, orgID primitive.ObjectID) error {
+	members, err := o.Store.Members(ctx, orgID)
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if err := o.refreshSeat(ctx, m.UserID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncSeats bills the organization's subscription for its current number
+// of members.
+func (o *Orgs) syncSeats(ctx context.Context, orgID primitive.ObjectID) error {
+	org, err := o.Store.Org(ctx, orgID)
+	if err != nil {
+		return err
+	}
+	if o.Billing == nil || org.SubscriptionID == "" {
+		return nil
+	}
+	members, err := o.Store.Members(ctx, orgID)
+	if err != nil {
+		return err
+	}
+	seats := int64(len(members))
+	if seats == org.Seats {
+		return nil
+	}
+	if err := o.Billing.UpdateSeats(ctx, org.SubscriptionID, seats); err != nil {
+		return fmt.Errorf("failed to update seats of organization %s: %v", orgID.Hex(), err)
+	}
+	return o.Store.SetSubscription(ctx, orgID, org.SubscriptionStatus, org.SubscriptionID, org.SubscriptionExpiresAt, seats)
+}
+
+// Seats returns the number of seats the organization needs, one per member.
+func (o *Orgs) Seats(ctx context.Context, orgID primitive.ObjectID) (int64, error) {
+	members, err := o.Store.Members(ctx, orgID)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(members)), nil
+}
+
+// SubscriptionPaid records a payment for the subscription of the
+// organization billed to the Stripe customer and gives its members paid
+// seats until expiresAt. It returns the organization as it was before the
+// payment, or nil when no organization is billed to the customer.
+func (o *Orgs) SubscriptionPaid(ctx context.Context, customerID, subscriptionID string, expiresAt time.Time, seats int64) (*Organization, error) {
+	org, err := o.Store.OrgByCustomer(ctx, customerID)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := o.Store.SetSubscription(ctx, org.ID, "active", subscriptionID, expiresAt, seats); err != nil {
+		return org, err
+	}
+	if err := o.refreshSeats(ctx, org.ID); err != nil {
+		return org, err
+	}
+	// Members may have joined or left while the checkout was open
+	return org, o.syncSeats(ctx, org.ID)
+}
+
+// SubscriptionCancelled ends the organization's subscription and the
+// members' paid seats.
+func (o *Orgs) SubscriptionCancelled(ctx context.Context, orgID primitive.ObjectID) error {
+	if err := o.Store.SetSubscription(ctx, orgID, "cancelled", "", o.now(), 0); err != nil {
+		return err
+	}
+	return o.refreshSeats(ctx, orgID)
+}
@@ -0,0 +1,579 @@
+package org
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"watermark-generator/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryOrgs is a Store for tests.
+type memoryOrgs struct {
+	mu      sync.Mutex
+	orgs    map[primitive.ObjectID]Organization
+	members []Member
+	seats   map[primitive.ObjectID]time.Time
+}
+
+func newMemoryOrgs() *memoryOrgs {
+	return &memoryOrgs{orgs: map[primitive.ObjectID]Organization{}, seats: map[primitive.ObjectID]time.Time{}}
+}
+
+func (m *memoryOrgs) CreateOrg(_ context.Context, o *Organization) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.orgs[o.ID] = *o
+	return nil
+}
+
+func (m *memoryOrgs) Org(_ context.Context, id primitive.ObjectID) (*Organization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.orgs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &o, nil
+}
+
+func (m *memoryOrgs) OrgByCustomer(_ context.Context, customerID string) (*Organization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, o := range m.orgs {
+		if o.StripeCustomerID == customerID {
+			return &o, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memoryOrgs) SetCustomer(_ context.Context, id primitive.ObjectID, customerID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := m.orgs[id]
+	o.StripeCustomerID = customerID
+	m.orgs[id] = o
+	return nil
+}
+
+func (m *memoryOrgs) SetSubscription(_ context.Context, id primitive.ObjectID, status, subscriptionID string, expiresAt time.Time, seats int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := m.orgs[id]
+	o.SubscriptionStatus, o.SubscriptionID, o.SubscriptionExpiresAt, o.Seats = status, subscriptionID, expiresAt, seats
+	m.orgs[id] = o
+	return nil
+}
+
+func (m *memoryOrgs) AddMember(_ context.Context, member *Member) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.members {
+		if existing.OrgID == member.OrgID && existing.UserID == member.UserID {
+			return ErrAlreadyMember
+		}
+	}
+	m.members = append(m.members, *member)
+	return nil
+}
+
+func (m *memoryOrgs) Member(_ context.Context, orgID, userID primitive.ObjectID) (*Member, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, member := range m.members {
+		if member.OrgID == orgID && member.UserID == userID {
+			return &member, nil
+		}
+	}
+	return nil, ErrNotMember
+}
+
+func (m *memoryOrgs) Members(_ context.Context, orgID primitive.ObjectID) ([]Member, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := []Member{}
+	for _, member := range m.members {
+		if member.OrgID == orgID {
+			members = append(members, member)
+		}
+	}
+	return members, nil
+}
+
+func (m *memoryOrgs) Memberships(_ context.Context, userID primitive.ObjectID) ([]Member, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := []Member{}
+	for _, member := range m.members {
+		if member.UserID == userID {
+			members = append(members, member)
+		}
+	}
+	return members, nil
+}
+
+func (m *memoryOrgs) SetMemberRole(_ context.Context, orgID, userID primitive.ObjectID, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, member := range m.members {
+		if member.OrgID == orgID && member.UserID == userID {
+			m.members[i].Role = role
+			return nil
+		}
+	}
+	return ErrNotMember
+}
+
+func (m *memoryOrgs) RemoveMember(_ context.Context, orgID, userID primitive.ObjectID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, member := range m.members {
+		if member.OrgID == orgID && member.UserID == userID {
+			m.members = append(m.members[:i], m.members[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotMember
+}
+
+func (m *memoryOrgs) SetSeatExpiry(_ context.Context, userID primitive.ObjectID, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seats[userID] = expiresAt
+	return nil
+}
+
+func (m *memoryOrgs) seat(userID primitive.ObjectID) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.seats[userID]
+}
+
+// memoryInvitations is an InvitationStore for tests.
+type memoryInvitations struct {
+	mu          sync.Mutex
+	invitations []Invitation
+}
+
+func (m *memoryInvitations) CreateInvitation(_ context.Context, inv *Invitation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.invitations = append(m.invitations, *inv)
+	return nil
+}
+
+func (m *memoryInvitations) InvitationByHash(_ context.Context, hash string, now time.Time) (*Invitation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, inv := range m.invitations {
+		if inv.TokenHash == hash && inv.ExpiresAt.After(now) {
+			return &inv, nil
+		}
+	}
+	return nil, ErrInvalidInvitation
+}
+
+func (m *memoryInvitations) Invitations(_ context.Context, orgID primitive.ObjectID, now time.Time) ([]Invitation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	invitations := []Invitation{}
+	for i := len(m.invitations) - 1; i >= 0; i-- {
+		if inv := m.invitations[i]; inv.OrgID == orgID && inv.ExpiresAt.After(now) {
+			invitations = append(invitations, inv)
+		}
+	}
+	return invitations, nil
+}
+
+func (m *memoryInvitations) DeleteInvitation(_ context.Context, orgID, id primitive.ObjectID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, inv := range m.invitations {
+		if inv.OrgID == orgID && inv.ID == id {
+			m.invitations = append(m.invitations[:i], m.invitations[i+1:]...)
+			return nil
+		}
+	}
+	return ErrInvitationNotFound
+}
+
+func (m *memoryInvitations) DeleteInvitationsTo(_ context.Context, orgID primitive.ObjectID, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.invitations[:0]
+	for _, inv := range m.invitations {
+		if inv.OrgID != orgID || inv.Email != email {
+			kept = append(kept, inv)
+		}
+	}
+	m.invitations = kept
+	return nil
+}
+
+// memoryLibrary is a LibraryStore for tests.
+type memoryLibrary struct {
+	mu      sync.Mutex
+	assets  []Asset
+	presets map[primitive.ObjectID]Preset
+}
+
+func newMemoryLibrary() *memoryLibrary {
+	return &memoryLibrary{presets: map[primitive.ObjectID]Preset{}}
+}
+
+func (m *memoryLibrary) CreateAsset(_ context.Context, a *Asset) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.assets = append(m.assets, *a)
+	return nil
+}
+
+func (m *memoryLibrary) Asset(_ context.Context, id primitive.ObjectID) (*Asset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, a := range m.assets {
+		if a.ID == id {
+			return &a, nil
+		}
+	}
+	return nil, ErrAssetNotFound
+}
+
+func (m *memoryLibrary) Assets(_ context.Context, orgID primitive.ObjectID) ([]Asset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	assets := []Asset{}
+	for i := len(m.assets) - 1; i >= 0; i-- {
+		if a := m.assets[i]; a.OrgID == orgID {
+			a.Data = nil
+			assets = append(assets, a)
+		}
+	}
+	return assets, nil
+}
+
+func (m *memoryLibrary) CountAssets(ctx context.Context, orgID primitive.ObjectID) (int64, error) {
+	assets, _ := m.Assets(ctx, orgID)
+	return int64(len(assets)), nil
+}
+
+func (m *memoryLibrary) DeleteAsset(_ context.Context, orgID, id primitive.ObjectID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, a := range m.assets {
+		if a.OrgID == orgID && a.ID == id {
+			m.assets = append(m.assets[:i], m.assets[i+1:]...)
+			return nil
+		}
+	}
+	return ErrAssetNotFound
+}
+
+func (m *memoryLibrary) SavePreset(_ context.Context, p *Preset) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.presets[p.ID] = *p
+	return nil
+}
+
+func (m *memoryLibrary) Preset(_ context.Context, orgID, id primitive.ObjectID) (*Preset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.presets[id]
+	if !ok || p.OrgID != orgID {
+		return nil, ErrPresetNotFound
+	}
+	return &p, nil
+}
+
+func (m *memoryLibrary) Presets(_ context.Context, orgID primitive.ObjectID) ([]Preset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	presets := []Preset{}
+	for _, p := range m.presets {
+		if p.OrgID == orgID {
+			presets = append(presets, p)
+		}
+	}
+	sort.Slice(presets, func(i, j int) bool { return presets[i].Name < presets[j].Name })
+	return presets, nil
+}
+
+func (m *memoryLibrary) CountPresets(ctx context.Context, orgID primitive.ObjectID) (int64, error) {
+	presets, _ := m.Presets(ctx, orgID)
+	return int64(len(presets)), nil
+}
+
+func (m *memoryLibrary) DeletePreset(_ context.Context, orgID, id primitive.ObjectID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, ok := m.presets[id]; !ok || p.OrgID != orgID {
+		return ErrPresetNotFound
+	}
+	delete(m.presets, id)
+	return nil
+}
+
+// recordingBilling is a SeatBilling that remembers the last update.
+type recordingBilling struct {
+	subscriptionID string
+	seats          int64
+}
+
+func (b *recordingBilling) UpdateSeats(_ context.Context, subscriptionID string, seats int64) error {
+	b.subscriptionID, b.seats = subscriptionID, seats
+	return nil
+}
+
+func newTestOrgs() (*Orgs, *memoryOrgs, *recordingBilling) {
+	store := newMemoryOrgs()
+	billing := &recordingBilling{}
+	return NewOrgs(store, &memoryInvitations{}, newMemoryLibrary(), billing), store, billing
+}
+
+func newUser(email string) *models.User {
+	return &models.User{ID: primitive.NewObjectID(), Email: email}
+}
+
+// join invites the user to the organization with role and accepts.
+func join(t *testing.T, orgs *Orgs, owner *Member, user *models.User, role string) *Member {
+	t.Helper()
+	token, _, err := orgs.Invite(context.Background(), owner, user.Email, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := orgs.Accept(context.Background(), user, token); err != nil {
+		t.Fatal(err)
+	}
+	m, err := orgs.Member(context.Background(), owner.OrgID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestCreateMakesOwner(t *testing.T) {
+	orgs, _, _ := newTestOrgs()
+	ctx := context.Background()
+	user := newUser("owner@example.com")
+
+	for _, name := range []string{"  ", "Studio\nBcc: someone@example.com", "Studio\x00", "Stu\u0085dio", "Studio\xff"} {
+		if _, err := orgs.Create(ctx, user, name); err == nil {
+			t.Errorf("name %q accepted", name)
+		}
+	}
+	org, err := orgs.Create(ctx, user, " Studio ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if org.Name != "Studio" {
+		t.Errorf("name = %q, want Studio", org.Name)
+	}
+	memberships, err := orgs.ForUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(memberships) != 1 || memberships[0].ID != org.ID || memberships[0].Role != RoleOwner {
+		t.Errorf("memberships = %+v, want owner of %s", memberships, org.ID.Hex())
+	}
+}
+
+func TestInvitations(t *testing.T) {
+	orgs, _, _ := newTestOrgs()
+	ctx := context.Background()
+	ownerUser := newUser("owner@example.com")
+	org, _ := orgs.Create(ctx, ownerUser, "Studio")
+	owner, _ := orgs.Member(ctx, org.ID, ownerUser.ID)
+	invitee := newUser("Photographer@Example.com")
+
+	first, _, err := orgs.Invite(ctx, owner, "photographer@example.com", RoleMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, inv, err := orgs.Invite(ctx, owner, "PHOTOGRAPHER@example.com ", RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.Email != "photographer@example.com" {
+		t.Errorf("email = %q, want it normalized", inv.Email)
+	}
+	if _, err := orgs.Accept(ctx, invitee, first); err != ErrInvalidInvitation {
+		t.Errorf("replaced invitation: err = %v, want ErrInvalidInvitation", err)
+	}
+	if _, err := orgs.Accept(ctx, newUser("someone@example.com"), second); err != ErrWrongRecipient {
+		t.Errorf("other user: err = %v, want ErrWrongRecipient", err)
+	}
+	if _, err := orgs.Accept(ctx, invitee, second); err != nil {
+		t.Fatal(err)
+	}
+	m, err := orgs.Member(ctx, org.ID, invitee.ID)
+	if err != nil || m.Role != RoleAdmin {
+		t.Errorf("member = %+v, %v; want admin", m, err)
+	}
+	if _, err := orgs.Accept(ctx, invitee, second); err != ErrInvalidInvitation {
+		t.Errorf("reused invitation: err = %v, want ErrInvalidInvitation", err)
+	}
+	if _, _, err := orgs.Invite(ctx, owner, invitee.Email, RoleMember); err != ErrAlreadyMember {
+		t.Errorf("inviting a member: err = %v, want ErrAlreadyMember", err)
+	}
+
+	member := join(t, orgs, owner, newUser("member@example.com"), RoleMember)
+	if _, _, err := orgs.Invite(ctx, member, "x@example.com", RoleMember); err != ErrForbidden {
+		t.Errorf("member inviting: err = %v, want ErrForbidden", err)
+	}
+	if _, _, err := orgs.Invite(ctx, m, "x@example.com", RoleOwner); err != ErrForbidden {
+		t.Errorf("admin inviting an owner: err = %v, want ErrForbidden", err)
+	}
+}
+
+func TestRolesAndRemoval(t *testing.T) {
+	orgs, _, _ := newTestOrgs()
+	ctx := context.Background()
+	ownerUser := newUser("owner@example.com")
+	org, _ := orgs.Create(ctx, ownerUser, "Studio")
+	owner, _ := orgs.Member(ctx, org.ID, ownerUser.ID)
+	admin := join(t, orgs, owner, newUser("admin@example.com"), RoleAdmin)
+	member := join(t, orgs, owner, newUser("member@example.com"), RoleMember)
+
+	if err := orgs.SetRole(ctx, owner, owner.UserID, RoleAdmin); err != ErrLastOwner {
+		t.Errorf("last owner stepping down: err = %v, want ErrLastOwner", err)
+	}
+	if err := orgs.Remove(ctx, owner, owner.UserID); err != ErrLastOwner {
+		t.Errorf("last owner leaving: err = %v, want ErrLastOwner", err)
+	}
+	if err := orgs.Remove(ctx, admin, owner.UserID); err != ErrForbidden {
+		t.Errorf("admin removing owner: err = %v, want ErrForbidden", err)
+	}
+	if err := orgs.SetRole(ctx, admin, member.UserID, RoleOwner); err != ErrForbidden {
+		t.Errorf("admin making an owner: err = %v, want ErrForbidden", err)
+	}
+	if err := orgs.SetRole(ctx, member, admin.UserID, RoleMember); err != ErrForbidden {
+		t.Errorf("member changing roles: err = %v, want ErrForbidden", err)
+	}
+	if err := orgs.SetRole(ctx, owner, admin.UserID, "boss"); err == nil {
+		t.Error("unknown role accepted")
+	}
+
+	if err := orgs.SetRole(ctx, owner, admin.UserID, RoleOwner); err != nil {
+		t.Fatal(err)
+	}
+	if err := orgs.Remove(ctx, owner, owner.UserID); err != nil {
+		t.Errorf("owner leaving with another owner: %v", err)
+	}
+	if err := orgs.Remove(ctx, member, member.UserID); err != nil {
+		t.Errorf("member leaving: %v", err)
+	}
+	members, _ := orgs.Store.Members(ctx, org.ID)
+	if len(members) != 1 || members[0].UserID != admin.UserID {
+		t.Errorf("members = %+v, want only the new owner", members)
+	}
+}
+
+func TestSeats(t *testing.T) {
+	orgs, store, billing := newTestOrgs()
+	ctx := context.Background()
+	ownerUser := newUser("owner@example.com")
+	org, _ := orgs.Create(ctx, ownerUser, "Studio")
+	owner, _ := orgs.Member(ctx, org.ID, ownerUser.ID)
+	store.SetCustomer(ctx, org.ID, "cus_1")
+
+	expiresAt := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	if paid, err := orgs.SubscriptionPaid(ctx, "cus_other", "sub_x", expiresAt, 1); paid != nil || err != nil {
+		t.Errorf("unknown customer: paid = %v, err = %v", paid, err)
+	}
+	if paid, err := orgs.SubscriptionPaid(ctx, "cus_1", "sub_1", expiresAt, 1); err != nil || paid == nil || paid.ID != org.ID {
+		t.Fatalf("paid = %v, err = %v", paid, err)
+	}
+	if got := store.seat(ownerUser.ID); !got.Equal(expiresAt) {
+		t.Errorf("owner seat = %v, want %v", got, expiresAt)
+	}
+
+	photographer := newUser("photographer@example.com")
+	join(t, orgs, owner, photographer, RoleMember)
+	if got := store.seat(photographer.ID); !got.Equal(expiresAt) {
+		t.Errorf("new member seat = %v, want %v", got, expiresAt)
+	}
+	if billing.subscriptionID != "sub_1" || billing.seats != 2 {
+		t.Errorf("billed %s for %d seats, want sub_1 for 2", billing.subscriptionID, billing.seats)
+	}
+
+	if err := orgs.Remove(ctx, owner, photographer.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.seat(photographer.ID); !got.IsZero() {
+		t.Errorf("removed member seat = %v, want none", got)
+	}
+	if billing.seats != 1 {
+		t.Errorf("billed for %d seats after removal, want 1", billing.seats)
+	}
+
+	if err := orgs.SubscriptionCancelled(ctx, org.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.seat(ownerUser.ID); !got.IsZero() {
+		t.Errorf("owner seat after cancelling = %v, want none", got)
+	}
+}
+
+func TestLibrary(t *testing.T) {
+	orgs, _, _ := newTestOrgs()
+	ctx := context.Background()
+	ownerUser := newUser("owner@example.com")
+	org, _ := orgs.Create(ctx, ownerUser, "Studio")
+	owner, _ := orgs.Member(ctx, org.ID, ownerUser.ID)
+	member := join(t, orgs, owner, newUser("member@example.com"), RoleMember)
+	outsider := newUser("outsider@example.com")
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"></svg>`)
+	if _, err := orgs.AddAsset(ctx, member, "Logo", png); err != ErrForbidden {
+		t.Errorf("member adding asset: err = %v, want ErrForbidden", err)
+	}
+	if _, err := orgs.AddAsset(ctx, owner, "Notes", []byte("just text")); err == nil {
+		t.Error("text asset accepted")
+	}
+	if a, err := orgs.AddAsset(ctx, owner, "Vector logo", svg); err != nil || a.ContentType != "image/svg+xml" {
+		t.Errorf("svg asset = %+v, %v", a, err)
+	}
+	asset, err := orgs.AddAsset(ctx, owner, "Logo", png)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := orgs.AssetFor(ctx, member.UserID, asset.ID); err != nil || string(got.Data) != string(png) {
+		t.Errorf("member fetching asset: %v", err)
+	}
+	if _, err := orgs.AssetFor(ctx, outsider.ID, asset.ID); err != ErrAssetNotFound {
+		t.Errorf("outsider fetching asset: err = %v, want ErrAssetNotFound", err)
+	}
+
+	preset, err := orgs.SavePreset(ctx, owner, &Preset{
+		Name:     "Client proofs",
+		Kind:     PresetImage,
+		Settings: map[string]string{"watermarkAssetId": asset.ID.Hex(), "opacity": "0.4"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := orgs.SavePreset(ctx, owner, &Preset{Name: "Bad", Kind: "video"}); err == nil {
+		t.Error("unknown kind accepted")
+	}
+	if _, err := orgs.SavePreset(ctx, owner, &Preset{ID: primitive.NewObjectID(), Name: "Ghost", Kind: PresetText}); err != ErrPresetNotFound {
+		t.Errorf("updating unknown preset: err = %v, want ErrPresetNotFound", err)
+	}
+	preset.Settings["opacity"] = "0.6"
+	if _, err := orgs.SavePreset(ctx, owner, preset); err != nil {
+		t.Fatal(err)
+	}
+	presets, _ := orgs.Library.Presets(ctx, org.ID)
+	if len(presets) != 1 || presets[0].Settings["opacity"] != "0.6" {
+		t.Errorf("presets = %+v, want the updated preset", presets)
+	}
+	if err := orgs.DeletePreset(ctx, member, preset.ID); err != ErrForbidden {
+		t.Errorf("member deleting preset: err = %v, want ErrForbidden", err)
+	}
+}
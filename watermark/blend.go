@@ -0,0 +1,114 @@
+package watermark
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+// BlendMode selects how a watermark layer is combined with the image below
+// it. The formulas follow the W3C Compositing and Blending specification.
+type BlendMode string
+
+const (
+	BlendNormal     BlendMode = "normal"
+	BlendMultiply   BlendMode = "multiply"
+	BlendScreen     BlendMode = "screen"
+	BlendOverlay    BlendMode = "overlay"
+	BlendSoftLight  BlendMode = "soft-light"
+	BlendDifference BlendMode = "difference"
+)
+
+// ParseBlendMode converts a form value into a BlendMode, defaulting to normal.
+func ParseBlendMode(s string) BlendMode {
+	switch mode := BlendMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case BlendMultiply, BlendScreen, BlendOverlay, BlendSoftLight, BlendDifference:
+		return mode
+	default:
+		return BlendNormal
+	}
+}
+
+// blendChannel applies the separable blend function of mode to a backdrop
+// channel cb and a source channel cs, both straight (non-premultiplied) and
+// in the range [0, 1].
+func blendChannel(mode BlendMode, cb, cs float64) float64 {
+	switch mode {
+	case BlendMultiply:
+		return cb * cs
+	case BlendScreen:
+		return cb + cs - cb*cs
+	case BlendOverlay:
+		// Overlay is hard-light with the layers swapped
+		if cb <= 0.5 {
+			return 2 * cb * cs
+		}
+		return blendChannel(BlendScreen, cs, 2*cb-1)
+	case BlendSoftLight:
+		if cs <= 0.5 {
+			return cb - (1-2*cs)*cb*(1-cb)
+		}
+		var d float64
+		if cb <= 0.25 {
+			d = ((16*cb-12)*cb + 4) * cb
+		} else {
+			d = math.Sqrt(cb)
+		}
+		return cb + (2*cs-1)*(d-cb)
+	case BlendDifference:
+		return math.Abs(cb - cs)
+	default:
+		return cs
+	}
+}
+
+// newLayer returns a transparent layer the size of dst for a watermark to
+// be drawn into before it is blended.
+func newLayer(dst *image.RGBA) *image.RGBA {
+	return image.NewRGBA(dst.Bounds())
+}
+
+// blendLayer composites layer onto dst using mode, scaling the layer's alpha
+// by opacity. Both images are premultiplied and must share bounds.
+func blendLayer(dst, layer *image.RGBA, mode BlendMode, opacity float64) {
+	bounds := dst.Bounds().Intersect(layer.Bounds())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			si := layer.PixOffset(x, y)
+			if layer.Pix[si+3] == 0 {
+				continue
+			}
+			di := dst.PixOffset(x, y)
+			blendPixel(dst.Pix[di:di+4:di+4], layer.Pix[si:si+4:si+4], mode, opacity)
+		}
+	}
+}
+
+// blendPixel blends the premultiplied source pixel s into the premultiplied
+// destination pixel d in place.
+func blendPixel(d, s []uint8, mode BlendMode, opacity float64) {
+	as := float64(s[3]) / 255
+	ab := float64(d[3]) / 255
+	if as == 0 {
+		return
+	}
+
+	// The source color is unpremultiplied with its own alpha before the
+	// opacity is applied so that it keeps its hue at any opacity.
+	a := as * opacity
+	ar := a + ab*(1-a)
+
+	for c := 0; c < 3; c++ {
+		cs := float64(s[c]) / 255 / as
+		cbp := float64(d[c]) / 255
+		cb := 0.0
+		if ab > 0 {
+			cb = cbp / ab
+		}
+
+		mixed := (1-ab)*cs + ab*blendChannel(mode, cb, cs)
+		v := a*mixed + (1-a)*cbp
+		d[c] = uint8(math.Round(math.Min(1, math.Max(0, v)) * 255))
+	}
+	d[3] = uint8(math.Round(math.Min(1, ar) * 255))
+}
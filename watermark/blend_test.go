@@ -0,0 +1,61 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestBlendLayer(t *testing.T) {
+	// A mid-grey backdrop under an opaque orange source
+	backdrop := color.RGBA{128, 128, 128, 255}
+	source := color.RGBA{255, 128, 0, 255}
+
+	tests := []struct {
+		mode    BlendMode
+		opacity float64
+		want    color.RGBA
+	}{
+		{BlendNormal, 1, color.RGBA{255, 128, 0, 255}},
+		{BlendNormal, 0.5, color.RGBA{192, 128, 64, 255}},
+		{BlendMultiply, 1, color.RGBA{128, 64, 0, 255}},
+		{BlendScreen, 1, color.RGBA{255, 192, 128, 255}},
+		{BlendDifference, 1, color.RGBA{127, 0, 128, 255}},
+		{BlendOverlay, 1, color.RGBA{255, 128, 1, 255}},
+		{BlendSoftLight, 1, color.RGBA{181, 128, 64, 255}},
+	}
+
+	for _, tt := range tests {
+		dst := image.NewRGBA(image.Rect(0, 0, 1, 1))
+		dst.SetRGBA(0, 0, backdrop)
+		layer := image.NewRGBA(dst.Bounds())
+		layer.SetRGBA(0, 0, source)
+
+		blendLayer(dst, layer, tt.mode, tt.opacity)
+
+		if got := dst.RGBAAt(0, 0); got != tt.want {
+			t.Errorf("%s at %.1f: got %v, want %v", tt.mode, tt.opacity, got, tt.want)
+		}
+	}
+}
+
+func TestBlendLayerSkipsTransparentPixels(t *testing.T) {
+	dst := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	dst.SetRGBA(0, 0, color.RGBA{10, 20, 30, 255})
+	layer := image.NewRGBA(dst.Bounds())
+
+	blendLayer(dst, layer, BlendDifference, 1)
+
+	if got := dst.RGBAAt(0, 0); got != (color.RGBA{10, 20, 30, 255}) {
+		t.Errorf("transparent layer changed pixel to %v", got)
+	}
+}
+
+func TestParseBlendMode(t *testing.T) {
+	if got := ParseBlendMode(" Soft-Light "); got != BlendSoftLight {
+		t.Errorf("ParseBlendMode(soft-light) = %q", got)
+	}
+	if got := ParseBlendMode("dodge"); got != BlendNormal {
+		t.Errorf("ParseBlendMode(dodge) = %q, want normal", got)
+	}
+}
@@ -0,0 +1,232 @@
+package watermark
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/qr"
+)
+
+// CodeKind selects the symbology of a code watermark.
+type CodeKind string
+
+const (
+	CodeQR      CodeKind = "qr"
+	CodeCode128 CodeKind = "code128"
+)
+
+// ParseCodeKind converts a form value into a CodeKind, defaulting to QR.
+func ParseCodeKind(s string) CodeKind {
+	switch kind := CodeKind(strings.ToLower(strings.TrimSpace(s))); kind {
+	case CodeCode128:
+		return kind
+	default:
+		return CodeQR
+	}
+}
+
+// ParseErrorCorrection converts a form value (L, M, Q or H) into a QR error
+// correction level, defaulting to M.
+func ParseErrorCorrection(s string) qr.ErrorCorrectionLevel {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "L":
+		return qr.L
+	case "Q":
+		return qr.Q
+	case "H":
+		return qr.H
+	default:
+		return qr.M
+	}
+}
+
+// MaxQuietZone is the widest quiet zone accepted, in modules. Wider margins
+// only shrink the code without helping scanners.
+const MaxQuietZone = 40
+
+// CodeOptions describes a QR code or barcode watermark. Content may contain
+// template placeholders, e.g. "https://example.com/license/{id}".
+type CodeOptions struct {
+	Content string
+	Kind    CodeKind
+	// Level is the QR error correction level; higher levels survive more
+	// damage and blending at the cost of a denser code.
+	Level qr.ErrorCorrectionLevel
+	// Size is the code width, including the quiet zone, as a percentage of
+	// the image width.
+	Size float64
+	// Foreground and Background are hex colors. An empty background is
+	// white; "none" leaves it transparent.
+	Foreground string
+	Background string
+	// QuietZone is the margin around the code in modules, at most
+	// MaxQuietZone. Zero uses the minimum the symbology requires.
+	QuietZone int
+	Opacity   float64
+	BlendMode BlendMode
+	// Spacing is the gap between tiles as a percentage of the code width.
+	Spacing  float64
+	Position Position
+	Tiling   TilingOptions
+	Template TemplateData
+}
+
+// ApplyCodeWatermark draws a QR code or barcode onto the image, either once
+// at opts.Position or tiled like the other watermark types.
+func (s *Service) ApplyCodeWatermark(r io.Reader, opts CodeOptions) ([]byte, error) {
+	log.Printf("ApplyCodeWatermark: Starting. Kind: %s, Size: %.2f, Position: %s", opts.Kind, opts.Size, opts.Position)
+	defer log.Println("ApplyCodeWatermark: Finished")
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		log.Printf("ApplyCodeWatermark: Failed to read source image: %v", err)
+		return nil, fmt.Errorf("failed to read source image: %v", err)
+	}
+	src, err := decodeSource(data)
+	if err != nil {
+		log.Printf("ApplyCodeWatermark: Failed to decode source image: %v", err)
+		return nil, fmt.Errorf("failed to decode source image: %v", err)
+	}
+
+	bounds := src.bounds()
+	opts.Template.Width = bounds.Dx()
+	opts.Template.Height = bounds.Dy()
+	content := ExpandTemplate(opts.Content, opts.Template)
+
+	code, err := renderCode(content, opts, int(float64(bounds.Dx())*opts.Size/100))
+	if err != nil {
+		log.Printf("ApplyCodeWatermark: Failed to encode %s code: %v", opts.Kind, err)
+		return nil, fmt.Errorf("failed to encode %s code: %v", opts.Kind, err)
+	}
+	size := code.Bounds().Size()
+	log.Printf("ApplyCodeWatermark: Code rendered at %dx%d", size.X, size.Y)
+
+	for _, result := range src.frames {
+		layer := newLayer(result)
+		if isPlaced(opts.Position) {
+			var at image.Rectangle
+			if opts.Position == PositionAuto {
+				// The code carries its own background, so only busy regions
+				// matter. Later frames of an animation reuse this anchor.
+				opts.Position, at = autoPlacement(result, size, placementMargin(bounds), -1)
+				log.Printf("ApplyCodeWatermark: Auto placement chose %s", opts.Position)
+			} else {
+				at = anchorRect(opts.Position, bounds, size, placementMargin(bounds))
+			}
+			draw.Draw(layer, at, code, image.Point{}, draw.Over)
+		} else {
+			gap := float64(size.X) * opts.Spacing / 100
+			for _, t := range layoutTiles(bounds, float64(size.X)+gap, float64(size.Y)+gap, opts.Tiling) {
+				drawTile(layer, code, t)
+			}
+		}
+		blendLayer(result, layer, opts.BlendMode, opts.Opacity)
+	}
+
+	var buf bytes.Buffer
+	if err := s.encode(&buf, src); err != nil {
+		log.Printf("ApplyCodeWatermark: Failed to encode result: %v", err)
+		return nil, fmt.Errorf("failed to encode result: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// RenderQRCode returns content as a black on white QR code PNG about width
+// pixels wide, for codes shown in the app rather than drawn on an image.
+func RenderQRCode(content string, width int) ([]byte, error) {
+	img, err := renderCode(content, CodeOptions{Kind: CodeQR, Level: qr.M}, width)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render QR code: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode QR code: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// renderCode encodes content and draws it about width pixels wide. Modules
+// are a whole number of pixels so that edges stay sharp for scanners.
+func renderCode(content string, opts CodeOptions, width int) (*image.RGBA, error) {
+	if content == "" {
+		return nil, fmt.Errorf("no content to encode")
+	}
+
+	var (
+		code      barcode.Barcode
+		err       error
+		quietZone = opts.QuietZone
+	)
+	switch opts.Kind {
+	case CodeCode128:
+		code, err = code128.Encode(content)
+		if quietZone <= 0 {
+			quietZone = 10
+		}
+	default:
+		code, err = qr.Encode(content, opts.Level, qr.Auto)
+		if quietZone <= 0 {
+			quietZone = 4
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	quietZone = min(quietZone, MaxQuietZone)
+
+	modules := code.Bounds().Dx()
+	total := modules + 2*quietZone
+	module := int(math.Max(1, math.Floor(float64(width)/float64(total))))
+
+	// Linear codes are bars a quarter as tall as they are wide, with the
+	// quiet zone only on the sides
+	rows := code.Bounds().Dy()
+	verticalQuiet := quietZone
+	if code.Metadata().Dimensions == 1 {
+		rows = int(math.Max(1, math.Round(float64(total)/4)))
+		verticalQuiet = 0
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, total*module, (rows+2*verticalQuiet)*module))
+	if !strings.EqualFold(opts.Background, "none") && !strings.EqualFold(opts.Background, "transparent") {
+		background := color.Color(color.White)
+		if opts.Background != "" {
+			background = parseColor(opts.Background)
+		}
+		draw.Draw(out, out.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	}
+
+	foreground := image.NewUniform(parseColor(opts.Foreground))
+	cb := code.Bounds()
+	for y := 0; y < rows; y++ {
+		for x := 0; x < modules; x++ {
+			sy := y
+			if code.Metadata().Dimensions == 1 {
+				sy = 0
+			}
+			if !isDark(code.At(cb.Min.X+x, cb.Min.Y+sy)) {
+				continue
+			}
+			at := image.Pt(x+quietZone, y+verticalQuiet).Mul(module)
+			r := image.Rectangle{Min: at, Max: at.Add(image.Pt(module, module))}
+			draw.Draw(out, r, foreground, image.Point{}, draw.Src)
+		}
+	}
+	return out, nil
+}
+
+// isDark reports whether a module of an encoded code is set.
+func isDark(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r+g+b < 3*0x8000
+}
@@ -0,0 +1,448 @@
+package watermark
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/qr"
+)
+
+func TestQRCodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		opts    CodeOptions
+	}{
+		{"url low", "https://example.com/license/{id}", CodeOptions{Level: qr.L}},
+		{"url high", "https://example.com/license/{id}", CodeOptions{Level: qr.H}},
+		{"alphanumeric", "PHOTO-{id}", CodeOptions{Level: qr.Q}},
+		{"colors", "{filename} #{index}", CodeOptions{Level: qr.M, Foreground: "#1a2a6c", Background: "#ffffcc", QuietZone: 6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := image.NewRGBA(image.Rect(0, 0, 600, 400))
+			draw.Draw(src, src.Bounds(), image.NewUniform(color.RGBA{235, 235, 235, 255}), image.Point{}, draw.Src)
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, src); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := tt.opts
+			opts.Content = tt.content
+			opts.Size = 40
+			opts.Opacity = 1
+			opts.Position = PositionBottomRight
+			opts.Template = TemplateData{Filename: "beach.jpg", ID: "3F2A", Index: 7}
+
+			out, err := (&Service{}).ApplyCodeWatermark(&buf, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := png.Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := decodeQR(toRGBA(img))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := ExpandTemplate(tt.content, opts.Template); got != want {
+				t.Errorf("decoded %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRenderQRCode(t *testing.T) {
+	content := "otpauth://totp/Watermark%20Generator:someone@example.com?issuer=Watermark+Generator&secret=JBSWY3DPEHPK3PXP"
+	out, err := RenderQRCode(content, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := img.Bounds().Dx(); w > 256 || w < 200 {
+		t.Errorf("width %d, want close to 256", w)
+	}
+	got, err := decodeQR(toRGBA(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != content {
+		t.Errorf("decoded %q, want %q", got, content)
+	}
+}
+
+func TestCode128QuietZone(t *testing.T) {
+	code, err := renderCode("IMG-0042", CodeOptions{Kind: CodeCode128, Background: "#ffffff"}, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := code.Bounds()
+	if b.Dx() > 400 || b.Dx() < 300 {
+		t.Errorf("code is %d px wide, want close to 400", b.Dx())
+	}
+
+	// The first bar starts after ten blank modules
+	bars, err := code128.Encode("IMG-0042")
+	if err != nil {
+		t.Fatal(err)
+	}
+	module := b.Dx() / (bars.Bounds().Dx() + 20)
+	y := b.Dy() / 2
+	for x := 0; x < 10*module; x++ {
+		if c := code.RGBAAt(x, y); c != (color.RGBA{255, 255, 255, 255}) {
+			t.Fatalf("quiet zone pixel %d = %v", x, c)
+		}
+	}
+	if c := code.RGBAAt(10*module, y); c != (color.RGBA{0, 0, 0, 255}) {
+		t.Errorf("first bar = %v, want black", c)
+	}
+}
+
+// decodeQR reads the single QR code on an otherwise light image. It is a
+// small reader for clean renders: it locates the symbol by its dark
+// modules, samples module centers and then follows ISO/IEC 18004, checking
+// the Reed-Solomon syndromes rather than correcting errors.
+func decodeQR(img *image.RGBA) (string, error) {
+	dark := func(x, y int) bool {
+		c := img.RGBAAt(x, y)
+		return 299*int(c.R)+587*int(c.G)+114*int(c.B) < 128*1000
+	}
+
+	// The finder patterns put dark modules on three corners of the symbol
+	b := img.Bounds()
+	box := image.Rectangle{Min: b.Max, Max: b.Min}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if dark(x, y) {
+				box = box.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	if box.Empty() {
+		return "", fmt.Errorf("no code found")
+	}
+	finder := 0
+	for dark(box.Min.X+finder, box.Min.Y) {
+		finder++
+	}
+	module := float64(finder) / 7
+	size := int(float64(box.Dx())/module + 0.5)
+	version := (size - 17) / 4
+	if version < 1 || version > len(qrBlocks) || size != 17+4*version {
+		return "", fmt.Errorf("unsupported symbol size %d", size)
+	}
+
+	grid := make([][]bool, size)
+	for y := range grid {
+		grid[y] = make([]bool, size)
+		for x := range grid[y] {
+			grid[y][x] = dark(box.Min.X+int((float64(x)+0.5)*module), box.Min.Y+int((float64(y)+0.5)*module))
+		}
+	}
+
+	// Format information: two bits of level, three of mask, BCH protected
+	var format int
+	for i := 0; i <= 5; i++ {
+		format |= bit(grid[i][8]) << i
+	}
+	format |= bit(grid[7][8])<<6 | bit(grid[8][8])<<7 | bit(grid[8][7])<<8
+	for i := 9; i < 15; i++ {
+		format |= bit(grid[8][14-i]) << i
+	}
+	info := -1
+	for data := 0; data < 32; data++ {
+		if hamming(qrFormatBits(data), format) <= 3 {
+			info = data
+		}
+	}
+	if info < 0 {
+		return "", fmt.Errorf("unreadable format information %015b", format)
+	}
+	level := []int{1, 0, 3, 2}[info>>3] // format order M, L, H, Q to table order L, M, Q, H
+	mask := info & 7
+
+	function := qrFunctionModules(version, size)
+	var codewords []byte
+	var current, count int
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = size - 1 - vert
+				}
+				if function[y][x] {
+					continue
+				}
+				current = current<<1 | bit(grid[y][x] != qrMask(mask, x, y))
+				if count++; count%8 == 0 {
+					codewords = append(codewords, byte(current))
+					current = 0
+				}
+			}
+		}
+	}
+
+	data, err := qrDeinterleave(codewords, qrBlocks[version-1][level][0], qrBlocks[version-1][level][1])
+	if err != nil {
+		return "", err
+	}
+	return qrParseSegments(data, version)
+}
+
+func bit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func hamming(a, b int) int {
+	n := 0
+	for x := a ^ b; x != 0; x &= x - 1 {
+		n++
+	}
+	return n
+}
+
+func qrFormatBits(data int) int {
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func qrMask(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// qrFunctionModules marks the finder, timing, alignment, format and version
+// areas, which carry no data.
+func qrFunctionModules(version, size int) [][]bool {
+	f := make([][]bool, size)
+	for i := range f {
+		f[i] = make([]bool, size)
+	}
+	fill := func(x0, y0, w, h int) {
+		for y := y0; y < y0+h; y++ {
+			for x := x0; x < x0+w; x++ {
+				if x >= 0 && y >= 0 && x < size && y < size {
+					f[y][x] = true
+				}
+			}
+		}
+	}
+
+	// Finders with separators and format areas, timing patterns, dark module
+	fill(0, 0, 9, 9)
+	fill(size-8, 0, 8, 9)
+	fill(0, size-8, 9, 8)
+	fill(6, 0, 1, size)
+	fill(0, 6, size, 1)
+
+	if version >= 2 {
+		n := version/7 + 2
+		step := (version*8 + n*3 + 5) / (n*4 - 4) * 2
+		positions := []int{6}
+		for pos := size - 7; len(positions) < n; pos -= step {
+			positions = append([]int{positions[0]}, append([]int{pos}, positions[1:]...)...)
+		}
+		for i, cy := range positions {
+			for j, cx := range positions {
+				if (i == 0 && j == 0) || (i == 0 && j == n-1) || (i == n-1 && j == 0) {
+					continue
+				}
+				fill(cx-2, cy-2, 5, 5)
+			}
+		}
+	}
+	if version >= 7 {
+		fill(size-11, 0, 3, 6)
+		fill(0, size-11, 6, 3)
+	}
+	return f
+}
+
+// qrBlocks holds, for versions 1 to 10 and levels L, M, Q and H, the error
+// correction codewords per block and the number of blocks.
+var qrBlocks = [][4][2]int{
+	{{7, 1}, {10, 1}, {13, 1}, {17, 1}},
+	{{10, 1}, {16, 1}, {22, 1}, {28, 1}},
+	{{15, 1}, {26, 1}, {18, 2}, {22, 2}},
+	{{20, 1}, {18, 2}, {26, 2}, {16, 4}},
+	{{26, 1}, {24, 2}, {18, 4}, {22, 4}},
+	{{18, 2}, {16, 4}, {24, 4}, {28, 4}},
+	{{20, 2}, {18, 4}, {18, 6}, {26, 5}},
+	{{24, 2}, {22, 4}, {22, 6}, {26, 6}},
+	{{30, 2}, {22, 5}, {20, 8}, {24, 8}},
+	{{18, 4}, {26, 5}, {24, 8}, {28, 8}},
+}
+
+// qrDeinterleave splits the codewords into blocks, checks each block's
+// Reed-Solomon syndromes and returns the data codewords in order.
+func qrDeinterleave(codewords []byte, ecc, blocks int) ([]byte, error) {
+	short := len(codewords) / blocks
+	numShort := blocks - len(codewords)%blocks
+	dataLen := func(i int) int {
+		if i < numShort {
+			return short - ecc
+		}
+		return short - ecc + 1
+	}
+
+	parts := make([][]byte, blocks)
+	k := 0
+	for i := 0; i <= short-ecc; i++ {
+		for j := range parts {
+			if i < dataLen(j) {
+				parts[j] = append(parts[j], codewords[k])
+				k++
+			}
+		}
+	}
+	for i := 0; i < ecc; i++ {
+		for j := range parts {
+			parts[j] = append(parts[j], codewords[k])
+			k++
+		}
+	}
+
+	var data []byte
+	for j, block := range parts {
+		for i := 0; i < ecc; i++ {
+			// Evaluate the block polynomial at alpha^i
+			var s byte
+			root := gfPow(i)
+			for _, c := range block {
+				s = gfMul(s, root) ^ c
+			}
+			if s != 0 {
+				return nil, fmt.Errorf("block %d: syndrome %d is %d", j, i, s)
+			}
+		}
+		data = append(data, block[:dataLen(j)]...)
+	}
+	return data, nil
+}
+
+func gfMul(a, b byte) byte {
+	var p byte
+	for b != 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1d
+		}
+		b >>= 1
+	}
+	return p
+}
+
+func gfPow(n int) byte {
+	p := byte(1)
+	for i := 0; i < n; i++ {
+		p = gfMul(p, 2)
+	}
+	return p
+}
+
+// qrParseSegments decodes numeric, alphanumeric and byte mode segments.
+func qrParseSegments(data []byte, version int) (string, error) {
+	pos := 0
+	read := func(n int) int {
+		v := 0
+		for i := 0; i < n; i++ {
+			if pos/8 >= len(data) {
+				return -1
+			}
+			v = v<<1 | int(data[pos/8]>>(7-pos%8)&1)
+			pos++
+		}
+		return v
+	}
+	countBits := func(small, medium, large int) int {
+		switch {
+		case version <= 9:
+			return small
+		case version <= 26:
+			return medium
+		default:
+			return large
+		}
+	}
+	const alphanumeric = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:"
+
+	var out strings.Builder
+	for {
+		mode := read(4)
+		switch mode {
+		case -1, 0:
+			return out.String(), nil
+		case 1:
+			n := read(countBits(10, 12, 14))
+			for ; n >= 3; n -= 3 {
+				fmt.Fprintf(&out, "%03d", read(10))
+			}
+			if n == 2 {
+				fmt.Fprintf(&out, "%02d", read(7))
+			} else if n == 1 {
+				fmt.Fprintf(&out, "%d", read(4))
+			}
+		case 2:
+			n := read(countBits(9, 11, 13))
+			for ; n >= 2; n -= 2 {
+				v := read(11)
+				out.WriteByte(alphanumeric[v/45])
+				out.WriteByte(alphanumeric[v%45])
+			}
+			if n == 1 {
+				out.WriteByte(alphanumeric[read(6)])
+			}
+		case 4:
+			n := read(countBits(8, 16, 16))
+			for i := 0; i < n; i++ {
+				out.WriteByte(byte(read(8)))
+			}
+		default:
+			return "", fmt.Errorf("unsupported mode %04b", mode)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// ContrastMode makes the watermark color follow the image underneath it so
+// that it stays readable on both light and dark regions.
+type ContrastMode string
+
+const (
+	// ContrastOff draws every tile in the chosen color.
+	ContrastOff ContrastMode = ""
+	// ContrastAuto picks a light or dark variant of the chosen color per tile.
+	ContrastAuto ContrastMode = "auto"
+	// ContrastInvert uses the inverse of the average color under each tile.
+	ContrastInvert ContrastMode = "invert"
+)
+
+// DefaultContrastThreshold is the relative luminance above which a region is
+// considered light. It can be overridden with WATERMARK_CONTRAST_THRESHOLD.
+const DefaultContrastThreshold = 0.5
+
+// ParseContrastMode converts a form value into a ContrastMode.
+func ParseContrastMode(s string) ContrastMode {
+	switch mode := ContrastMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case ContrastAuto, ContrastInvert:
+		return mode
+	default:
+		return ContrastOff
+	}
+}
+
+// contrastThresholdFromEnv reads WATERMARK_CONTRAST_THRESHOLD, falling back to
+// DefaultContrastThreshold when it is unset or out of range.
+func contrastThresholdFromEnv() float64 {
+	v, err := strconv.ParseFloat(os.Getenv("WATERMARK_CONTRAST_THRESHOLD"), 64)
+	if err != nil || v <= 0 || v >= 1 {
+		return DefaultContrastThreshold
+	}
+	return v
+}
+
+// regionStats returns the average color and relative luminance of img inside
+// r. Large regions are subsampled to roughly 1024 pixels.
+func regionStats(img *image.RGBA, r image.Rectangle) (color.RGBA, float64) {
+	r = r.Intersect(img.Bounds())
+	if r.Empty() {
+		return color.RGBA{}, 0
+	}
+
+	step := int(math.Sqrt(float64(r.Dx()*r.Dy()) / 1024))
+	if step < 1 {
+		step = 1
+	}
+
+	var sumR, sumG, sumB, sumL float64
+	n := 0
+	for y := r.Min.Y; y < r.Max.Y; y += step {
+		for x := r.Min.X; x < r.Max.X; x += step {
+			i := img.PixOffset(x, y)
+			cr, cg, cb := float64(img.Pix[i]), float64(img.Pix[i+1]), float64(img.Pix[i+2])
+			sumR += cr
+			sumG += cg
+			sumB += cb
+			sumL += relativeLuminance(cr/255, cg/255, cb/255)
+			n++
+		}
+	}
+
+	avg := color.RGBA{
+		R: uint8(sumR / float64(n)),
+		G: uint8(sumG / float64(n)),
+		B: uint8(sumB / float64(n)),
+		A: 255,
+	}
+	return avg, sumL / float64(n)
+}
+
+// relativeLuminance follows the WCAG definition for sRGB components in [0, 1].
+func relativeLuminance(r, g, b float64) float64 {
+	linear := func(c float64) float64 {
+		if c <= 0.03928 {
+			return c / 12.92
+		}
+		return math.Pow((c+0.055)/1.055, 2.4)
+	}
+	return 0.2126*linear(r) + 0.7152*linear(g) + 0.0722*linear(b)
+}
+
+// contrastColor returns the color a tile should be drawn in given the average
+// color and luminance of the region beneath it.
+func contrastColor(base color.Color, mode ContrastMode, threshold float64, avg color.RGBA, luminance float64) color.Color {
+	switch mode {
+	case ContrastAuto:
+		c, _ := colorful.MakeColor(base)
+		h, chroma, _ := c.Hcl()
+		if luminance > threshold {
+			return colorful.Hcl(h, chroma, 0.2).Clamped()
+		}
+		return colorful.Hcl(h, chroma, 0.95).Clamped()
+	case ContrastInvert:
+		return color.RGBA{R: 255 - avg.R, G: 255 - avg.G, B: 255 - avg.B, A: 255}
+	default:
+		return base
+	}
+}
+
+// colorLuminance returns the relative luminance of c, ignoring alpha.
+func colorLuminance(c color.Color) float64 {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return relativeLuminance(float64(n.R)/255, float64(n.G)/255, float64(n.B)/255)
+}
+
+// imageLuminance returns the alpha-weighted mean relative luminance of img.
+func imageLuminance(img image.Image) float64 {
+	b := img.Bounds()
+	var sum, weight float64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			a := float64(c.A) / 255
+			sum += a * relativeLuminance(float64(c.R)/255, float64(c.G)/255, float64(c.B)/255)
+			weight += a
+		}
+	}
+	if weight == 0 {
+		return 0
+	}
+	return sum / weight
+}
+
+// invertImage returns a copy of img with its colors inverted and its alpha
+// preserved.
+func invertImage(img *image.RGBA) *image.RGBA {
+	out := image.NewRGBA(img.Bounds())
+	for i := 0; i < len(img.Pix); i += 4 {
+		a := img.Pix[i+3]
+		// Premultiplied channels invert against alpha rather than 255
+		out.Pix[i] = a - img.Pix[i]
+		out.Pix[i+1] = a - img.Pix[i+1]
+		out.Pix[i+2] = a - img.Pix[i+2]
+		out.Pix[i+3] = a
+	}
+	return out
+}
+
+// tintImage returns a copy of img filled with c, keeping img's alpha.
+func tintImage(img *image.RGBA, c color.Color) *image.RGBA {
+	r, g, b, _ := c.RGBA()
+	out := image.NewRGBA(img.Bounds())
+	for i := 0; i < len(img.Pix); i += 4 {
+		a := uint32(img.Pix[i+3])
+		out.Pix[i] = uint8((r >> 8) * a / 255)
+		out.Pix[i+1] = uint8((g >> 8) * a / 255)
+		out.Pix[i+2] = uint8((b >> 8) * a / 255)
+		out.Pix[i+3] = uint8(a)
+	}
+	return out
+}
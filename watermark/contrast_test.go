@@ -0,0 +1,47 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestContrastColorPicksVariantPerRegion(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	draw.Draw(img, image.Rect(0, 0, 50, 50), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(50, 0, 100, 50), image.NewUniform(color.Black), image.Point{}, draw.Src)
+
+	base := color.RGBA{255, 255, 255, 255}
+
+	avg, luminance := regionStats(img, image.Rect(0, 0, 50, 50))
+	light := contrastColor(base, ContrastAuto, DefaultContrastThreshold, avg, luminance)
+	avg, luminance = regionStats(img, image.Rect(50, 0, 100, 50))
+	dark := contrastColor(base, ContrastAuto, DefaultContrastThreshold, avg, luminance)
+
+	lum := func(c color.Color) float64 {
+		r, g, b, _ := c.RGBA()
+		return relativeLuminance(float64(r)/0xffff, float64(g)/0xffff, float64(b)/0xffff)
+	}
+	if lum(light) >= 0.2 {
+		t.Errorf("color over white region has luminance %.2f, want dark", lum(light))
+	}
+	if lum(dark) <= 0.8 {
+		t.Errorf("color over black region has luminance %.2f, want light", lum(dark))
+	}
+
+	avg, luminance = regionStats(img, image.Rect(0, 0, 50, 50))
+	if got := contrastColor(base, ContrastInvert, DefaultContrastThreshold, avg, luminance); got != (color.RGBA{0, 0, 0, 255}) {
+		t.Errorf("inverted color over white = %v, want black", got)
+	}
+}
+
+func TestContrastThresholdOverride(t *testing.T) {
+	s := &Service{ContrastThreshold: 0.3}
+	if got := s.contrastThreshold(0); got != 0.3 {
+		t.Errorf("default threshold = %v, want service value 0.3", got)
+	}
+	if got := s.contrastThreshold(0.7); got != 0.7 {
+		t.Errorf("request threshold = %v, want 0.7", got)
+	}
+}
@@ -0,0 +1,147 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// exifTagNames maps the ASCII EXIF tags we expose to template variables.
+var exifTagNames = map[uint16]string{
+	0x010F: "Make",
+	0x0110: "Model",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x013B: "Artist",
+	0x8298: "Copyright",
+	0x9003: "DateTimeOriginal",
+	0x9004: "DateTimeDigitized",
+	0xA434: "LensModel",
+}
+
+const (
+	exifIFDPointerTag = 0x8769
+	exifTypeASCII     = 2
+	exifTypeLong      = 4
+)
+
+// readExif extracts the ASCII EXIF fields listed in exifTagNames from a JPEG
+// or PNG file. It never fails: missing or malformed metadata simply yields an
+// empty map.
+func readExif(data []byte) map[string]string {
+	fields := make(map[string]string)
+
+	tiff := findTIFFHeader(data)
+	if tiff == nil {
+		return fields
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return fields
+	}
+
+	ifd0 := order.Uint32(tiff[4:8])
+	exifIFD := readIFD(tiff, order, ifd0, fields)
+	if exifIFD != 0 {
+		readIFD(tiff, order, exifIFD, fields)
+	}
+	return fields
+}
+
+// findTIFFHeader locates the TIFF structure holding the EXIF data, either in
+// a JPEG APP1 segment or a PNG eXIf chunk.
+func findTIFFHeader(data []byte) []byte {
+	switch {
+	case len(data) > 4 && data[0] == 0xFF && data[1] == 0xD8:
+		pos := 2
+		for pos+4 <= len(data) && data[pos] == 0xFF {
+			marker := data[pos+1]
+			if marker == 0xDA || marker == 0xD9 {
+				break
+			}
+			length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+			if length < 2 || pos+2+length > len(data) {
+				break
+			}
+			segment := data[pos+4 : pos+2+length]
+			if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				return validTIFF(segment[6:])
+			}
+			pos += 2 + length
+		}
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		pos := 8
+		for pos+8 <= len(data) {
+			length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+			chunkType := string(data[pos+4 : pos+8])
+			if length < 0 || pos+12+length > len(data) {
+				break
+			}
+			if chunkType == "eXIf" {
+				return validTIFF(data[pos+8 : pos+8+length])
+			}
+			if chunkType == "IDAT" {
+				break
+			}
+			pos += 12 + length
+		}
+	}
+	return nil
+}
+
+func validTIFF(b []byte) []byte {
+	if len(b) < 8 {
+		return nil
+	}
+	return b
+}
+
+// readIFD collects the known ASCII tags of the IFD at offset into fields and
+// returns the offset of the EXIF sub-IFD if the IFD points to one.
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32, fields map[string]string) uint32 {
+	if int(offset)+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	var exifIFD uint32
+
+	for i := 0; i < count; i++ {
+		entry := int(offset) + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		tag := order.Uint16(tiff[entry:])
+		typ := order.Uint16(tiff[entry+2:])
+		n := order.Uint32(tiff[entry+4:])
+
+		if tag == exifIFDPointerTag && typ == exifTypeLong {
+			exifIFD = order.Uint32(tiff[entry+8:])
+			continue
+		}
+
+		name, ok := exifTagNames[tag]
+		if !ok || typ != exifTypeASCII || n == 0 {
+			continue
+		}
+
+		var value []byte
+		if n <= 4 {
+			value = tiff[entry+8 : entry+8+int(n)]
+		} else {
+			start := order.Uint32(tiff[entry+8:])
+			if uint64(start)+uint64(n) > uint64(len(tiff)) {
+				continue
+			}
+			value = tiff[start : start+n]
+		}
+		fields[name] = strings.TrimRight(string(value), "\x00 ")
+	}
+
+	return exifIFD
+}
@@ -0,0 +1,260 @@
+package watermark
+
+import (
+	"embed"
+	"fmt"
+	"image"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/math/fixed"
+)
+
+// bundledFallbacks holds every TrueType font in fonts/, tried in order of
+// file name after gobold. DejaVu Sans Bold covers Arabic, Hebrew, Greek and
+// Cyrillic, which gobold lacks, and a Hangul subset of Nanum Barun Gothic
+// covers Korean. Chinese and Japanese ideographs and emoji are not bundled;
+// they need a font in WATERMARK_FONT_DIR. Each font's license is in
+// fonts/LICENSE-*.txt.
+//
+//go:embed fonts/*.ttf
+var bundledFallbacks embed.FS
+
+// FontChain is an ordered list of fonts used to draw watermark text. Every
+// rune is drawn with the first font in the chain that has a glyph for it.
+type FontChain struct {
+	fonts []*truetype.Font
+	// files holds the TrueType file of each font, where known, so that
+	// fonts can be embedded in PDFs.
+	files [][]byte
+}
+
+// NewFontChain creates a chain from fonts in priority order.
+func NewFontChain(fonts ...*truetype.Font) *FontChain {
+	return &FontChain{fonts: fonts}
+}
+
+// DefaultFontChain returns gobold, followed by the bundled fallback fonts
+// and any fonts found under the directory named by WATERMARK_FONT_DIR. The
+// directory is where ideograph and emoji fonts are installed, such as the
+// Docker image's Droid Sans Fallback.
+func DefaultFontChain() (*FontChain, error) {
+	c := &FontChain{}
+	if err := c.add(gobold.TTF); err != nil {
+		return nil, fmt.Errorf("failed to parse font: %v", err)
+	}
+	entries, err := bundledFallbacks.ReadDir("fonts")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundled fonts: %v", err)
+	}
+	for _, entry := range entries {
+		data, err := bundledFallbacks.ReadFile("fonts/" + entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read font %s: %v", entry.Name(), err)
+		}
+		if err := c.add(data); err != nil {
+			return nil, fmt.Errorf("failed to parse font %s: %v", entry.Name(), err)
+		}
+	}
+
+	if dir := os.Getenv("WATERMARK_FONT_DIR"); dir != "" {
+		names, files, err := readFontDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for i, data := range files {
+			if err := c.add(data); err != nil {
+				log.Printf("DefaultFontChain: Skipping %s: %v", names[i], err)
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// add parses a TrueType file and appends it to the chain.
+func (c *FontChain) add(data []byte) error {
+	f, err := truetype.Parse(data)
+	if err != nil {
+		return err
+	}
+	c.fonts = append(c.fonts, f)
+	c.files = append(c.files, data)
+	return nil
+}
+
+// file returns the TrueType file of font i, or nil when the chain was built
+// from parsed fonts only.
+func (c *FontChain) file(i int) []byte {
+	if i < len(c.files) {
+		return c.files[i]
+	}
+	return nil
+}
+
+// LoadFontDir parses every .ttf file under dir, in lexical order of path.
+func LoadFontDir(dir string) ([]*truetype.Font, error) {
+	names, files, err := readFontDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var fonts []*truetype.Font
+	for i, data := range files {
+		f, err := truetype.Parse(data)
+		if err != nil {
+			log.Printf("LoadFontDir: Skipping %s: %v", names[i], err)
+			continue
+		}
+		fonts = append(fonts, f)
+	}
+	return fonts, nil
+}
+
+// readFontDir reads every .ttf file under dir, in lexical order of path.
+// Subdirectories are searched so that dir can be a system font directory,
+// where packages install fonts into directories of their own. Only
+// TrueType outlines can be drawn, so OpenType CFF fonts such as the .otf
+// and .ttc releases of Noto Sans CJK are not read.
+func readFontDir(dir string) ([]string, [][]byte, error) {
+	var names []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), ".ttf") {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			names = append(names, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read font directory: %v", err)
+	}
+	sort.Strings(names)
+
+	files := make([][]byte, len(names))
+	for i, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read font %s: %v", name, err)
+		}
+		files[i] = data
+	}
+	return names, files, nil
+}
+
+// bundledFonts are the primary fonts a footer can be drawn in.
+var bundledFonts = map[string][]byte{
+	"bold":    gobold.TTF,
+	"regular": goregular.TTF,
+	"mono":    gomono.TTF,
+}
+
+// FontNames lists the names accepted by FontChain.WithPrimary.
+func FontNames() []string {
+	names := make([]string, 0, len(bundledFonts))
+	for name := range bundledFonts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithPrimary returns a copy of the chain whose first font is the bundled
+// font called name, keeping the remaining fallbacks. Unknown names return
+// the chain unchanged.
+func (c *FontChain) WithPrimary(name string) *FontChain {
+	data, ok := bundledFonts[name]
+	if !ok || len(c.fonts) == 0 {
+		return c
+	}
+	out := &FontChain{}
+	if err := out.add(data); err != nil {
+		return c
+	}
+	out.fonts = append(out.fonts, c.fonts[1:]...)
+	for i := 1; i < len(c.fonts); i++ {
+		out.files = append(out.files, c.file(i))
+	}
+	return out
+}
+
+// index returns the position of the first font with a glyph for r. Runes no
+// font covers fall back to the primary font.
+func (c *FontChain) index(r rune) int {
+	for i, f := range c.fonts {
+		if f.Index(r) != 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// Face returns a font.Face of the given point size that draws each rune with
+// the first font in the chain that supports it.
+func (c *FontChain) Face(size float64) font.Face {
+	faces := make([]font.Face, len(c.fonts))
+	for i, f := range c.fonts {
+		faces[i] = truetype.NewFace(f, &truetype.Options{
+			Size: size,
+			DPI:  72,
+		})
+	}
+	return &fallbackFace{chain: c, faces: faces}
+}
+
+type fallbackFace struct {
+	chain *FontChain
+	faces []font.Face
+}
+
+func (f *fallbackFace) face(r rune) font.Face {
+	return f.faces[f.chain.index(r)]
+}
+
+func (f *fallbackFace) Close() error {
+	for _, face := range f.faces {
+		face.Close()
+	}
+	return nil
+}
+
+func (f *fallbackFace) Glyph(dot fixed.Point26_6, r rune) (image.Rectangle, image.Image, image.Point, fixed.Int26_6, bool) {
+	return f.face(r).Glyph(dot, r)
+}
+
+func (f *fallbackFace) GlyphBounds(r rune) (fixed.Rectangle26_6, fixed.Int26_6, bool) {
+	return f.face(r).GlyphBounds(r)
+}
+
+func (f *fallbackFace) GlyphAdvance(r rune) (fixed.Int26_6, bool) {
+	return f.face(r).GlyphAdvance(r)
+}
+
+// Kern only applies between runes drawn with the same font.
+func (f *fallbackFace) Kern(r0, r1 rune) fixed.Int26_6 {
+	i := f.chain.index(r0)
+	if i != f.chain.index(r1) {
+		return 0
+	}
+	return f.faces[i].Kern(r0, r1)
+}
+
+// Metrics are those of the primary font so that line layout does not shift
+// depending on which fallback fonts a piece of text happens to use.
+func (f *fallbackFace) Metrics() font.Metrics {
+	return f.faces[0].Metrics()
+}
@@ -0,0 +1,374 @@
+package watermark
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"sort"
+)
+
+// source is a decoded upload: one frame for still images, or the composited
+// canvas after each frame of an animated GIF. Watermarks are drawn onto the
+// frames in place before the source is encoded again.
+type source struct {
+	format string
+	frames []*image.RGBA
+	// anim is the original animation, kept for its timing, disposal and
+	// frame bounds. It is nil for still images.
+	anim *gif.GIF
+}
+
+// decodeSource decodes data as an animated GIF or as any registered still
+// image format.
+func decodeSource(data []byte) (*source, error) {
+	if bytes.HasPrefix(data, []byte("GIF8")) {
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		frames, err := compositeFrames(anim)
+		if err != nil {
+			return nil, err
+		}
+		return &source{format: "gif", frames: frames, anim: anim}, nil
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	frame := image.NewRGBA(b)
+	draw.Draw(frame, b, img, b.Min, draw.Src)
+	return &source{format: format, frames: []*image.RGBA{frame}}, nil
+}
+
+// bounds returns the size of the image or animation canvas.
+func (src *source) bounds() image.Rectangle {
+	return src.frames[0].Bounds()
+}
+
+// maxAnimationBytes bounds the memory of the composited frames of one
+// animation. GIF frames are small on disk, but each becomes a full RGBA
+// canvas, so a long animation with a large canvas would otherwise use
+// gigabytes.
+const maxAnimationBytes = 512 << 20
+
+// compositeFrames plays the animation and returns the full canvas as shown
+// while each frame is displayed, so that watermarks are drawn on what the
+// viewer sees rather than on partial update rectangles. Animations whose
+// frames would need more than maxAnimationBytes are rejected.
+func compositeFrames(anim *gif.GIF) ([]*image.RGBA, error) {
+	canvasRect := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	if canvasRect.Empty() {
+		for _, frame := range anim.Image {
+			canvasRect = canvasRect.Union(frame.Bounds())
+		}
+	}
+
+	// One canvas per frame plus the one being played onto
+	frameBytes := int64(canvasRect.Dx()) * int64(canvasRect.Dy()) * 4
+	if frameBytes*int64(len(anim.Image)+1) > maxAnimationBytes {
+		return nil, fmt.Errorf("animation of %d frames at %dx%d is too large to watermark", len(anim.Image), canvasRect.Dx(), canvasRect.Dy())
+	}
+
+	canvas := image.NewRGBA(canvasRect)
+	frames := make([]*image.RGBA, len(anim.Image))
+	for i, frame := range anim.Image {
+		canvas = playFrame(canvas, frame, frame.Bounds(), disposal(anim, i), func(shown *image.RGBA) {
+			frames[i] = cloneRGBA(shown)
+		})
+	}
+	return frames, nil
+}
+
+// playFrame draws the r part of frame onto canvas, calls show with what the
+// viewer now sees and applies the disposal method. It returns the canvas the
+// next frame is drawn onto.
+func playFrame(canvas *image.RGBA, frame image.Image, r image.Rectangle, disposal byte, show func(*image.RGBA)) *image.RGBA {
+	var previous *image.RGBA
+	if disposal == gif.DisposalPrevious {
+		previous = cloneRGBA(canvas)
+	}
+
+	draw.Draw(canvas, r, frame, r.Min, draw.Over)
+	if show != nil {
+		show(canvas)
+	}
+
+	switch disposal {
+	case gif.DisposalBackground:
+		// Browsers clear to transparent rather than the background color
+		draw.Draw(canvas, r, image.Transparent, image.Point{}, draw.Src)
+	case gif.DisposalPrevious:
+		return previous
+	}
+	return canvas
+}
+
+func disposal(anim *gif.GIF, i int) byte {
+	if i < len(anim.Disposal) {
+		return anim.Disposal[i]
+	}
+	return gif.DisposalNone
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	out := image.NewRGBA(img.Bounds())
+	copy(out.Pix, img.Pix)
+	return out
+}
+
+// encode writes the watermarked frames in the source format.
+func (s *Service) encode(w io.Writer, src *source) error {
+	if src.anim == nil {
+		return s.encodeImage(w, src.frames[0], src.format)
+	}
+	return encodeAnimation(w, src)
+}
+
+// encodeAnimation writes the watermarked frames back with the original
+// delays, disposal methods and loop count. Each frame gets its own palette and
+// keeps its original update rectangle, grown to cover wherever the watermark
+// differs from what the viewer would otherwise still be showing.
+func encodeAnimation(w io.Writer, src *source) error {
+	canvas := src.bounds()
+	out := &gif.GIF{
+		Delay:     src.anim.Delay,
+		Disposal:  src.anim.Disposal,
+		LoopCount: src.anim.LoopCount,
+		Config:    image.Config{Width: canvas.Dx(), Height: canvas.Dy()},
+	}
+
+	// Replay the encoded frames to know what each one is drawn over
+	shown := image.NewRGBA(canvas)
+	for i, frame := range src.frames {
+		r := src.anim.Image[i].Bounds().Union(changedRect(shown, frame)).Intersect(canvas)
+		if r.Empty() {
+			r = image.Rect(canvas.Min.X, canvas.Min.Y, canvas.Min.X+1, canvas.Min.Y+1)
+		}
+		paletted := quantize(frame, r)
+		out.Image = append(out.Image, paletted)
+		shown = playFrame(shown, paletted, r, disposal(src.anim, i), nil)
+	}
+	if err := gif.EncodeAll(w, out); err != nil {
+		return fmt.Errorf("failed to encode GIF: %v", err)
+	}
+	return nil
+}
+
+// frameTolerance is how far a channel may differ before a pixel counts as
+// changed, so that dithering noise in earlier frames is not redrawn.
+const frameTolerance = 32
+
+// changedRect returns the bounding box of the pixels that differ between a
+// and b, which must have the same bounds.
+func changedRect(a, b *image.RGBA) image.Rectangle {
+	var r image.Rectangle
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := a.PixOffset(x, y)
+			pa, pb := a.Pix[i:i+4:i+4], b.Pix[i:i+4:i+4]
+			if (pa[3] < 128) != (pb[3] < 128) || pa[3] >= 128 &&
+				(absDiff(pa[0], pb[0]) > frameTolerance || absDiff(pa[1], pb[1]) > frameTolerance || absDiff(pa[2], pb[2]) > frameTolerance) {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return r
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// quantize converts the r part of img to a paletted image. The palette is
+// chosen for the frame's own colors by median cut, and Floyd-Steinberg
+// dithering hides the steps between palette entries that would otherwise
+// show as banding in gradients and soft watermark edges. GIF transparency is
+// binary, so pixels are either kept opaque or dropped below half alpha.
+func quantize(img *image.RGBA, r image.Rectangle) *image.Paletted {
+	flat := image.NewNRGBA(r)
+	transparent := false
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			if c.A < 128 {
+				transparent = true
+				continue
+			}
+			n := color.NRGBAModel.Convert(c).(color.NRGBA)
+			n.A = 255
+			flat.SetNRGBA(x, y, n)
+		}
+	}
+
+	size := 256
+	if transparent {
+		size = 255
+	}
+	palette := medianCut(flat, size)
+	if transparent {
+		palette = append(palette, color.NRGBA{})
+	}
+	if len(palette) == 0 {
+		palette = color.Palette{color.NRGBA{}}
+	}
+
+	dst := image.NewPaletted(r, palette)
+	draw.FloydSteinberg.Draw(dst, r, flat, r.Min)
+	return dst
+}
+
+// colorBox is a set of histogram cells for median cut.
+type colorBox []histCell
+
+// histCell is one occupied cell of a 15-bit color histogram, with the sums
+// of the exact colors that fell into it.
+type histCell struct {
+	key     int
+	count   int
+	r, g, b int
+}
+
+func (c histCell) channel(i int) int {
+	return c.key >> (10 - 5*i) & 31
+}
+
+// medianCut returns a palette of at most n colors for the opaque pixels of
+// img. Images with few colors get them exactly.
+func medianCut(img *image.NRGBA, n int) color.Palette {
+	exact := make(map[color.NRGBA]bool)
+	var hist [1 << 15]histCell
+	for i := 0; i < len(img.Pix); i += 4 {
+		if img.Pix[i+3] == 0 {
+			continue
+		}
+		r, g, b := int(img.Pix[i]), int(img.Pix[i+1]), int(img.Pix[i+2])
+		if len(exact) <= n {
+			exact[color.NRGBA{uint8(r), uint8(g), uint8(b), 255}] = true
+		}
+		key := r>>3<<10 | g>>3<<5 | b>>3
+		cell := &hist[key]
+		cell.key = key
+		cell.count++
+		cell.r += r
+		cell.g += g
+		cell.b += b
+	}
+
+	if len(exact) <= n {
+		palette := make(color.Palette, 0, len(exact))
+		for c := range exact {
+			palette = append(palette, c)
+		}
+		// Map iteration order is random; keep the output deterministic
+		sort.Slice(palette, func(i, j int) bool {
+			a, b := palette[i].(color.NRGBA), palette[j].(color.NRGBA)
+			return uint32(a.R)<<16|uint32(a.G)<<8|uint32(a.B) < uint32(b.R)<<16|uint32(b.G)<<8|uint32(b.B)
+		})
+		return palette
+	}
+
+	var all colorBox
+	for _, cell := range hist {
+		if cell.count > 0 {
+			all = append(all, cell)
+		}
+	}
+
+	// Repeatedly split the box with the widest channel range, weighted by
+	// how many pixels it covers
+	type scored struct {
+		box     colorBox
+		channel int
+		score   int
+	}
+	score := func(box colorBox) scored {
+		channel, spread := box.widest()
+		return scored{box, channel, spread * box.population()}
+	}
+	boxes := []scored{score(all)}
+	for len(boxes) < n {
+		best := -1
+		for i, b := range boxes {
+			if len(b.box) > 1 && (best < 0 || b.score > boxes[best].score) {
+				best = i
+			}
+		}
+		if best < 0 || boxes[best].score == 0 {
+			break
+		}
+		a, b := boxes[best].box.split(boxes[best].channel)
+		boxes[best] = score(a)
+		boxes = append(boxes, score(b))
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, b := range boxes {
+		palette = append(palette, b.box.average())
+	}
+	return palette
+}
+
+func (box colorBox) population() int {
+	n := 0
+	for _, c := range box {
+		n += c.count
+	}
+	return n
+}
+
+// widest returns the channel with the largest range and that range.
+func (box colorBox) widest() (int, int) {
+	channel, spread := 0, -1
+	for i := 0; i < 3; i++ {
+		lo, hi := 31, 0
+		for _, c := range box {
+			v := c.channel(i)
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if hi-lo > spread {
+			channel, spread = i, hi-lo
+		}
+	}
+	return channel, spread
+}
+
+// split divides the box at the pixel-weighted median of channel.
+func (box colorBox) split(channel int) (colorBox, colorBox) {
+	sort.Slice(box, func(i, j int) bool { return box[i].channel(channel) < box[j].channel(channel) })
+	half := box.population() / 2
+	seen := 0
+	for i, c := range box[:len(box)-1] {
+		seen += c.count
+		if seen >= half {
+			return box[:i+1], box[i+1:]
+		}
+	}
+	return box[:len(box)-1], box[len(box)-1:]
+}
+
+func (box colorBox) average() color.NRGBA {
+	var r, g, b, n int
+	for _, c := range box {
+		r += c.r
+		g += c.g
+		b += c.b
+		n += c.count
+	}
+	return color.NRGBA{uint8((r + n/2) / n), uint8((g + n/2) / n), uint8((b + n/2) / n), 255}
+}
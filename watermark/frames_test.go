@@ -0,0 +1,144 @@
+package watermark
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"math"
+	"strings"
+	"testing"
+)
+
+// testAnimation is a 60x40 animation whose second frame only updates a
+// small rectangle and whose frames use different delays and disposals.
+func testAnimation() *gif.GIF {
+	palette := color.Palette{color.RGBA{0, 0, 0, 0}, color.RGBA{200, 40, 40, 255}, color.RGBA{40, 200, 40, 255}, color.RGBA{40, 40, 200, 255}}
+	full := image.NewPaletted(image.Rect(0, 0, 60, 40), palette)
+	draw.Draw(full, full.Bounds(), image.NewUniform(palette[1]), image.Point{}, draw.Src)
+	patch := image.NewPaletted(image.Rect(5, 5, 15, 15), palette)
+	draw.Draw(patch, patch.Bounds(), image.NewUniform(palette[2]), image.Point{}, draw.Src)
+	last := image.NewPaletted(image.Rect(0, 0, 60, 40), palette)
+	draw.Draw(last, last.Bounds(), image.NewUniform(palette[3]), image.Point{}, draw.Src)
+
+	return &gif.GIF{
+		Image:     []*image.Paletted{full, patch, last},
+		Delay:     []int{10, 25, 40},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalPrevious, gif.DisposalBackground},
+		LoopCount: 3,
+		Config:    image.Config{Width: 60, Height: 40},
+	}
+}
+
+func TestApplyCodeWatermarkAnimation(t *testing.T) {
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, testAnimation()); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := (&Service{}).ApplyCodeWatermark(&buf, CodeOptions{
+		Content:    "frame",
+		Kind:       CodeQR,
+		Size:       50,
+		Foreground: "#000000",
+		Background: "#ffffff",
+		Opacity:    1,
+		Position:   PositionBottomRight,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	anim, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(anim.Image) != 3 {
+		t.Fatalf("got %d frames, want 3", len(anim.Image))
+	}
+	want := testAnimation()
+	for i := range anim.Image {
+		if anim.Delay[i] != want.Delay[i] || anim.Disposal[i] != want.Disposal[i] {
+			t.Errorf("frame %d: delay %d disposal %d, want %d and %d", i, anim.Delay[i], anim.Disposal[i], want.Delay[i], want.Disposal[i])
+		}
+	}
+	if anim.LoopCount != want.LoopCount {
+		t.Errorf("loop count %d, want %d", anim.LoopCount, want.LoopCount)
+	}
+
+	// The code's white quiet zone must show in every frame as played back,
+	// including the partial second frame, and the original colors elsewhere
+	frames, err := compositeFrames(anim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range frames {
+		if c := frame.RGBAAt(58, 38); c.R < 200 || c.G < 200 || c.B < 200 {
+			t.Errorf("frame %d: corner = %v, want the code's background", i, c)
+		}
+	}
+	if c := frames[1].RGBAAt(10, 10); c.G != 200 {
+		t.Errorf("frame 1: patch = %v, want green", c)
+	}
+	if c := frames[1].RGBAAt(2, 2); c.R != 200 {
+		t.Errorf("frame 1: outside patch = %v, want red", c)
+	}
+}
+
+func TestDecodeSourceRejectsHugeAnimation(t *testing.T) {
+	// Twenty one-pixel frames on a 4000x4000 canvas are tiny on disk but
+	// would composite to over a gigabyte
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{Config: image.Config{Width: 4000, Height: 4000, ColorModel: palette}}
+	for i := 0; i < 20; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(i, i, i+1, i+1), palette))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := decodeSource(buf.Bytes()); err == nil {
+		t.Error("decoded an animation beyond the memory budget")
+	} else if !strings.Contains(err.Error(), "too large") {
+		t.Errorf("error = %v, want the animation rejected as too large", err)
+	}
+}
+
+func TestQuantizeGradientWithoutBanding(t *testing.T) {
+	// A smooth three-channel gradient has far more than 256 colors
+	img := image.NewRGBA(image.Rect(0, 0, 256, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 256; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x), uint8(255 - x), uint8(y * 4), 255})
+		}
+	}
+
+	paletted := quantize(img, img.Bounds())
+	if n := len(paletted.Palette); n < 200 || n > 256 {
+		t.Errorf("palette has %d colors, want close to 256", n)
+	}
+
+	// Averaged over 8x8 blocks the dithered image should follow the
+	// gradient closely; banding would show as large block errors
+	for by := 0; by < 64; by += 8 {
+		for bx := 0; bx < 256; bx += 8 {
+			var got, want [3]float64
+			for y := by; y < by+8; y++ {
+				for x := bx; x < bx+8; x++ {
+					r, g, b, _ := paletted.At(x, y).RGBA()
+					o := img.RGBAAt(x, y)
+					got[0], got[1], got[2] = got[0]+float64(r>>8), got[1]+float64(g>>8), got[2]+float64(b>>8)
+					want[0], want[1], want[2] = want[0]+float64(o.R), want[1]+float64(o.G), want[2]+float64(o.B)
+				}
+			}
+			for c := 0; c < 3; c++ {
+				if d := math.Abs(got[c]-want[c]) / 64; d > 6 {
+					t.Fatalf("block (%d, %d) channel %d off by %.1f", bx, by, c, d)
+				}
+			}
+		}
+	}
+}
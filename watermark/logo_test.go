@@ -0,0 +1,130 @@
+package watermark
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden images in testdata/golden")
+
+// testLogo is a red-to-blue disc with a soft, semi-transparent edge.
+func testLogo() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			d := math.Hypot(float64(x)-15.5, float64(y)-15.5)
+			alpha := math.Max(0, math.Min(1, (15-d)/4))
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(255 * x / 31),
+				G: 64,
+				B: uint8(255 - 255*x/31),
+				A: uint8(alpha * 255),
+			})
+		}
+	}
+	return img
+}
+
+// checkerboard is a light and dark backdrop so that alpha errors show up as
+// halos on one of the two.
+func checkerboard(size int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			c := color.RGBA{230, 230, 230, 255}
+			if (x/8+y/8)%2 == 1 {
+				c = color.RGBA{40, 40, 40, 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestColorizeLogoGolden(t *testing.T) {
+	modes := []LogoColorMode{LogoOriginal, LogoGrayscale, LogoTint, LogoInvert}
+	tint := color.RGBA{0, 160, 80, 255}
+
+	for _, mode := range modes {
+		t.Run(string(mode), func(t *testing.T) {
+			logo := colorizeLogo(toRGBA(testLogo()), mode, tint)
+
+			result := checkerboard(48)
+			layer := newLayer(result)
+			draw.Draw(layer, image.Rect(8, 8, 40, 40), logo, image.Point{}, draw.Over)
+			blendLayer(result, layer, BlendNormal, 0.8)
+
+			compareGolden(t, filepath.Join("testdata", "golden", "logo_"+string(mode)+".png"), result)
+		})
+	}
+}
+
+func TestColorizeLogoAlpha(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	src.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 128})
+
+	tests := []struct {
+		mode LogoColorMode
+		want color.RGBA
+	}{
+		// Straight red at half alpha is premultiplied to (128, 0, 0, 128)
+		{LogoOriginal, color.RGBA{128, 0, 0, 128}},
+		{LogoGrayscale, color.RGBA{38, 38, 38, 128}},
+		{LogoTint, color.RGBA{0, 0, 128, 128}},
+		{LogoInvert, color.RGBA{0, 128, 128, 128}},
+	}
+	for _, tt := range tests {
+		got := colorizeLogo(toRGBA(src), tt.mode, color.RGBA{0, 0, 255, 255}).RGBAAt(0, 0)
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func compareGolden(t *testing.T, path string, got *image.RGBA) {
+	t.Helper()
+
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := png.Encode(f, got); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("missing golden image, run go test -update: %v", err)
+	}
+	defer f.Close()
+	golden, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := toRGBA(golden)
+
+	if want.Bounds() != got.Bounds() {
+		t.Fatalf("bounds %v, want %v", got.Bounds(), want.Bounds())
+	}
+	for y := 0; y < want.Bounds().Dy(); y++ {
+		for x := 0; x < want.Bounds().Dx(); x++ {
+			if g, w := got.RGBAAt(x, y), want.RGBAAt(x, y); g != w {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, g, w)
+			}
+		}
+	}
+}
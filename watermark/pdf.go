@@ -0,0 +1,496 @@
+package watermark
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"math"
+	"strings"
+
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// pdfLogoDPI is the resolution logos are rasterized at for PDFs, high
+	// enough to print sharply.
+	pdfLogoDPI = 300
+	// maxPDFLogoWidth bounds the rasterized logo for very large pages.
+	maxPDFLogoWidth = 4096
+	// maxPDFPageSize is the largest page side viewers support, in points.
+	// Watermarks on larger pages are laid out over this much of the page.
+	maxPDFPageSize = 14400
+	// maxPDFDraws bounds the watermark copies drawn on one page, so that
+	// tiny tiles cannot grow the overlay without limit.
+	maxPDFDraws = 50000
+)
+
+// pdfBlendModes maps blend modes to their names in a PDF graphics state.
+var pdfBlendModes = map[BlendMode]pdfName{
+	BlendMultiply:   "Multiply",
+	BlendScreen:     "Screen",
+	BlendOverlay:    "Overlay",
+	BlendSoftLight:  "SoftLight",
+	BlendDifference: "Difference",
+}
+
+// ApplyPDFWatermark adds a text watermark to every page of a PDF. The text
+// is drawn with embedded fonts from the service font chain, so it stays
+// selectable, and is laid out as on images with sizes in points: tiled on
+// the diagonal grid, tiled with opts.Tiling, or placed at opts.Position.
+// Adaptive colors would need the page rendered, so the fixed color is used;
+// auto placement uses the center.
+func (s *Service) ApplyPDFWatermark(r io.Reader, opts TextOptions) ([]byte, error) {
+	log.Printf("ApplyPDFWatermark: Starting. Text: %s, Opacity: %.2f, Font Size: %.2f, Position: %s", opts.Text, opts.Opacity, opts.FontSize, opts.Position)
+	defer log.Println("ApplyPDFWatermark: Finished")
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		log.Printf("ApplyPDFWatermark: Failed to read document: %v", err)
+		return nil, fmt.Errorf("failed to read document: %v", err)
+	}
+
+	position := opts.Position
+	if position == PositionAuto {
+		position = PositionCenter
+	}
+	fill := parseColor(opts.Color)
+
+	result, err := overlayPDF(data, opts.BlendMode, func(o *pdfOverlay, page int) error {
+		bounds := o.bounds()
+		pageOpts := opts
+		pageOpts.Template.Width = bounds.Dx()
+		pageOpts.Template.Height = bounds.Dy()
+		pageOpts.Text = ExpandTemplate(opts.Text, pageOpts.Template)
+
+		size := s.fontSizeFor(pageOpts, bounds)
+		face := s.Fonts.Face(size)
+		defer face.Close()
+		block := layoutText(face, pageOpts.Text, opts.LineHeight, opts.Align)
+		w, h := points(block.width), points(block.ascent+block.height()+block.descent)
+		ascent := points(block.ascent)
+		draw := func(m svgMatrix, opacity float64) error {
+			return o.text(s.Fonts, block, size, fill, m, opacity)
+		}
+
+		switch {
+		case isPlaced(position):
+			r := anchorRect(position, bounds, image.Pt(int(math.Ceil(w)), int(math.Ceil(h))), placementMargin(bounds))
+			return draw(translate(float64(r.Min.X), float64(r.Min.Y)+ascent), opts.Opacity)
+		case opts.Tiling.varied():
+			gap := float64(textGap(face, opts.Spacing))
+			for _, t := range layoutTiles(bounds, w+gap, h+gap, opts.Tiling) {
+				if err := draw(tileMatrix(t, w, h).mul(translate(0, ascent)), opts.Opacity*t.Opacity); err != nil {
+					return err
+				}
+			}
+		default:
+			// The same diagonal grid as on images
+			gap := textGap(face, opts.Spacing)
+			stepX := max(1, block.width.Ceil()+gap)
+			stepY := max(1, (block.ascent+block.height()+block.descent).Ceil()+gap)
+			for y := bounds.Min.Y - bounds.Max.Y; y < bounds.Max.Y*2; y += stepY {
+				for x := bounds.Min.X - bounds.Max.X; x < bounds.Max.X*2; x += stepX {
+					origin := rotatedOrigin(block, x, y, 45)
+					if !block.bounds(origin).Overlaps(bounds) {
+						continue
+					}
+					if err := draw(translate(points(origin.X), points(origin.Y)), opts.Opacity); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ApplyPDFWatermark: Failed to watermark document: %v", err)
+		return nil, fmt.Errorf("failed to watermark document: %v", err)
+	}
+	return result, nil
+}
+
+// ApplyPDFImageWatermark adds a logo, and the footer if any, to every page
+// of a PDF. The logo is stored once as an image and shared by all pages;
+// WatermarkSize is a percentage of each page's width. Per-tile contrast
+// modes would need the page rendered and are not applied.
+func (s *Service) ApplyPDFImageWatermark(r io.Reader, watermarkR io.Reader, opts ImageOptions) ([]byte, error) {
+	log.Printf("ApplyPDFImageWatermark: Starting with uniqueId: %s", opts.UniqueId)
+	defer log.Printf("ApplyPDFImageWatermark: Finished with uniqueId: %s", opts.UniqueId)
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		log.Printf("ApplyPDFImageWatermark: Failed to read document: %v", err)
+		return nil, fmt.Errorf("failed to read document: %v", err)
+	}
+	watermarkData, err := io.ReadAll(watermarkR)
+	if err != nil {
+		log.Printf("ApplyPDFImageWatermark: Failed to read watermark image: %v", err)
+		return nil, fmt.Errorf("failed to read watermark image: %v", err)
+	}
+
+	position := opts.Position
+	if position == PositionAuto {
+		position = PositionCenter
+	}
+
+	var logo pdfRef
+	var aspect float64
+	result, err := overlayPDF(data, opts.BlendMode, func(o *pdfOverlay, page int) error {
+		bounds := o.bounds()
+		w := o.width * opts.WatermarkSize / 100
+		if w <= 0 {
+			return fmt.Errorf("watermark size must be positive")
+		}
+
+		// Rasterize the logo once, at print resolution for the first page
+		if page == 0 {
+			pixels := min(maxPDFLogoWidth, max(1, int(w*pdfLogoDPI/72)))
+			img, err := loadLogo(watermarkData, pixels, image.Pt(maxPDFLogoWidth, maxPDFLogoWidth))
+			if err != nil {
+				return fmt.Errorf("failed to decode watermark image: %v", err)
+			}
+			img = colorizeLogo(img, opts.LogoColorMode, parseColor(opts.TintColor))
+			if img.Bounds().Empty() {
+				return fmt.Errorf("watermark image is empty")
+			}
+			aspect = float64(img.Bounds().Dy()) / float64(img.Bounds().Dx())
+			logo = pdfImage(o.u, img)
+		}
+		h := w * aspect
+
+		// Spacing matches ApplyImageWatermark
+		spacingX := w * opts.Spacing / 100 / 10
+		spacingY := h * opts.Spacing / 100 / 10
+
+		switch {
+		case isPlaced(position):
+			r := anchorRect(position, bounds, image.Pt(int(math.Ceil(w)), int(math.Ceil(h))), placementMargin(bounds))
+			if err := o.image(logo, w, h, translate(float64(r.Min.X), float64(r.Min.Y)), opts.Opacity); err != nil {
+				return err
+			}
+		case opts.Tiling.varied():
+			for _, t := range layoutTiles(bounds, w+spacingX, h+spacingY, opts.Tiling) {
+				if err := o.image(logo, w, h, tileMatrix(t, w, h), opts.Opacity*t.Opacity); err != nil {
+					return err
+				}
+			}
+		default:
+			for y := 0.0; y < o.height; y += math.Max(1, h+spacingY) {
+				for x := 0.0; x < o.width; x += math.Max(1, w+spacingX) {
+					if err := o.image(logo, w, h, translate(x, y), opts.Opacity); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if opts.Footer != nil {
+			return o.footer(s.fontsFor(opts.Footer.Font), opts.Footer)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ApplyPDFImageWatermark: Failed to watermark document: %v", err)
+		return nil, fmt.Errorf("failed to watermark document: %v", err)
+	}
+	return result, nil
+}
+
+// overlayPDF appends an incremental update to the PDF in data that draws a
+// form XObject over every page. draw fills in each page's overlay. The
+// original content is wrapped in q/Q so that graphics state it leaves
+// behind cannot distort the overlay.
+func overlayPDF(data []byte, blend BlendMode, draw func(o *pdfOverlay, page int) error) ([]byte, error) {
+	reader, err := openPDF(data)
+	if err != nil {
+		return nil, err
+	}
+	pages, err := reader.pages()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("overlayPDF: Document has %d pages", len(pages))
+
+	u := newPDFUpdate(reader)
+	fonts := newPDFFonts()
+	save := u.add(&pdfStream{dict: pdfDict{}, data: []byte("q\n")})
+
+	for i, page := range pages {
+		w, h := page.box[2]-page.box[0], page.box[3]-page.box[1]
+		if page.rotate == 90 || page.rotate == 270 {
+			w, h = h, w
+		}
+		w, h = math.Min(w, maxPDFPageSize), math.Min(h, maxPDFPageSize)
+		o := &pdfOverlay{
+			u:       u,
+			fonts:   fonts,
+			width:   w,
+			height:  h,
+			blend:   blend,
+			fontRes: pdfDict{},
+			states:  pdfDict{},
+			images:  pdfDict{},
+		}
+		if err := draw(o, i); err != nil {
+			return nil, err
+		}
+
+		form := u.add(flateStream(pdfDict{
+			"Type":      pdfName("XObject"),
+			"Subtype":   pdfName("Form"),
+			"BBox":      pdfArray{0, 0, w, h},
+			"Matrix":    pageMatrix(page),
+			"Resources": o.resources(),
+		}, o.content.Bytes()))
+
+		resources := pdfDict{}
+		for k, v := range page.resources {
+			resources[k] = v
+		}
+		xobjects := pdfDict{}
+		for k, v := range reader.dict(resources["XObject"]) {
+			xobjects[k] = v
+		}
+		name := pdfName("Wm")
+		for n := 1; xobjects[name] != nil; n++ {
+			name = pdfName(fmt.Sprintf("Wm%d", n))
+		}
+		xobjects[name] = form
+		resources["XObject"] = xobjects
+		restore := u.add(&pdfStream{dict: pdfDict{}, data: []byte(fmt.Sprintf("Q q /%s Do Q\n", name))})
+
+		contents := pdfArray{save}
+		contents = append(contents, reader.contents(page)...)
+		contents = append(contents, restore)
+
+		dict := pdfDict{}
+		for k, v := range page.dict {
+			dict[k] = v
+		}
+		dict["Resources"] = resources
+		dict["Contents"] = contents
+		u.set(page.ref, dict)
+	}
+
+	fonts.write(u)
+	return u.bytes(), nil
+}
+
+// contents returns the page's content streams.
+func (r *pdfReader) contents(page pdfPage) pdfArray {
+	switch v := page.dict["Contents"].(type) {
+	case pdfRef:
+		if arr, ok := r.resolve(v).(pdfArray); ok {
+			return arr
+		}
+		return pdfArray{v}
+	case pdfArray:
+		return v
+	}
+	return nil
+}
+
+// pageMatrix maps the page as displayed, with its origin at the lower left,
+// onto the page's default user space, undoing /Rotate and the box offset.
+func pageMatrix(page pdfPage) pdfArray {
+	x0, y0, w, h := page.box[0], page.box[1], page.box[2]-page.box[0], page.box[3]-page.box[1]
+	switch page.rotate {
+	case 90:
+		return pdfArray{0, 1, -1, 0, x0 + w, y0}
+	case 180:
+		return pdfArray{-1, 0, 0, -1, x0 + w, y0 + h}
+	case 270:
+		return pdfArray{0, -1, 1, 0, x0, y0 + h}
+	}
+	return pdfArray{1, 0, 0, 1, x0, y0}
+}
+
+// pdfOverlay collects the content and resources of one page's overlay.
+// Drawing methods take coordinates in points from the top-left corner of
+// the page as displayed, as image pixels are, and flip them for PDF.
+type pdfOverlay struct {
+	u             *pdfUpdate
+	fonts         *pdfFonts
+	width, height float64
+	blend         BlendMode
+	// draws counts the copies drawn, up to maxPDFDraws
+	draws   int
+	content bytes.Buffer
+	fontRes pdfDict
+	states  pdfDict
+	images  pdfDict
+}
+
+// bounds returns the displayed page in whole points, for the layout helpers
+// shared with images.
+func (o *pdfOverlay) bounds() image.Rectangle {
+	return image.Rect(0, 0, int(math.Round(o.width)), int(math.Round(o.height)))
+}
+
+func (o *pdfOverlay) resources() pdfDict {
+	res := pdfDict{}
+	for k, v := range map[pdfName]pdfDict{"Font": o.fontRes, "ExtGState": o.states, "XObject": o.images} {
+		if len(v) > 0 {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// state returns the name of a graphics state with the given opacity and
+// the overlay's blend mode.
+func (o *pdfOverlay) state(opacity float64) pdfName {
+	name := pdfName("GS" + formatPDFNumber(opacity))
+	if _, ok := o.states[name]; !ok {
+		gs := pdfDict{"Type": pdfName("ExtGState"), "ca": opacity, "CA": opacity}
+		if mode, ok := pdfBlendModes[o.blend]; ok {
+			gs["BM"] = mode
+		}
+		o.states[name] = gs
+	}
+	return name
+}
+
+// begin saves the graphics state and sets up m, which maps top-down local
+// coordinates onto the page. It fails once the page has maxPDFDraws copies.
+func (o *pdfOverlay) begin(m svgMatrix, opacity float64) error {
+	if o.draws >= maxPDFDraws {
+		return fmt.Errorf("watermark needs more than %d copies per page; use a larger size or spacing", maxPDFDraws)
+	}
+	o.draws++
+	m = svgMatrix{1, 0, 0, -1, 0, o.height}.mul(m)
+	o.content.WriteString("q ")
+	writePDFName(&o.content, o.state(opacity))
+	o.content.WriteString(" gs")
+	for _, v := range m {
+		o.content.WriteString(" " + formatPDFNumber(v))
+	}
+	o.content.WriteString(" cm\n")
+	return nil
+}
+
+// text draws block with its first baseline starting at the local origin.
+func (o *pdfOverlay) text(chain *FontChain, block *textBlock, size float64, fill color.Color, m svgMatrix, opacity float64) error {
+	if opacity <= 0 {
+		return nil
+	}
+	// Text space has y pointing up, so mirror the local space back
+	if err := o.begin(m.mul(svgMatrix{1, 0, 0, -1, 0, 0}), opacity); err != nil {
+		return err
+	}
+	r, g, b, _ := color.NRGBAModel.Convert(fill).RGBA()
+	fmt.Fprintf(&o.content, "%s %s %s rg\nBT\n", formatPDFNumber(float64(r)/0xffff), formatPDFNumber(float64(g)/0xffff), formatPDFNumber(float64(b)/0xffff))
+	for i, line := range block.lines {
+		runs, err := o.fonts.runs(o.u, chain, line)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&o.content, "1 0 0 1 %s %s Tm\n", formatPDFNumber(points(block.lineOffset(i))), formatPDFNumber(-points(block.lineHeight)*float64(i)))
+		for _, run := range runs {
+			o.fontRes[run.font.name] = run.font.ref
+			writePDFName(&o.content, run.font.name)
+			fmt.Fprintf(&o.content, " %s Tf <%X> Tj\n", formatPDFNumber(size), run.glyphs)
+		}
+	}
+	o.content.WriteString("ET\nQ\n")
+	return nil
+}
+
+// image draws the image XObject ref over the local rectangle (0, 0)-(w, h).
+func (o *pdfOverlay) image(ref pdfRef, w, h float64, m svgMatrix, opacity float64) error {
+	if opacity <= 0 {
+		return nil
+	}
+	o.images["Im"] = ref
+	// Images fill the unit square with their top row at y = 1
+	if err := o.begin(m.mul(svgMatrix{w, 0, 0, -h, 0, h}), opacity); err != nil {
+		return err
+	}
+	o.content.WriteString("/Im Do\nQ\n")
+	return nil
+}
+
+// footer draws the footer line where addBottomWatermark puts it on images.
+func (o *pdfOverlay) footer(chain *FontChain, footer *FooterOptions) error {
+	fontSize := footer.FontSize
+	if fontSize <= 0 {
+		fontSize = 20
+	}
+	bandHeight := fontSize * 1.5
+	margin := fontSize / 2
+
+	face := chain.Face(fontSize)
+	defer face.Close()
+	block := layoutText(face, footer.Text, 1, AlignLeft)
+
+	x := margin
+	switch {
+	case strings.HasSuffix(footer.Position, "-center"):
+		x = (o.width - points(block.width)) / 2
+	case strings.HasSuffix(footer.Position, "-right"):
+		x = o.width - points(block.width) - margin
+	}
+	y := o.height - bandHeight
+	if strings.HasPrefix(footer.Position, "top-") {
+		y = 0
+	}
+	return o.text(chain, block, fontSize, parseColor(footer.Color), translate(x, y+fontSize), footer.Opacity)
+}
+
+// pdfImage stores img as an image XObject with its alpha channel as a soft
+// mask.
+func pdfImage(u *pdfUpdate, img *image.RGBA) pdfRef {
+	b := img.Bounds()
+	rgb := make([]byte, 0, b.Dx()*b.Dy()*3)
+	alpha := make([]byte, 0, b.Dx()*b.Dy())
+	opaque := true
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.RGBAAt(x, y)).(color.NRGBA)
+			rgb = append(rgb, c.R, c.G, c.B)
+			alpha = append(alpha, c.A)
+			opaque = opaque && c.A == 255
+		}
+	}
+
+	dict := pdfDict{
+		"Type":             pdfName("XObject"),
+		"Subtype":          pdfName("Image"),
+		"Width":            b.Dx(),
+		"Height":           b.Dy(),
+		"ColorSpace":       pdfName("DeviceRGB"),
+		"BitsPerComponent": 8,
+	}
+	if !opaque {
+		dict["SMask"] = u.add(flateStream(pdfDict{
+			"Type":             pdfName("XObject"),
+			"Subtype":          pdfName("Image"),
+			"Width":            b.Dx(),
+			"Height":           b.Dy(),
+			"ColorSpace":       pdfName("DeviceGray"),
+			"BitsPerComponent": 8,
+		}, alpha))
+	}
+	return u.add(flateStream(dict, rgb))
+}
+
+// tileMatrix maps a w by h sprite drawn centered on the tile, rotated and
+// scaled as the tile describes, onto the page.
+func tileMatrix(t tile, w, h float64) svgMatrix {
+	sin, cos := math.Sincos(t.Angle * math.Pi / 180)
+	s := t.Scale
+	return svgMatrix{s * cos, s * sin, -s * sin, s * cos, t.X, t.Y}.mul(translate(-w/2, -h/2))
+}
+
+func translate(x, y float64) svgMatrix {
+	return svgMatrix{1, 0, 0, 1, x, y}
+}
+
+// points converts a font measurement to points, which faces at 72 DPI use
+// as pixels.
+func points(v fixed.Int26_6) float64 {
+	return float64(v) / 64
+}
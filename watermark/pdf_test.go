@@ -0,0 +1,333 @@
+package watermark
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// testPDF returns a two-page document. The second page is rotated and
+// cropped, and both inherit their font from the page tree. With objStreams
+// the dictionaries are stored in an object stream and indexed by a
+// predictor-encoded cross-reference stream, as PDF 1.5 writers do.
+func testPDF(objStreams bool) []byte {
+	return testPDFWithMediaBox(objStreams, "[0 0 612 792]")
+}
+
+// testPDFWithMediaBox returns testPDF with mediaBox as the page tree's
+// MediaBox.
+func testPDFWithMediaBox(objStreams bool, mediaBox string) []byte {
+	objects := []string{
+		1: "<< /Type /Catalog /Pages 2 0 R >>",
+		2: "<< /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 /MediaBox " + mediaBox + " /Resources << /Font << /F1 5 0 R >> >> >>",
+		3: "<< /Type /Page /Parent 2 0 R /Contents 6 0 R >>",
+		4: "<< /Type /Page /Parent 2 0 R /Contents 7 0 R /Rotate 90 /CropBox [10 10 400 600] >>",
+		5: "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	}
+	contents := map[int]string{
+		6: "BT /F1 12 Tf 72 720 Td (Hello page one) Tj ET",
+		7: "BT /F1 12 Tf 72 500 Td (Hello page two) Tj ET",
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.5\n%\xe2\xe3\xcf\xd3\n")
+	offsets := map[int]int{}
+	for num := 6; num <= 7; num++ {
+		offsets[num] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n<< /Length %d >>\nstream\n%s\nendstream\nendobj\n", num, len(contents[num]), contents[num])
+	}
+
+	if !objStreams {
+		for num := 1; num <= 5; num++ {
+			offsets[num] = buf.Len()
+			fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", num, objects[num])
+		}
+		start := buf.Len()
+		buf.WriteString("xref\n0 8\n0000000000 65535 f\r\n")
+		for num := 1; num <= 7; num++ {
+			fmt.Fprintf(&buf, "%010d 00000 n\r\n", offsets[num])
+		}
+		fmt.Fprintf(&buf, "trailer\n<< /Size 8 /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", start)
+		return buf.Bytes()
+	}
+
+	// Object stream 8 holds objects 1 to 5
+	var header, body bytes.Buffer
+	for num := 1; num <= 5; num++ {
+		fmt.Fprintf(&header, "%d %d ", num, body.Len())
+		body.WriteString(objects[num] + "\n")
+	}
+	offsets[8] = buf.Len()
+	packed := deflate(append(header.Bytes(), body.Bytes()...))
+	fmt.Fprintf(&buf, "8 0 obj\n<< /Type /ObjStm /N 5 /First %d /Filter /FlateDecode /Length %d >>\nstream\n", header.Len(), len(packed))
+	buf.Write(packed)
+	buf.WriteString("\nendstream\nendobj\n")
+
+	// Cross-reference stream 9 with W [1 2 2] rows, each PNG "up" filtered
+	offsets[9] = buf.Len()
+	var rows [][]byte
+	rows = append(rows, []byte{0, 0, 0, 0xff, 0xff})
+	for num := 1; num <= 9; num++ {
+		if num <= 5 {
+			rows = append(rows, []byte{2, 0, 8, 0, byte(num - 1)})
+		} else {
+			rows = append(rows, []byte{1, byte(offsets[num] >> 8), byte(offsets[num]), 0, 0})
+		}
+	}
+	var filtered []byte
+	prev := make([]byte, 5)
+	for _, row := range rows {
+		filtered = append(filtered, 2)
+		for i := range row {
+			filtered = append(filtered, row[i]-prev[i])
+		}
+		prev = row
+	}
+	packed = deflate(filtered)
+	fmt.Fprintf(&buf, "9 0 obj\n<< /Type /XRef /Size 10 /W [1 2 2] /Root 1 0 R /Filter /FlateDecode /DecodeParms << /Predictor 12 /Columns 5 >> /Length %d >>\nstream\n", len(packed))
+	buf.Write(packed)
+	fmt.Fprintf(&buf, "\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", offsets[9])
+	return buf.Bytes()
+}
+
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// openTestPDF parses out with an independent reader, checking that the
+// original bytes were kept as they were.
+func openTestPDF(t *testing.T, original, out []byte) *pdf.Reader {
+	t.Helper()
+	if !bytes.HasPrefix(out, original) {
+		t.Fatal("original document was modified instead of appended to")
+	}
+	r, err := pdf.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatalf("reading watermarked PDF: %v", err)
+	}
+	if r.NumPage() != 2 {
+		t.Fatalf("got %d pages, want 2", r.NumPage())
+	}
+	return r
+}
+
+// overlayOps runs the page's watermark form and returns its operators
+// with their operands, decoding shown text through the fonts' ToUnicode maps.
+func overlayOps(page pdf.Page) (ops []string, args [][]pdf.Value, text string) {
+	form := page.V.Key("Resources").Key("XObject").Key("Wm")
+	fonts := form.Key("Resources").Key("Font")
+	var font pdf.Font
+	pdf.Interpret(form, func(stk *pdf.Stack, op string) {
+		operands := make([]pdf.Value, stk.Len())
+		for i := len(operands) - 1; i >= 0; i-- {
+			operands[i] = stk.Pop()
+		}
+		switch op {
+		case "Tf":
+			font = pdf.Font{V: fonts.Key(operands[0].Name())}
+		case "Tj":
+			text += font.Encoder().Decode(operands[0].RawString())
+		}
+		ops = append(ops, op)
+		args = append(args, operands)
+	})
+	return ops, args, text
+}
+
+// pageText returns the strings shown by the page's own content streams,
+// which the original test documents write in plain ASCII.
+func pageText(page pdf.Page) string {
+	var text string
+	contents := page.V.Key("Contents")
+	for i := 0; i < contents.Len(); i++ {
+		pdf.Interpret(contents.Index(i), func(stk *pdf.Stack, op string) {
+			if op == "Tj" {
+				text += stk.Pop().RawString()
+			}
+		})
+	}
+	return text
+}
+
+func TestApplyPDFWatermark(t *testing.T) {
+	chain, err := DefaultFontChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{Fonts: chain}
+
+	for _, objStreams := range []bool{false, true} {
+		t.Run(fmt.Sprintf("objStreams=%v", objStreams), func(t *testing.T) {
+			original := testPDF(objStreams)
+			out, err := s.ApplyPDFWatermark(bytes.NewReader(original), TextOptions{
+				Text:      "CONFIDENTIAL",
+				Color:     "#ff0000",
+				Opacity:   0.3,
+				FontSize:  48,
+				Spacing:   100,
+				BlendMode: BlendMultiply,
+				Position:  PositionCenter,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := openTestPDF(t, original, out)
+
+			for i, want := range []string{"Hello page one", "Hello page two"} {
+				page := r.Page(i + 1)
+				if got := pageText(page); !strings.Contains(got, want) {
+					t.Errorf("page %d: original text %q missing: %q", i+1, want, got)
+				}
+				if page.Resources().Key("Font").Key("F1").Kind() != pdf.Dict {
+					t.Errorf("page %d: inherited font lost", i+1)
+				}
+				if _, _, text := overlayOps(page); text != "CONFIDENTIAL" {
+					t.Errorf("page %d: overlay text = %q, want CONFIDENTIAL", i+1, text)
+				}
+
+				gs := page.V.Key("Resources").Key("XObject").Key("Wm").Key("Resources").Key("ExtGState")
+				state := gs.Key(gs.Keys()[0])
+				if state.Key("ca").Float64() != 0.3 || state.Key("BM").Name() != "Multiply" {
+					t.Errorf("page %d: graphics state = %v", i+1, state)
+				}
+			}
+
+			// The rotated page's overlay is laid out on the page as displayed
+			form := r.Page(2).V.Key("Resources").Key("XObject").Key("Wm")
+			if w, h := form.Key("BBox").Index(2).Float64(), form.Key("BBox").Index(3).Float64(); w != 590 || h != 390 {
+				t.Errorf("rotated page overlay is %vx%v, want 590x390", w, h)
+			}
+		})
+	}
+}
+
+func TestApplyPDFWatermarkTiles(t *testing.T) {
+	chain, err := DefaultFontChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{Fonts: chain}
+	original := testPDF(false)
+
+	// Text from the fallback font is embedded as a second font
+	out, err := s.ApplyPDFWatermark(bytes.NewReader(original), TextOptions{
+		Text:     "Draft مسودة",
+		Opacity:  0.5,
+		FontSize: 24,
+		Spacing:  50,
+		Tiling:   TilingOptions{Pattern: PatternBrick, AngleJitter: 30, Seed: 7},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := openTestPDF(t, original, out)
+
+	ops, _, text := overlayOps(r.Page(1))
+	tiles := strings.Count(strings.Join(ops, " "), "BT")
+	if tiles < 4 {
+		t.Errorf("got %d tiles, want the page covered", tiles)
+	}
+	if !strings.Contains(text, "Draft") {
+		t.Errorf("overlay text %q lacks the Latin part", text)
+	}
+	fonts := r.Page(1).V.Key("Resources").Key("XObject").Key("Wm").Key("Resources").Key("Font")
+	if n := len(fonts.Keys()); n != 2 {
+		t.Errorf("got %d fonts, want the primary and the Arabic fallback", n)
+	}
+}
+
+func TestApplyPDFImageWatermark(t *testing.T) {
+	logo := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			logo.SetNRGBA(x, y, color.NRGBA{200, 0, 0, uint8(x * 6)})
+		}
+	}
+	var logoPNG bytes.Buffer
+	if err := png.Encode(&logoPNG, logo); err != nil {
+		t.Fatal(err)
+	}
+
+	original := testPDF(true)
+	out, err := (&Service{}).ApplyPDFImageWatermark(bytes.NewReader(original), &logoPNG, ImageOptions{
+		Opacity:       0.8,
+		WatermarkSize: 25,
+		LogoColorMode: LogoOriginal,
+		Position:      PositionTopLeft,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := openTestPDF(t, original, out)
+
+	page := r.Page(1)
+	img := page.V.Key("Resources").Key("XObject").Key("Wm").Key("Resources").Key("XObject").Key("Im")
+	if img.Key("Subtype").Name() != "Image" || img.Key("SMask").Kind() != pdf.Stream {
+		t.Fatalf("logo image = %v, want an image with a soft mask", img)
+	}
+	if w := img.Key("Width").Int64(); w != 612*25/100*pdfLogoDPI/72 {
+		t.Errorf("logo rasterized %d pixels wide, want print resolution", w)
+	}
+
+	// A 153 point wide logo in the top-left corner, inset by 3% of the
+	// page's short side. The height follows the rasterized logo's aspect.
+	ops, args, _ := overlayOps(page)
+	for i, op := range ops {
+		if op != "cm" {
+			continue
+		}
+		want := []float64{153, 0, 0, 76.5, 18, 792 - 18 - 76.5}
+		for j, v := range args[i] {
+			if math.Abs(v.Float64()-want[j]) > 0.5 {
+				t.Errorf("logo matrix = %v, want %v", args[i], want)
+				break
+			}
+		}
+	}
+}
+
+func TestApplyPDFWatermarkHugePage(t *testing.T) {
+	original := testPDFWithMediaBox(false, "[0 0 1000000000 1000000000]")
+	logo := `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><rect width="10" height="10"/></svg>`
+
+	chain, err := DefaultFontChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Text is laid out over at most maxPDFPageSize points of the page
+	if _, err := (&Service{Fonts: chain}).ApplyPDFWatermark(bytes.NewReader(original), TextOptions{
+		Text: "Draft", Color: "#000000", Opacity: 0.5, FontSize: 48, Spacing: 100,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Logos a fraction of a point wide would tile the page millions of times
+	_, err = (&Service{}).ApplyPDFImageWatermark(bytes.NewReader(original), strings.NewReader(logo), ImageOptions{
+		Opacity:       0.5,
+		WatermarkSize: 0.0001,
+		LogoColorMode: LogoOriginal,
+	})
+	if err == nil || !strings.Contains(err.Error(), "copies per page") {
+		t.Errorf("tiny logo: err = %v, want the copy limit", err)
+	}
+}
+
+func TestOpenPDFRejectsEncrypted(t *testing.T) {
+	data := bytes.Replace(testPDF(false), []byte("/Root 1 0 R >>"), []byte("/Root 1 0 R /Encrypt 5 0 R >>"), 1)
+	if _, err := openPDF(data); err == nil || !strings.Contains(err.Error(), "encrypted") {
+		t.Errorf("openPDF = %v, want an encryption error", err)
+	}
+}
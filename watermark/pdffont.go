@@ -0,0 +1,195 @@
+package watermark
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/math/fixed"
+)
+
+// pdfFonts embeds the fonts that overlay text is drawn with. Each TrueType
+// font becomes a Type 0 font with Identity-H encoding, so any glyph can be
+// shown by its index, and a ToUnicode map keeps the text searchable and
+// copyable. The font objects are written once all pages are drawn, when the
+// glyphs in use are known.
+type pdfFonts struct {
+	fonts map[*truetype.Font]*pdfFont
+	order []*pdfFont
+}
+
+type pdfFont struct {
+	font   *truetype.Font
+	file   []byte
+	ref    pdfRef
+	name   pdfName
+	glyphs map[truetype.Index]rune
+}
+
+// pdfRun is a piece of a line drawn with one font, as two-byte glyph IDs.
+type pdfRun struct {
+	font   *pdfFont
+	glyphs []byte
+}
+
+func newPDFFonts() *pdfFonts {
+	return &pdfFonts{fonts: map[*truetype.Font]*pdfFont{}}
+}
+
+// runs splits line into runs of the chain's fonts, reserving objects for
+// fonts on first use.
+func (p *pdfFonts) runs(u *pdfUpdate, chain *FontChain, line string) ([]pdfRun, error) {
+	var runs []pdfRun
+	for _, r := range line {
+		i := chain.index(r)
+		f := chain.fonts[i]
+		font, ok := p.fonts[f]
+		if !ok {
+			file := chain.file(i)
+			if file == nil {
+				return nil, fmt.Errorf("font %d of the chain cannot be embedded", i)
+			}
+			font = &pdfFont{
+				font:   f,
+				file:   file,
+				ref:    u.reserve(),
+				name:   pdfName(fmt.Sprintf("F%d", len(p.order))),
+				glyphs: map[truetype.Index]rune{},
+			}
+			p.fonts[f] = font
+			p.order = append(p.order, font)
+		}
+
+		index := f.Index(r)
+		if _, ok := font.glyphs[index]; !ok {
+			font.glyphs[index] = r
+		}
+		if n := len(runs); n == 0 || runs[n-1].font != font {
+			runs = append(runs, pdfRun{font: font})
+		}
+		runs[len(runs)-1].glyphs = append(runs[len(runs)-1].glyphs, byte(index>>8), byte(index))
+	}
+	return runs, nil
+}
+
+// write stores the font objects of every font used.
+func (p *pdfFonts) write(u *pdfUpdate) {
+	for _, font := range p.order {
+		font.write(u)
+	}
+}
+
+func (font *pdfFont) write(u *pdfUpdate) {
+	f := font.font
+	upem := f.FUnitsPerEm()
+	scale := func(v fixed.Int26_6) int {
+		// Metrics at a scale of one em per unit are in font units
+		return int(v) * 1000 / int(upem)
+	}
+
+	baseFont := pdfName(postScriptName(f))
+	bounds := f.Bounds(fixed.Int26_6(upem))
+
+	fileDict := pdfDict{"Length1": len(font.file)}
+	descriptor := pdfDict{
+		"Type":        pdfName("FontDescriptor"),
+		"FontName":    baseFont,
+		"Flags":       4,
+		"FontBBox":    pdfArray{scale(bounds.Min.X), scale(bounds.Min.Y), scale(bounds.Max.X), scale(bounds.Max.Y)},
+		"ItalicAngle": 0,
+		"Ascent":      scale(bounds.Max.Y),
+		"Descent":     scale(bounds.Min.Y),
+		"CapHeight":   scale(bounds.Max.Y),
+		"StemV":       80,
+		"FontFile2":   u.add(flateStream(fileDict, font.file)),
+	}
+
+	glyphs := make([]int, 0, len(font.glyphs))
+	for index := range font.glyphs {
+		glyphs = append(glyphs, int(index))
+	}
+	sort.Ints(glyphs)
+	var widths pdfArray
+	for _, index := range glyphs {
+		advance := f.HMetric(fixed.Int26_6(upem), truetype.Index(index)).AdvanceWidth
+		widths = append(widths, index, pdfArray{scale(advance)})
+	}
+
+	cidFont := pdfDict{
+		"Type":     pdfName("Font"),
+		"Subtype":  pdfName("CIDFontType2"),
+		"BaseFont": baseFont,
+		"CIDSystemInfo": pdfDict{
+			"Registry":   pdfString("Adobe"),
+			"Ordering":   pdfString("Identity"),
+			"Supplement": 0,
+		},
+		"FontDescriptor": u.add(descriptor),
+		"W":              widths,
+		"CIDToGIDMap":    pdfName("Identity"),
+	}
+
+	u.set(font.ref, pdfDict{
+		"Type":            pdfName("Font"),
+		"Subtype":         pdfName("Type0"),
+		"BaseFont":        baseFont,
+		"Encoding":        pdfName("Identity-H"),
+		"DescendantFonts": pdfArray{u.add(cidFont)},
+		"ToUnicode":       u.add(flateStream(nil, font.toUnicode(glyphs))),
+	})
+}
+
+// toUnicode returns a CMap from glyph IDs back to the characters they were
+// drawn for.
+func (font *pdfFont) toUnicode(glyphs []int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n" +
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n" +
+		"/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n" +
+		"1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+
+	// Glyph 0 is .notdef and has no meaning to map
+	var mapped []int
+	for _, index := range glyphs {
+		if index != 0 {
+			mapped = append(mapped, index)
+		}
+	}
+	for start := 0; start < len(mapped); start += 100 {
+		chunk := mapped[start:min(start+100, len(mapped))]
+		fmt.Fprintf(&buf, "%d beginbfchar\n", len(chunk))
+		for _, index := range chunk {
+			fmt.Fprintf(&buf, "<%04X> <", index)
+			for _, unit := range utf16.Encode([]rune{font.glyphs[truetype.Index(index)]}) {
+				fmt.Fprintf(&buf, "%04X", unit)
+			}
+			buf.WriteString(">\n")
+		}
+		buf.WriteString("endbfchar\n")
+	}
+
+	buf.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend\n")
+	return buf.Bytes()
+}
+
+// postScriptName returns the font's PostScript name, which PDF requires
+// to contain no spaces.
+func postScriptName(f *truetype.Font) string {
+	name := f.Name(truetype.NameIDPostscriptName)
+	if name == "" {
+		name = f.Name(truetype.NameIDFontFullName)
+	}
+	name = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || strings.ContainsRune("()<>[]{}/%#", r) {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "" {
+		name = "WatermarkFont"
+	}
+	return name
+}
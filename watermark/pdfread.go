@@ -0,0 +1,850 @@
+package watermark
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// PDF objects are represented by nil (null), bool, int, float64, pdfName,
+// pdfString, pdfArray, pdfDict, pdfStream and pdfRef.
+type pdfObject interface{}
+
+type pdfName string
+
+type pdfString []byte
+
+type pdfArray []pdfObject
+
+type pdfDict map[pdfName]pdfObject
+
+// pdfStream is a stream object. data holds the bytes as stored in the file,
+// still encoded by the stream's filters.
+type pdfStream struct {
+	dict pdfDict
+	data []byte
+}
+
+type pdfRef struct {
+	num, gen int
+}
+
+// pdfKeyword is a bare token such as obj, stream or trailer.
+type pdfKeyword string
+
+func isPDFSpace(c byte) bool {
+	return c == 0 || c == '\t' || c == '\n' || c == '\f' || c == '\r' || c == ' '
+}
+
+func isPDFDelimiter(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+// pdfLexer parses PDF objects from data starting at pos.
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		switch {
+		case isPDFSpace(c):
+			l.pos++
+		case c == '%':
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// regular reads a run of regular characters: a number, keyword or name.
+func (l *pdfLexer) regular() string {
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	return string(l.data[start:l.pos])
+}
+
+func (l *pdfLexer) peek(offset int) byte {
+	if l.pos+offset < len(l.data) {
+		return l.data[l.pos+offset]
+	}
+	return 0
+}
+
+// object reads the next object. Indirect references are recognized, but
+// streams are left to pdfReader, which knows how to find their length.
+func (l *pdfLexer) object() (pdfObject, error) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	switch c := l.data[l.pos]; {
+	case c == '/':
+		l.pos++
+		return pdfName(decodePDFName(l.regular())), nil
+	case c == '<' && l.peek(1) == '<':
+		l.pos += 2
+		return l.dict()
+	case c == '<':
+		l.pos++
+		return l.hexString()
+	case c == '(':
+		l.pos++
+		return l.literalString()
+	case c == '[':
+		l.pos++
+		var arr pdfArray
+		for {
+			l.skipSpace()
+			if l.peek(0) == ']' {
+				l.pos++
+				return arr, nil
+			}
+			obj, err := l.object()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := obj.(pdfKeyword); ok {
+				return nil, fmt.Errorf("unexpected %v in array at offset %d", obj, l.pos)
+			}
+			arr = append(arr, obj)
+		}
+	case isPDFDelimiter(c):
+		return nil, fmt.Errorf("unexpected %q at offset %d", c, l.pos)
+	}
+
+	tok := l.regular()
+	switch tok {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	if n, err := strconv.Atoi(tok); err == nil {
+		// An integer may start an indirect reference "num gen R"
+		if n >= 0 {
+			save := l.pos
+			l.skipSpace()
+			if gen, err := strconv.Atoi(l.regular()); err == nil && gen >= 0 {
+				l.skipSpace()
+				if l.regular() == "R" {
+					return pdfRef{n, gen}, nil
+				}
+			}
+			l.pos = save
+		}
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(tok, 64); err == nil {
+		return f, nil
+	}
+	return pdfKeyword(tok), nil
+}
+
+func (l *pdfLexer) dict() (pdfDict, error) {
+	d := pdfDict{}
+	for {
+		l.skipSpace()
+		if l.peek(0) == '>' && l.peek(1) == '>' {
+			l.pos += 2
+			return d, nil
+		}
+		key, err := l.object()
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(pdfName)
+		if !ok {
+			return nil, fmt.Errorf("dictionary key %v is not a name at offset %d", key, l.pos)
+		}
+		value, err := l.object()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := value.(pdfKeyword); ok {
+			return nil, fmt.Errorf("unexpected %v in dictionary at offset %d", value, l.pos)
+		}
+		d[name] = value
+	}
+}
+
+func (l *pdfLexer) hexString() (pdfString, error) {
+	var digits []byte
+	for l.pos < len(l.data) && l.data[l.pos] != '>' {
+		if c := l.data[l.pos]; !isPDFSpace(c) {
+			digits = append(digits, c)
+		}
+		l.pos++
+	}
+	if l.pos >= len(l.data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	l.pos++
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	out := make([]byte, len(digits)/2)
+	if _, err := hex.Decode(out, digits); err != nil {
+		return nil, fmt.Errorf("invalid hex string: %v", err)
+	}
+	return out, nil
+}
+
+func (l *pdfLexer) literalString() (pdfString, error) {
+	var out []byte
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return out, nil
+			}
+		case '\\':
+			if l.pos >= len(l.data) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			c = l.data[l.pos]
+			l.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				// A backslash before a line break continues the line
+				if l.peek(0) == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					v := int(c - '0')
+					for i := 0; i < 2 && l.peek(0) >= '0' && l.peek(0) <= '7'; i++ {
+						v = v*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					c = byte(v)
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+// decodePDFName resolves #xx escapes in a name.
+func decodePDFName(s string) string {
+	if !bytes.ContainsRune([]byte(s), '#') {
+		return s
+	}
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '#' && i+2 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				out = append(out, byte(v))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// xrefEntry locates an object either at a file offset or inside an object
+// stream.
+type xrefEntry struct {
+	offset     int
+	gen        int
+	compressed bool
+	stream     int
+	index      int
+}
+
+// pdfReader gives random access to the objects of a PDF file.
+type pdfReader struct {
+	data    []byte
+	xref    map[int]xrefEntry
+	trailer pdfDict
+	// startxref is the offset of the last cross-reference section, and
+	// xrefStream whether that section is a stream; an update must chain to
+	// it in the same form.
+	startxref  int
+	xrefStream bool
+	cache      map[int]pdfObject
+}
+
+// openPDF reads the cross-reference sections of data.
+func openPDF(data []byte) (*pdfReader, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data[:min(len(data), 1024)], "\x00\t\n\f\r "), []byte("%PDF-")) {
+		return nil, fmt.Errorf("not a PDF file")
+	}
+
+	r := &pdfReader{data: data, xref: map[int]xrefEntry{}, cache: map[int]pdfObject{}}
+	tail := data[max(0, len(data)-2048):]
+	i := bytes.LastIndex(tail, []byte("startxref"))
+	if i < 0 {
+		return nil, fmt.Errorf("startxref not found")
+	}
+	l := &pdfLexer{data: tail, pos: i + len("startxref")}
+	l.skipSpace()
+	offset, err := strconv.Atoi(l.regular())
+	if err != nil || offset < 0 || offset >= len(data) {
+		return nil, fmt.Errorf("invalid startxref offset")
+	}
+	r.startxref = offset
+
+	seen := map[int]bool{}
+	for first := true; !seen[offset]; first = false {
+		seen[offset] = true
+		trailer, isStream, err := r.readXrefSection(offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cross-reference section: %v", err)
+		}
+		if first {
+			r.trailer = trailer
+			r.xrefStream = isStream
+		}
+		// Hybrid files list compressed objects in a separate stream
+		if stm, ok := trailer["XRefStm"].(int); ok && !seen[stm] {
+			seen[stm] = true
+			if _, _, err := r.readXrefSection(stm); err != nil {
+				return nil, fmt.Errorf("failed to read cross-reference stream: %v", err)
+			}
+		}
+		prev, ok := trailer["Prev"].(int)
+		if !ok || prev < 0 || prev >= len(data) {
+			break
+		}
+		offset = prev
+	}
+
+	if _, ok := r.trailer["Encrypt"]; ok {
+		return nil, fmt.Errorf("encrypted PDFs are not supported")
+	}
+	if _, ok := r.trailer["Root"].(pdfRef); !ok {
+		return nil, fmt.Errorf("document catalog not found")
+	}
+	return r, nil
+}
+
+// setEntry records an entry unless a newer section already did.
+func (r *pdfReader) setEntry(num int, e xrefEntry) {
+	if _, ok := r.xref[num]; !ok {
+		r.xref[num] = e
+	}
+}
+
+// readXrefSection reads the table or stream at offset and returns its
+// trailer dictionary.
+func (r *pdfReader) readXrefSection(offset int) (pdfDict, bool, error) {
+	l := &pdfLexer{data: r.data, pos: offset}
+	l.skipSpace()
+	start := l.pos
+	if l.regular() != "xref" {
+		l.pos = start
+		return r.readXrefStream(offset)
+	}
+
+	for {
+		l.skipSpace()
+		save := l.pos
+		tok := l.regular()
+		if tok == "trailer" {
+			obj, err := l.object()
+			if err != nil {
+				return nil, false, err
+			}
+			trailer, ok := obj.(pdfDict)
+			if !ok {
+				return nil, false, fmt.Errorf("trailer is not a dictionary")
+			}
+			return trailer, false, nil
+		}
+		l.pos = save
+
+		first, err1 := strconv.Atoi(l.regular())
+		l.skipSpace()
+		count, err2 := strconv.Atoi(l.regular())
+		if err1 != nil || err2 != nil || first < 0 || count < 0 {
+			return nil, false, fmt.Errorf("invalid subsection header at offset %d", save)
+		}
+		for i := 0; i < count; i++ {
+			l.skipSpace()
+			off, err1 := strconv.Atoi(l.regular())
+			l.skipSpace()
+			gen, err2 := strconv.Atoi(l.regular())
+			l.skipSpace()
+			kind := l.regular()
+			if err1 != nil || err2 != nil || (kind != "n" && kind != "f") {
+				return nil, false, fmt.Errorf("invalid entry for object %d", first+i)
+			}
+			if kind == "n" {
+				r.setEntry(first+i, xrefEntry{offset: off, gen: gen})
+			} else if _, ok := r.xref[first+i]; !ok {
+				// Free entries hide older definitions of the number
+				r.xref[first+i] = xrefEntry{offset: -1}
+			}
+		}
+	}
+}
+
+func (r *pdfReader) readXrefStream(offset int) (pdfDict, bool, error) {
+	obj, err := r.objectAt(offset)
+	if err != nil {
+		return nil, false, err
+	}
+	stream, ok := obj.(*pdfStream)
+	if !ok || stream.dict["Type"] != pdfName("XRef") {
+		return nil, false, fmt.Errorf("no cross-reference table at offset %d", offset)
+	}
+	data, err := r.decodeStream(stream)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var widths [3]int
+	w, _ := stream.dict["W"].(pdfArray)
+	if len(w) < 3 {
+		return nil, false, fmt.Errorf("invalid W array")
+	}
+	rowSize := 0
+	for i := range widths {
+		n, ok := w[i].(int)
+		if !ok || n < 0 || n > 8 {
+			return nil, false, fmt.Errorf("invalid W array")
+		}
+		widths[i] = n
+		rowSize += n
+	}
+
+	size, _ := stream.dict["Size"].(int)
+	index, _ := stream.dict["Index"].(pdfArray)
+	if index == nil {
+		index = pdfArray{0, size}
+	}
+
+	field := func(row []byte, i, def int) int {
+		if widths[i] == 0 {
+			return def
+		}
+		start := 0
+		for j := 0; j < i; j++ {
+			start += widths[j]
+		}
+		v := 0
+		for _, b := range row[start : start+widths[i]] {
+			v = v<<8 | int(b)
+		}
+		return v
+	}
+
+	pos := 0
+	for i := 0; i+1 < len(index); i += 2 {
+		first, ok1 := index[i].(int)
+		count, ok2 := index[i+1].(int)
+		if !ok1 || !ok2 {
+			return nil, false, fmt.Errorf("invalid Index array")
+		}
+		for j := 0; j < count; j++ {
+			if pos+rowSize > len(data) {
+				return nil, false, fmt.Errorf("cross-reference stream is truncated")
+			}
+			row := data[pos : pos+rowSize]
+			pos += rowSize
+			switch field(row, 0, 1) {
+			case 0:
+				if _, ok := r.xref[first+j]; !ok {
+					r.xref[first+j] = xrefEntry{offset: -1}
+				}
+			case 1:
+				r.setEntry(first+j, xrefEntry{offset: field(row, 1, 0), gen: field(row, 2, 0)})
+			case 2:
+				r.setEntry(first+j, xrefEntry{compressed: true, stream: field(row, 1, 0), index: field(row, 2, 0)})
+			}
+		}
+	}
+	return stream.dict, true, nil
+}
+
+// objectAt parses the indirect object "num gen obj ... endobj" at offset.
+func (r *pdfReader) objectAt(offset int) (pdfObject, error) {
+	if offset < 0 || offset >= len(r.data) {
+		return nil, fmt.Errorf("object offset %d out of range", offset)
+	}
+	l := &pdfLexer{data: r.data, pos: offset}
+	for _, want := range []string{"", "", "obj"} {
+		l.skipSpace()
+		tok := l.regular()
+		if want == "" {
+			if _, err := strconv.Atoi(tok); err != nil {
+				return nil, fmt.Errorf("no object at offset %d", offset)
+			}
+		} else if tok != want {
+			return nil, fmt.Errorf("no object at offset %d", offset)
+		}
+	}
+
+	obj, err := l.object()
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := obj.(pdfDict)
+	if !ok {
+		return obj, nil
+	}
+	l.skipSpace()
+	save := l.pos
+	if l.regular() != "stream" {
+		l.pos = save
+		return obj, nil
+	}
+
+	// The data starts after the end of line following the keyword
+	if l.peek(0) == '\r' {
+		l.pos++
+	}
+	if l.peek(0) == '\n' {
+		l.pos++
+	}
+	start := l.pos
+	length := -1
+	if n, ok := r.resolve(dict["Length"]).(int); ok && n >= 0 && start+n <= len(r.data) {
+		end := &pdfLexer{data: r.data, pos: start + n}
+		end.skipSpace()
+		if end.regular() == "endstream" {
+			length = n
+		}
+	}
+	if length < 0 {
+		// Recover from a missing or wrong length by searching for the end
+		i := bytes.Index(r.data[start:], []byte("endstream"))
+		if i < 0 {
+			return nil, fmt.Errorf("unterminated stream at offset %d", offset)
+		}
+		length = len(bytes.TrimRight(r.data[start:start+i], "\r\n"))
+	}
+	return &pdfStream{dict: dict, data: r.data[start : start+length]}, nil
+}
+
+// object returns object num, or nil when it does not exist.
+func (r *pdfReader) object(num int) (pdfObject, error) {
+	if obj, ok := r.cache[num]; ok {
+		return obj, nil
+	}
+	e, ok := r.xref[num]
+	if !ok || (!e.compressed && e.offset < 0) {
+		return nil, nil
+	}
+	// Guard against reference cycles while the object is being read
+	r.cache[num] = nil
+
+	var obj pdfObject
+	var err error
+	if e.compressed {
+		obj, err = r.compressedObject(e.stream, e.index)
+	} else {
+		obj, err = r.objectAt(e.offset)
+	}
+	if err != nil {
+		delete(r.cache, num)
+		return nil, fmt.Errorf("object %d: %v", num, err)
+	}
+	r.cache[num] = obj
+	return obj, nil
+}
+
+// compressedObject returns the index-th object of object stream num.
+func (r *pdfReader) compressedObject(num, index int) (pdfObject, error) {
+	obj, err := r.object(num)
+	if err != nil {
+		return nil, err
+	}
+	stream, ok := obj.(*pdfStream)
+	if !ok {
+		return nil, fmt.Errorf("object stream %d not found", num)
+	}
+	data, err := r.decodeStream(stream)
+	if err != nil {
+		return nil, err
+	}
+	n, _ := stream.dict["N"].(int)
+	first, _ := stream.dict["First"].(int)
+	if index >= n || first > len(data) {
+		return nil, fmt.Errorf("object %d not in object stream %d", index, num)
+	}
+
+	l := &pdfLexer{data: data}
+	var offset int
+	for i := 0; i <= index; i++ {
+		l.skipSpace()
+		l.regular()
+		l.skipSpace()
+		if offset, err = strconv.Atoi(l.regular()); err != nil {
+			return nil, fmt.Errorf("invalid object stream header")
+		}
+	}
+	l.pos = first + offset
+	return l.object()
+}
+
+// resolve follows an indirect reference. Errors resolve to null, as a
+// reader would treat a missing object.
+func (r *pdfReader) resolve(obj pdfObject) pdfObject {
+	if ref, ok := obj.(pdfRef); ok {
+		obj, _ = r.object(ref.num)
+	}
+	return obj
+}
+
+func (r *pdfReader) dict(obj pdfObject) pdfDict {
+	switch v := r.resolve(obj).(type) {
+	case pdfDict:
+		return v
+	case *pdfStream:
+		return v.dict
+	}
+	return nil
+}
+
+func (r *pdfReader) number(obj pdfObject) (float64, bool) {
+	switch v := r.resolve(obj).(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// decodeStream removes the stream's filters. Only FlateDecode is supported,
+// which is all that cross-reference and object streams use in practice.
+func (r *pdfReader) decodeStream(s *pdfStream) ([]byte, error) {
+	filters := r.resolve(s.dict["Filter"])
+	params := r.resolve(s.dict["DecodeParms"])
+	if name, ok := filters.(pdfName); ok {
+		filters, params = pdfArray{name}, pdfArray{params}
+	}
+	list, _ := filters.(pdfArray)
+	paramList, _ := params.(pdfArray)
+
+	data := s.data
+	for i, f := range list {
+		if r.resolve(f) != pdfName("FlateDecode") {
+			return nil, fmt.Errorf("unsupported stream filter %v", f)
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		// Tolerate truncated streams as long as some data came out
+		out, err := io.ReadAll(zr)
+		if err != nil && len(out) == 0 {
+			return nil, err
+		}
+		data = out
+		if i < len(paramList) {
+			if data, err = r.unpredict(data, r.dict(paramList[i])); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return data, nil
+}
+
+// unpredict reverses the PNG predictors used by Flate-encoded streams.
+func (r *pdfReader) unpredict(data []byte, params pdfDict) ([]byte, error) {
+	predictor, _ := r.resolve(params["Predictor"]).(int)
+	if predictor < 10 {
+		if predictor > 1 {
+			return nil, fmt.Errorf("unsupported predictor %d", predictor)
+		}
+		return data, nil
+	}
+	columns, ok := r.resolve(params["Columns"]).(int)
+	if !ok || columns < 1 {
+		columns = 1
+	}
+	colors, ok := r.resolve(params["Colors"]).(int)
+	if !ok || colors < 1 {
+		colors = 1
+	}
+	bpc, ok := r.resolve(params["BitsPerComponent"]).(int)
+	if !ok || bpc < 1 {
+		bpc = 8
+	}
+	bpp := max(1, colors*bpc/8)
+	rowLen := (columns*colors*bpc + 7) / 8
+
+	out := make([]byte, 0, len(data))
+	prev := make([]byte, rowLen)
+	for pos := 0; pos+1+rowLen <= len(data); pos += 1 + rowLen {
+		kind, row := data[pos], append([]byte(nil), data[pos+1:pos+1+rowLen]...)
+		for i := range row {
+			var left, upLeft byte
+			if i >= bpp {
+				left, upLeft = row[i-bpp], prev[i-bpp]
+			}
+			up := prev[i]
+			switch kind {
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[i] += paeth(left, up, upLeft)
+			}
+		}
+		out = append(out, row...)
+		prev = row
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// pdfPage is a page with the attributes it inherits from the page tree.
+type pdfPage struct {
+	ref       pdfRef
+	dict      pdfDict
+	resources pdfDict
+	// box is the visible area, the crop box or else the media box, as
+	// [llx lly urx ury].
+	box    [4]float64
+	rotate int
+}
+
+// pages returns the document's pages in order.
+func (r *pdfReader) pages() ([]pdfPage, error) {
+	catalog := r.dict(r.trailer["Root"])
+	root, ok := catalog["Pages"].(pdfRef)
+	if !ok {
+		return nil, fmt.Errorf("page tree not found")
+	}
+
+	var pages []pdfPage
+	seen := map[int]bool{}
+	var walk func(ref pdfRef, inherited pdfDict) error
+	walk = func(ref pdfRef, inherited pdfDict) error {
+		if seen[ref.num] || len(seen) > 1_000_000 {
+			return fmt.Errorf("page tree has a cycle")
+		}
+		seen[ref.num] = true
+		node := r.dict(ref)
+		if node == nil {
+			return nil
+		}
+
+		attrs := pdfDict{}
+		for k, v := range inherited {
+			attrs[k] = v
+		}
+		for _, k := range []pdfName{"Resources", "MediaBox", "CropBox", "Rotate"} {
+			if v, ok := node[k]; ok {
+				attrs[k] = v
+			}
+		}
+
+		if kids, ok := r.resolve(node["Kids"]).(pdfArray); ok && node["Type"] != pdfName("Page") {
+			for _, kid := range kids {
+				if kidRef, ok := kid.(pdfRef); ok {
+					if err := walk(kidRef, attrs); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+
+		page := pdfPage{ref: ref, dict: node, resources: r.dict(attrs["Resources"])}
+		page.box = [4]float64{0, 0, 612, 792}
+		for _, k := range []pdfName{"MediaBox", "CropBox"} {
+			if box, ok := r.rect(attrs[k]); ok {
+				page.box = box
+			}
+		}
+		if rotate, ok := r.resolve(attrs["Rotate"]).(int); ok {
+			page.rotate = ((rotate % 360) + 360) % 360 / 90 * 90
+		}
+		pages = append(pages, page)
+		return nil
+	}
+
+	if err := walk(root, nil); err != nil {
+		return nil, err
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("document has no pages")
+	}
+	return pages, nil
+}
+
+// rect reads a rectangle array, normalized so that the first corner is the
+// lower left one.
+func (r *pdfReader) rect(obj pdfObject) ([4]float64, bool) {
+	arr, ok := r.resolve(obj).(pdfArray)
+	if !ok || len(arr) != 4 {
+		return [4]float64{}, false
+	}
+	var v [4]float64
+	for i := range v {
+		if v[i], ok = r.number(arr[i]); !ok {
+			return [4]float64{}, false
+		}
+	}
+	box := [4]float64{math.Min(v[0], v[2]), math.Min(v[1], v[3]), math.Max(v[0], v[2]), math.Max(v[1], v[3])}
+	if box[2]-box[0] < 1 || box[3]-box[1] < 1 {
+		return [4]float64{}, false
+	}
+	return box, true
+}
@@ -0,0 +1,228 @@
+package watermark
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// writePDFObject serializes obj in PDF syntax.
+func writePDFObject(buf *bytes.Buffer, obj pdfObject) {
+	switch v := obj.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case int:
+		buf.WriteString(strconv.Itoa(v))
+	case float64:
+		buf.WriteString(formatPDFNumber(v))
+	case pdfName:
+		writePDFName(buf, v)
+	case pdfString:
+		fmt.Fprintf(buf, "<%x>", []byte(v))
+	case pdfRef:
+		fmt.Fprintf(buf, "%d %d R", v.num, v.gen)
+	case pdfArray:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			writePDFObject(buf, item)
+		}
+		buf.WriteByte(']')
+	case pdfDict:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, string(k))
+		}
+		sort.Strings(keys)
+		buf.WriteString("<<")
+		for _, k := range keys {
+			writePDFName(buf, pdfName(k))
+			buf.WriteByte(' ')
+			writePDFObject(buf, v[pdfName(k)])
+		}
+		buf.WriteString(">>")
+	case *pdfStream:
+		dict := pdfDict{}
+		for k, item := range v.dict {
+			dict[k] = item
+		}
+		dict["Length"] = len(v.data)
+		writePDFObject(buf, dict)
+		buf.WriteString("\nstream\n")
+		buf.Write(v.data)
+		buf.WriteString("\nendstream")
+	case pdfKeyword:
+		buf.WriteString(string(v))
+	default:
+		panic(fmt.Sprintf("writePDFObject: unexpected %T", obj))
+	}
+}
+
+func writePDFName(buf *bytes.Buffer, name pdfName) {
+	buf.WriteByte('/')
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < '!' || c > '~' || c == '#' || isPDFDelimiter(c) {
+			fmt.Fprintf(buf, "#%02X", c)
+		} else {
+			buf.WriteByte(c)
+		}
+	}
+}
+
+// formatPDFNumber writes v with at most five decimals and no exponent.
+func formatPDFNumber(v float64) string {
+	v = math.Round(v*1e5) / 1e5
+	if v == 0 {
+		// Avoid "-0"
+		return "0"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// flateStream returns a stream holding data compressed with FlateDecode.
+func flateStream(dict pdfDict, data []byte) *pdfStream {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+
+	if dict == nil {
+		dict = pdfDict{}
+	}
+	dict["Filter"] = pdfName("FlateDecode")
+	return &pdfStream{dict: dict, data: buf.Bytes()}
+}
+
+// pdfUpdate collects new and replaced objects and appends them to the
+// original file as an incremental update, leaving the original bytes, and
+// any signatures over them, untouched.
+type pdfUpdate struct {
+	r       *pdfReader
+	next    int
+	objects map[int]pdfObject
+	gens    map[int]int
+}
+
+func newPDFUpdate(r *pdfReader) *pdfUpdate {
+	next, _ := r.trailer["Size"].(int)
+	for num := range r.xref {
+		if num >= next {
+			next = num + 1
+		}
+	}
+	return &pdfUpdate{r: r, next: next, objects: map[int]pdfObject{}, gens: map[int]int{}}
+}
+
+// reserve allocates an object number whose object is set later.
+func (u *pdfUpdate) reserve() pdfRef {
+	ref := pdfRef{num: u.next}
+	u.next++
+	return ref
+}
+
+// add stores obj as a new object and returns a reference to it.
+func (u *pdfUpdate) add(obj pdfObject) pdfRef {
+	ref := u.reserve()
+	u.set(ref, obj)
+	return ref
+}
+
+// set stores obj under ref, replacing an existing object of that number.
+func (u *pdfUpdate) set(ref pdfRef, obj pdfObject) {
+	u.objects[ref.num] = obj
+	u.gens[ref.num] = ref.gen
+}
+
+// bytes returns the original file followed by the update.
+func (u *pdfUpdate) bytes() []byte {
+	var buf bytes.Buffer
+	buf.Grow(len(u.r.data) + 64<<10)
+	buf.Write(u.r.data)
+	if n := len(u.r.data); n > 0 && u.r.data[n-1] != '\n' && u.r.data[n-1] != '\r' {
+		buf.WriteByte('\n')
+	}
+
+	nums := make([]int, 0, len(u.objects))
+	for num := range u.objects {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	offsets := map[int]int{}
+	for _, num := range nums {
+		offsets[num] = buf.Len()
+		fmt.Fprintf(&buf, "%d %d obj\n", num, u.gens[num])
+		writePDFObject(&buf, u.objects[num])
+		buf.WriteString("\nendobj\n")
+	}
+
+	trailer := pdfDict{"Prev": u.r.startxref}
+	for _, k := range []pdfName{"Root", "Info", "ID"} {
+		if v, ok := u.r.trailer[k]; ok {
+			trailer[k] = v
+		}
+	}
+
+	if !u.r.xrefStream {
+		trailer["Size"] = u.next
+		startxref := buf.Len()
+		buf.WriteString("xref\n")
+		for _, run := range pdfRuns(nums) {
+			fmt.Fprintf(&buf, "%d %d\n", run[0], run[1])
+			for num := run[0]; num < run[0]+run[1]; num++ {
+				fmt.Fprintf(&buf, "%010d %05d n\r\n", offsets[num], u.gens[num])
+			}
+		}
+		buf.WriteString("trailer\n")
+		writePDFObject(&buf, trailer)
+		fmt.Fprintf(&buf, "\nstartxref\n%d\n%%%%EOF\n", startxref)
+		return buf.Bytes()
+	}
+
+	// Files with cross-reference streams get another stream, which lists
+	// itself too
+	self := u.next
+	startxref := buf.Len()
+	offsets[self] = startxref
+	nums = append(nums, self)
+	trailer["Size"] = self + 1
+	trailer["Type"] = pdfName("XRef")
+	trailer["W"] = pdfArray{1, 4, 2}
+
+	var rows bytes.Buffer
+	var index pdfArray
+	for _, run := range pdfRuns(nums) {
+		index = append(index, run[0], run[1])
+		for num := run[0]; num < run[0]+run[1]; num++ {
+			off := offsets[num]
+			rows.Write([]byte{1, byte(off >> 24), byte(off >> 16), byte(off >> 8), byte(off), byte(u.gens[num] >> 8), byte(u.gens[num])})
+		}
+	}
+	trailer["Index"] = index
+
+	fmt.Fprintf(&buf, "%d 0 obj\n", self)
+	writePDFObject(&buf, flateStream(trailer, rows.Bytes()))
+	fmt.Fprintf(&buf, "\nendobj\nstartxref\n%d\n%%%%EOF\n", startxref)
+	return buf.Bytes()
+}
+
+// pdfRuns groups sorted object numbers into [first, count] runs.
+func pdfRuns(nums []int) [][2]int {
+	var runs [][2]int
+	for _, num := range nums {
+		if n := len(runs); n > 0 && runs[n-1][0]+runs[n-1][1] == num {
+			runs[n-1][1]++
+		} else {
+			runs = append(runs, [2]int{num, 1})
+		}
+	}
+	return runs
+}
@@ -0,0 +1,232 @@
+package watermark
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+// Position selects where a watermark is placed. The default tiles it across
+// the whole image; the anchors place a single copy; auto picks the anchor
+// that covers the least detailed part of the image.
+type Position string
+
+const (
+	PositionTile        Position = "tile"
+	PositionAuto        Position = "auto"
+	PositionTopLeft     Position = "top-left"
+	PositionTop         Position = "top"
+	PositionTopRight    Position = "top-right"
+	PositionLeft        Position = "left"
+	PositionCenter      Position = "center"
+	PositionRight       Position = "right"
+	PositionBottomLeft  Position = "bottom-left"
+	PositionBottom      Position = "bottom"
+	PositionBottomRight Position = "bottom-right"
+)
+
+// anchorPositions lists the single-placement anchors in the order they are
+// considered by auto placement; earlier anchors win ties.
+var anchorPositions = []Position{
+	PositionBottomRight,
+	PositionBottomLeft,
+	PositionTopRight,
+	PositionTopLeft,
+	PositionBottom,
+	PositionTop,
+	PositionRight,
+	PositionLeft,
+	PositionCenter,
+}
+
+// ParsePosition converts a form value into a Position, defaulting to tiling.
+func ParsePosition(s string) Position {
+	p := Position(strings.ToLower(strings.TrimSpace(s)))
+	if p == PositionAuto {
+		return p
+	}
+	for _, anchor := range anchorPositions {
+		if p == anchor {
+			return p
+		}
+	}
+	return PositionTile
+}
+
+// placementMargin is the gap kept between a placed watermark and the image
+// edge: 3% of the shorter side.
+func placementMargin(bounds image.Rectangle) int {
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	return side * 3 / 100
+}
+
+// anchorRect returns the rectangle of the given size placed at anchor p
+// inside bounds, inset by margin.
+func anchorRect(p Position, bounds image.Rectangle, size image.Point, margin int) image.Rectangle {
+	inner := bounds.Inset(margin)
+	if inner.Empty() {
+		inner = bounds
+	}
+
+	x := inner.Min.X + (inner.Dx()-size.X)/2
+	switch p {
+	case PositionTopLeft, PositionLeft, PositionBottomLeft:
+		x = inner.Min.X
+	case PositionTopRight, PositionRight, PositionBottomRight:
+		x = inner.Max.X - size.X
+	}
+
+	y := inner.Min.Y + (inner.Dy()-size.Y)/2
+	switch p {
+	case PositionTopLeft, PositionTop, PositionTopRight:
+		y = inner.Min.Y
+	case PositionBottomLeft, PositionBottom, PositionBottomRight:
+		y = inner.Max.Y - size.Y
+	}
+
+	return image.Rectangle{Min: image.Pt(x, y), Max: image.Pt(x+size.X, y+size.Y)}
+}
+
+// saliencyMap scores how "busy" each part of an image is. It is computed on a
+// downsampled copy and stored as a summed-area table so that the mean over
+// any rectangle is cheap to look up.
+type saliencyMap struct {
+	bounds image.Rectangle
+	scale  float64
+	w, h   int
+	sum    []float64
+}
+
+// saliencyMaxSide bounds the working resolution of the saliency map.
+const saliencyMaxSide = 256
+
+// newSaliencyMap computes the gradient magnitude of img plus a center bias,
+// so that both detailed areas and the middle of the frame, where subjects
+// usually are, score as salient.
+func newSaliencyMap(img *image.RGBA) *saliencyMap {
+	bounds := img.Bounds()
+	scale := 1.0
+	if side := math.Max(float64(bounds.Dx()), float64(bounds.Dy())); side > saliencyMaxSide {
+		scale = side / saliencyMaxSide
+	}
+	w := int(math.Max(1, math.Round(float64(bounds.Dx())/scale)))
+	h := int(math.Max(1, math.Round(float64(bounds.Dy())/scale)))
+
+	// Box-downsample to grayscale luminance
+	gray := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		y0 := bounds.Min.Y + int(float64(y)*scale)
+		y1 := bounds.Min.Y + int(math.Max(float64(y+1)*scale, float64(y)*scale+1))
+		for x := 0; x < w; x++ {
+			x0 := bounds.Min.X + int(float64(x)*scale)
+			x1 := bounds.Min.X + int(math.Max(float64(x+1)*scale, float64(x)*scale+1))
+			var sum float64
+			n := 0
+			for sy := y0; sy < y1 && sy < bounds.Max.Y; sy++ {
+				for sx := x0; sx < x1 && sx < bounds.Max.X; sx++ {
+					i := img.PixOffset(sx, sy)
+					sum += 0.299*float64(img.Pix[i]) + 0.587*float64(img.Pix[i+1]) + 0.114*float64(img.Pix[i+2])
+					n++
+				}
+			}
+			if n > 0 {
+				gray[y*w+x] = sum / float64(n) / 255
+			}
+		}
+	}
+
+	at := func(x, y int) float64 {
+		if x < 0 {
+			x = 0
+		} else if x >= w {
+			x = w - 1
+		}
+		if y < 0 {
+			y = 0
+		} else if y >= h {
+			y = h - 1
+		}
+		return gray[y*w+x]
+	}
+
+	// Sobel gradient magnitude plus a Gaussian center prior
+	const centerWeight = 0.25
+	sigmaX, sigmaY := float64(w)/3, float64(h)/3
+	s := &saliencyMap{bounds: bounds, scale: scale, w: w, h: h, sum: make([]float64, (w+1)*(h+1))}
+	for y := 0; y < h; y++ {
+		rowSum := 0.0
+		for x := 0; x < w; x++ {
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+			dx := (float64(x) - float64(w-1)/2) / sigmaX
+			dy := (float64(y) - float64(h-1)/2) / sigmaY
+			value := math.Hypot(gx, gy) + centerWeight*math.Exp(-(dx*dx+dy*dy)/2)
+
+			rowSum += value
+			s.sum[(y+1)*(w+1)+x+1] = s.sum[y*(w+1)+x+1] + rowSum
+		}
+	}
+	return s
+}
+
+// mean returns the average saliency inside r, given in image coordinates.
+func (s *saliencyMap) mean(r image.Rectangle) float64 {
+	r = r.Intersect(s.bounds).Sub(s.bounds.Min)
+	if r.Empty() {
+		return math.Inf(1)
+	}
+	clamp := func(v float64, max int) int {
+		i := int(v)
+		if i < 0 {
+			return 0
+		}
+		if i > max {
+			return max
+		}
+		return i
+	}
+	x0 := clamp(float64(r.Min.X)/s.scale, s.w)
+	y0 := clamp(float64(r.Min.Y)/s.scale, s.h)
+	x1 := clamp(math.Ceil(float64(r.Max.X)/s.scale), s.w)
+	y1 := clamp(math.Ceil(float64(r.Max.Y)/s.scale), s.h)
+	if x1 <= x0 || y1 <= y0 {
+		return math.Inf(1)
+	}
+
+	stride := s.w + 1
+	total := s.sum[y1*stride+x1] - s.sum[y0*stride+x1] - s.sum[y1*stride+x0] + s.sum[y0*stride+x0]
+	return total / float64((x1-x0)*(y1-y0))
+}
+
+// minVisibleContrast is the luminance difference below which a candidate
+// region is penalised because the watermark would barely show on it.
+const minVisibleContrast = 0.25
+
+// autoPlacement picks the anchor whose region is least busy while still
+// contrasting with a watermark of the given mean luminance. A negative
+// luminance skips the visibility check, e.g. when colors adapt per region.
+func autoPlacement(img *image.RGBA, size image.Point, margin int, watermarkLuminance float64) (Position, image.Rectangle) {
+	saliency := newSaliencyMap(img)
+
+	best := PositionBottomRight
+	bestRect := anchorRect(best, img.Bounds(), size, margin)
+	bestScore := math.Inf(1)
+
+	for _, p := range anchorPositions {
+		r := anchorRect(p, img.Bounds(), size, margin)
+		score := saliency.mean(r)
+		if watermarkLuminance >= 0 {
+			_, luminance := regionStats(img, r)
+			if diff := math.Abs(luminance - watermarkLuminance); diff < minVisibleContrast {
+				score += (minVisibleContrast - diff) * 4
+			}
+		}
+		if score < bestScore {
+			best, bestRect, bestScore = p, r, score
+		}
+	}
+	return best, bestRect
+}
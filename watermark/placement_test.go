@@ -0,0 +1,74 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestAnchorRect(t *testing.T) {
+	bounds := image.Rect(0, 0, 200, 100)
+	size := image.Pt(40, 20)
+
+	tests := []struct {
+		p    Position
+		want image.Rectangle
+	}{
+		{PositionTopLeft, image.Rect(10, 10, 50, 30)},
+		{PositionCenter, image.Rect(80, 40, 120, 60)},
+		{PositionBottomRight, image.Rect(150, 70, 190, 90)},
+		{PositionTop, image.Rect(80, 10, 120, 30)},
+	}
+	for _, tt := range tests {
+		if got := anchorRect(tt.p, bounds, size, 10); got != tt.want {
+			t.Errorf("anchorRect(%s) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestAutoPlacementAvoidsDetail(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{120, 140, 160, 255}), image.Point{}, draw.Src)
+
+	// A checkerboard "subject" covering everything except the top-left corner
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			if x < 120 && y < 80 {
+				continue
+			}
+			if (x/4+y/4)%2 == 0 {
+				img.SetRGBA(x, y, color.RGBA{250, 250, 250, 255})
+			}
+		}
+	}
+
+	position, r := autoPlacement(img, image.Pt(60, 30), placementMargin(img.Bounds()), -1)
+	if position != PositionTopLeft {
+		t.Errorf("autoPlacement chose %s (%v), want top-left", position, r)
+	}
+}
+
+func TestAutoPlacementKeepsWatermarkVisible(t *testing.T) {
+	// A flat image that is white on the right half: a white watermark should
+	// go on the left even though both halves are equally quiet
+	img := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{40, 40, 40, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(150, 0, 300, 200), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	position, _ := autoPlacement(img, image.Pt(60, 30), placementMargin(img.Bounds()), 1)
+	switch position {
+	case PositionTopLeft, PositionLeft, PositionBottomLeft:
+	default:
+		t.Errorf("autoPlacement chose %s for a white watermark, want a left anchor", position)
+	}
+}
+
+func TestParsePosition(t *testing.T) {
+	if got := ParsePosition("Bottom-Right"); got != PositionBottomRight {
+		t.Errorf("ParsePosition(Bottom-Right) = %q", got)
+	}
+	if got := ParsePosition(""); got != PositionTile {
+		t.Errorf("ParsePosition(\"\") = %q, want tile", got)
+	}
+}
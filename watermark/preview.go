@@ -0,0 +1,128 @@
+package watermark
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"log"
+
+	"github.com/nfnt/resize"
+)
+
+// DefaultPreviewSize is the longest side, in pixels, of preview renders.
+const DefaultPreviewSize = 800
+
+// previewQuality is the JPEG quality of preview renders, which favor speed
+// and size over fidelity.
+const previewQuality = 70
+
+// Preview is a downsampled copy of a source image. It is decoded once and
+// can be watermarked repeatedly, e.g. while a user adjusts settings.
+type Preview struct {
+	img *image.RGBA
+	// scale is the preview size relative to the original
+	scale  float64
+	width  int
+	height int
+	exif   map[string]string
+}
+
+// NewPreview decodes an image, or the first frame of an animation, and
+// downsamples it so that its longest side is at most maxSize pixels.
+func NewPreview(r io.Reader, maxSize int) (*Preview, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source image: %v", err)
+	}
+	src, err := DecodeSource(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode source image: %v", err)
+	}
+	return src.Preview(maxSize), nil
+}
+
+// Preview downsamples the image, or the first frame of an animation, so
+// that its longest side is at most maxSize pixels.
+func (src *Source) Preview(maxSize int) *Preview {
+	if maxSize <= 0 {
+		maxSize = DefaultPreviewSize
+	}
+
+	img := src.src.frames[0]
+	b := img.Bounds()
+	p := &Preview{img: img, scale: 1, width: b.Dx(), height: b.Dy(), exif: src.exif}
+	if longest := max(b.Dx(), b.Dy()); longest > maxSize {
+		p.scale = float64(maxSize) / float64(longest)
+		w := max(1, int(float64(b.Dx())*p.scale+0.5))
+		h := max(1, int(float64(b.Dy())*p.scale+0.5))
+		p.img = toRGBA(resize.Resize(uint(w), uint(h), img, resize.Bilinear))
+	}
+	return p
+}
+
+// Size returns the approximate memory held by the preview in bytes.
+func (p *Preview) Size() int {
+	return len(p.img.Pix)
+}
+
+// PreviewText renders a text watermark onto the preview as a JPEG. Sizes
+// given in absolute points are scaled with the image, so the result looks
+// like a downsampled ApplyWatermark result. Templates see the original
+// dimensions.
+func (s *Service) PreviewText(p *Preview, opts TextOptions) ([]byte, error) {
+	opts.Template.Width = p.width
+	opts.Template.Height = p.height
+	opts.Template.Exif = p.exif
+	opts.Text = ExpandTemplate(opts.Text, opts.Template)
+	if opts.SizeMode == SizeAbsolute || opts.SizeMode == "" {
+		opts.FontSize *= p.scale
+	}
+
+	img := cloneRGBA(p.img)
+	if err := s.drawTextFrames([]*image.RGBA{img}, opts); err != nil {
+		log.Printf("PreviewText: Failed to apply watermark: %v", err)
+		return nil, fmt.Errorf("failed to apply watermark: %v", err)
+	}
+	return encodePreview(img)
+}
+
+// PreviewImage renders a logo watermark onto the preview as a JPEG, scaling
+// the footer with the image.
+func (s *Service) PreviewImage(p *Preview, watermarkR io.Reader, opts ImageOptions) ([]byte, error) {
+	watermarkData, err := io.ReadAll(watermarkR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read watermark image: %v", err)
+	}
+	if opts.Footer != nil {
+		footer := *opts.Footer
+		if footer.FontSize <= 0 {
+			footer.FontSize = DefaultFooter().FontSize
+		}
+		footer.FontSize *= p.scale
+		opts.Footer = &footer
+	}
+
+	img := cloneRGBA(p.img)
+	if err := s.drawLogoFrames([]*image.RGBA{img}, watermarkData, opts); err != nil {
+		log.Printf("PreviewImage: Failed to decode watermark image: %v", err)
+		return nil, fmt.Errorf("failed to decode watermark image: %v", err)
+	}
+	return encodePreview(img)
+}
+
+// encodePreview flattens img onto white, since JPEG has no transparency,
+// and encodes it.
+func encodePreview(img *image.RGBA) ([]byte, error) {
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: previewQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode preview: %v", err)
+	}
+	return buf.Bytes(), nil
+}
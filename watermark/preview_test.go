@@ -0,0 +1,84 @@
+package watermark
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+)
+
+// inkBounds returns the bounds of the pixels darker than mid gray.
+func inkBounds(img image.Image) image.Rectangle {
+	var r image.Rectangle
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if c := color.GrayModel.Convert(img.At(x, y)).(color.Gray); c.Y < 128 {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return r
+}
+
+func TestPreviewTextMatchesFullRender(t *testing.T) {
+	chain, err := DefaultFontChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{Fonts: chain}
+
+	src := image.NewRGBA(image.Rect(0, 0, 2000, 1000))
+	draw.Draw(src, src.Bounds(), image.White, image.Point{}, draw.Src)
+	var data bytes.Buffer
+	if err := png.Encode(&data, src); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := TextOptions{
+		Text:       "{width}px",
+		Color:      "#000000",
+		Opacity:    1,
+		FontSize:   200,
+		LineHeight: 1.2,
+		Position:   PositionCenter,
+	}
+	full, err := s.ApplyWatermark(bytes.NewReader(data.Bytes()), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullImg, err := png.Decode(bytes.NewReader(full))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPreview(bytes.NewReader(data.Bytes()), 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := s.PreviewText(p, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("preview is not a decodable image: %v", err)
+	}
+	if img.Bounds().Dx() != 400 || img.Bounds().Dy() != 200 {
+		t.Fatalf("preview is %v, want 400x200", img.Bounds())
+	}
+
+	// The text, including the expanded original width, covers the same
+	// part of the image in both renders
+	want := inkBounds(fullImg)
+	got := inkBounds(img)
+	scaled := image.Rect(want.Min.X/5, want.Min.Y/5, want.Max.X/5, want.Max.Y/5)
+	for i, d := range []int{got.Min.X - scaled.Min.X, got.Min.Y - scaled.Min.Y, got.Max.X - scaled.Max.X, got.Max.Y - scaled.Max.Y} {
+		if d < -4 || d > 4 {
+			t.Errorf("preview text at %v, want about %v (edge %d off by %d)", got, scaled, i, d)
+			break
+		}
+	}
+}
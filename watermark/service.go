@@ -6,53 +6,101 @@ import (
 	"image"
 	"image/color"
 	"image/draw"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
 	"log"
 	"math"
-	"time"
+	"strings"
 
-	"database/sql"
-
-	"github.com/golang/freetype/truetype"
-	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/image/font"
 	"golang.org/x/image/font/gofont/gobold"
 	"golang.org/x/image/math/fixed"
 
-	"crypto/rand"
-	"encoding/base64"
-
 	"github.com/lucasb-eyer/go-colorful"
 	"github.com/nfnt/resize"
 )
 
 type Service struct {
-	DB *sql.DB
+	Fonts *FontChain
+	// ContrastThreshold is the default luminance cut-off between light and
+	// dark regions for adaptive watermark colors.
+	ContrastThreshold float64
 }
 
 func NewService() *Service {
-	return &Service{}
+	fonts, err := DefaultFontChain()
+	if err != nil {
+		log.Printf("NewService: Failed to load font chain, using gobold only: %v", err)
+		fonts = &FontChain{}
+		fonts.add(gobold.TTF)
+	}
+	return &Service{
+		Fonts:             fonts,
+		ContrastThreshold: contrastThresholdFromEnv(),
+	}
 }
 
-func (s *Service) ApplyWatermark(r io.Reader, text string, textColor string, opacity float64, fontSize float64, spacing float64) ([]byte, error) {
-	log.Printf("ApplyWatermark: Starting. Text: %s, Color: %s, Opacity: %.2f, Font Size: %.2f, Spacing: %.2f", text, textColor, opacity, fontSize, spacing)
-	defer log.Println("ApplyWatermark: Finished")
+// TextOptions describes a text watermark. Text may span several lines and
+// contain template placeholders which are expanded against Template.
+type TextOptions struct {
+	Text    string
+	Color   string
+	Opacity float64
+	// FontSize is in points or, for relative SizeModes, a percentage.
+	FontSize float64
+	SizeMode SizeMode
+	// Spacing is the gap between tiles as a percentage of the line height.
+	Spacing    float64
+	LineHeight float64
+	Align      Alignment
+	BlendMode  BlendMode
+	// ColorMode adapts Color to the region under each tile; see ContrastMode.
+	ColorMode         ContrastMode
+	ContrastThreshold float64
+	// Position places a single copy at an anchor instead of tiling.
+	Position Position
+	Tiling   TilingOptions
+	Template TemplateData
+}
+
+func (s *Service) ApplyWatermark(r io.Reader, opts TextOptions) ([]byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		log.Printf("ApplyWatermark: Failed to read source image: %v", err)
+		return nil, fmt.Errorf("failed to read source image: %v", err)
+	}
 
-	// Decode the original image
-	srcImg, format, err := image.Decode(r)
+	// Decode the original image, or every frame of an animation
+	src, err := DecodeSource(data)
 	if err != nil {
 		log.Printf("ApplyWatermark: Failed to decode source image: %v", err)
 		return nil, fmt.Errorf("failed to decode source image: %v", err)
 	}
-	log.Printf("ApplyWatermark: Image decoded. Format: %s, Bounds: %v", format, srcImg.Bounds())
+	return s.applyText(src.src, src.exif, opts)
+}
+
+// ApplyWatermarkSource is ApplyWatermark for an already decoded source,
+// which is left unchanged.
+func (s *Service) ApplyWatermarkSource(src *Source, opts TextOptions) ([]byte, error) {
+	return s.applyText(src.copy(), src.exif, opts)
+}
+
+// applyText draws the text watermark onto the frames of src and encodes it.
+func (s *Service) applyText(src *source, exif map[string]string, opts TextOptions) ([]byte, error) {
+	log.Printf("ApplyWatermark: Starting. Text: %s, Color: %s, Opacity: %.2f, Font Size: %.2f, Spacing: %.2f", opts.Text, opts.Color, opts.Opacity, opts.FontSize, opts.Spacing)
+	defer log.Println("ApplyWatermark: Finished")
+	log.Printf("ApplyWatermark: Image decoded. Format: %s, Bounds: %v, Frames: %d", src.format, src.bounds(), len(src.frames))
 
-	result := image.NewRGBA(srcImg.Bounds())
-	draw.Draw(result, srcImg.Bounds(), srcImg, image.Point{}, draw.Src)
+	// Expand per-image template variables
+	opts.Template.Width = src.bounds().Dx()
+	opts.Template.Height = src.bounds().Dy()
+	opts.Template.Exif = exif
+	opts.Text = ExpandTemplate(opts.Text, opts.Template)
 
 	// Create and apply watermark
-	if err := s.applyRepeatedWatermark(result, text, textColor, opacity, fontSize, spacing, 0, 0); err != nil {
+	if err := s.drawTextFrames(src.frames, opts); err != nil {
 		log.Printf("ApplyWatermark: Failed to apply watermark: %v", err)
 		return nil, fmt.Errorf("failed to apply watermark: %v", err)
 	}
@@ -60,7 +108,7 @@ func (s *Service) ApplyWatermark(r io.Reader, text string, textColor string, opa
 
 	// Encode the result
 	var buf bytes.Buffer
-	if err := s.encodeImage(&buf, result, format); err != nil {
+	if err := s.encode(&buf, src); err != nil {
 		log.Printf("ApplyWatermark: Failed to encode result: %v", err)
 		return nil, fmt.Errorf("failed to encode result: %v", err)
 	}
@@ -71,70 +119,191 @@ func (s *Service) ApplyWatermark(r io.Reader, text string, textColor string, opa
 	return resultBytes, nil
 }
 
-func (s *Service) applyRepeatedWatermark(img *image.RGBA, text string, textColor string, opacity float64, fontSize float64, spacing float64, width, height int) error {
-	log.Printf("Applying repeated watermark. Text: %s, Opacity: %.2f, Font Size: %.2f, Spacing: %.2f", text, opacity, fontSize, spacing)
+// drawTextFrames draws the text watermark, with its template already
+// expanded, onto each frame.
+func (s *Service) drawTextFrames(frames []*image.RGBA, opts TextOptions) error {
+	for _, frame := range frames {
+		if isPlaced(opts.Position) {
+			// Later frames of an animation reuse the anchor of the first, so
+			// that auto placement does not jump between frames
+			opts.Position = s.applyPlacedWatermark(frame, opts)
+		} else if err := s.applyRepeatedWatermark(frame, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	bounds := img.Bounds()
-	// Set base spacing appropriate for font size, then apply spacing multiplier
-	baseSpacing := fontSize / 100
-	verticalSpacing := int(baseSpacing * spacing)
-	horizontalSpacing := int(baseSpacing * spacing)
+func (s *Service) applyRepeatedWatermark(img *image.RGBA, opts TextOptions) error {
+	log.Printf("Applying repeated watermark. Text: %s, Opacity: %.2f, Font Size: %.2f, Spacing: %.2f", opts.Text, opts.Opacity, opts.FontSize, opts.Spacing)
 
-	f, err := truetype.Parse(gobold.TTF)
-	if err != nil {
-		return fmt.Errorf("failed to parse font: %v", err)
-	}
+	bounds := img.Bounds()
+	face := s.Fonts.Face(s.fontSizeFor(opts, bounds))
+	defer face.Close()
 
-	face := truetype.NewFace(f, &truetype.Options{
-		Size: fontSize,
-		DPI:  72,
-	})
+	// The gap between copies is a percentage of the measured line height
+	gap := textGap(face, opts.Spacing)
 
+	// Draw the text opaque into its own layer; opacity is applied when the
+	// layer is blended onto the image
+	layer := newLayer(img)
+	baseColor := parseColor(opts.Color)
 	d := &font.Drawer{
-		Dst:  img,
-		Src:  image.NewUniform(applyOpacity(parseColor(textColor), opacity)),
+		Dst:  layer,
+		Src:  image.NewUniform(baseColor),
 		Face: face,
 	}
+	threshold := s.contrastThreshold(opts.ContrastThreshold)
+
+	block := layoutText(face, opts.Text, opts.LineHeight, opts.Align)
+
+	if opts.Tiling.varied() {
+		s.applyPatternedText(img, opts, block, face, gap, gap)
+		log.Printf("Watermark applied successfully")
+		return nil
+	}
+
+	// Step by the measured size of the block so copies never overlap. Text
+	// that measures nothing, such as whitespace, still steps one pixel so
+	// the loops end.
+	horizontalSpacing := max(block.width.Ceil()+gap, 1)
+	verticalSpacing := max((block.ascent+block.height()+block.descent).Ceil()+gap, 1)
 
 	angle := 45.0
 
 	for y := bounds.Min.Y - bounds.Max.Y; y < bounds.Max.Y*2; y += verticalSpacing {
 		for x := bounds.Min.X - bounds.Max.X; x < bounds.Max.X*2; x += horizontalSpacing {
-			err := drawRotatedText(d, text, x, y, angle)
-			if err != nil {
-				return fmt.Errorf("failed to draw rotated text: %v", err)
+			origin := rotatedOrigin(block, x, y, angle)
+			if opts.ColorMode != ContrastOff {
+				avg, luminance := regionStats(img, block.bounds(origin))
+				d.Src = image.NewUniform(contrastColor(baseColor, opts.ColorMode, threshold, avg, luminance))
 			}
+			block.draw(d, origin)
 		}
 	}
 
+	blendLayer(img, layer, opts.BlendMode, opts.Opacity)
+
 	log.Printf("Watermark applied successfully")
 	return nil
 }
 
-func drawRotatedText(d *font.Drawer, text string, x, y int, angle float64) error {
+// applyPatternedText tiles the text using opts.Tiling. Unlike the classic
+// grid, each tile is drawn from a sprite so that it can be individually
+// rotated, scaled and faded.
+func (s *Service) applyPatternedText(img *image.RGBA, opts TextOptions, block *textBlock, face font.Face, gapX, gapY int) {
+	size := image.Pt(block.width.Ceil(), (block.ascent + block.height() + block.descent).Ceil())
+	if size.X <= 0 || size.Y <= 0 {
+		return
+	}
+
+	// Render the text once in white so that it can be tinted per tile
+	sprite := image.NewRGBA(image.Rectangle{Max: size})
+	d := &font.Drawer{
+		Dst:  sprite,
+		Src:  image.White,
+		Face: face,
+	}
+	block.draw(d, fixed.Point26_6{Y: block.ascent})
+
+	baseColor := parseColor(opts.Color)
+	plain := tintImage(sprite, baseColor)
+	threshold := s.contrastThreshold(opts.ContrastThreshold)
+
+	layer := newLayer(img)
+	tiles := layoutTiles(img.Bounds(), float64(size.X+gapX), float64(size.Y+gapY), opts.Tiling)
+	for _, t := range tiles {
+		tinted := plain
+		if opts.ColorMode != ContrastOff {
+			avg, luminance := regionStats(img, t.bounds(size))
+			tinted = tintImage(sprite, contrastColor(baseColor, opts.ColorMode, threshold, avg, luminance))
+		}
+		drawTile(layer, tinted, t)
+	}
+	blendLayer(img, layer, opts.BlendMode, opts.Opacity)
+}
+
+// applyPlacedWatermark draws a single, unrotated copy of the text at the
+// anchor selected by opts.Position and returns the anchor it used.
+func (s *Service) applyPlacedWatermark(img *image.RGBA, opts TextOptions) Position {
+	log.Printf("Applying placed watermark. Text: %s, Position: %s", opts.Text, opts.Position)
+
+	face := s.Fonts.Face(s.fontSizeFor(opts, img.Bounds()))
+	defer face.Close()
+
+	block := layoutText(face, opts.Text, opts.LineHeight, opts.Align)
+	size := image.Pt(block.width.Ceil(), (block.ascent + block.height() + block.descent).Ceil())
+	baseColor := parseColor(opts.Color)
+
+	position := opts.Position
+	var r image.Rectangle
+	if position == PositionAuto {
+		// Adaptive colors are visible anywhere, so only fixed colors need
+		// a contrasting region
+		luminance := -1.0
+		if opts.ColorMode == ContrastOff {
+			luminance = colorLuminance(baseColor)
+		}
+		position, r = autoPlacement(img, size, placementMargin(img.Bounds()), luminance)
+		log.Printf("Auto placement chose %s", position)
+	} else {
+		r = anchorRect(position, img.Bounds(), size, placementMargin(img.Bounds()))
+	}
+
+	textColor := baseColor
+	if opts.ColorMode != ContrastOff {
+		avg, luminance := regionStats(img, r)
+		textColor = contrastColor(baseColor, opts.ColorMode, s.contrastThreshold(opts.ContrastThreshold), avg, luminance)
+	}
+
+	layer := newLayer(img)
+	d := &font.Drawer{
+		Dst:  layer,
+		Src:  image.NewUniform(textColor),
+		Face: face,
+	}
+	block.draw(d, fixed.Point26_6{X: fixed.I(r.Min.X), Y: fixed.I(r.Min.Y) + block.ascent})
+	blendLayer(img, layer, opts.BlendMode, opts.Opacity)
+
+	return position
+}
+
+// isPlaced reports whether p places a single watermark rather than tiling.
+func isPlaced(p Position) bool {
+	return p != "" && p != PositionTile
+}
+
+// rotatedOrigin returns the first baseline origin of a block whose grid
+// position (x, y) is rotated by angle degrees around the image origin.
+func rotatedOrigin(block *textBlock, x, y int, angle float64) fixed.Point26_6 {
 	// Convert angle to radians
 	radians := angle * math.Pi / 180.0
 	sin, cos := math.Sincos(radians)
 
 	// Calculate the center point of the text
-	width := d.MeasureString(text)
-	centerX := float64(x) + float64(width.Round())/2
+	centerX := float64(x) + float64(block.width.Round())/2
 	centerY := float64(y)
 
 	// Calculate rotated starting point
 	startX := centerX*cos - centerY*sin
 	startY := centerX*sin + centerY*cos
 
-	// Set the starting point for the text
-	d.Dot = fixed.Point26_6{
+	return fixed.Point26_6{
 		X: fixed.I(int(startX)),
 		Y: fixed.I(int(startY)),
 	}
+}
 
-	// Draw the entire text string at once
-	d.DrawString(text)
-
-	return nil
+// contrastThreshold returns the per-request threshold, or the service default
+// when none was given.
+func (s *Service) contrastThreshold(threshold float64) float64 {
+	if threshold > 0 && threshold < 1 {
+		return threshold
+	}
+	if s.ContrastThreshold > 0 {
+		return s.ContrastThreshold
+	}
+	return DefaultContrastThreshold
 }
 
 func applyOpacity(c color.Color, opacity float64) color.Color {
@@ -162,177 +331,284 @@ func (s *Service) encodeImage(w io.Writer, img image.Image, format string) error
 		return jpeg.Encode(w, img, nil)
 	case "png":
 		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, nil)
 	default:
 		return fmt.Errorf("unsupported image format: %s", format)
 	}
 }
 
-func (s *Service) AuthenticateUser(email, password string) (*User, error) {
-	var user User
-	var hashedPassword string
-
-	err := s.DB.QueryRow("SELECT id, email, password FROM users WHERE email = ?", email).Scan(&user.ID, &user.Email, &hashedPassword)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("user not found")
-		}
-		return nil, fmt.Errorf("database error: %v", err)
-	}
-
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
-	if err != nil {
-		return nil, fmt.Errorf("invalid password")
-	}
-
-	return &user, nil
+// ImageOptions describes a logo watermark tiled across the image.
+// WatermarkSize is the logo width as a percentage of the image width.
+type ImageOptions struct {
+	Opacity       float64
+	Spacing       float64
+	WatermarkSize float64
+	BlendMode     BlendMode
+	LogoColorMode LogoColorMode
+	// TintColor is the hex color used by LogoTint.
+	TintColor string
+	// Footer is drawn along the image edge when set.
+	Footer *FooterOptions
+	// ColorMode inverts or recolors individual tiles so the logo contrasts
+	// with the region beneath it; see ContrastMode.
+	ColorMode         ContrastMode
+	ContrastThreshold float64
+	// Position places a single copy at an anchor instead of tiling.
+	Position Position
+	Tiling   TilingOptions
+	UniqueId string
 }
 
-func (s *Service) CreateSession(userID string) (string, error) {
-	// Generate a random token
-	tokenBytes := make([]byte, 32)
-	_, err := rand.Read(tokenBytes)
+func (s *Service) ApplyImageWatermark(r io.Reader, watermarkR io.Reader, opts ImageOptions) ([]byte, error) {
+	// Decode the original image, or every frame of an animation
+	data, err := io.ReadAll(r)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate token: %v", err)
+		log.Printf("ApplyImageWatermark: Failed to read source image: %v", err)
+		return nil, fmt.Errorf("failed to read source image: %v", err)
 	}
-	token := base64.URLEncoding.EncodeToString(tokenBytes)
-
-	// Set expiration time (e.g., 24 hours from now)
-	expiresAt := time.Now().Add(24 * time.Hour)
-
-	// Store the session in the database
-	_, err = s.DB.Exec("INSERT INTO sessions (user_id, token, expires_at) VALUES (?, ?, ?)",
-		userID, token, expiresAt)
+	src, err := decodeSource(data)
 	if err != nil {
-		return "", fmt.Errorf("failed to store session: %v", err)
+		log.Printf("ApplyImageWatermark: Failed to decode source image: %v", err)
+		return nil, fmt.Errorf("failed to decode source image: %v", err)
 	}
-
-	return token, nil
+	return s.applyLogo(src, watermarkR, opts)
 }
 
-type User struct {
-	ID    string
-	Email string
+// ApplyImageWatermarkSource is ApplyImageWatermark for an already decoded
+// source, which is left unchanged.
+func (s *Service) ApplyImageWatermarkSource(src *Source, watermarkR io.Reader, opts ImageOptions) ([]byte, error) {
+	return s.applyLogo(src.copy(), watermarkR, opts)
 }
 
-func (s *Service) ApplyImageWatermark(r io.Reader, watermarkR io.Reader, opacity float64, spacing float64, watermarkSize float64, uniqueId string) ([]byte, error) {
-	log.Printf("ApplyImageWatermark: Starting with uniqueId: %s", uniqueId)
-	defer log.Printf("ApplyImageWatermark: Finished with uniqueId: %s", uniqueId)
+// applyLogo draws the logo watermark onto the frames of src and encodes it.
+func (s *Service) applyLogo(src *source, watermarkR io.Reader, opts ImageOptions) ([]byte, error) {
+	log.Printf("ApplyImageWatermark: Starting with uniqueId: %s", opts.UniqueId)
+	defer log.Printf("ApplyImageWatermark: Finished with uniqueId: %s", opts.UniqueId)
 
-	// Decode the original image
-	srcImg, format, err := image.Decode(r)
+	watermarkData, err := io.ReadAll(watermarkR)
 	if err != nil {
-		log.Printf("ApplyImageWatermark: Failed to decode source image: %v", err)
-		return nil, fmt.Errorf("failed to decode source image: %v", err)
+		log.Printf("ApplyImageWatermark: Failed to read watermark image: %v", err)
+		return nil, fmt.Errorf("failed to read watermark image: %v", err)
 	}
 
-	// Decode the watermark image
-	watermarkImg, _, err := image.Decode(watermarkR)
-	if err != nil {
+	if err := s.drawLogoFrames(src.frames, watermarkData, opts); err != nil {
 		log.Printf("ApplyImageWatermark: Failed to decode watermark image: %v", err)
 		return nil, fmt.Errorf("failed to decode watermark image: %v", err)
 	}
-	log.Printf("ApplyImageWatermark: Watermark image decoded successfully")
 
-	// Create a new RGBA image
-	bounds := srcImg.Bounds()
-	result := image.NewRGBA(bounds)
-
-	// Draw the original image onto the result image
-	draw.Draw(result, bounds, srcImg, image.Point{}, draw.Src)
+	// Encode the result
+	var buf bytes.Buffer
+	if err := s.encode(&buf, src); err != nil {
+		return nil, fmt.Errorf("failed to encode result: %v", err)
+	}
 
-	// Resize the watermark image
-	watermarkBounds := watermarkImg.Bounds()
-	scaleFactor := float64(bounds.Dx()) * (watermarkSize / 100)
-	newWidth := int(float64(watermarkBounds.Dx()) * scaleFactor / float64(watermarkBounds.Dx()))
-	newHeight := int(float64(watermarkBounds.Dy()) * scaleFactor / float64(watermarkBounds.Dx()))
-	resizedWatermark := resize.Resize(uint(newWidth), uint(newHeight), watermarkImg, resize.Lanczos3)
+	log.Printf("ApplyImageWatermark: Watermark applied successfully")
+	return buf.Bytes(), nil
+}
 
-	// Create a new RGBA image for the whitewashed watermark
-	whitewashedWatermark := image.NewRGBA(resizedWatermark.Bounds())
+// drawLogoFrames prepares the logo in watermarkData at the size and colors
+// set by opts and draws it onto each frame.
+func (s *Service) drawLogoFrames(frames []*image.RGBA, watermarkData []byte, opts ImageOptions) error {
+	bounds := frames[0].Bounds()
+	resizedWatermark, err := loadLogo(watermarkData, int(float64(bounds.Dx())*(opts.WatermarkSize/100)), bounds.Size())
+	if err != nil {
+		return err
+	}
+	newWidth, newHeight := resizedWatermark.Bounds().Dx(), resizedWatermark.Bounds().Dy()
+	log.Printf("ApplyImageWatermark: Watermark prepared at %dx%d", newWidth, newHeight)
 
-	for y := 0; y < newHeight; y++ {
-		for x := 0; x < newWidth; x++ {
-			oldColor := resizedWatermark.At(x, y)
-			r, g, b, a := oldColor.RGBA()
+	// Apply the requested logo colors
+	logo := colorizeLogo(resizedWatermark, opts.LogoColorMode, parseColor(opts.TintColor))
 
-			// Calculate the luminance
-			luminance := 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+	// Calculate spacing based on the size of the watermark and the provided spacing value
+	spacingX := int((float64(newWidth) * opts.Spacing / 100) / 10)
+	spacingY := int((float64(newHeight) * opts.Spacing / 100) / 10)
+
+	// With auto contrast each tile uses either the logo or its inverse,
+	// whichever opposes the luminance of the region beneath it
+	threshold := s.contrastThreshold(opts.ContrastThreshold)
+	var logoIsLight bool
+	var invertedWatermark *image.RGBA
+	if opts.ColorMode == ContrastAuto {
+		logoIsLight = imageLuminance(logo) > threshold
+		invertedWatermark = invertImage(logo)
+	}
 
-			// Convert to white while preserving transparency and shading
-			whiteR := uint16(luminance)
-			whiteG := uint16(luminance)
-			whiteB := uint16(luminance)
+	for _, result := range frames {
+		// Later frames of an animation reuse the anchor of the first
+		opts.Position = s.drawLogo(result, logo, invertedWatermark, logoIsLight, spacingX, spacingY, opts)
+	}
+	return nil
+}
 
-			whitewashedWatermark.Set(x, y, color.NRGBA64{
-				R: whiteR,
-				G: whiteG,
-				B: whiteB,
-				A: uint16(float64(a) * opacity),
-			})
+// loadLogo decodes a bitmap or SVG logo at the given width, shrunk if need
+// be to fit within limit. SVG logos are rendered directly at that size;
+// bitmaps are resized in premultiplied space.
+func loadLogo(data []byte, width int, limit image.Point) (*image.RGBA, error) {
+	if isSVG(data) {
+		doc, err := parseSVG(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
 		}
+		size := logoSize(width, doc.aspect(), limit)
+		return doc.rasterize(size.X, size.Y), nil
 	}
 
-	// Calculate spacing based on the size of the watermark and the provided spacing value
-	spacingX := int((float64(newWidth) * spacing / 100) / 10)
-	spacingY := int((float64(newHeight) * spacing / 100) / 10)
-
-	// Apply repeated watermark
-	for y := bounds.Min.Y; y < bounds.Max.Y; y += newHeight + spacingY {
-		for x := bounds.Min.X; x < bounds.Max.X; x += newWidth + spacingX {
-			r := image.Rectangle{
-				Min: image.Point{X: x, Y: y},
-				Max: image.Point{X: x + newWidth, Y: y + newHeight},
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	size := logoSize(width, float64(b.Dy())/float64(b.Dx()), limit)
+	return toRGBA(resize.Resize(uint(size.X), uint(size.Y), toRGBA(img), resize.Lanczos3)), nil
+}
+
+// logoSize returns the pixel size of a logo width pixels wide whose height
+// is aspect times its width. The size is shrunk to fit within limit and is
+// at least one pixel each way, so that extreme dimensions in an SVG can
+// neither allocate more than the image nor produce an empty tile.
+func logoSize(width int, aspect float64, limit image.Point) image.Point {
+	if math.IsNaN(aspect) || aspect <= 0 {
+		aspect = 1
+	}
+	w := math.Min(math.Max(float64(width), 1), float64(limit.X))
+	h := w * aspect
+	if h > float64(limit.Y) {
+		h = float64(limit.Y)
+		w = h / aspect
+	}
+	return image.Pt(max(int(w), 1), max(int(h), 1))
+}
+
+// drawLogo draws the prepared logo watermark, and the footer if any, onto
+// one image or animation frame. It returns the anchor used for placed logos.
+func (s *Service) drawLogo(result, logo, invertedWatermark *image.RGBA, logoIsLight bool, spacingX, spacingY int, opts ImageOptions) Position {
+	bounds := result.Bounds()
+	newWidth, newHeight := logo.Bounds().Dx(), logo.Bounds().Dy()
+	threshold := s.contrastThreshold(opts.ContrastThreshold)
+
+	tileFor := func(r image.Rectangle) *image.RGBA {
+		switch opts.ColorMode {
+		case ContrastAuto:
+			_, luminance := regionStats(result, r)
+			if (luminance > threshold) == logoIsLight {
+				return invertedWatermark
 			}
-			draw.Draw(result, r, whitewashedWatermark, image.Point{}, draw.Over)
+		case ContrastInvert:
+			avg, luminance := regionStats(result, r)
+			return tintImage(logo, contrastColor(nil, ContrastInvert, threshold, avg, luminance))
 		}
+		return logo
 	}
 
-	// Add the bottom watermark text
-	addBottomWatermark(result, "watermark-generator.com", color.RGBA{R: 173, G: 216, B: 230, A: 255}, 0.5)
+	// Draw the watermark into its own layer, then blend it onto the image
+	layer := newLayer(result)
+	if isPlaced(opts.Position) {
+		size := image.Pt(newWidth, newHeight)
+		var r image.Rectangle
+		if opts.Position == PositionAuto {
+			luminance := -1.0
+			if opts.ColorMode == ContrastOff {
+				luminance = imageLuminance(logo)
+			}
+			opts.Position, r = autoPlacement(result, size, placementMargin(bounds), luminance)
+			log.Printf("ApplyImageWatermark: Auto placement chose %s", opts.Position)
+		} else {
+			r = anchorRect(opts.Position, bounds, size, placementMargin(bounds))
+		}
+		draw.Draw(layer, r, tileFor(r), image.Point{}, draw.Over)
+	} else if opts.Tiling.varied() {
+		size := image.Pt(newWidth, newHeight)
+		for _, t := range layoutTiles(bounds, float64(newWidth+spacingX), float64(newHeight+spacingY), opts.Tiling) {
+			drawTile(layer, tileFor(t.bounds(size)), t)
+		}
+	} else {
+		// Negative spacing may overlap tiles but must still move forward
+		stepX, stepY := max(newWidth+spacingX, 1), max(newHeight+spacingY, 1)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y += stepY {
+			for x := bounds.Min.X; x < bounds.Max.X; x += stepX {
+				r := image.Rectangle{
+					Min: image.Point{X: x, Y: y},
+					Max: image.Point{X: x + newWidth, Y: y + newHeight},
+				}
+				draw.Draw(layer, r, tileFor(r), image.Point{}, draw.Over)
+			}
+		}
+	}
+	blendLayer(result, layer, opts.BlendMode, opts.Opacity)
 
-	// Encode the result
-	var buf bytes.Buffer
-	if err := s.encodeImage(&buf, result, format); err != nil {
-		return nil, fmt.Errorf("failed to encode result: %v", err)
+	// Add the footer text when the account requires or asked for one
+	if opts.Footer != nil {
+		addBottomWatermark(result, s.fontsFor(opts.Footer.Font), opts.Footer)
 	}
+	return opts.Position
+}
 
-	log.Printf("ApplyImageWatermark: Watermark applied successfully")
-	return buf.Bytes(), nil
+// FooterOptions describes the line of text drawn along the top or bottom
+// edge of an image, e.g. the site credit shown on free accounts.
+type FooterOptions struct {
+	Text    string
+	Color   string
+	Opacity float64
+	// Position is one of bottom-left, bottom-center, bottom-right,
+	// top-left, top-center or top-right.
+	Position string
+	FontSize float64
+	// Font is a bundled font name; see FontNames.
+	Font string
+}
+
+// DefaultFooter is the credit line added to images from free accounts.
+func DefaultFooter() *FooterOptions {
+	return &FooterOptions{
+		Text:     "watermark-generator.com",
+		Color:    "#add8e6",
+		Opacity:  0.5,
+		Position: "bottom-left",
+		FontSize: 20,
+		Font:     "bold",
+	}
 }
 
-func addBottomWatermark(img *image.RGBA, text string, textColor color.Color, opacity float64) {
+func addBottomWatermark(img *image.RGBA, fonts *FontChain, footer *FooterOptions) {
 	bounds := img.Bounds()
-	watermarkHeight := 30 // Height of the watermark text area
+	fontSize := footer.FontSize
+	if fontSize <= 0 {
+		fontSize = 20
+	}
+	watermarkHeight := int(fontSize * 1.5) // Height of the watermark text area
+	margin := int(fontSize / 2)
 
 	// Create a new RGBA image for the watermark text
 	watermarkImg := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), watermarkHeight))
 
-	// Set the background to transparent
-	for y := 0; y < watermarkHeight; y++ {
-		for x := 0; x < bounds.Dx(); x++ {
-			watermarkImg.Set(x, y, color.RGBA{0, 0, 0, 0})
-		}
+	face := fonts.Face(fontSize)
+	defer face.Close()
+	text := shapeText(footer.Text)
+
+	// Align the text horizontally within the band
+	x := margin
+	width := font.MeasureString(face, text).Ceil()
+	switch {
+	case strings.HasSuffix(footer.Position, "-center"):
+		x = (bounds.Dx() - width) / 2
+	case strings.HasSuffix(footer.Position, "-right"):
+		x = bounds.Dx() - width - margin
 	}
 
 	// Draw the text onto the watermark image
-	drawText(watermarkImg, text, textColor, opacity, 10, 20)
-
-	// Draw the watermark image onto the result image
-	draw.Draw(img, image.Rect(0, bounds.Dy()-watermarkHeight, bounds.Dx(), bounds.Dy()), watermarkImg, image.Point{}, draw.Over)
-}
+	drawText(watermarkImg, face, text, parseColor(footer.Color), footer.Opacity, x, int(fontSize))
 
-func drawText(img *image.RGBA, text string, textColor color.Color, opacity float64, x, y int) {
-	f, err := truetype.Parse(gobold.TTF)
-	if err != nil {
-		log.Printf("drawText: Failed to parse font: %v", err)
-		return
+	// Draw the watermark image onto the top or bottom of the result image
+	y := bounds.Max.Y - watermarkHeight
+	if strings.HasPrefix(footer.Position, "top-") {
+		y = bounds.Min.Y
 	}
+	draw.Draw(img, image.Rect(bounds.Min.X, y, bounds.Max.X, y+watermarkHeight), watermarkImg, image.Point{}, draw.Over)
+}
 
-	face := truetype.NewFace(f, &truetype.Options{
-		Size: 20,
-		DPI:  72,
-	})
-
+func drawText(img *image.RGBA, face font.Face, text string, textColor color.Color, opacity float64, x, y int) {
 	d := &font.Drawer{
 		Dst:  img,
 		Src:  image.NewUniform(applyOpacity(textColor, opacity)),
@@ -342,3 +618,12 @@ func drawText(img *image.RGBA, text string, textColor color.Color, opacity float
 
 	d.DrawString(text)
 }
+
+// fontsFor returns the service font chain with the named bundled font as
+// primary, or the default chain when name is empty or unknown.
+func (s *Service) fontsFor(name string) *FontChain {
+	if name == "" || name == "bold" {
+		return s.Fonts
+	}
+	return s.Fonts.WithPrimary(name)
+}
@@ -0,0 +1,56 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font/gofont/gobold"
+)
+
+func TestAddBottomWatermarkPosition(t *testing.T) {
+	primary, err := truetype.Parse(gobold.TTF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fonts := NewFontChain(primary)
+
+	inked := func(img *image.RGBA, r image.Rectangle) bool {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if img.RGBAAt(x, y) != (color.RGBA{0, 0, 0, 255}) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		position   string
+		inked, not image.Rectangle
+	}{
+		{"bottom-left", image.Rect(0, 170, 100, 200), image.Rect(0, 0, 300, 30)},
+		{"top-right", image.Rect(200, 0, 300, 30), image.Rect(0, 170, 300, 200)},
+	}
+	for _, tt := range tests {
+		img := image.NewRGBA(image.Rect(0, 0, 300, 200))
+		draw.Draw(img, img.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+
+		footer := DefaultFooter()
+		footer.Text = "footer"
+		footer.Color = "#ffffff"
+		footer.Opacity = 1
+		footer.Position = tt.position
+		addBottomWatermark(img, fonts, footer)
+
+		if !inked(img, tt.inked) {
+			t.Errorf("%s: no footer drawn in %v", tt.position, tt.inked)
+		}
+		if inked(img, tt.not) {
+			t.Errorf("%s: footer drawn in %v", tt.position, tt.not)
+		}
+	}
+}
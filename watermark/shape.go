@@ -0,0 +1,297 @@
+package watermark
+
+import (
+	"golang.org/x/text/unicode/bidi"
+)
+
+// shapeText prepares a single line of text for drawing with a font.Drawer,
+// which places glyphs strictly left to right: Arabic letters are replaced by
+// their contextual presentation forms and right-to-left runs are reordered
+// into visual order.
+func shapeText(s string) string {
+	if !hasRTL(s) {
+		return s
+	}
+	return visualOrder(shapeArabic(s))
+}
+
+func hasRTL(s string) bool {
+	for _, r := range s {
+		if isRTL(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func isRTL(r rune) bool {
+	props, _ := bidi.LookupRune(r)
+	class := props.Class()
+	return class == bidi.R || class == bidi.AL
+}
+
+// visualOrder reorders a logically ordered line for left-to-right drawing.
+// Only embedding levels up to two are handled (e.g. numbers inside Arabic
+// text inside a Latin sentence), which covers watermark-length text.
+func visualOrder(s string) string {
+	var p bidi.Paragraph
+	if _, err := p.SetString(s); err != nil {
+		return s
+	}
+	ordering, err := p.Order()
+	if err != nil {
+		return s
+	}
+
+	runs := make([]bidi.Run, ordering.NumRuns())
+	for i := range runs {
+		runs[i] = ordering.Run(i)
+	}
+
+	var out []rune
+	if paragraphIsRTL(s) {
+		for i := len(runs) - 1; i >= 0; i-- {
+			out = appendRun(out, runs[i])
+		}
+		return string(out)
+	}
+
+	for i := 0; i < len(runs); i++ {
+		if runs[i].Direction() != bidi.RightToLeft {
+			out = appendRun(out, runs[i])
+			continue
+		}
+		// Numbers between two right-to-left runs belong to the same
+		// embedding, so the whole group is reversed together.
+		j := i
+		for j+2 < len(runs) && !hasStrongLTR(runs[j+1].String()) && runs[j+2].Direction() == bidi.RightToLeft {
+			j += 2
+		}
+		for k := j; k >= i; k-- {
+			out = appendRun(out, runs[k])
+		}
+		i = j
+	}
+	return string(out)
+}
+
+func appendRun(out []rune, run bidi.Run) []rune {
+	runes := []rune(run.String())
+	if run.Direction() != bidi.RightToLeft {
+		return append(out, runes...)
+	}
+	for i := len(runes) - 1; i >= 0; i-- {
+		out = append(out, mirrorRune(runes[i]))
+	}
+	return out
+}
+
+func paragraphIsRTL(s string) bool {
+	for _, r := range s {
+		props, _ := bidi.LookupRune(r)
+		switch props.Class() {
+		case bidi.L:
+			return false
+		case bidi.R, bidi.AL:
+			return true
+		}
+	}
+	return false
+}
+
+func hasStrongLTR(s string) bool {
+	for _, r := range s {
+		props, _ := bidi.LookupRune(r)
+		if props.Class() == bidi.L {
+			return true
+		}
+	}
+	return false
+}
+
+var mirroredRunes = map[rune]rune{
+	'(': ')', ')': '(',
+	'[': ']', ']': '[',
+	'{': '}', '}': '{',
+	'<': '>', '>': '<',
+	'«': '»', '»': '«',
+}
+
+func mirrorRune(r rune) rune {
+	if m, ok := mirroredRunes[r]; ok {
+		return m
+	}
+	return r
+}
+
+// arabicForms lists the presentation forms of an Arabic letter in the order
+// isolated, final, initial, medial. Letters that only join to the right have
+// no initial or medial form.
+type arabicForms [4]rune
+
+const (
+	formIsolated = iota
+	formFinal
+	formInitial
+	formMedial
+)
+
+func (f arabicForms) joinsBoth() bool {
+	return f[formInitial] != 0
+}
+
+var arabicLetters = map[rune]arabicForms{
+	0x0621: {0xFE80, 0, 0, 0},
+	0x0622: {0xFE81, 0xFE82, 0, 0},
+	0x0623: {0xFE83, 0xFE84, 0, 0},
+	0x0624: {0xFE85, 0xFE86, 0, 0},
+	0x0625: {0xFE87, 0xFE88, 0, 0},
+	0x0626: {0xFE89, 0xFE8A, 0xFE8B, 0xFE8C},
+	0x0627: {0xFE8D, 0xFE8E, 0, 0},
+	0x0628: {0xFE8F, 0xFE90, 0xFE91, 0xFE92},
+	0x0629: {0xFE93, 0xFE94, 0, 0},
+	0x062A: {0xFE95, 0xFE96, 0xFE97, 0xFE98},
+	0x062B: {0xFE99, 0xFE9A, 0xFE9B, 0xFE9C},
+	0x062C: {0xFE9D, 0xFE9E, 0xFE9F, 0xFEA0},
+	0x062D: {0xFEA1, 0xFEA2, 0xFEA3, 0xFEA4},
+	0x062E: {0xFEA5, 0xFEA6, 0xFEA7, 0xFEA8},
+	0x062F: {0xFEA9, 0xFEAA, 0, 0},
+	0x0630: {0xFEAB, 0xFEAC, 0, 0},
+	0x0631: {0xFEAD, 0xFEAE, 0, 0},
+	0x0632: {0xFEAF, 0xFEB0, 0, 0},
+	0x0633: {0xFEB1, 0xFEB2, 0xFEB3, 0xFEB4},
+	0x0634: {0xFEB5, 0xFEB6, 0xFEB7, 0xFEB8},
+	0x0635: {0xFEB9, 0xFEBA, 0xFEBB, 0xFEBC},
+	0x0636: {0xFEBD, 0xFEBE, 0xFEBF, 0xFEC0},
+	0x0637: {0xFEC1, 0xFEC2, 0xFEC3, 0xFEC4},
+	0x0638: {0xFEC5, 0xFEC6, 0xFEC7, 0xFEC8},
+	0x0639: {0xFEC9, 0xFECA, 0xFECB, 0xFECC},
+	0x063A: {0xFECD, 0xFECE, 0xFECF, 0xFED0},
+	0x0641: {0xFED1, 0xFED2, 0xFED3, 0xFED4},
+	0x0642: {0xFED5, 0xFED6, 0xFED7, 0xFED8},
+	0x0643: {0xFED9, 0xFEDA, 0xFEDB, 0xFEDC},
+	0x0644: {0xFEDD, 0xFEDE, 0xFEDF, 0xFEE0},
+	0x0645: {0xFEE1, 0xFEE2, 0xFEE3, 0xFEE4},
+	0x0646: {0xFEE5, 0xFEE6, 0xFEE7, 0xFEE8},
+	0x0647: {0xFEE9, 0xFEEA, 0xFEEB, 0xFEEC},
+	0x0648: {0xFEED, 0xFEEE, 0, 0},
+	0x0649: {0xFEEF, 0xFEF0, 0, 0},
+	0x064A: {0xFEF1, 0xFEF2, 0xFEF3, 0xFEF4},
+	// Persian and Urdu letters from Presentation Forms-A
+	0x067E: {0xFB56, 0xFB57, 0xFB58, 0xFB59},
+	0x0686: {0xFB7A, 0xFB7B, 0xFB7C, 0xFB7D},
+	0x0698: {0xFB8A, 0xFB8B, 0, 0},
+	0x06A9: {0xFB8E, 0xFB8F, 0xFB90, 0xFB91},
+	0x06AF: {0xFB92, 0xFB93, 0xFB94, 0xFB95},
+	0x06CC: {0xFBFC, 0xFBFD, 0xFBFE, 0xFBFF},
+}
+
+// lamAlef maps the alef following a lam to the isolated and final forms of
+// the mandatory lam-alef ligature.
+var lamAlef = map[rune][2]rune{
+	0x0622: {0xFEF5, 0xFEF6},
+	0x0623: {0xFEF7, 0xFEF8},
+	0x0625: {0xFEF9, 0xFEFA},
+	0x0627: {0xFEFB, 0xFEFC},
+}
+
+const (
+	arabicLam     = 0x0644
+	arabicTatweel = 0x0640
+)
+
+// isArabicTransparent reports whether r is a combining mark that does not
+// break the joining of the letters around it.
+func isArabicTransparent(r rune) bool {
+	return (r >= 0x064B && r <= 0x065F) || r == 0x0670
+}
+
+// joinsNext reports whether r connects to the letter after it.
+func joinsNext(r rune) bool {
+	if r == arabicTatweel {
+		return true
+	}
+	forms, ok := arabicLetters[r]
+	return ok && forms.joinsBoth()
+}
+
+// joinsPrev reports whether r connects to the letter before it.
+func joinsPrev(r rune) bool {
+	if r == arabicTatweel {
+		return true
+	}
+	forms, ok := arabicLetters[r]
+	return ok && forms[formFinal] != 0
+}
+
+// shapeArabic replaces Arabic letters, still in logical order, with the
+// presentation form matching their position in a word.
+func shapeArabic(s string) string {
+	runes := []rune(s)
+	out := make([]rune, 0, len(runes))
+
+	// neighbour finds the closest non-transparent rune in direction step.
+	neighbour := func(i, step int) rune {
+		for j := i + step; j >= 0 && j < len(runes); j += step {
+			if !isArabicTransparent(runes[j]) {
+				return runes[j]
+			}
+		}
+		return 0
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		forms, ok := arabicLetters[r]
+		if !ok {
+			out = append(out, r)
+			continue
+		}
+
+		prevJoins := joinsNext(neighbour(i, -1)) && joinsPrev(r)
+
+		if r == arabicLam {
+			if j := nextLetter(runes, i); j >= 0 {
+				if lig, ok := lamAlef[runes[j]]; ok {
+					if prevJoins {
+						out = append(out, lig[1])
+					} else {
+						out = append(out, lig[0])
+					}
+					// Keep any marks between the lam and the alef
+					out = append(out, runes[i+1:j]...)
+					i = j
+					continue
+				}
+			}
+		}
+
+		nextJoins := joinsNext(r) && joinsPrev(neighbour(i, 1))
+
+		form := formIsolated
+		switch {
+		case prevJoins && nextJoins:
+			form = formMedial
+		case prevJoins:
+			form = formFinal
+		case nextJoins:
+			form = formInitial
+		}
+		if forms[form] == 0 {
+			form = formIsolated
+		}
+		out = append(out, forms[form])
+	}
+	return string(out)
+}
+
+// nextLetter returns the index of the first non-transparent rune after i, or
+// -1 if there is none.
+func nextLetter(runes []rune, i int) int {
+	for j := i + 1; j < len(runes); j++ {
+		if !isArabicTransparent(runes[j]) {
+			return j
+		}
+	}
+	return -1
+}
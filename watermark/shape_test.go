@@ -0,0 +1,162 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/math/fixed"
+)
+
+func TestShapeArabic(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		// seen (initial) + lam-alef (final ligature) + meem (isolated)
+		{"salam", "سلام", "ﺳﻼﻡ"},
+		// beh (initial), teh (medial), beh (final)
+		{"joining", "ببب", "ﺑﺒﺐ"},
+		// alef only joins to the right, so the following beh starts a new shape
+		{"right joining", "اب", "ﺍﺏ"},
+		// harakat do not break joining
+		{"transparent marks", "بَب", "ﺑَﺐ"},
+		{"latin untouched", "abc", "abc"},
+	}
+
+	for _, tt := range tests {
+		if got := shapeArabic(tt.in); got != tt.want {
+			t.Errorf("%s: shapeArabic(%q) = %U, want %U", tt.name, tt.in, []rune(got), []rune(tt.want))
+		}
+	}
+}
+
+func TestVisualOrder(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"hello", "hello"},
+		{"abc שלום def", "abc םולש def"},
+		{"שלום", "םולש"},
+		// numbers keep their order inside right-to-left text
+		{"שנה 2024", "2024 הנש"},
+		{"(שלום)", "(םולש)"},
+	}
+
+	for _, tt := range tests {
+		if got := visualOrder(tt.in); got != tt.want {
+			t.Errorf("visualOrder(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFontChainFallback(t *testing.T) {
+	chain, err := DefaultFontChain()
+	if err != nil {
+		t.Fatalf("DefaultFontChain: %v", err)
+	}
+
+	tests := []struct {
+		r    rune
+		want int
+	}{
+		{'A', 0},
+		{'ש', 1},
+		{0xFEB3, 1},
+	}
+	for _, tt := range tests {
+		if got := chain.index(tt.r); got != tt.want {
+			t.Errorf("index(%q) = %d, want %d", tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestBundledFontsCoverHangul(t *testing.T) {
+	t.Setenv("WATERMARK_FONT_DIR", "")
+	chain, err := DefaultFontChain()
+	if err != nil {
+		t.Fatalf("DefaultFontChain: %v", err)
+	}
+
+	// Korean needs no installed fonts; ideographs and emoji are documented
+	// as coming from WATERMARK_FONT_DIR
+	for _, r := range "한국어가힣ㄱ" {
+		if chain.fonts[chain.index(r)].Index(r) == 0 {
+			t.Errorf("no bundled font covers %q", r)
+		}
+	}
+}
+
+func TestFontDirIsSearchedRecursively(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "truetype", "dejavu")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	data, err := bundledFallbacks.ReadFile("fonts/DejaVuSans-Bold.ttf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string][]byte{"DejaVuSans-Bold.ttf": data, "NotoSansCJK.otf": data, "broken.ttf": []byte("not a font")} {
+		if err := os.WriteFile(filepath.Join(sub, name), content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv("WATERMARK_FONT_DIR", dir)
+	chain, err := DefaultFontChain()
+	if err != nil {
+		t.Fatalf("DefaultFontChain: %v", err)
+	}
+	// gobold, the bundled DejaVu and Nanum, and the installed copy; the .otf
+	// and the unparseable file are left out
+	if len(chain.fonts) != 4 {
+		t.Errorf("chain has %d fonts, want 4", len(chain.fonts))
+	}
+}
+
+func TestFallbackFaceDrawsArabic(t *testing.T) {
+	primary, err := truetype.Parse(gobold.TTF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	draw := func(chain *FontChain) int {
+		img := image.NewRGBA(image.Rect(0, 0, 200, 60))
+		face := chain.Face(32)
+		defer face.Close()
+		d := &font.Drawer{
+			Dst:  img,
+			Src:  image.NewUniform(color.Black),
+			Face: face,
+			Dot:  fixed.P(10, 40),
+		}
+		d.DrawString(shapeText("سلام"))
+
+		// Count inked pixels; gobold alone draws tofu boxes instead
+		inked := 0
+		for i := 3; i < len(img.Pix); i += 4 {
+			if img.Pix[i] != 0 {
+				inked++
+			}
+		}
+		return inked
+	}
+
+	withFallback, err := DefaultFontChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gobOnly := NewFontChain(primary)
+
+	if a, b := draw(withFallback), draw(gobOnly); a == b {
+		t.Errorf("fallback chain drew the same %d pixels as gobold alone", a)
+	}
+}
@@ -0,0 +1,83 @@
+package watermark
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"golang.org/x/image/font"
+)
+
+// SizeMode selects how TextOptions.FontSize is interpreted, so that one
+// setting gives consistent results across images of different sizes.
+type SizeMode string
+
+const (
+	// SizeAbsolute treats FontSize as a size in points. This is the default.
+	SizeAbsolute SizeMode = "absolute"
+	// SizeWidth treats FontSize as a percentage of the image width.
+	SizeWidth SizeMode = "width"
+	// SizeShortSide treats FontSize as a percentage of the image's shorter side.
+	SizeShortSide SizeMode = "short"
+	// SizeFit scales the text so that its widest line spans FontSize percent
+	// of the image width, like WatermarkSize does for logos.
+	SizeFit SizeMode = "fit"
+)
+
+// minFontSize and maxFontSize bound the point size of every mode, keeping
+// tiny thumbnails legible and huge images tractable.
+const (
+	minFontSize = 6
+	maxFontSize = 2000
+)
+
+// ParseSizeMode converts a form value into a SizeMode, defaulting to absolute.
+func ParseSizeMode(s string) SizeMode {
+	switch mode := SizeMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case SizeWidth, SizeShortSide, SizeFit:
+		return mode
+	default:
+		return SizeAbsolute
+	}
+}
+
+// fontSizeFor returns the point size to draw text at on an image with the
+// given bounds.
+func (s *Service) fontSizeFor(opts TextOptions, bounds image.Rectangle) float64 {
+	var size float64
+	switch opts.SizeMode {
+	case SizeWidth:
+		size = float64(bounds.Dx()) * opts.FontSize / 100
+	case SizeShortSide:
+		size = math.Min(float64(bounds.Dx()), float64(bounds.Dy())) * opts.FontSize / 100
+	case SizeFit:
+		// Glyph advances scale linearly with the point size, so measure once
+		// at a reference size and scale to the target width
+		const reference = 100
+		face := s.Fonts.Face(reference)
+		width := layoutText(face, opts.Text, opts.LineHeight, opts.Align).width
+		face.Close()
+		target := float64(bounds.Dx()) * opts.FontSize / 100
+		if width <= 0 {
+			// Nothing to measure, such as empty text: size it as SizeWidth
+			// would rather than reading the percentage as points
+			size = target
+			break
+		}
+		size = reference * target / (float64(width) / 64)
+	default:
+		size = opts.FontSize
+	}
+	return math.Max(minFontSize, math.Min(maxFontSize, size))
+}
+
+// textGap returns the space between repeated copies of a text block:
+// spacing percent of the height of one line as drawn with face. Negative
+// spacing is treated as none, so copies touch but never step backwards.
+func textGap(face font.Face, spacing float64) int {
+	if spacing <= 0 {
+		return 0
+	}
+	m := face.Metrics()
+	return int(math.Round(float64(m.Ascent+m.Descent) / 64 * spacing / 100))
+}
@@ -0,0 +1,92 @@
+package watermark
+
+import (
+	"image"
+	"math"
+	"testing"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font/gofont/gobold"
+)
+
+func TestFontSizeFor(t *testing.T) {
+	primary, err := truetype.Parse(gobold.TTF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{Fonts: NewFontChain(primary)}
+	bounds := image.Rect(0, 0, 2000, 1000)
+
+	tests := []struct {
+		mode SizeMode
+		size float64
+		want float64
+	}{
+		{SizeAbsolute, 32, 32},
+		{SizeAbsolute, 1, minFontSize},
+		{SizeAbsolute, 1e6, maxFontSize},
+		{SizeWidth, 500, maxFontSize},
+		{SizeWidth, 5, 100},
+		{SizeShortSide, 5, 50},
+		{SizeShortSide, 0.01, minFontSize},
+	}
+	for _, tt := range tests {
+		opts := TextOptions{Text: "Sample", FontSize: tt.size, SizeMode: tt.mode}
+		if got := s.fontSizeFor(opts, bounds); got != tt.want {
+			t.Errorf("fontSizeFor(%s, %v) = %v, want %v", tt.mode, tt.size, got, tt.want)
+		}
+	}
+
+	// Empty text has no width to fit, so it is sized against the image width
+	// instead of treating the percentage as points
+	for _, text := range []string{"", "\n"} {
+		opts := TextOptions{Text: text, FontSize: 5, SizeMode: SizeFit}
+		if got := s.fontSizeFor(opts, bounds); got != 100 {
+			t.Errorf("fontSizeFor(fit, %q) = %v, want 100", text, got)
+		}
+	}
+
+	// Fit-to-width should make the widest line span the requested share of
+	// the image, whatever the image size
+	for _, width := range []int{400, 6000} {
+		opts := TextOptions{Text: "Short\nA longer line", FontSize: 50, SizeMode: SizeFit, LineHeight: 1}
+		size := s.fontSizeFor(opts, image.Rect(0, 0, width, width))
+		face := s.Fonts.Face(size)
+		got := float64(layoutText(face, opts.Text, 1, AlignLeft).width) / 64
+		face.Close()
+		if want := float64(width) / 2; math.Abs(got-want) > want*0.03 {
+			t.Errorf("fit on %dpx: text is %.1fpx wide, want about %.1fpx", width, got, want)
+		}
+	}
+}
+
+func TestParseSizeMode(t *testing.T) {
+	if got := ParseSizeMode("Fit"); got != SizeFit {
+		t.Errorf("ParseSizeMode(Fit) = %q", got)
+	}
+	if got := ParseSizeMode("percent"); got != SizeAbsolute {
+		t.Errorf("ParseSizeMode(percent) = %q, want absolute", got)
+	}
+}
+
+func TestRepeatedWatermarkNegativeSpacing(t *testing.T) {
+	primary, err := truetype.Parse(gobold.TTF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{Fonts: NewFontChain(primary)}
+	face := s.Fonts.Face(32)
+	defer face.Close()
+	if gap := textGap(face, -500); gap != 0 {
+		t.Errorf("textGap(-500) = %d, want 0", gap)
+	}
+
+	// A gap larger than the text used to step backwards and never finish
+	for _, text := range []string{"Sample", " "} {
+		img := image.NewRGBA(image.Rect(0, 0, 120, 80))
+		opts := TextOptions{Text: text, Color: "#ffffff", Opacity: 0.5, FontSize: 32, Spacing: -500}
+		if err := s.applyRepeatedWatermark(img, opts); err != nil {
+			t.Fatalf("%q: %v", text, err)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package watermark
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Source is a decoded upload that can be watermarked any number of times;
+// every call draws on a copy of its frames.
+type Source struct {
+	src  *source
+	exif map[string]string
+}
+
+// DecodeSource decodes an image or animated GIF for repeated watermarking.
+func DecodeSource(data []byte) (*Source, error) {
+	src, err := decodeSource(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Source{src: src, exif: readExif(data)}, nil
+}
+
+// Bounds returns the size of the image or animation canvas.
+func (s *Source) Bounds() image.Rectangle {
+	return s.src.bounds()
+}
+
+// Size returns the memory held by the decoded frames in bytes.
+func (s *Source) Size() int {
+	size := 0
+	for _, frame := range s.src.frames {
+		size += len(frame.Pix)
+	}
+	return size
+}
+
+// copy returns a source whose frames can be drawn on without changing s.
+func (s *Source) copy() *source {
+	out := *s.src
+	out.frames = make([]*image.RGBA, len(s.src.frames))
+	for i, frame := range s.src.frames {
+		out.frames[i] = cloneRGBA(frame)
+	}
+	return &out
+}
+
+// ErrSourceNotFound is returned for source IDs that were never stored or
+// have expired.
+var ErrSourceNotFound = errors.New("source not found or expired")
+
+// SourceStore keeps uploaded images so that several requests can watermark
+// the same source without uploading it again. The uploaded bytes are kept on
+// disk until TTL has passed since the last upload, under an ID derived from
+// their SHA-256. Decoded sources and their previews are cached in memory,
+// dropping the least recently used once their total size exceeds the byte
+// budget, and dropped with the upload when it expires.
+type SourceStore struct {
+	dir    string
+	TTL    time.Duration
+	budget int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	used    int
+}
+
+// storeEntry is a cached source or preview. key is the source ID for
+// sources and the ID and preview size for previews.
+type storeEntry struct {
+	key     string
+	id      string
+	src     *Source
+	preview *Preview
+	size    int
+}
+
+// NewSourceStore returns a store that writes uploads to dir and caches up to
+// budget bytes of decoded images.
+func NewSourceStore(dir string, ttl time.Duration, budget int) (*SourceStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create source directory: %v", err)
+	}
+	return &SourceStore{
+		dir:     dir,
+		TTL:     ttl,
+		budget:  budget,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}, nil
+}
+
+// SourceID returns the ID under which data is stored.
+func SourceID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Put decodes and stores data, returning its ID. Storing the same bytes
+// again returns the same ID and restarts its TTL.
+func (st *SourceStore) Put(data []byte) (string, error) {
+	st.removeExpired()
+
+	src, err := DecodeSource(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode source image: %v", err)
+	}
+	id := SourceID(data)
+	if err := os.WriteFile(st.path(id), data, 0o600); err != nil {
+		return "", fmt.Errorf("failed to store source image: %v", err)
+	}
+	st.cache(&storeEntry{key: id, id: id, src: src, size: src.Size()})
+	return id, nil
+}
+
+// Get returns the decoded source stored under id, decoding it again if it
+// has been dropped from memory.
+func (st *SourceStore) Get(id string) (*Source, error) {
+	if !st.stored(id) {
+		return nil, ErrSourceNotFound
+	}
+	if entry, ok := st.lookup(id); ok {
+		return entry.src, nil
+	}
+
+	data, err := os.ReadFile(st.path(id))
+	if err != nil {
+		return nil, ErrSourceNotFound
+	}
+	src, err := DecodeSource(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode source image: %v", err)
+	}
+	st.cache(&storeEntry{key: id, id: id, src: src, size: src.Size()})
+	return src, nil
+}
+
+// Preview returns the source stored under id downsampled as by
+// Source.Preview. Previews are cached with the decoded sources and share
+// their budget.
+func (st *SourceStore) Preview(id string, maxSize int) (*Preview, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultPreviewSize
+	}
+	if !st.stored(id) {
+		return nil, ErrSourceNotFound
+	}
+	key := id + ":" + strconv.Itoa(maxSize)
+	if entry, ok := st.lookup(key); ok {
+		return entry.preview, nil
+	}
+
+	src, err := st.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	p := src.Preview(maxSize)
+	st.cache(&storeEntry{key: key, id: id, preview: p, size: p.Size()})
+	return p, nil
+}
+
+// stored reports whether an unexpired upload is stored under id, dropping
+// what is cached for it otherwise.
+func (st *SourceStore) stored(id string) bool {
+	if !validSourceID(id) {
+		return false
+	}
+	info, err := os.Stat(st.path(id))
+	if err != nil || st.expired(info) {
+		st.forget(id)
+		return false
+	}
+	return true
+}
+
+// lookup returns the cached entry for key, marking it recently used.
+func (st *SourceStore) lookup(key string) (*storeEntry, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	el, ok := st.entries[key]
+	if !ok {
+		return nil, false
+	}
+	st.order.MoveToFront(el)
+	return el.Value.(*storeEntry), true
+}
+
+// cache adds entry to the cached sources and previews, evicting the least
+// recently used ones to stay within the budget. Entries larger than the
+// whole budget are not cached.
+func (st *SourceStore) cache(entry *storeEntry) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if el, ok := st.entries[entry.key]; ok {
+		st.order.MoveToFront(el)
+		return
+	}
+	if entry.size > st.budget {
+		return
+	}
+	st.entries[entry.key] = st.order.PushFront(entry)
+	st.used += entry.size
+	for st.used > st.budget {
+		st.removeElement(st.order.Back())
+	}
+}
+
+// forget drops the source stored under id and its previews from memory.
+func (st *SourceStore) forget(id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for el := st.order.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*storeEntry).id == id {
+			st.removeElement(el)
+		}
+		el = next
+	}
+}
+
+func (st *SourceStore) removeElement(el *list.Element) {
+	entry := el.Value.(*storeEntry)
+	st.order.Remove(el)
+	delete(st.entries, entry.key)
+	st.used -= entry.size
+}
+
+// removeExpired deletes stored uploads whose TTL has passed.
+func (st *SourceStore) removeExpired() {
+	files, err := os.ReadDir(st.dir)
+	if err != nil {
+		log.Printf("removeExpired: Failed to list sources: %v", err)
+		return
+	}
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil || !validSourceID(file.Name()) || !st.expired(info) {
+			continue
+		}
+		st.forget(file.Name())
+		if err := os.Remove(st.path(file.Name())); err != nil && !os.IsNotExist(err) {
+			log.Printf("removeExpired: Failed to remove source %s: %v", file.Name(), err)
+		}
+	}
+}
+
+func (st *SourceStore) expired(info os.FileInfo) bool {
+	return time.Since(info.ModTime()) > st.TTL
+}
+
+func (st *SourceStore) path(id string) string {
+	return filepath.Join(st.dir, id)
+}
+
+// validSourceID reports whether id looks like a SHA-256 hex digest, so that
+// it can be used as a file name.
+func validSourceID(id string) bool {
+	if len(id) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,133 @@
+package watermark
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSourceStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	// Room for two decoded 10x10 images
+	st, err := NewSourceStore(t.TempDir(), time.Hour, 2*10*10*4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, h := range []int{10, 9, 8} {
+		id, err := st.Put(testPNG(t, 10, h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if again, _ := st.Put(testPNG(t, 10, 10)); again != ids[0] {
+		t.Errorf("same bytes stored as %s and %s", ids[0], again)
+	}
+
+	if _, ok := st.entries[ids[0]]; !ok {
+		t.Error("recently stored source was evicted")
+	}
+	if _, ok := st.entries[ids[1]]; ok {
+		t.Error("least recently used source is still cached")
+	}
+	if st.used > st.budget {
+		t.Errorf("cache holds %d bytes, over its budget of %d", st.used, st.budget)
+	}
+
+	// Evicted sources are decoded again from disk
+	src, err := st.Get(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.Bounds().Dy() != 9 {
+		t.Errorf("got a %v source, want 10x9", src.Bounds())
+	}
+}
+
+func TestSourceStoreExpiry(t *testing.T) {
+	dir := t.TempDir()
+	st, err := NewSourceStore(dir, time.Minute, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := st.Put(testPNG(t, 4, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Get(id); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(filepath.Join(dir, id), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Get(id); err != ErrSourceNotFound {
+		t.Errorf("expired source: got %v, want ErrSourceNotFound", err)
+	}
+
+	// Expired uploads are removed from disk by the next upload
+	if _, err := st.Put(testPNG(t, 5, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, id)); !os.IsNotExist(err) {
+		t.Errorf("expired upload still on disk: %v", err)
+	}
+
+	if _, err := st.Get("../" + id[3:]); err != ErrSourceNotFound {
+		t.Errorf("malformed ID: got %v, want ErrSourceNotFound", err)
+	}
+}
+
+func TestSourceStorePreviews(t *testing.T) {
+	dir := t.TempDir()
+	// Room for the 100x100 source and one 50px preview, not two
+	st, err := NewSourceStore(dir, time.Minute, 100*100*4+50*50*4+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := st.Put(testPNG(t, 100, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := st.Preview(id, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := st.Preview(id, 50); again != p {
+		t.Error("preview was not cached")
+	}
+	if _, err := st.Preview(id, 40); err != nil {
+		t.Fatal(err)
+	}
+	if st.used > st.budget {
+		t.Errorf("cache holds %d bytes, over its budget of %d", st.used, st.budget)
+	}
+
+	// Previews go with their source when the upload expires
+	old := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(filepath.Join(dir, id), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Preview(id, 50); err != ErrSourceNotFound {
+		t.Errorf("expired source: got %v, want ErrSourceNotFound", err)
+	}
+	if len(st.entries) != 0 || st.used != 0 {
+		t.Errorf("%d entries of %d bytes cached after expiry, want none", len(st.entries), st.used)
+	}
+}
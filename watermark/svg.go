@@ -0,0 +1,1332 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/colornames"
+	"golang.org/x/image/vector"
+)
+
+// The SVG support here covers what logos exported from design tools use:
+// paths, the basic shapes, groups with transforms, solid fills and strokes,
+// opacity and the root viewBox. Gradients, patterns, text, <use>, masks,
+// clipping and dashes are not rendered; a url() paint falls back to its
+// fallback color if one is given and is skipped otherwise.
+
+// isSVG reports whether data looks like an SVG document rather than one of
+// the raster formats image.Decode understands.
+func isSVG(data []byte) bool {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	data = bytes.TrimLeft(data, " \t\r\n")
+	if len(data) == 0 || data[0] != '<' {
+		return false
+	}
+	head := data
+	if len(head) > 4096 {
+		head = head[:4096]
+	}
+	return bytes.Contains(head, []byte("<svg"))
+}
+
+// svgPoint is a point in user or device space.
+type svgPoint struct{ X, Y float64 }
+
+func (p svgPoint) add(q svgPoint) svgPoint { return svgPoint{p.X + q.X, p.Y + q.Y} }
+func (p svgPoint) sub(q svgPoint) svgPoint { return svgPoint{p.X - q.X, p.Y - q.Y} }
+func (p svgPoint) mul(k float64) svgPoint  { return svgPoint{p.X * k, p.Y * k} }
+func (p svgPoint) dot(q svgPoint) float64  { return p.X*q.X + p.Y*q.Y }
+func (p svgPoint) length() float64         { return math.Hypot(p.X, p.Y) }
+func (p svgPoint) lerp(q svgPoint, t float64) svgPoint {
+	return svgPoint{p.X + (q.X-p.X)*t, p.Y + (q.Y-p.Y)*t}
+}
+
+// svgMatrix is an affine transform [a b c d e f] mapping (x, y) to
+// (a*x + c*y + e, b*x + d*y + f), as in the SVG transform attribute.
+type svgMatrix [6]float64
+
+var svgIdentity = svgMatrix{1, 0, 0, 1, 0, 0}
+
+// mul returns the transform that applies n and then m.
+func (m svgMatrix) mul(n svgMatrix) svgMatrix {
+	return svgMatrix{
+		m[0]*n[0] + m[2]*n[1],
+		m[1]*n[0] + m[3]*n[1],
+		m[0]*n[2] + m[2]*n[3],
+		m[1]*n[2] + m[3]*n[3],
+		m[0]*n[4] + m[2]*n[5] + m[4],
+		m[1]*n[4] + m[3]*n[5] + m[5],
+	}
+}
+
+func (m svgMatrix) apply(p svgPoint) svgPoint {
+	return svgPoint{m[0]*p.X + m[2]*p.Y + m[4], m[1]*p.X + m[3]*p.Y + m[5]}
+}
+
+// scale returns the factor by which m scales lengths on average, used for
+// stroke widths.
+func (m svgMatrix) scale() float64 {
+	return math.Sqrt(math.Abs(m[0]*m[3] - m[1]*m[2]))
+}
+
+type segKind int
+
+const (
+	segMove segKind = iota
+	segLine
+	segQuad
+	segCubic
+	segClose
+)
+
+// pathSeg is one path command in absolute user coordinates. The last used
+// point of pts is the end point; the ones before it are control points.
+type pathSeg struct {
+	kind segKind
+	pts  [3]svgPoint
+}
+
+// svgPaint is a fill or stroke paint.
+type svgPaint struct {
+	none    bool
+	current bool
+	c       color.NRGBA
+}
+
+// svgStyle holds the presentation properties of an element after
+// inheritance.
+type svgStyle struct {
+	fill, stroke  svgPaint
+	fillOpacity   float64
+	strokeOpacity float64
+	opacity       float64
+	evenOdd       bool
+	strokeWidth   float64
+	lineCap       string
+	lineJoin      string
+	miterLimit    float64
+	color         color.NRGBA
+	hidden        bool
+}
+
+func defaultSVGStyle() svgStyle {
+	black := color.NRGBA{A: 255}
+	return svgStyle{
+		fill:          svgPaint{c: black},
+		stroke:        svgPaint{none: true},
+		fillOpacity:   1,
+		strokeOpacity: 1,
+		opacity:       1,
+		strokeWidth:   1,
+		lineCap:       "butt",
+		lineJoin:      "miter",
+		miterLimit:    4,
+		color:         black,
+	}
+}
+
+// apply sets the properties given by an element's presentation attributes
+// and its style attribute, which takes precedence.
+func (s *svgStyle) apply(attrs []xml.Attr) {
+	var style string
+	for _, a := range attrs {
+		if a.Name.Local == "style" {
+			style = a.Value
+			continue
+		}
+		s.set(a.Name.Local, a.Value)
+	}
+	for _, decl := range strings.Split(style, ";") {
+		if name, value, ok := strings.Cut(decl, ":"); ok {
+			s.set(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+}
+
+func (s *svgStyle) set(name, value string) {
+	value = strings.TrimSpace(value)
+	number := func() (float64, bool) {
+		v, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil {
+			return 0, false
+		}
+		if strings.HasSuffix(value, "%") {
+			v /= 100
+		}
+		return v, true
+	}
+
+	switch name {
+	case "fill":
+		if p, ok := parsePaint(value); ok {
+			s.fill = p
+		}
+	case "stroke":
+		if p, ok := parsePaint(value); ok {
+			s.stroke = p
+		}
+	case "color":
+		if c, ok := parseSVGColor(value); ok {
+			s.color = c
+		}
+	case "fill-opacity":
+		if v, ok := number(); ok {
+			s.fillOpacity = clamp01(v)
+		}
+	case "stroke-opacity":
+		if v, ok := number(); ok {
+			s.strokeOpacity = clamp01(v)
+		}
+	case "opacity":
+		// Group opacity is approximated by applying it to each child
+		if v, ok := number(); ok {
+			s.opacity *= clamp01(v)
+		}
+	case "fill-rule":
+		s.evenOdd = value == "evenodd"
+	case "stroke-width":
+		if v, ok := parseLength(value); ok && v >= 0 {
+			s.strokeWidth = v
+		}
+	case "stroke-linecap":
+		s.lineCap = value
+	case "stroke-linejoin":
+		s.lineJoin = value
+	case "stroke-miterlimit":
+		if v, ok := number(); ok && v >= 1 {
+			s.miterLimit = v
+		}
+	case "display":
+		if value == "none" {
+			s.hidden = true
+		}
+	case "visibility":
+		s.hidden = value == "hidden" || value == "collapse"
+	}
+}
+
+// paintColor returns the premultiplied color of p with the given opacity.
+func (s *svgStyle) paintColor(p svgPaint, opacity float64) color.RGBA {
+	c := p.c
+	if p.current {
+		c = s.color
+	}
+	a := float64(c.A) / 255 * opacity * s.opacity
+	return color.RGBA{
+		R: uint8(float64(c.R)*a + 0.5),
+		G: uint8(float64(c.G)*a + 0.5),
+		B: uint8(float64(c.B)*a + 0.5),
+		A: uint8(255*a + 0.5),
+	}
+}
+
+func parsePaint(s string) (svgPaint, bool) {
+	switch {
+	case s == "none" || s == "transparent":
+		return svgPaint{none: true}, true
+	case s == "currentColor":
+		return svgPaint{current: true}, true
+	case strings.HasPrefix(s, "url("):
+		// Only the fallback color of a paint server reference is used
+		if end := strings.Index(s, ")"); end >= 0 {
+			if c, ok := parseSVGColor(strings.TrimSpace(s[end+1:])); ok {
+				return svgPaint{c: c}, true
+			}
+		}
+		return svgPaint{none: true}, true
+	}
+	c, ok := parseSVGColor(s)
+	return svgPaint{c: c}, ok
+}
+
+// parseSVGColor parses hex, rgb()/rgba() and named colors.
+func parseSVGColor(s string) (color.NRGBA, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if strings.HasPrefix(s, "#") {
+		hex := s[1:]
+		if len(hex) == 3 || len(hex) == 4 {
+			var expanded strings.Builder
+			for _, r := range hex {
+				expanded.WriteRune(r)
+				expanded.WriteRune(r)
+			}
+			hex = expanded.String()
+		}
+		if len(hex) == 6 {
+			hex += "ff"
+		}
+		if len(hex) != 8 {
+			return color.NRGBA{}, false
+		}
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil {
+			return color.NRGBA{}, false
+		}
+		return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, true
+	}
+
+	if strings.HasPrefix(s, "rgb") {
+		open, end := strings.Index(s, "("), strings.LastIndex(s, ")")
+		if open < 0 || end < open {
+			return color.NRGBA{}, false
+		}
+		fields := strings.FieldsFunc(s[open+1:end], func(r rune) bool { return r == ',' || r == ' ' || r == '/' })
+		if len(fields) < 3 {
+			return color.NRGBA{}, false
+		}
+		channel := func(f string, scale float64) (uint8, bool) {
+			percent := strings.HasSuffix(f, "%")
+			v, err := strconv.ParseFloat(strings.TrimSuffix(f, "%"), 64)
+			if err != nil {
+				return 0, false
+			}
+			if percent {
+				v = v / 100 * 255
+			} else {
+				v *= scale
+			}
+			return uint8(math.Max(0, math.Min(255, v)) + 0.5), true
+		}
+		c := color.NRGBA{A: 255}
+		var ok [4]bool
+		c.R, ok[0] = channel(fields[0], 1)
+		c.G, ok[1] = channel(fields[1], 1)
+		c.B, ok[2] = channel(fields[2], 1)
+		ok[3] = true
+		if len(fields) > 3 {
+			c.A, ok[3] = channel(fields[3], 255)
+		}
+		return c, ok[0] && ok[1] && ok[2] && ok[3]
+	}
+
+	if c, ok := colornames.Map[s]; ok {
+		return color.NRGBA{c.R, c.G, c.B, c.A}, true
+	}
+	return color.NRGBA{}, false
+}
+
+// parseLength parses an SVG length in user units. Percentages are not
+// supported.
+func parseLength(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	units := map[string]float64{
+		"px": 1, "pt": 4.0 / 3, "pc": 16, "mm": 96 / 25.4, "cm": 96 / 2.54, "in": 96, "em": 16, "ex": 8,
+	}
+	factor := 1.0
+	for unit, f := range units {
+		if strings.HasSuffix(s, unit) {
+			s, factor = strings.TrimSuffix(s, unit), f
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, false
+	}
+	return v * factor, true
+}
+
+// svgShape is one element to paint: its outline in user space, the
+// transform to the document's user space and its style.
+type svgShape struct {
+	segs  []pathSeg
+	m     svgMatrix
+	style svgStyle
+}
+
+// svgDocument is a parsed SVG ready to be rasterized at any size.
+type svgDocument struct {
+	width, height float64
+	viewBox       [4]float64
+	// alignX and alignY are 0, 0.5 or 1 for min, mid and max alignment;
+	// a negative alignX means preserveAspectRatio="none".
+	alignX, alignY float64
+	slice          bool
+	shapes         []svgShape
+}
+
+// svgSkipped are elements whose content is never painted directly.
+var svgSkipped = map[string]bool{
+	"defs": true, "clipPath": true, "mask": true, "symbol": true, "pattern": true, "marker": true,
+	"linearGradient": true, "radialGradient": true, "style": true, "title": true, "desc": true,
+	"metadata": true, "script": true, "filter": true, "text": true, "foreignObject": true,
+}
+
+// parseSVG parses an SVG document.
+func parseSVG(r io.Reader) (*svgDocument, error) {
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+
+	type frame struct {
+		style svgStyle
+		m     svgMatrix
+	}
+	var (
+		doc   *svgDocument
+		stack []frame
+		skip  int
+	)
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SVG: %v", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if skip > 0 {
+				skip++
+				continue
+			}
+			if doc == nil {
+				if t.Name.Local != "svg" {
+					return nil, fmt.Errorf("not an SVG document: root element is <%s>", t.Name.Local)
+				}
+				doc = newSVGDocument(t.Attr)
+			}
+			if svgSkipped[t.Name.Local] {
+				skip = 1
+				continue
+			}
+
+			parent := frame{style: defaultSVGStyle(), m: svgIdentity}
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1]
+			}
+			f := parent
+			if transform := attr(t.Attr, "transform"); transform != "" {
+				m, err := parseTransform(transform)
+				if err != nil {
+					return nil, err
+				}
+				f.m = f.m.mul(m)
+			}
+			if t.Name.Local == "svg" && len(stack) > 0 {
+				// Nested viewports are positioned but not clipped or rescaled
+				x, _ := parseLength(attr(t.Attr, "x"))
+				y, _ := parseLength(attr(t.Attr, "y"))
+				f.m = f.m.mul(svgMatrix{1, 0, 0, 1, x, y})
+			}
+			f.style.apply(t.Attr)
+			stack = append(stack, f)
+
+			segs, err := shapeSegments(t)
+			if err != nil {
+				return nil, err
+			}
+			if len(segs) > 0 && !f.style.hidden {
+				doc.shapes = append(doc.shapes, svgShape{segs: segs, m: f.m, style: f.style})
+			}
+
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+
+	if doc == nil {
+		return nil, fmt.Errorf("not an SVG document")
+	}
+	return doc, nil
+}
+
+// newSVGDocument reads the size, viewBox and preserveAspectRatio of the root
+// element. A missing size falls back to the viewBox, and both fall back to
+// the 300x150 default viewport.
+func newSVGDocument(attrs []xml.Attr) *svgDocument {
+	doc := &svgDocument{alignX: 0.5, alignY: 0.5}
+
+	var hasViewBox bool
+	if vb := parseNumbers(attr(attrs, "viewBox")); len(vb) == 4 && vb[2] > 0 && vb[3] > 0 {
+		copy(doc.viewBox[:], vb)
+		hasViewBox = true
+	}
+
+	doc.width, _ = parseLength(attr(attrs, "width"))
+	doc.height, _ = parseLength(attr(attrs, "height"))
+	switch {
+	case doc.width > 0 && doc.height > 0:
+	case hasViewBox && doc.width > 0:
+		doc.height = doc.width * doc.viewBox[3] / doc.viewBox[2]
+	case hasViewBox && doc.height > 0:
+		doc.width = doc.height * doc.viewBox[2] / doc.viewBox[3]
+	case hasViewBox:
+		doc.width, doc.height = doc.viewBox[2], doc.viewBox[3]
+	default:
+		doc.width, doc.height = 300, 150
+	}
+	if !hasViewBox {
+		doc.viewBox = [4]float64{0, 0, doc.width, doc.height}
+	}
+
+	fields := strings.Fields(attr(attrs, "preserveAspectRatio"))
+	if len(fields) > 0 {
+		align := fields[0]
+		if align == "none" {
+			doc.alignX = -1
+		} else if len(align) == 8 {
+			positions := map[string]float64{"Min": 0, "Mid": 0.5, "Max": 1}
+			doc.alignX = positions[align[1:4]]
+			doc.alignY = positions[align[5:8]]
+		}
+		doc.slice = len(fields) > 1 && fields[1] == "slice"
+	}
+	return doc
+}
+
+func attr(attrs []xml.Attr, name string) string {
+	for _, a := range attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// shapeSegments returns the outline of a path or basic shape element, or
+// nil for any other element.
+func shapeSegments(el xml.StartElement) ([]pathSeg, error) {
+	num := func(name string) float64 {
+		v, _ := parseLength(attr(el.Attr, name))
+		return v
+	}
+
+	switch el.Name.Local {
+	case "path":
+		return parsePathData(attr(el.Attr, "d"))
+
+	case "rect":
+		x, y, w, h := num("x"), num("y"), num("width"), num("height")
+		if w <= 0 || h <= 0 {
+			return nil, nil
+		}
+		rx, hasRX := parseLength(attr(el.Attr, "rx"))
+		ry, hasRY := parseLength(attr(el.Attr, "ry"))
+		if !hasRX {
+			rx = ry
+		}
+		if !hasRY {
+			ry = rx
+		}
+		rx, ry = math.Min(math.Max(rx, 0), w/2), math.Min(math.Max(ry, 0), h/2)
+		if rx == 0 || ry == 0 {
+			return []pathSeg{
+				{kind: segMove, pts: [3]svgPoint{{x, y}}},
+				{kind: segLine, pts: [3]svgPoint{{x + w, y}}},
+				{kind: segLine, pts: [3]svgPoint{{x + w, y + h}}},
+				{kind: segLine, pts: [3]svgPoint{{x, y + h}}},
+				{kind: segClose},
+			}, nil
+		}
+		segs := []pathSeg{{kind: segMove, pts: [3]svgPoint{{x + rx, y}}}}
+		// Each side is a straight edge followed by a quarter ellipse
+		corner := func(from, to svgPoint) {
+			segs = append(segs, pathSeg{kind: segLine, pts: [3]svgPoint{from}})
+			segs = append(segs, arcSegments(from, rx, ry, 0, false, true, to)...)
+		}
+		corner(svgPoint{x + w - rx, y}, svgPoint{x + w, y + ry})
+		corner(svgPoint{x + w, y + h - ry}, svgPoint{x + w - rx, y + h})
+		corner(svgPoint{x + rx, y + h}, svgPoint{x, y + h - ry})
+		corner(svgPoint{x, y + ry}, svgPoint{x + rx, y})
+		return append(segs, pathSeg{kind: segClose}), nil
+
+	case "circle":
+		r := num("r")
+		return ellipseSegments(num("cx"), num("cy"), r, r), nil
+
+	case "ellipse":
+		return ellipseSegments(num("cx"), num("cy"), num("rx"), num("ry")), nil
+
+	case "line":
+		return []pathSeg{
+			{kind: segMove, pts: [3]svgPoint{{num("x1"), num("y1")}}},
+			{kind: segLine, pts: [3]svgPoint{{num("x2"), num("y2")}}},
+		}, nil
+
+	case "polyline", "polygon":
+		coords := parseNumbers(attr(el.Attr, "points"))
+		if len(coords) < 4 {
+			return nil, nil
+		}
+		var segs []pathSeg
+		for i := 0; i+1 < len(coords); i += 2 {
+			kind := segLine
+			if i == 0 {
+				kind = segMove
+			}
+			segs = append(segs, pathSeg{kind: kind, pts: [3]svgPoint{{coords[i], coords[i+1]}}})
+		}
+		if el.Name.Local == "polygon" {
+			segs = append(segs, pathSeg{kind: segClose})
+		}
+		return segs, nil
+	}
+	return nil, nil
+}
+
+func ellipseSegments(cx, cy, rx, ry float64) []pathSeg {
+	if rx <= 0 || ry <= 0 {
+		return nil
+	}
+	right, left := svgPoint{cx + rx, cy}, svgPoint{cx - rx, cy}
+	segs := []pathSeg{{kind: segMove, pts: [3]svgPoint{right}}}
+	segs = append(segs, arcSegments(right, rx, ry, 0, false, true, left)...)
+	segs = append(segs, arcSegments(left, rx, ry, 0, false, true, right)...)
+	return append(segs, pathSeg{kind: segClose})
+}
+
+// svgScanner reads the numbers, flags and command letters of path data,
+// transforms and point lists.
+type svgScanner struct {
+	s string
+	i int
+}
+
+func (sc *svgScanner) skipSeparators() {
+	for sc.i < len(sc.s) && strings.IndexByte(" \t\r\n,", sc.s[sc.i]) >= 0 {
+		sc.i++
+	}
+}
+
+func (sc *svgScanner) done() bool {
+	sc.skipSeparators()
+	return sc.i >= len(sc.s)
+}
+
+// atNumber reports whether the next token is a number.
+func (sc *svgScanner) atNumber() bool {
+	sc.skipSeparators()
+	return sc.i < len(sc.s) && strings.IndexByte("+-.0123456789", sc.s[sc.i]) >= 0
+}
+
+func (sc *svgScanner) number() (float64, error) {
+	sc.skipSeparators()
+	start := sc.i
+	digits := func() {
+		for sc.i < len(sc.s) && sc.s[sc.i] >= '0' && sc.s[sc.i] <= '9' {
+			sc.i++
+		}
+	}
+	if sc.i < len(sc.s) && (sc.s[sc.i] == '+' || sc.s[sc.i] == '-') {
+		sc.i++
+	}
+	digits()
+	if sc.i < len(sc.s) && sc.s[sc.i] == '.' {
+		sc.i++
+		digits()
+	}
+	if sc.i < len(sc.s) && (sc.s[sc.i] == 'e' || sc.s[sc.i] == 'E') {
+		// Only an exponent if digits follow, so that "2em" is not misread
+		j := sc.i + 1
+		if j < len(sc.s) && (sc.s[j] == '+' || sc.s[j] == '-') {
+			j++
+		}
+		if j < len(sc.s) && sc.s[j] >= '0' && sc.s[j] <= '9' {
+			sc.i = j
+			digits()
+		}
+	}
+	v, err := strconv.ParseFloat(sc.s[start:sc.i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number at offset %d in %q", start, sc.s)
+	}
+	return v, nil
+}
+
+// flag reads an arc flag, which may be written without a separator.
+func (sc *svgScanner) flag() (bool, error) {
+	sc.skipSeparators()
+	if sc.i < len(sc.s) && (sc.s[sc.i] == '0' || sc.s[sc.i] == '1') {
+		sc.i++
+		return sc.s[sc.i-1] == '1', nil
+	}
+	return false, fmt.Errorf("invalid arc flag at offset %d in %q", sc.i, sc.s)
+}
+
+// parseNumbers reads a list of numbers, stopping at the first invalid one.
+func parseNumbers(s string) []float64 {
+	sc := &svgScanner{s: s}
+	var out []float64
+	for sc.atNumber() {
+		v, err := sc.number()
+		if err != nil {
+			break
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// parseTransform parses a transform attribute into a single matrix.
+func parseTransform(s string) (svgMatrix, error) {
+	m := svgIdentity
+	rest := s
+	for {
+		rest = strings.TrimLeft(rest, " \t\r\n,")
+		if rest == "" {
+			return m, nil
+		}
+		open, end := strings.Index(rest, "("), strings.Index(rest, ")")
+		if open < 0 || end < open {
+			return m, fmt.Errorf("invalid transform %q", s)
+		}
+		name := strings.TrimSpace(rest[:open])
+		args := parseNumbers(rest[open+1 : end])
+		rest = rest[end+1:]
+
+		arg := func(i int, def float64) float64 {
+			if i < len(args) {
+				return args[i]
+			}
+			return def
+		}
+		var t svgMatrix
+		switch {
+		case name == "matrix" && len(args) == 6:
+			copy(t[:], args)
+		case name == "translate" && len(args) >= 1:
+			t = svgMatrix{1, 0, 0, 1, args[0], arg(1, 0)}
+		case name == "scale" && len(args) >= 1:
+			t = svgMatrix{args[0], 0, 0, arg(1, args[0]), 0, 0}
+		case name == "rotate" && len(args) >= 1:
+			sin, cos := math.Sincos(args[0] * math.Pi / 180)
+			cx, cy := arg(1, 0), arg(2, 0)
+			t = svgMatrix{1, 0, 0, 1, cx, cy}.
+				mul(svgMatrix{cos, sin, -sin, cos, 0, 0}).
+				mul(svgMatrix{1, 0, 0, 1, -cx, -cy})
+		case name == "skewX" && len(args) == 1:
+			t = svgMatrix{1, 0, math.Tan(args[0] * math.Pi / 180), 1, 0, 0}
+		case name == "skewY" && len(args) == 1:
+			t = svgMatrix{1, math.Tan(args[0] * math.Pi / 180), 0, 1, 0, 0}
+		default:
+			return m, fmt.Errorf("invalid transform %q", s)
+		}
+		m = m.mul(t)
+	}
+}
+
+// parsePathData parses path data into absolute segments. Arcs are converted
+// to cubic curves and smooth curves get their reflected control points.
+func parsePathData(d string) ([]pathSeg, error) {
+	sc := &svgScanner{s: d}
+	var (
+		segs       []pathSeg
+		cmd        byte
+		cur, start svgPoint
+		lastCubic  *svgPoint
+		lastQuad   *svgPoint
+		needMove   bool
+	)
+
+	point := func(relative bool) (svgPoint, error) {
+		x, err := sc.number()
+		if err != nil {
+			return svgPoint{}, err
+		}
+		y, err := sc.number()
+		if err != nil {
+			return svgPoint{}, err
+		}
+		p := svgPoint{x, y}
+		if relative {
+			p = p.add(cur)
+		}
+		return p, nil
+	}
+	emit := func(kind segKind, pts ...svgPoint) {
+		if needMove && kind != segMove {
+			segs = append(segs, pathSeg{kind: segMove, pts: [3]svgPoint{cur}})
+		}
+		needMove = false
+		seg := pathSeg{kind: kind}
+		copy(seg.pts[:], pts)
+		segs = append(segs, seg)
+		if len(pts) > 0 {
+			cur = pts[len(pts)-1]
+		}
+	}
+
+	for !sc.done() {
+		if c := sc.s[sc.i]; (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+			cmd = c
+			sc.i++
+		} else if cmd == 0 || cmd == 'z' || cmd == 'Z' {
+			return nil, fmt.Errorf("invalid path data %q: expected a command at offset %d", d, sc.i)
+		}
+		relative := cmd >= 'a'
+		prevCubic, prevQuad := lastCubic, lastQuad
+		lastCubic, lastQuad = nil, nil
+
+		switch cmd {
+		case 'M', 'm':
+			p, err := point(relative)
+			if err != nil {
+				return nil, err
+			}
+			emit(segMove, p)
+			start = p
+			// Further coordinate pairs are implicit line-tos
+			cmd = 'L' + (cmd - 'M')
+
+		case 'L', 'l':
+			p, err := point(relative)
+			if err != nil {
+				return nil, err
+			}
+			emit(segLine, p)
+
+		case 'H', 'h', 'V', 'v':
+			v, err := sc.number()
+			if err != nil {
+				return nil, err
+			}
+			p := cur
+			switch cmd {
+			case 'H':
+				p.X = v
+			case 'h':
+				p.X += v
+			case 'V':
+				p.Y = v
+			case 'v':
+				p.Y += v
+			}
+			emit(segLine, p)
+
+		case 'C', 'c', 'S', 's':
+			c1 := cur
+			if cmd == 'C' || cmd == 'c' {
+				var err error
+				if c1, err = point(relative); err != nil {
+					return nil, err
+				}
+			} else if prevCubic != nil {
+				c1 = cur.mul(2).sub(*prevCubic)
+			}
+			c2, err := point(relative)
+			if err != nil {
+				return nil, err
+			}
+			p, err := point(relative)
+			if err != nil {
+				return nil, err
+			}
+			emit(segCubic, c1, c2, p)
+			lastCubic = &c2
+
+		case 'Q', 'q', 'T', 't':
+			c := cur
+			if cmd == 'Q' || cmd == 'q' {
+				var err error
+				if c, err = point(relative); err != nil {
+					return nil, err
+				}
+			} else if prevQuad != nil {
+				c = cur.mul(2).sub(*prevQuad)
+			}
+			p, err := point(relative)
+			if err != nil {
+				return nil, err
+			}
+			emit(segQuad, c, p)
+			lastQuad = &c
+
+		case 'A', 'a':
+			rx, err := sc.number()
+			if err != nil {
+				return nil, err
+			}
+			ry, err := sc.number()
+			if err != nil {
+				return nil, err
+			}
+			rotation, err := sc.number()
+			if err != nil {
+				return nil, err
+			}
+			large, err := sc.flag()
+			if err != nil {
+				return nil, err
+			}
+			sweep, err := sc.flag()
+			if err != nil {
+				return nil, err
+			}
+			p, err := point(relative)
+			if err != nil {
+				return nil, err
+			}
+			for _, seg := range arcSegments(cur, rx, ry, rotation, large, sweep, p) {
+				emit(seg.kind, seg.pts[:seg.pointCount()]...)
+			}
+
+		case 'Z', 'z':
+			emit(segClose)
+			cur, needMove = start, true
+
+		default:
+			return nil, fmt.Errorf("invalid path data %q: unknown command %q", d, cmd)
+		}
+	}
+	return segs, nil
+}
+
+// pointCount returns the number of points a segment of this kind uses.
+func (s pathSeg) pointCount() int {
+	switch s.kind {
+	case segQuad:
+		return 2
+	case segCubic:
+		return 3
+	case segClose:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// arcSegments converts an elliptical arc from p0 to p, given in SVG endpoint
+// form, into cubic curves of at most a quarter turn each.
+func arcSegments(p0 svgPoint, rx, ry, rotation float64, large, sweep bool, p svgPoint) []pathSeg {
+	if p0 == p {
+		return nil
+	}
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 {
+		return []pathSeg{{kind: segLine, pts: [3]svgPoint{p}}}
+	}
+
+	sin, cos := math.Sincos(rotation * math.Pi / 180)
+	dx, dy := (p0.X-p.X)/2, (p0.Y-p.Y)/2
+	x1, y1 := cos*dx+sin*dy, -sin*dx+cos*dy
+
+	// Work on the unit circle so that huge radii are never squared, which
+	// would overflow to Inf and make the angles NaN
+	xs, ys := x1/rx, y1/ry
+	lambda := xs*xs + ys*ys
+	if lambda == 0 || math.IsInf(lambda, 0) || math.IsNaN(lambda) {
+		// The radii dwarf the distance to the end point; the arc is a line
+		return []pathSeg{{kind: segLine, pts: [3]svgPoint{p}}}
+	}
+	// Scale up radii that are too small to reach the end point
+	if lambda > 1 {
+		rx, ry = rx*math.Sqrt(lambda), ry*math.Sqrt(lambda)
+		xs, ys = xs/math.Sqrt(lambda), ys/math.Sqrt(lambda)
+		lambda = 1
+	}
+
+	coef := math.Sqrt(math.Max(0, (1-lambda)/lambda))
+	if large == sweep {
+		coef = -coef
+	}
+	cxp, cyp := coef*rx*ys, -coef*ry*xs
+	cx := cos*cxp - sin*cyp + (p0.X+p.X)/2
+	cy := sin*cxp + cos*cyp + (p0.Y+p.Y)/2
+
+	angle := func(ux, uy, vx, vy float64) float64 {
+		return math.Atan2(ux*vy-uy*vx, ux*vx+uy*vy)
+	}
+	theta := angle(1, 0, xs-coef*ys, ys+coef*xs)
+	delta := angle(xs-coef*ys, ys+coef*xs, -xs-coef*ys, -ys+coef*xs)
+	if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	} else if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	}
+	for _, v := range []float64{cx, cy, theta, delta} {
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return []pathSeg{{kind: segLine, pts: [3]svgPoint{p}}}
+		}
+	}
+
+	at := func(t float64) (svgPoint, svgPoint) {
+		st, ct := math.Sincos(t)
+		pt := svgPoint{cx + rx*ct*cos - ry*st*sin, cy + rx*ct*sin + ry*st*cos}
+		deriv := svgPoint{-rx*st*cos - ry*ct*sin, -rx*st*sin + ry*ct*cos}
+		return pt, deriv
+	}
+
+	n := max(int(math.Ceil(math.Abs(delta)/(math.Pi/2))), 1)
+	step := delta / float64(n)
+	k := 4.0 / 3 * math.Tan(step/4)
+	segs := make([]pathSeg, 0, n)
+	for i := 0; i < n; i++ {
+		a, da := at(theta + float64(i)*step)
+		b, db := at(theta + float64(i+1)*step)
+		if i == n-1 {
+			b = p
+		}
+		segs = append(segs, pathSeg{kind: segCubic, pts: [3]svgPoint{a.add(da.mul(k)), b.sub(db.mul(k)), b}})
+	}
+	return segs
+}
+
+// svgSubpath is a flattened subpath in device space.
+type svgSubpath struct {
+	pts    []svgPoint
+	closed bool
+}
+
+// flatten transforms segs by m and approximates curves with line segments
+// short enough to look smooth at device resolution.
+func flatten(segs []pathSeg, m svgMatrix) []svgSubpath {
+	var (
+		paths []svgSubpath
+		cur   *svgSubpath
+		last  svgPoint
+	)
+	steps := func(length float64) int {
+		return int(math.Min(256, math.Max(1, math.Ceil(math.Sqrt(length*2)))))
+	}
+
+	for _, seg := range segs {
+		var pts [3]svgPoint
+		for i := 0; i < seg.pointCount(); i++ {
+			pts[i] = m.apply(seg.pts[i])
+		}
+		if seg.kind == segMove {
+			paths = append(paths, svgSubpath{pts: []svgPoint{pts[0]}})
+			cur, last = &paths[len(paths)-1], pts[0]
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+
+		switch seg.kind {
+		case segLine:
+			cur.pts = append(cur.pts, pts[0])
+			last = pts[0]
+		case segQuad:
+			n := steps(last.sub(pts[0]).length() + pts[0].sub(pts[1]).length())
+			for i := 1; i <= n; i++ {
+				t := float64(i) / float64(n)
+				cur.pts = append(cur.pts, last.lerp(pts[0], t).lerp(pts[0].lerp(pts[1], t), t))
+			}
+			last = pts[1]
+		case segCubic:
+			n := steps(last.sub(pts[0]).length() + pts[0].sub(pts[1]).length() + pts[1].sub(pts[2]).length())
+			for i := 1; i <= n; i++ {
+				t := float64(i) / float64(n)
+				a, b, c := last.lerp(pts[0], t), pts[0].lerp(pts[1], t), pts[1].lerp(pts[2], t)
+				cur.pts = append(cur.pts, a.lerp(b, t).lerp(b.lerp(c, t), t))
+			}
+			last = pts[2]
+		case segClose:
+			cur.closed = true
+		}
+	}
+	return paths
+}
+
+// aspect returns the document's height divided by its width.
+func (d *svgDocument) aspect() float64 {
+	return d.height / d.width
+}
+
+// viewTransform maps the viewBox onto a w by h pixel canvas.
+func (d *svgDocument) viewTransform(w, h int) svgMatrix {
+	vb := d.viewBox
+	sx, sy := float64(w)/vb[2], float64(h)/vb[3]
+	if d.alignX < 0 {
+		return svgMatrix{sx, 0, 0, sy, -vb[0] * sx, -vb[1] * sy}
+	}
+	s := math.Min(sx, sy)
+	if d.slice {
+		s = math.Max(sx, sy)
+	}
+	tx := -vb[0]*s + (float64(w)-vb[2]*s)*d.alignX
+	ty := -vb[1]*s + (float64(h)-vb[3]*s)*d.alignY
+	return svgMatrix{s, 0, 0, s, tx, ty}
+}
+
+// rasterize renders the document onto a transparent w by h image.
+func (d *svgDocument) rasterize(w, h int) *image.RGBA {
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	if w <= 0 || h <= 0 {
+		return out
+	}
+	view := d.viewTransform(w, h)
+	z := vector.NewRasterizer(w, h)
+
+	for _, shape := range d.shapes {
+		m := view.mul(shape.m)
+		paths := flatten(shape.segs, m)
+		style := shape.style
+
+		if !style.fill.none {
+			c := style.paintColor(style.fill, style.fillOpacity)
+			if style.evenOdd && len(paths) > 1 {
+				fillEvenOdd(z, out, paths, c)
+			} else {
+				fillPolygons(z, out, subpathPoints(paths), c)
+			}
+		}
+		if !style.stroke.none && style.strokeWidth > 0 {
+			c := style.paintColor(style.stroke, style.strokeOpacity)
+			fillPolygons(z, out, strokePolygons(paths, style.strokeWidth*m.scale(), style), c)
+		}
+	}
+	return out
+}
+
+func subpathPoints(paths []svgSubpath) [][]svgPoint {
+	polys := make([][]svgPoint, len(paths))
+	for i, p := range paths {
+		polys[i] = p.pts
+	}
+	return polys
+}
+
+// fillPolygons fills polys with the non-zero winding rule and composites
+// the result over dst.
+func fillPolygons(z *vector.Rasterizer, dst *image.RGBA, polys [][]svgPoint, c color.RGBA) {
+	if c.A == 0 {
+		return
+	}
+	b := dst.Bounds()
+	z.Reset(b.Dx(), b.Dy())
+	addPolygons(z, polys)
+	z.DrawOp = draw.Over
+	z.Draw(dst, b, image.NewUniform(c), image.Point{})
+}
+
+func addPolygons(z *vector.Rasterizer, polys [][]svgPoint) {
+	size := z.Size()
+	for _, poly := range polys {
+		// The rasterizer fails on coordinates far outside the canvas, so
+		// polygons are clipped to it with a pixel to spare
+		poly = clipPolygon(poly, -1, -1, float64(size.X+1), float64(size.Y+1))
+		if len(poly) < 2 {
+			continue
+		}
+		z.MoveTo(float32(poly[0].X), float32(poly[0].Y))
+		for _, p := range poly[1:] {
+			z.LineTo(float32(p.X), float32(p.Y))
+		}
+		z.ClosePath()
+	}
+}
+
+// clipPolygon clips poly to the rectangle from (x0, y0) to (x1, y1) one edge
+// at a time (Sutherland-Hodgman). Parts outside are replaced by runs along
+// the rectangle's border, which leaves the coverage inside unchanged.
+// Polygons with infinite or NaN points are dropped.
+func clipPolygon(poly []svgPoint, x0, y0, x1, y1 float64) []svgPoint {
+	for _, p := range poly {
+		if math.IsInf(p.X, 0) || math.IsInf(p.Y, 0) || math.IsNaN(p.X) || math.IsNaN(p.Y) {
+			return nil
+		}
+	}
+	for edge := 0; edge < 4 && len(poly) > 0; edge++ {
+		inside := func(p svgPoint) bool {
+			switch edge {
+			case 0:
+				return p.X >= x0
+			case 1:
+				return p.X <= x1
+			case 2:
+				return p.Y >= y0
+			}
+			return p.Y <= y1
+		}
+		// cross weighs the end points rather than their difference, which
+		// can overflow for huge coordinates
+		cross := func(a, b svgPoint) svgPoint {
+			switch edge {
+			case 0, 1:
+				x := x0
+				if edge == 1 {
+					x = x1
+				}
+				t := (x - a.X) / (b.X - a.X)
+				return svgPoint{x, a.Y*(1-t) + b.Y*t}
+			}
+			y := y0
+			if edge == 3 {
+				y = y1
+			}
+			t := (y - a.Y) / (b.Y - a.Y)
+			return svgPoint{a.X*(1-t) + b.X*t, y}
+		}
+		var out []svgPoint
+		prev := poly[len(poly)-1]
+		for _, p := range poly {
+			switch {
+			case inside(p) && inside(prev):
+				out = append(out, p)
+			case inside(p):
+				out = append(out, cross(prev, p), p)
+			case inside(prev):
+				out = append(out, cross(prev, p))
+			}
+			prev = p
+		}
+		poly = out
+	}
+	return poly
+}
+
+// fillEvenOdd fills paths with the even-odd rule by rasterizing each subpath
+// on its own and combining the coverages as an exclusive or.
+func fillEvenOdd(z *vector.Rasterizer, dst *image.RGBA, paths []svgSubpath, c color.RGBA) {
+	if c.A == 0 {
+		return
+	}
+	b := dst.Bounds()
+	acc := image.NewAlpha(b)
+	mask := image.NewAlpha(b)
+	for _, p := range paths {
+		for i := range mask.Pix {
+			mask.Pix[i] = 0
+		}
+		z.Reset(b.Dx(), b.Dy())
+		addPolygons(z, [][]svgPoint{p.pts})
+		z.DrawOp = draw.Src
+		z.Draw(mask, b, image.Opaque, image.Point{})
+		for i, m := range mask.Pix {
+			a, v := uint32(acc.Pix[i]), uint32(m)
+			acc.Pix[i] = uint8((a*255 + v*255 - 2*a*v + 127) / 255)
+		}
+	}
+	draw.DrawMask(dst, b, image.NewUniform(c), image.Point{}, acc, b.Min, draw.Over)
+}
+
+// strokePolygons outlines the subpaths with the given device-space width.
+// Every polygon is wound the same way so that the non-zero fill of their
+// union covers each pixel once.
+func strokePolygons(paths []svgSubpath, width float64, style svgStyle) [][]svgPoint {
+	hw := width / 2
+	var polys [][]svgPoint
+	add := func(poly ...svgPoint) {
+		if signedArea(poly) < 0 {
+			for i, j := 0, len(poly)-1; i < j; i, j = i+1, j-1 {
+				poly[i], poly[j] = poly[j], poly[i]
+			}
+		}
+		polys = append(polys, poly)
+	}
+	circle := func(c svgPoint) {
+		n := int(math.Min(64, math.Max(8, math.Ceil(hw*2))))
+		poly := make([]svgPoint, n)
+		for i := range poly {
+			sin, cos := math.Sincos(2 * math.Pi * float64(i) / float64(n))
+			poly[i] = svgPoint{c.X + cos*hw, c.Y + sin*hw}
+		}
+		add(poly...)
+	}
+
+	for _, path := range paths {
+		// Drop repeated points, which have no direction
+		var pts []svgPoint
+		for _, p := range path.pts {
+			if len(pts) == 0 || p.sub(pts[len(pts)-1]).length() > 1e-9 {
+				pts = append(pts, p)
+			}
+		}
+		closed := path.closed
+		if closed && len(pts) > 1 && pts[0].sub(pts[len(pts)-1]).length() < 1e-9 {
+			pts = pts[:len(pts)-1]
+		}
+		if len(pts) == 1 {
+			// A zero-length subpath only shows its caps
+			switch style.lineCap {
+			case "round":
+				circle(pts[0])
+			case "square":
+				p := pts[0]
+				add(svgPoint{p.X - hw, p.Y - hw}, svgPoint{p.X + hw, p.Y - hw}, svgPoint{p.X + hw, p.Y + hw}, svgPoint{p.X - hw, p.Y + hw})
+			}
+			continue
+		}
+		if len(pts) < 2 {
+			continue
+		}
+
+		n := len(pts) - 1
+		if closed {
+			n = len(pts)
+		}
+		dir := func(i int) svgPoint {
+			a, b := pts[i%len(pts)], pts[(i+1)%len(pts)]
+			d := b.sub(a)
+			return d.mul(1 / d.length())
+		}
+
+		for i := 0; i < n; i++ {
+			a, b := pts[i], pts[(i+1)%len(pts)]
+			u := dir(i)
+			if !closed && style.lineCap == "square" {
+				if i == 0 {
+					a = a.sub(u.mul(hw))
+				}
+				if i == n-1 {
+					b = b.add(u.mul(hw))
+				}
+			}
+			nrm := svgPoint{-u.Y * hw, u.X * hw}
+			add(a.add(nrm), b.add(nrm), b.sub(nrm), a.sub(nrm))
+		}
+
+		// Joins between consecutive segments
+		first, last := 1, n-1
+		if closed {
+			first, last = 0, n-1
+		}
+		for i := first; i <= last; i++ {
+			p := pts[i]
+			u1, u2 := dir((i-1+n)%n), dir(i)
+			if style.lineJoin == "round" {
+				circle(p)
+				continue
+			}
+			n1, n2 := svgPoint{-u1.Y, u1.X}, svgPoint{-u2.Y, u2.X}
+			for _, side := range []float64{1, -1} {
+				a, b := p.add(n1.mul(side*hw)), p.add(n2.mul(side*hw))
+				cos := n1.dot(n2)
+				if style.lineJoin != "bevel" && 1+cos > 1e-9 && math.Sqrt(2/(1+cos)) <= style.miterLimit {
+					miter := n1.add(n2).mul(side * hw / (1 + cos))
+					add(p, a, p.add(miter), b)
+				} else {
+					add(p, a, b)
+				}
+			}
+		}
+
+		if !closed && style.lineCap == "round" {
+			circle(pts[0])
+			circle(pts[len(pts)-1])
+		}
+	}
+	return polys
+}
+
+func signedArea(poly []svgPoint) float64 {
+	var area float64
+	for i, p := range poly {
+		q := poly[(i+1)%len(poly)]
+		area += p.X*q.Y - q.X*p.Y
+	}
+	return area / 2
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
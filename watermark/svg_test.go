@@ -0,0 +1,216 @@
+package watermark
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"strings"
+	"testing"
+)
+
+func rasterizeSVG(t *testing.T, src string, w, h int) *image.RGBA {
+	t.Helper()
+	doc, err := parseSVG(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc.rasterize(w, h)
+}
+
+func TestSVGFillsAndViewBox(t *testing.T) {
+	src := `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10">
+		<rect width="5" height="10" fill="#f00"/>
+		<g transform="translate(5 0)" style="fill: rgb(0, 0, 255)">
+			<rect width="5" height="5" fill-opacity="0.5"/>
+		</g>
+	</svg>`
+
+	// The same document rendered at two sizes must land on the same places
+	for _, size := range []int{20, 400} {
+		img := rasterizeSVG(t, src, size, size)
+		at := func(fx, fy float64) color.RGBA {
+			return img.RGBAAt(int(fx*float64(size)), int(fy*float64(size)))
+		}
+		if got := at(0.25, 0.5); got != (color.RGBA{255, 0, 0, 255}) {
+			t.Errorf("%dpx: left half = %v, want red", size, got)
+		}
+		if got := at(0.75, 0.25); got != (color.RGBA{0, 0, 128, 128}) {
+			t.Errorf("%dpx: top right = %v, want half transparent blue", size, got)
+		}
+		if got := at(0.75, 0.75); got.A != 0 {
+			t.Errorf("%dpx: bottom right = %v, want transparent", size, got)
+		}
+	}
+}
+
+func TestSVGEvenOddAndStroke(t *testing.T) {
+	src := `<svg width="100" height="100">
+		<path d="M10 10h80v80h-80z M30 30h40v40h-40z" fill-rule="evenodd"/>
+		<line x1="0" y1="5" x2="100" y2="5" stroke="lime" stroke-width="4"/>
+	</svg>`
+	img := rasterizeSVG(t, src, 100, 100)
+
+	if got := img.RGBAAt(20, 50); got != (color.RGBA{0, 0, 0, 255}) {
+		t.Errorf("ring = %v, want black", got)
+	}
+	if got := img.RGBAAt(50, 50); got.A != 0 {
+		t.Errorf("even-odd hole = %v, want transparent", got)
+	}
+	if got := img.RGBAAt(50, 4); got != (color.RGBA{0, 255, 0, 255}) {
+		t.Errorf("stroke = %v, want lime", got)
+	}
+	if got := img.RGBAAt(50, 8); got.A != 0 {
+		t.Errorf("outside stroke = %v, want transparent", got)
+	}
+}
+
+func TestParsePathData(t *testing.T) {
+	// Implicit line-tos after a relative move, compact numbers and arc
+	// flags written without separators
+	segs, err := parsePathData("m10 10 5 0-5.5.5a5 5 0 01 10 0z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ends []svgPoint
+	for _, s := range segs {
+		if n := s.pointCount(); n > 0 {
+			ends = append(ends, s.pts[n-1])
+		}
+	}
+	want := []svgPoint{{10, 10}, {15, 10}, {9.5, 10.5}, {19.5, 10.5}}
+	if len(ends) < len(want) {
+		t.Fatalf("got %d points, want at least %d", len(ends), len(want))
+	}
+	for i, p := range want[:3] {
+		if ends[i] != p {
+			t.Errorf("point %d = %v, want %v", i, ends[i], p)
+		}
+	}
+	if last := ends[len(ends)-1]; math.Abs(last.X-19.5) > 1e-9 || math.Abs(last.Y-10.5) > 1e-9 {
+		t.Errorf("arc ends at %v, want %v", last, want[3])
+	}
+	if segs[len(segs)-1].kind != segClose {
+		t.Error("path does not end with a close")
+	}
+
+	if _, err := parsePathData("M0 0 L10"); err == nil {
+		t.Error("truncated path data parsed without error")
+	}
+}
+
+func TestArcWithHugeRadii(t *testing.T) {
+	// Squaring these radii overflows, which used to panic in makeslice, and
+	// far away points used to panic in the rasterizer
+	for _, d := range []string{
+		"M0 0 A1e300 1e300 0 0 1 5 5",
+		"M0 0 A1e200 1 0 0 1 5 5",
+		"M0 0 A1 1e308 45 1 0 5 5",
+		"M0 0 L1e300 0 L5 5",
+	} {
+		segs, err := parsePathData(d)
+		if err != nil {
+			t.Fatalf("%s: %v", d, err)
+		}
+		last := segs[len(segs)-1]
+		if end := last.pts[last.pointCount()-1]; math.Abs(end.X-5) > 1e-9 || math.Abs(end.Y-5) > 1e-9 {
+			t.Errorf("%s: ends at %v, want (5, 5)", d, end)
+		}
+		rasterizeSVG(t, `<svg width="10" height="10"><path d="`+d+`" stroke="black"/></svg>`, 10, 10)
+	}
+
+	// Clipping the far corner away keeps the fill inside the canvas
+	img := rasterizeSVG(t, `<svg width="10" height="10"><path d="M0 0 L1e12 0 L0 10z"/></svg>`, 10, 10)
+	if got := img.RGBAAt(5, 4); got.A != 255 {
+		t.Errorf("inside the huge triangle = %v, want black", got)
+	}
+
+	// Ordinary arcs keep their shape: a half circle of radius 5 reaches
+	// 5 units away from the chord
+	segs := arcSegments(svgPoint{0, 0}, 5, 5, 0, false, true, svgPoint{10, 0})
+	if len(segs) != 2 || math.Abs(segs[0].pts[2].Y+5) > 1e-9 {
+		t.Errorf("half circle = %+v, want two quarters through (5, -5)", segs)
+	}
+}
+
+func TestApplyImageWatermarkSVG(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	logo := `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 40 20"><rect width="40" height="20" fill="white"/></svg>`
+
+	out, err := (&Service{}).ApplyImageWatermark(&buf, strings.NewReader(logo), ImageOptions{
+		Opacity:       1,
+		WatermarkSize: 25,
+		LogoColorMode: LogoOriginal,
+		Position:      PositionCenter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A 100x50 white logo centered on the image
+	if r, _, _, _ := img.At(200, 100).RGBA(); r>>8 != 255 {
+		t.Errorf("center = %v, want white", img.At(200, 100))
+	}
+	if r, _, _, _ := img.At(200, 70).RGBA(); r != 0 {
+		t.Errorf("above logo = %v, want untouched", img.At(200, 70))
+	}
+}
+
+func TestApplyImageWatermarkSVGSizeBounds(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		logo string
+		size float64
+	}{
+		// 0.1% of 100px used to rasterize to nothing and tile forever
+		{"tiny", `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><rect width="10" height="10" fill="white"/></svg>`, 0.1},
+		// an absurd height used to overflow the pixel buffer
+		{"tall", `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="1e12"><rect width="10" height="10" fill="white"/></svg>`, 25},
+	}
+	for _, tt := range tests {
+		_, err := (&Service{}).ApplyImageWatermark(bytes.NewReader(buf.Bytes()), strings.NewReader(tt.logo), ImageOptions{
+			Opacity:       1,
+			WatermarkSize: tt.size,
+			LogoColorMode: LogoOriginal,
+		})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestLogoSize(t *testing.T) {
+	limit := image.Pt(100, 80)
+	tests := []struct {
+		width  int
+		aspect float64
+		want   image.Point
+	}{
+		{50, 0.5, image.Pt(50, 25)},
+		{0, 1, image.Pt(1, 1)},
+		{500, 0.5, image.Pt(100, 50)},
+		{50, 1e11, image.Pt(1, 80)},
+		{50, math.Inf(1), image.Pt(1, 80)},
+		{50, math.NaN(), image.Pt(50, 50)},
+	}
+	for _, tt := range tests {
+		if got := logoSize(tt.width, tt.aspect, limit); got != tt.want {
+			t.Errorf("logoSize(%d, %v) = %v, want %v", tt.width, tt.aspect, got, tt.want)
+		}
+	}
+}
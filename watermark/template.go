@@ -0,0 +1,87 @@
+package watermark
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TemplateData holds the per-image values that can be referenced from a
+// text watermark, e.g. "{filename} - {date:2006-01-02}".
+type TemplateData struct {
+	Filename string
+	// ID identifies the processed image, e.g. the request's unique ID.
+	ID        string
+	UserEmail string
+	Index     int
+	Width     int
+	Height    int
+	Now       time.Time
+	Exif      map[string]string
+}
+
+// ExpandTemplate replaces the {name} and {name:arg} placeholders in text with
+// values from data. Unknown placeholders are left untouched so that literal
+// braces in a watermark keep working.
+func ExpandTemplate(text string, data TemplateData) string {
+	if !strings.Contains(text, "{") {
+		return text
+	}
+
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(text, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(text[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+
+		b.WriteString(text[:start])
+		if value, ok := lookupTemplateVar(text[start+1:end], data); ok {
+			b.WriteString(value)
+		} else {
+			b.WriteString(text[start : end+1])
+		}
+		text = text[end+1:]
+	}
+	b.WriteString(text)
+	return b.String()
+}
+
+func lookupTemplateVar(name string, data TemplateData) (string, bool) {
+	arg := ""
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name, arg = name[:i], name[i+1:]
+	}
+
+	switch {
+	case name == "filename":
+		return data.Filename, true
+	case name == "id":
+		return data.ID, true
+	case name == "user.email":
+		return data.UserEmail, true
+	case name == "index":
+		return strconv.Itoa(data.Index), true
+	case name == "width":
+		return strconv.Itoa(data.Width), true
+	case name == "height":
+		return strconv.Itoa(data.Height), true
+	case name == "date":
+		if arg == "" {
+			arg = "2006-01-02"
+		}
+		now := data.Now
+		if now.IsZero() {
+			now = time.Now()
+		}
+		return now.Format(arg), true
+	case strings.HasPrefix(name, "exif."):
+		return data.Exif[strings.TrimPrefix(name, "exif.")], true
+	}
+	return "", false
+}
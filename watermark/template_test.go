@@ -0,0 +1,42 @@
+package watermark
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	data := TemplateData{
+		Filename:  "beach.jpg",
+		ID:        "3f2a",
+		UserEmail: "studio@example.com",
+		Index:     3,
+		Width:     6000,
+		Height:    4000,
+		Now:       time.Date(2024, 9, 8, 15, 4, 5, 0, time.UTC),
+		Exif:      map[string]string{"DateTimeOriginal": "2024:09:01 10:00:00"},
+	}
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"plain text", "plain text"},
+		{"{filename} #{index}", "beach.jpg #3"},
+		{"{width}x{height}", "6000x4000"},
+		{"https://example.com/license/{id}", "https://example.com/license/3f2a"},
+		{"© {user.email}", "© studio@example.com"},
+		{"{date}", "2024-09-08"},
+		{"{date:02 Jan 2006 15:04}", "08 Sep 2024 15:04"},
+		{"Shot {exif.DateTimeOriginal}", "Shot 2024:09:01 10:00:00"},
+		{"{exif.Model}", ""},
+		{"{unknown} {", "{unknown} {"},
+		{"line one\n{filename}", "line one\nbeach.jpg"},
+	}
+
+	for _, tt := range tests {
+		if got := ExpandTemplate(tt.text, data); got != tt.want {
+			t.Errorf("ExpandTemplate(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
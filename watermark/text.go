@@ -0,0 +1,114 @@
+package watermark
+
+import (
+	"image"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// Alignment controls how the lines of a multi-line text watermark are
+// positioned relative to each other.
+type Alignment string
+
+const (
+	AlignLeft   Alignment = "left"
+	AlignCenter Alignment = "center"
+	AlignRight  Alignment = "right"
+)
+
+// ParseAlignment converts a form value into an Alignment, defaulting to left.
+func ParseAlignment(s string) Alignment {
+	switch Alignment(strings.ToLower(strings.TrimSpace(s))) {
+	case AlignCenter:
+		return AlignCenter
+	case AlignRight:
+		return AlignRight
+	default:
+		return AlignLeft
+	}
+}
+
+// textBlock is a measured, multi-line piece of text ready to be drawn.
+type textBlock struct {
+	lines      []string
+	widths     []fixed.Int26_6
+	width      fixed.Int26_6
+	lineHeight fixed.Int26_6
+	ascent     fixed.Int26_6
+	descent    fixed.Int26_6
+	align      Alignment
+}
+
+// layoutText splits text on newlines, shapes each line into visual order and
+// measures it with face. lineHeight is a multiple of the face's natural line
+// height.
+func layoutText(face font.Face, text string, lineHeight float64, align Alignment) *textBlock {
+	if lineHeight <= 0 {
+		lineHeight = 1
+	}
+
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = shapeText(line)
+	}
+
+	b := &textBlock{
+		lines:      lines,
+		widths:     make([]fixed.Int26_6, len(lines)),
+		lineHeight: fixed.Int26_6(float64(face.Metrics().Height) * lineHeight),
+		ascent:     face.Metrics().Ascent,
+		descent:    face.Metrics().Descent,
+		align:      align,
+	}
+
+	for i, line := range lines {
+		b.widths[i] = font.MeasureString(face, line)
+		if b.widths[i] > b.width {
+			b.width = b.widths[i]
+		}
+	}
+	return b
+}
+
+// height returns the distance from the first baseline to the last one.
+func (b *textBlock) height() fixed.Int26_6 {
+	return b.lineHeight * fixed.Int26_6(len(b.lines)-1)
+}
+
+// bounds returns the pixel rectangle covered by the block when its first
+// baseline starts at origin.
+func (b *textBlock) bounds(origin fixed.Point26_6) image.Rectangle {
+	return image.Rect(
+		origin.X.Floor(),
+		(origin.Y - b.ascent).Floor(),
+		(origin.X + b.width).Ceil(),
+		(origin.Y + b.height() + b.descent).Ceil(),
+	)
+}
+
+// lineOffset returns the horizontal offset of line i within the block.
+func (b *textBlock) lineOffset(i int) fixed.Int26_6 {
+	switch b.align {
+	case AlignCenter:
+		return (b.width - b.widths[i]) / 2
+	case AlignRight:
+		return b.width - b.widths[i]
+	default:
+		return 0
+	}
+}
+
+// draw renders every line of the block with its first baseline starting at
+// origin.
+func (b *textBlock) draw(d *font.Drawer, origin fixed.Point26_6) {
+	for i, line := range b.lines {
+		d.Dot = fixed.Point26_6{
+			X: origin.X + b.lineOffset(i),
+			Y: origin.Y + b.lineHeight*fixed.Int26_6(i),
+		}
+		d.DrawString(line)
+	}
+}
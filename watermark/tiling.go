@@ -0,0 +1,174 @@
+package watermark
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"math/rand"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// TilePattern selects how repeated watermarks are arranged. Patterns other
+// than a plain grid, together with per-tile jitter, break the periodicity
+// that inpainting tools use to remove tiled watermarks.
+type TilePattern string
+
+const (
+	PatternGrid   TilePattern = "grid"
+	PatternBrick  TilePattern = "brick"
+	PatternHex    TilePattern = "hex"
+	PatternRandom TilePattern = "random"
+)
+
+// ParseTilePattern converts a form value into a TilePattern, defaulting to grid.
+func ParseTilePattern(s string) TilePattern {
+	switch p := TilePattern(strings.ToLower(strings.TrimSpace(s))); p {
+	case PatternBrick, PatternHex, PatternRandom:
+		return p
+	default:
+		return PatternGrid
+	}
+}
+
+// TilingOptions controls the arrangement of repeated watermarks. The jitter
+// amounts are maximum deviations: PositionJitter and ScaleJitter are
+// fractions of the tile step and size, AngleJitter is in degrees and
+// OpacityJitter is a fraction of the watermark opacity. Seed makes the
+// random choices reproducible.
+type TilingOptions struct {
+	Pattern        TilePattern
+	Seed           int64
+	PositionJitter float64
+	AngleJitter    float64
+	ScaleJitter    float64
+	OpacityJitter  float64
+}
+
+// varied reports whether the options ask for anything beyond the classic
+// fixed grid.
+func (o TilingOptions) varied() bool {
+	return (o.Pattern != "" && o.Pattern != PatternGrid) ||
+		o.PositionJitter > 0 || o.AngleJitter > 0 || o.ScaleJitter > 0 || o.OpacityJitter > 0
+}
+
+// tile is one placed copy of a watermark: its center, rotation in degrees,
+// scale factor and opacity factor.
+type tile struct {
+	X, Y    float64
+	Angle   float64
+	Scale   float64
+	Opacity float64
+}
+
+// layoutTiles returns the tiles covering area for the given step between
+// tile centers.
+func layoutTiles(area image.Rectangle, stepX, stepY float64, opts TilingOptions) []tile {
+	if stepX < 1 {
+		stepX = 1
+	}
+	if stepY < 1 {
+		stepY = 1
+	}
+	rng := rand.New(rand.NewSource(opts.Seed))
+	jitter := func(amount float64) float64 {
+		return (rng.Float64()*2 - 1) * amount
+	}
+
+	rowStep := stepY
+	if opts.Pattern == PatternHex {
+		rowStep = stepY * math.Sqrt(3) / 2
+	}
+
+	positionJitter := opts.PositionJitter
+	if opts.Pattern == PatternRandom && positionJitter < 0.5 {
+		positionJitter = 0.5
+	}
+
+	// Start one step outside the area so jittered and offset rows still
+	// cover the edges
+	minX, minY := float64(area.Min.X)-stepX, float64(area.Min.Y)-rowStep
+	maxX, maxY := float64(area.Max.X)+stepX, float64(area.Max.Y)+rowStep
+
+	var tiles []tile
+	for row, y := 0, minY; y < maxY; row, y = row+1, y+rowStep {
+		offset := 0.0
+		if row%2 == 1 && (opts.Pattern == PatternBrick || opts.Pattern == PatternHex) {
+			offset = stepX / 2
+		}
+		for x := minX + offset; x < maxX; x += stepX {
+			t := tile{X: x, Y: y, Scale: 1, Opacity: 1}
+			if positionJitter > 0 {
+				t.X += jitter(positionJitter * stepX)
+				t.Y += jitter(positionJitter * rowStep)
+			}
+			if opts.AngleJitter > 0 {
+				t.Angle = jitter(opts.AngleJitter)
+			}
+			if opts.ScaleJitter > 0 {
+				t.Scale = math.Max(0.1, 1+jitter(opts.ScaleJitter))
+			}
+			if opts.OpacityJitter > 0 {
+				t.Opacity = math.Min(1, math.Max(0, 1-rng.Float64()*opts.OpacityJitter))
+			}
+			tiles = append(tiles, t)
+		}
+	}
+	return tiles
+}
+
+// bounds returns the axis-aligned rectangle covered by a sprite of the given
+// size drawn as this tile.
+func (t tile) bounds(size image.Point) image.Rectangle {
+	sin, cos := math.Sincos(t.Angle * math.Pi / 180)
+	w, h := float64(size.X)*t.Scale, float64(size.Y)*t.Scale
+	halfW := (math.Abs(w*cos) + math.Abs(h*sin)) / 2
+	halfH := (math.Abs(w*sin) + math.Abs(h*cos)) / 2
+	return image.Rect(
+		int(math.Floor(t.X-halfW)), int(math.Floor(t.Y-halfH)),
+		int(math.Ceil(t.X+halfW)), int(math.Ceil(t.Y+halfH)),
+	)
+}
+
+// drawTile draws sprite centered on the tile, rotated, scaled and faded as
+// the tile describes.
+func drawTile(dst *image.RGBA, sprite *image.RGBA, t tile) {
+	if t.Opacity <= 0 {
+		return
+	}
+	if t.Opacity < 1 {
+		sprite = fadeImage(sprite, t.Opacity)
+	}
+
+	sb := sprite.Bounds()
+	if t.Angle == 0 && t.Scale == 1 {
+		// Nothing to resample, so copy the pixels as they are
+		at := image.Pt(int(math.Round(t.X-float64(sb.Dx())/2)), int(math.Round(t.Y-float64(sb.Dy())/2)))
+		draw.Draw(dst, image.Rectangle{Min: at, Max: at.Add(sb.Size())}, sprite, sb.Min, draw.Over)
+		return
+	}
+
+	cx, cy := float64(sb.Min.X)+float64(sb.Dx())/2, float64(sb.Min.Y)+float64(sb.Dy())/2
+	sin, cos := math.Sincos(t.Angle * math.Pi / 180)
+	s := t.Scale
+
+	// Map sprite space to image space: move the sprite center to the
+	// origin, scale and rotate, then move it to the tile center
+	m := f64.Aff3{
+		s * cos, -s * sin, t.X - s*(cos*cx-sin*cy),
+		s * sin, s * cos, t.Y - s*(sin*cx+cos*cy),
+	}
+	xdraw.BiLinear.Transform(dst, m, sprite, sb, xdraw.Over, nil)
+}
+
+// fadeImage returns a copy of img with every channel scaled by opacity,
+// which for premultiplied pixels fades the image uniformly.
+func fadeImage(img *image.RGBA, opacity float64) *image.RGBA {
+	out := image.NewRGBA(img.Bounds())
+	for i, v := range img.Pix {
+		out.Pix[i] = uint8(float64(v)*opacity + 0.5)
+	}
+	return out
+}
@@ -0,0 +1,73 @@
+package watermark
+
+import (
+	"image"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestLayoutTilesIsReproducible(t *testing.T) {
+	opts := TilingOptions{
+		Pattern:        PatternHex,
+		Seed:           42,
+		PositionJitter: 0.2,
+		AngleJitter:    15,
+		ScaleJitter:    0.3,
+		OpacityJitter:  0.5,
+	}
+	area := image.Rect(0, 0, 640, 480)
+
+	a := layoutTiles(area, 100, 60, opts)
+	b := layoutTiles(area, 100, 60, opts)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatal("same seed produced different layouts")
+	}
+
+	opts.Seed = 43
+	if c := layoutTiles(area, 100, 60, opts); reflect.DeepEqual(a, c) {
+		t.Fatal("different seeds produced the same layout")
+	}
+
+	for _, tl := range a {
+		if math.Abs(tl.Angle) > 15 || tl.Scale < 0.7 || tl.Scale > 1.3 || tl.Opacity < 0.5 || tl.Opacity > 1 {
+			t.Fatalf("tile %+v outside jitter limits", tl)
+		}
+	}
+}
+
+func TestLayoutTilesPatterns(t *testing.T) {
+	area := image.Rect(0, 0, 400, 400)
+
+	rowStarts := func(tiles []tile) map[float64]float64 {
+		starts := make(map[float64]float64)
+		for _, tl := range tiles {
+			if x, ok := starts[tl.Y]; !ok || tl.X < x {
+				starts[tl.Y] = tl.X
+			}
+		}
+		return starts
+	}
+
+	grid := rowStarts(layoutTiles(area, 100, 50, TilingOptions{Pattern: PatternGrid}))
+	for _, x := range grid {
+		if x != -100 {
+			t.Fatalf("grid row starts at %v, want -100", x)
+		}
+	}
+
+	offsets := 0
+	for _, x := range rowStarts(layoutTiles(area, 100, 50, TilingOptions{Pattern: PatternBrick})) {
+		if x == -50 {
+			offsets++
+		}
+	}
+	if offsets == 0 {
+		t.Fatal("brick pattern has no offset rows")
+	}
+
+	hex := layoutTiles(area, 100, 50, TilingOptions{Pattern: PatternHex})
+	if rows := len(rowStarts(hex)); rows <= len(grid) {
+		t.Fatalf("hex pattern has %d rows, want more than the grid's %d", rows, len(grid))
+	}
+}